@@ -0,0 +1,74 @@
+package main
+
+import (
+    "os"
+    "path"
+    "bufio"
+    "strings"
+    "sync"
+)
+
+/* FileAbstract:
+ * Short description of a listed file, the first line of
+ * its abstract file. Kept with the abstract file's
+ * modified time so edits are picked up when next listed.
+ */
+type FileAbstract struct {
+    ModTime int64
+    Text    string
+}
+
+/* Cache of read abstract files, keyed by abstract file path */
+var fileAbstractCache = struct {
+    Abstracts map[string]*FileAbstract
+    Mutex     sync.Mutex
+}{ make(map[string]*FileAbstract), sync.Mutex{} }
+
+/* Get first line of abstract file at path, blank if there isn't one */
+func getFileAbstract(abstractPath string) string {
+    stat, err := os.Stat(abstractPath)
+    if err != nil || stat.IsDir() {
+        /* No abstract file (any longer), drop any cached copy */
+        fileAbstractCache.Mutex.Lock()
+        delete(fileAbstractCache.Abstracts, abstractPath)
+        fileAbstractCache.Mutex.Unlock()
+        return ""
+    }
+
+    fileAbstractCache.Mutex.Lock()
+    defer fileAbstractCache.Mutex.Unlock()
+
+    /* Reload if we've not seen it before, or it has since changed */
+    abstract, ok := fileAbstractCache.Abstracts[abstractPath]
+    if !ok || abstract.ModTime != stat.ModTime().UnixNano() {
+        abstract = &FileAbstract{ stat.ModTime().UnixNano(), readFileAbstract(abstractPath) }
+        fileAbstractCache.Abstracts[abstractPath] = abstract
+    }
+    return abstract.Text
+}
+
+/* Read first line of abstract file, trimmed of surrounding whitespace */
+func readFileAbstract(abstractPath string) string {
+    text := ""
+    gophorErr := bufferedScan(abstractPath,
+        func(scanner *bufio.Scanner) bool {
+            text = strings.TrimSpace(scanner.Text())
+            return false
+        },
+    )
+    if gophorErr != nil {
+        Config.LogSystemError("Error reading abstract file %s: %s\n", abstractPath, gophorErr.Error())
+    }
+    return text
+}
+
+/* Get abstract of listed item at path, from a sibling 'name.abstract' file
+ * or, for directories, a '.abstract' file within. Blank if neither
+ */
+func abstractFor(itemPath string, isDir bool) string {
+    text := getFileAbstract(itemPath+AbstractFileStr)
+    if text == "" && isDir {
+        text = getFileAbstract(path.Join(itemPath, AbstractFileStr))
+    }
+    return text
+}
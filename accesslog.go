@@ -0,0 +1,110 @@
+package main
+
+import (
+    "io"
+    "bufio"
+    "strconv"
+    "sync"
+    "time"
+    "encoding/json"
+)
+
+type RequestLogFormat int
+const (
+    RequestLogText RequestLogFormat = iota
+    RequestLogJSON RequestLogFormat = iota
+)
+
+/* Request status recorded in the access log */
+const (
+    RequestServed   = "served"
+    RequestError    = "error"
+    RequestNotFound = "not-found"
+    RequestDisconnected = "disconnected"
+)
+
+/* RequestLogEntry:
+ * Details of a single served request, as written to
+ * the structured access log.
+ */
+type RequestLogEntry struct {
+    Time     time.Time     `json:"time"`
+    ClientIP string        `json:"client_ip"`
+    Location string        `json:"location,omitempty"`
+    ConnID   uint64        `json:"conn_id"`
+    Selector string        `json:"selector"`
+    Query    string        `json:"query"`
+    Size     int           `json:"size"`
+    Status   string        `json:"status"`
+    Duration time.Duration `json:"duration_ns"`
+}
+
+/* RequestLogger:
+ * Writes one line per request, either human readable or
+ * JSON, through a buffered writer that is periodically
+ * flushed. Safe for use by concurrent handler goroutines.
+ */
+type RequestLogger struct {
+    Format RequestLogFormat
+    Writer *bufio.Writer
+    Mutex  sync.Mutex
+}
+
+func NewRequestLogger(format RequestLogFormat, writer io.Writer) *RequestLogger {
+    return &RequestLogger{ format, bufio.NewWriter(writer), sync.Mutex{} }
+}
+
+/* Parse request log format name */
+func parseRequestLogFormat(format string) (RequestLogFormat, bool) {
+    switch format {
+        case "text":
+            return RequestLogText, true
+        case "json":
+            return RequestLogJSON, true
+        default:
+            return RequestLogText, false
+    }
+}
+
+func (l *RequestLogger) Log(entry *RequestLogEntry) {
+    line := l.formatEntry(entry)
+
+    l.Mutex.Lock()
+    l.Writer.Write(line)
+    l.Mutex.Unlock()
+}
+
+func (l *RequestLogger) formatEntry(entry *RequestLogEntry) []byte {
+    switch l.Format {
+        case RequestLogJSON:
+            line, err := json.Marshal(entry)
+            if err != nil {
+                return nil
+            }
+            return append(line, '\n')
+
+        default:
+            client := entry.ClientIP
+            if entry.Location != "" {
+                client += " ("+entry.Location+")"
+            }
+            line := entry.Time.Format(time.RFC3339)+" "+client+" #"+strconv.FormatUint(entry.ConnID, 10)+" "+strconv.Quote(entry.Selector)+" "+strconv.Quote(entry.Query)+" "+strconv.Itoa(entry.Size)+" "+entry.Status+" "+entry.Duration.String()+"\n"
+            return []byte(line)
+    }
+}
+
+func (l *RequestLogger) Flush() {
+    l.Mutex.Lock()
+    l.Writer.Flush()
+    l.Mutex.Unlock()
+}
+
+/* Periodically flush buffered request log lines */
+func startRequestLogFlusher(l *RequestLogger, freq time.Duration) {
+    go func() {
+        for {
+            time.Sleep(freq)
+            l.Flush()
+        }
+    }()
+}
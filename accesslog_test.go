@@ -0,0 +1,51 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "encoding/json"
+)
+
+func TestRequestLoggerText(t *testing.T) {
+    buf := &bytes.Buffer{}
+    logger := NewRequestLogger(RequestLogText, buf)
+    logger.Log(&RequestLogEntry{ time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), "10.0.0.1", "", 7, "/search", "gopher holes", 123, RequestServed, 1500*time.Microsecond })
+    logger.Flush()
+
+    expected := `2020-01-02T03:04:05Z 10.0.0.1 #7 "/search" "gopher holes" 123 served 1.5ms`+"\n"
+    if buf.String() != expected {
+        t.Errorf("expected %q, got %q", expected, buf.String())
+    }
+}
+
+func TestRequestLoggerJSONConcurrent(t *testing.T) {
+    buf := &bytes.Buffer{}
+    logger := NewRequestLogger(RequestLogJSON, buf)
+
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i += 1 {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            logger.Log(&RequestLogEntry{ time.Now(), "10.0.0.1", "", uint64(i), fmt.Sprintf("/%d", i), "", i, RequestNotFound, time.Millisecond })
+        }(i)
+    }
+    wg.Wait()
+    logger.Flush()
+
+    /* Every line must be complete, valid JSON */
+    lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    if len(lines) != 50 {
+        t.Fatalf("expected 50 lines, got %d", len(lines))
+    }
+    for _, line := range lines {
+        entry := &RequestLogEntry{}
+        if err := json.Unmarshal([]byte(line), entry); err != nil || entry.Status != RequestNotFound {
+            t.Errorf("bad JSON log line %q: %v", line, err)
+        }
+    }
+}
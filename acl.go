@@ -0,0 +1,250 @@
+package main
+
+import (
+    "os"
+    "net"
+    "path"
+    "bufio"
+    "strings"
+    "sync"
+)
+
+/* DirACL:
+ * Parsed per-directory access file, listing the networks
+ * allowed access to the directory and everything below it.
+ * Kept alongside the access file's modified time so edits
+ * are picked up on the next request.
+ */
+type DirACL struct {
+    ModTime  int64
+    Networks []*net.IPNet
+}
+
+/* Check IP falls within one of the allowed networks */
+func (acl *DirACL) Allows(ip net.IP) bool {
+    if ip == nil {
+        return false
+    }
+
+    for _, network := range acl.Networks {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Cache of parsed directory access files, keyed by access file path */
+var dirACLCache = struct {
+    ACLs  map[string]*DirACL
+    Mutex sync.Mutex
+}{ make(map[string]*DirACL), sync.Mutex{} }
+
+/* Get parsed access file at path, or nil if there isn't one */
+func getDirACL(aclPath string) *DirACL {
+    stat, err := os.Stat(aclPath)
+    if err != nil {
+        /* No access file (any longer), drop any cached copy */
+        dirACLCache.Mutex.Lock()
+        delete(dirACLCache.ACLs, aclPath)
+        dirACLCache.Mutex.Unlock()
+        return nil
+    }
+
+    dirACLCache.Mutex.Lock()
+    defer dirACLCache.Mutex.Unlock()
+
+    /* Reload if we've not seen it before, or it has since changed */
+    acl, ok := dirACLCache.ACLs[aclPath]
+    if !ok || acl.ModTime != stat.ModTime().UnixNano() {
+        acl = readDirACL(aclPath)
+        acl.ModTime = stat.ModTime().UnixNano()
+        dirACLCache.ACLs[aclPath] = acl
+    }
+    return acl
+}
+
+/* Read access file of CIDRs (or single IPs), one per line with '#' comments.
+ * Invalid entries are logged and skipped, so at worst we allow less
+ */
+func readDirACL(aclPath string) *DirACL {
+    acl := &DirACL{ 0, make([]*net.IPNet, 0) }
+
+    gophorErr := bufferedScan(aclPath,
+        func(scanner *bufio.Scanner) bool {
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                return true
+            }
+
+            network, err := parseNetwork(line)
+            if err != nil {
+                Config.LogSystemError("Invalid network in %s: %s\n", aclPath, line)
+            } else {
+                acl.Networks = append(acl.Networks, network)
+            }
+            return true
+        },
+    )
+    if gophorErr != nil {
+        Config.LogSystemError("Error reading access file %s: %s\n", aclPath, gophorErr.Error())
+    }
+
+    return acl
+}
+
+/* Parse CIDR, treating a bare IP as a single host network */
+func parseNetwork(str string) (*net.IPNet, error) {
+    if !strings.Contains(str, "/") {
+        if ip := net.ParseIP(str); ip != nil && ip.To4() != nil {
+            str += "/32"
+        } else {
+            str += "/128"
+        }
+    }
+
+    _, network, err := net.ParseCIDR(str)
+    return network, err
+}
+
+/* Get every directory access file covering path, keyed by access file path,
+ * from the path's directory up to the root, so restrictions are inherited
+ * by subdirectories
+ */
+func dirACLsFor(requestPath string) map[string]*DirACL {
+    acls := make(map[string]*DirACL)
+
+    /* Start from the directory itself if path is one */
+    dir := requestPath
+    if stat, err := os.Stat(requestPath); err != nil || !stat.IsDir() {
+        dir = path.Dir(requestPath)
+    }
+
+    for {
+        aclPath := path.Join(dir, AclFileStr)
+        if acl := getDirACL(aclPath); acl != nil {
+            acls[aclPath] = acl
+        }
+
+        parent := path.Dir(dir)
+        if parent == dir {
+            return acls
+        }
+        dir = parent
+    }
+}
+
+/* Check client IP is allowed access to path by the selector network lists,
+ * and every directory access file covering it
+ */
+func isNetworkAllowed(requestPath, ip string) bool {
+    clientIP := net.ParseIP(ip)
+    if !isSelectorNetworkAllowed(requestPath, clientIP) {
+        return false
+    }
+
+    for _, acl := range dirACLsFor(requestPath) {
+        if !acl.Allows(clientIP) {
+            return false
+        }
+    }
+    return true
+}
+
+/* Check client IP against selector network lists. Denied networks take
+ * precedence, then the IP must be within every allow list covering path
+ */
+func isSelectorNetworkAllowed(requestPath string, ip net.IP) bool {
+    for prefix, networks := range Config.NetworkDeny {
+        if hasPathPrefix(requestPath, prefix) && (ip == nil || (&DirACL{ 0, networks }).Allows(ip)) {
+            return false
+        }
+    }
+
+    for prefix, networks := range Config.NetworkAllow {
+        if hasPathPrefix(requestPath, prefix) && !(&DirACL{ 0, networks }).Allows(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+/* Get access restrictions covering path, by client certificate, selector
+ * network lists and directory access files
+ */
+func accessRestrictions(requestPath string) map[string]bool {
+    restrictions := make(map[string]bool)
+    for prefix := range Config.ClientCertACL {
+        if hasPathPrefix(requestPath, prefix) {
+            restrictions["cert "+prefix] = true
+        }
+    }
+    for prefix := range Config.NetworkAllow {
+        if hasPathPrefix(requestPath, prefix) {
+            restrictions["allow "+prefix] = true
+        }
+    }
+    for prefix := range Config.NetworkDeny {
+        if hasPathPrefix(requestPath, prefix) {
+            restrictions["deny "+prefix] = true
+        }
+    }
+    for aclPath := range dirACLsFor(requestPath) {
+        restrictions["dir "+aclPath] = true
+    }
+    return restrictions
+}
+
+/* Check target can be included in gophermap at path. Included contents are
+ * served to anyone allowed the gophermap, so target mustn't have any access
+ * restrictions beyond those of the gophermap itself
+ */
+func isIncludeAllowed(gophermapPath, target string) bool {
+    allowed := accessRestrictions(gophermapPath)
+    for restriction := range accessRestrictions(target) {
+        if !allowed[restriction] {
+            return false
+        }
+    }
+    return true
+}
+
+/* Map selector prefixes of access controls to paths under root, for
+ * reading gophermaps without chroot
+ */
+func rerootAccessControls(root string) {
+    clientCertACL := make(map[string][]string)
+    for prefix, subjects := range Config.ClientCertACL {
+        clientCertACL[path.Join(root, prefix)] = subjects
+    }
+    Config.ClientCertACL = clientCertACL
+    Config.NetworkAllow = rerootNetworkMap(Config.NetworkAllow, root)
+    Config.NetworkDeny  = rerootNetworkMap(Config.NetworkDeny, root)
+}
+
+func rerootNetworkMap(networkMap map[string][]*net.IPNet, root string) map[string][]*net.IPNet {
+    ret := make(map[string][]*net.IPNet)
+    for prefix, networks := range networkMap {
+        ret[path.Join(root, prefix)] = networks
+    }
+    return ret
+}
+
+/* Parse selector prefixes mapped to comma separated networks, as for
+ * parseSelectorListMap
+ */
+func parseSelectorNetworkMap(entries string) map[string][]*net.IPNet {
+    ret := make(map[string][]*net.IPNet)
+    for prefix, values := range parseSelectorListMap(entries, false) {
+        networks := make([]*net.IPNet, 0, len(values))
+        for _, value := range values {
+            network, err := parseNetwork(strings.TrimSpace(value))
+            if err != nil {
+                Config.LogSystemFatal("Invalid network for selector %s: %s\n", prefix, value)
+            }
+            networks = append(networks, network)
+        }
+        ret[prefix] = networks
+    }
+    return ret
+}
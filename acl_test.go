@@ -0,0 +1,152 @@
+package main
+
+import (
+    "net"
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDirACLEnforcement(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "private/notes.txt", "notes")
+    writeTestFile(t, dir, "private/"+AclFileStr, "# office network\n10.0.0.0/8\n192.168.1.5\nnot-a-network\n")
+
+    tests := []struct {
+        IP      string
+        Allowed bool
+    }{
+        { "10.1.2.3",     true },
+        { "192.168.1.5",  true },
+        { "192.168.1.6",  false },
+        { "8.8.8.8",      false },
+        { "garbage",      false },
+    }
+
+    for _, test := range tests {
+        if allowed := isNetworkAllowed(filePath, test.IP); allowed != test.Allowed {
+            t.Errorf("isNetworkAllowed(%q, %q) = %t, expected %t", filePath, test.IP, allowed, test.Allowed)
+        }
+    }
+
+    /* Directory itself is covered by its own access file */
+    if isNetworkAllowed(dir+"/private", "8.8.8.8") {
+        t.Error("expected directory itself to be restricted")
+    }
+
+    /* Outside the subtree is unaffected */
+    if !isNetworkAllowed(writeTestFile(t, dir, "public.txt", "public"), "8.8.8.8") {
+        t.Error("expected file outside restricted subtree to be allowed")
+    }
+}
+
+func TestDirACLInheritance(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, AclFileStr, "10.0.0.0/8\n")
+    writeTestFile(t, dir, "sub/"+AclFileStr, "10.1.0.0/16\n")
+    filePath := writeTestFile(t, dir, "sub/deeper/file.txt", "file")
+
+    /* Must satisfy every access file on the way up */
+    if !isNetworkAllowed(filePath, "10.1.2.3") {
+        t.Error("expected address allowed by all access files to be allowed")
+    }
+    if isNetworkAllowed(filePath, "10.2.0.1") {
+        t.Error("expected address denied by subdirectory access file to be denied")
+    }
+    if isNetworkAllowed(filePath, "172.16.0.1") {
+        t.Error("expected address denied by parent access file to be denied")
+    }
+}
+
+func TestDirACLReload(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "file")
+    aclPath := writeTestFile(t, dir, AclFileStr, "10.0.0.0/8\n")
+
+    if isNetworkAllowed(filePath, "172.16.0.1") {
+        t.Fatal("expected address to be denied")
+    }
+
+    /* Change access file, with a new modified time */
+    writeTestFile(t, dir, AclFileStr, "172.16.0.0/12\n")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(aclPath, modTime, modTime)
+    if !isNetworkAllowed(filePath, "172.16.0.1") {
+        t.Error("expected access file reloaded after change")
+    }
+
+    /* And removing it lifts restrictions */
+    os.Remove(aclPath)
+    if !isNetworkAllowed(filePath, "8.8.8.8") {
+        t.Error("expected no restrictions once access file removed")
+    }
+}
+
+func TestDirACLHidden(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, AclFileStr, "10.0.0.0/8\n")
+    writeTestFile(t, dir, "file.txt", "file")
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if names := listingNames(t, output); len(names) != 1 || names[0] != "file.txt" {
+        t.Errorf("expected access file hidden from listing, got %q", names)
+    }
+}
+
+func TestSelectorNetworkLists(t *testing.T) {
+    setupTestConfig()
+    Config.NetworkAllow = parseSelectorNetworkMap("/private=192.168.1.0/24,10.0.0.1")
+    Config.NetworkDeny  = parseSelectorNetworkMap("/private=192.168.1.13\n/public/spam=203.0.113.0/24")
+
+    tests := []struct {
+        Path    string
+        IP      string
+        Allowed bool
+    }{
+        { "/private/phlog",  "192.168.1.2",  true  },
+        { "/private",        "10.0.0.1",     true  },
+        { "/private/phlog",  "8.8.8.8",      false },
+        { "/private/phlog",  "192.168.1.13", false },
+        { "/privateer",      "8.8.8.8",      true  },
+        { "/public/spam",    "203.0.113.9",  false },
+        { "/public/spam",    "8.8.8.8",      true  },
+        { "/public",         "203.0.113.9",  true  },
+    }
+
+    for _, test := range tests {
+        if allowed := isNetworkAllowed(test.Path, test.IP); allowed != test.Allowed {
+            t.Errorf("isNetworkAllowed(%s, %s) = %v, expected %v", test.Path, test.IP, allowed, test.Allowed)
+        }
+    }
+}
+
+func TestIncludeAccessRestricted(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    privateDir := path.Join(dir, "private")
+    Config.NetworkAllow = map[string][]*net.IPNet{ privateDir: nil }
+    secretPath := writeTestFile(t, dir, "private/secret.txt", "secret\n")
+    writeTestFile(t, dir, "private/sub/"+GophermapFileStr, "secret submap\n")
+
+    /* Public gophermap can't include restricted files or submaps */
+    publicPath := writeTestFile(t, dir, "public/"+GophermapFileStr, "="+secretPath+"\n="+privateDir+"/sub/"+GophermapFileStr+"\n")
+    output := renderTestGophermap(t, publicPath)
+    if strings.Contains(output, "isecret") || strings.Count(output, "Error: include target is access restricted") != 2 {
+        t.Errorf("expected restricted includes refused, got %q", output)
+    }
+
+    /* Gophermap under the same restrictions can */
+    privatePath := writeTestFile(t, dir, "private/"+GophermapFileStr, "="+secretPath+"\n")
+    if output := renderTestGophermap(t, privatePath); output != string(buildInfoLine("secret")) {
+        t.Errorf("expected include within same restrictions allowed, got %q", output)
+    }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "os"
+    "path"
+    "bufio"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* DirCacheControl:
+ * Parsed per-directory cache control file, setting how
+ * long cached files under the directory are trusted
+ * before checking them against disk again. Kept with
+ * the control file's modified time so edits are picked
+ * up on the next freshness check.
+ */
+type DirCacheControl struct {
+    ModTime int64
+    MaxAge  time.Duration
+}
+
+/* Cache of parsed directory cache control files, keyed by control file path */
+var dirCacheControlCache = struct {
+    Controls map[string]*DirCacheControl
+    Mutex    sync.Mutex
+}{ make(map[string]*DirCacheControl), sync.Mutex{} }
+
+/* Get parsed cache control file at path, or nil if there isn't one */
+func getDirCacheControl(controlPath string) *DirCacheControl {
+    stat, err := os.Stat(controlPath)
+    if err != nil {
+        /* No control file (any longer), drop any cached copy */
+        dirCacheControlCache.Mutex.Lock()
+        delete(dirCacheControlCache.Controls, controlPath)
+        dirCacheControlCache.Mutex.Unlock()
+        return nil
+    }
+
+    dirCacheControlCache.Mutex.Lock()
+    defer dirCacheControlCache.Mutex.Unlock()
+
+    /* Reload if we've not seen it before, or it has since changed */
+    control, ok := dirCacheControlCache.Controls[controlPath]
+    if !ok || control.ModTime != stat.ModTime().UnixNano() {
+        control = readDirCacheControl(controlPath)
+        control.ModTime = stat.ModTime().UnixNano()
+        dirCacheControlCache.Controls[controlPath] = control
+    }
+    return control
+}
+
+/* Read cache control file of 'max-age=duration' lines with '#' comments,
+ * e.g. 'max-age=24h'. Invalid lines are logged and skipped, the last valid
+ * max-age wins
+ */
+func readDirCacheControl(controlPath string) *DirCacheControl {
+    control := &DirCacheControl{ 0, 0 }
+
+    gophorErr := bufferedScan(controlPath,
+        func(scanner *bufio.Scanner) bool {
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                return true
+            }
+
+            split := strings.SplitN(line, "=", 2)
+            if len(split) != 2 || strings.TrimSpace(split[0]) != "max-age" {
+                Config.LogSystemError("Invalid cache control in %s: %s\n", controlPath, line)
+                return true
+            }
+
+            maxAge, err := time.ParseDuration(strings.TrimSpace(split[1]))
+            if err != nil || maxAge < 0 {
+                Config.LogSystemError("Invalid cache max-age in %s: %s\n", controlPath, line)
+            } else {
+                control.MaxAge = maxAge
+            }
+            return true
+        },
+    )
+    if gophorErr != nil {
+        Config.LogSystemError("Error reading cache control file %s: %s\n", controlPath, gophorErr.Error())
+    }
+
+    return control
+}
+
+/* Get max age of cached file at path from the cache control file in the
+ * deepest directory containing it, 0 if none. Lookups are remembered in
+ * seen (keyed by directory) so a sweep only stats each control file once
+ */
+func cacheMaxAgeFor(filePath string, seen map[string]*DirCacheControl) time.Duration {
+    dir := path.Dir(filePath)
+    for {
+        control, ok := seen[dir]
+        if !ok {
+            control = getDirCacheControl(path.Join(dir, CacheControlFileStr))
+            seen[dir] = control
+        }
+        if control != nil {
+            return control.MaxAge
+        }
+
+        parent := path.Dir(dir)
+        if parent == dir {
+            return 0
+        }
+        dir = parent
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "os"
+    "testing"
+    "time"
+)
+
+func TestReadDirCacheControl(t *testing.T) {
+    setupTestConfig()
+    controlPath := writeTestFile(t, t.TempDir(), CacheControlFileStr, "# archives\nmax-age=24h\nmax-age=forever\nstale\n")
+
+    control := getDirCacheControl(controlPath)
+    if control == nil || control.MaxAge != 24*time.Hour {
+        t.Fatalf("expected 24h max-age with invalid lines skipped, got %+v", control)
+    }
+
+    /* Edits picked up, removal forgotten */
+    os.WriteFile(controlPath, []byte("max-age=1h\n"), 0644)
+    os.Chtimes(controlPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+    if control = getDirCacheControl(controlPath); control == nil || control.MaxAge != time.Hour {
+        t.Errorf("expected changed control file reloaded, got %+v", control)
+    }
+
+    os.Remove(controlPath)
+    if control = getDirCacheControl(controlPath); control != nil {
+        t.Errorf("expected removed control file forgotten, got %+v", control)
+    }
+}
+
+func TestCacheControlMaxAge(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.initShards(10, 1)
+    dir := t.TempDir()
+    writeTestFile(t, dir, "archives/"+CacheControlFileStr, "max-age=24h\n")
+    writeTestFile(t, dir, "archives/hourly/"+CacheControlFileStr, "max-age=0\n")
+
+    paths := map[string]bool{
+        writeTestFile(t, dir, "archives/old.txt", "old"):        true,
+        writeTestFile(t, dir, "archives/deep/old.txt", "old"):   true,
+        writeTestFile(t, dir, "archives/hourly/new.txt", "new"): false,
+        writeTestFile(t, dir, "news.txt", "new"):                false,
+    }
+    for filePath := range paths {
+        if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+
+        /* Modified since cached */
+        future := time.Now().Add(time.Minute)
+        os.Chtimes(filePath, future, future)
+    }
+
+    /* Only files outside a max-age are checked, and found stale */
+    checkCacheFreshness()
+    for filePath, fresh := range paths {
+        file := Config.FileSystem.shardFor(filePath).Map.Get(filePath)
+        if file == nil {
+            t.Fatalf("expected %s still cached", filePath)
+        }
+        if file.Fresh != fresh {
+            t.Errorf("expected %s fresh %v, got %v", filePath, fresh, file.Fresh)
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Changelog:
+ * Generated "recent changes" menu listing files under
+ * the server root modified within the configured window,
+ * newest first. The tree is walked at most once per TTL,
+ * with entries filtered per request by what the client is
+ * allowed access to before being rendered.
+ */
+type Changelog struct {
+    Selector  string
+    Window    time.Duration
+    MaxDepth  int
+    TTL       time.Duration
+
+    Mutex     sync.Mutex
+    Entries   []*changelogEntry
+    Generated time.Time
+}
+
+/* A single changelog entry */
+type changelogEntry struct {
+    Path    string
+    ModTime time.Time
+    IsDir   bool
+}
+
+func NewChangelog(selector string, window time.Duration, maxDepth int, ttl time.Duration) *Changelog {
+    return &Changelog{
+        Selector: selector,
+        Window:   window,
+        MaxDepth: maxDepth,
+        TTL:      ttl,
+    }
+}
+
+func (c *Changelog) Render(host *ConnHost, allowed func(string) bool) []byte {
+    c.Mutex.Lock()
+    if c.Entries == nil || time.Since(c.Generated) > c.TTL {
+        c.Entries   = walkRecentChanges("/", time.Now().Add(-c.Window), c.MaxDepth)
+        c.Generated = time.Now()
+    }
+    entries := c.Entries
+    c.Mutex.Unlock()
+
+    /* Create return slice, first add a title + a space */
+    output := make([]byte, 0)
+    output = append(output, buildLine(TypeInfo, "[ Recent changes ]", "TITLE", NullHost, NullPort)...)
+    output = append(output, buildInfoLine("")...)
+
+    count := 0
+    for _, entry := range entries {
+        /* Only list changes within the host's root */
+        if !hasPathPrefix(entry.Path, host.PathFor("/")) || !allowed(entry.Path) {
+            continue
+        }
+
+        itemType := TypeDirectory
+        if !entry.IsDir {
+            itemType = guessItemType(entry.Path)
+        }
+        selector := host.SelectorFor(entry.Path)
+        output = append(output, buildLine(itemType, entry.ModTime.Format(ChangelogDateFormat)+" "+selector, selector, host.Name, host.Port)...)
+        count += 1
+    }
+
+    if count == 0 {
+        output = append(output, buildInfoLine("No recent changes")...)
+    }
+
+    /* Append footer text (contains last line) and return */
+    return append(output, Config.Current().FooterText...)
+}
+
+/* Walk tree at root collecting files and directories modified since
+ * supplied time, skipping hidden files and anything deeper than maxDepth
+ */
+func walkRecentChanges(root string, since time.Time, maxDepth int) []*changelogEntry {
+    entries := make([]*changelogEntry, 0)
+    hiddenByDir := make(map[string]map[string]bool)
+
+    filepath.Walk(root, func(itemPath string, info os.FileInfo, err error) error {
+        /* Skip anything we fail to stat, and the root itself */
+        if err != nil || itemPath == root {
+            return nil
+        }
+
+        /* Skip hidden files, and directories if hidden or too deep */
+        depth := strings.Count(strings.TrimPrefix(strings.TrimPrefix(itemPath, root), "/"), "/") + 1
+        if isHiddenFromWalk(itemPath, info.Name(), hiddenByDir) || (info.IsDir() && depth > maxDepth) {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        /* Gophermaps themselves are shown via their directory */
+        if isGophermapName(info.Name()) || info.Mode() & (os.ModeType &^ os.ModeDir) != 0 {
+            return nil
+        }
+
+        if info.ModTime().After(since) {
+            entries = append(entries, &changelogEntry{ itemPath, info.ModTime(), info.IsDir() })
+        }
+        return nil
+    })
+
+    /* Newest first, limited to max entries */
+    sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime.After(entries[j].ModTime) })
+    if len(entries) > ChangelogMaxEntries {
+        entries = entries[:ChangelogMaxEntries]
+    }
+
+    return entries
+}
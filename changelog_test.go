@@ -0,0 +1,47 @@
+package main
+
+import (
+    "os"
+    "testing"
+    "time"
+)
+
+/* Write test file with modified time set to supplied age */
+func writeAgedTestFile(t *testing.T, dir, name string, age time.Duration) string {
+    filePath := writeTestFile(t, dir, name, name)
+    modTime := time.Now().Add(-age)
+    if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+        t.Fatal(err)
+    }
+    return filePath
+}
+
+func TestWalkRecentChangesWindow(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+
+    recent := writeAgedTestFile(t, dir, "recent.txt", 24*time.Hour)
+    newest := writeAgedTestFile(t, dir, "newest.txt", time.Hour)
+    writeAgedTestFile(t, dir, "old.txt", 10*24*time.Hour)
+    writeAgedTestFile(t, dir, "edge.txt", 7*24*time.Hour+time.Minute)
+
+    entries := walkRecentChanges(dir, time.Now().Add(-7*24*time.Hour), 10)
+    if len(entries) != 2 {
+        t.Fatalf("expected 2 entries within window, got %d", len(entries))
+    }
+
+    /* Newest first */
+    if entries[0].Path != newest || entries[1].Path != recent {
+        t.Errorf("expected [%s %s], got [%s %s]", newest, recent, entries[0].Path, entries[1].Path)
+    }
+}
+
+func TestWalkRecentChangesEmptyWindow(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeAgedTestFile(t, dir, "old.txt", 24*time.Hour)
+
+    if entries := walkRecentChanges(dir, time.Now().Add(-time.Hour), 10); len(entries) != 0 {
+        t.Errorf("expected no entries outside window, got %d", len(entries))
+    }
+}
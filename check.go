@@ -0,0 +1,198 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "path"
+    "bufio"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "path/filepath"
+)
+
+/* Lines that look like a directive, so are likely a misspelt one */
+var directiveLikeRegex = regexp.MustCompile(`^%[a-z][a-z-]*(\s|$)`)
+
+/* GophermapCheck:
+ * Problems found checking every gophermap within a root,
+ * for validating gophermaps before serving them. Embeds
+ * are noted as gophermaps are read, so cycles through
+ * them can be found once they've all been read.
+ */
+type GophermapCheck struct {
+    Checked  int
+    Problems []string
+    Reported map[string]bool
+    Embeds   map[string][]string
+}
+
+func NewGophermapCheck() *GophermapCheck {
+    return &GophermapCheck{ 0, make([]string, 0), make(map[string]bool), make(map[string][]string) }
+}
+
+/* Report problem with file at path, once. Problems within included
+ * gophermaps are found again reading each gophermap including them
+ */
+func (c *GophermapCheck) Report(filePath, problem string) {
+    problem = filePath+": "+problem
+    if !c.Reported[problem] {
+        c.Reported[problem] = true
+        c.Problems = append(c.Problems, problem)
+    }
+}
+
+/* Check every gophermap within root, plus the header and footer gophermaps */
+func (c *GophermapCheck) CheckRoot(root string) {
+    filepath.Walk(root, func(itemPath string, info os.FileInfo, err error) error {
+        if err != nil {
+            c.Report(itemPath, "error walking: "+err.Error())
+            return nil
+        }
+        if !info.IsDir() && isGophermapName(info.Name()) {
+            c.CheckGophermap(itemPath)
+        }
+        return nil
+    })
+
+    for _, mapPath := range []string{ Config.HeaderMap, Config.FooterMap } {
+        if mapPath != "" && !isGophermapName(path.Base(mapPath)) {
+            c.CheckGophermap(mapPath)
+        }
+    }
+
+    c.CheckEmbedCycles()
+}
+
+/* Check gophermap at path, both as parsed for serving and line by line */
+func (c *GophermapCheck) CheckGophermap(gophermapPath string) {
+    c.Checked += 1
+
+    sections, errs, gophorErr := readGophermapWithErrors(gophermapPath)
+    if gophorErr != nil {
+        c.Report(gophermapPath, "error reading: "+gophorErr.Error())
+        return
+    }
+
+    /* Drop the 'Error' prefix, everything reported is one */
+    for _, err := range errs {
+        c.Report(err.Path, "line "+strconv.Itoa(err.Line)+": "+strings.TrimPrefix(strings.TrimPrefix(err.Text, "Error: "), "Error "))
+    }
+
+    for _, section := range sections {
+        /* Embeds are only fetched when rendered, so check target is there */
+        if s, ok := section.(*GophermapEmbed); ok {
+            if _, err := os.Stat(s.Target); err != nil {
+                c.Report(s.Source, "embed target not found: "+s.Target)
+            } else if s.Menu {
+                c.Embeds[s.Source] = append(c.Embeds[s.Source], s.Target)
+            }
+        }
+    }
+
+    c.CheckLines(gophermapPath)
+}
+
+/* Check gophermap lines for anything served as-is but likely a mistake, which
+ * parsing alone won't catch: misspelt directives and incomplete menu lines
+ */
+func (c *GophermapCheck) CheckLines(gophermapPath string) {
+    lineNo := 0
+    infoBlock := false
+
+    bufferedScan(gophermapPath,
+        func(scanner *bufio.Scanner) bool {
+            lineNo += 1
+            line := scanner.Text()
+            lineType := parseLineType(line)
+            at := "line "+strconv.Itoa(lineNo)+": "
+
+            /* Info block lines are text, whatever they look like */
+            if infoBlock {
+                infoBlock = !(lineType == TypeDirective && strings.Fields(line[1:])[0] == DirectiveEndInfo)
+                return true
+            }
+
+            switch lineType {
+                case TypeEnd, TypeEndBeginList:
+                    return false
+
+                case TypeDirective:
+                    infoBlock = strings.Fields(line[1:])[0] == DirectiveBeginInfo
+
+                case TypeUnknown:
+                    c.Report(gophermapPath, at+"malformed line: "+line)
+
+                case TypeInfoNotStated:
+                    if directiveLikeRegex.MatchString(line) {
+                        c.Report(gophermapPath, at+"unknown directive: "+strings.Fields(line[1:])[0])
+                    }
+
+                case TypeComment, TypeTitle, TypeHiddenFile, TypeSubGophermap, TypeExec:
+                    /* server only, checked when parsed */
+
+                default:
+                    if len(strings.Split(line, string(Tab))) < 4 {
+                        c.Report(gophermapPath, at+"malformed menu line, expected display text, selector, host and port: "+line)
+                    }
+            }
+            return true
+        },
+    )
+}
+
+/* Check embeds between gophermaps never lead back to where they started */
+func (c *GophermapCheck) CheckEmbedCycles() {
+    sources := make([]string, 0, len(c.Embeds))
+    for source := range c.Embeds {
+        sources = append(sources, source)
+    }
+    sort.Strings(sources)
+
+    for _, source := range sources {
+        if chain := c.findEmbedCycle(source, []string{ source }); chain != nil {
+            c.Report(source, "embed cycle: "+strings.Join(chain, " -> "))
+        }
+    }
+}
+
+func (c *GophermapCheck) findEmbedCycle(start string, chain []string) []string {
+    for _, target := range c.Embeds[chain[len(chain)-1]] {
+        if target == start {
+            return append(chain, target)
+        }
+
+        /* Cycles not through start are reported from their own gophermaps */
+        seen := false
+        for _, embedder := range chain {
+            seen = seen || embedder == target
+        }
+        if seen {
+            continue
+        }
+
+        if found := c.findEmbedCycle(start, append(chain, target)); found != nil {
+            return found
+        }
+    }
+    return nil
+}
+
+/* Check gophermaps within root, printing problems found. Returns the exit
+ * code, non-zero if there were any
+ */
+func runGophermapCheck(root string) int {
+    check := NewGophermapCheck()
+    check.CheckRoot(root)
+
+    for _, problem := range check.Problems {
+        fmt.Println(problem)
+    }
+    fmt.Printf("Checked %d gophermaps, found %d problems\n", check.Checked, len(check.Problems))
+
+    if len(check.Problems) > 0 {
+        return 1
+    }
+    return 0
+}
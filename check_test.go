@@ -0,0 +1,77 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestGophermapCheck(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", "notes")
+    writeTestFile(t, dir, GophermapFileStr, "Welcome\n="+dir+"/notes.txt\n0Notes\t/notes.txt\tlocalhost\t70\n%50 off\n")
+    writeTestFile(t, dir, "broken/"+GophermapFileStr, "="+dir+"/missing.txt\n%srot newest\n0Notes\t/notes.txt\n%width 5\n%begin-info\n%not-a-directive\n%end-info\n")
+    writeTestFile(t, dir, "first/"+GophermapFileStr, "%embed "+dir+"/second/"+GophermapFileStr+"\n%embed "+dir+"/gone/"+GophermapFileStr+"\n")
+    writeTestFile(t, dir, "second/"+GophermapFileStr, "%embed "+dir+"/first/"+GophermapFileStr+"\n")
+
+    check := NewGophermapCheck()
+    check.CheckRoot(dir)
+
+    first, second := dir+"/first/"+GophermapFileStr, dir+"/second/"+GophermapFileStr
+    broken := dir+"/broken/"+GophermapFileStr
+    expected := []string{
+        broken+": line 1: reading include: "+dir+"/missing.txt (not found)",
+        broken+": line 4: width directive requires a page width from 10 to 1024",
+        broken+": line 2: unknown directive: srot",
+        broken+": line 3: malformed menu line, expected display text, selector, host and port: 0Notes\t/notes.txt",
+        first+": embed target not found: "+dir+"/gone/"+GophermapFileStr,
+        first+": embed cycle: "+first+" -> "+second+" -> "+first,
+        second+": embed cycle: "+second+" -> "+first+" -> "+second,
+    }
+    if check.Checked != 4 {
+        t.Errorf("expected 4 gophermaps checked, got %d", check.Checked)
+    }
+    if strings.Join(check.Problems, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("expected problems:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(check.Problems, "\n"))
+    }
+}
+
+func TestGophermapCheckWithoutChroot(t *testing.T) {
+    setupTestConfig()
+    Config.ClientCertACL = map[string][]string{ "/private": []string{ "alice" } }
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", "notes")
+    writeTestFile(t, dir, "private/secret.txt", "secret")
+    writeTestFile(t, dir, "sub/"+GophermapFileStr, "Sub\n")
+    writeTestFile(t, dir, GophermapFileStr, "=/notes.txt\n%embed /sub/"+GophermapFileStr+"\n=/missing.txt\n=/private/secret.txt\n")
+
+    /* Paths within the server root resolve under it, as if chroot'd */
+    setupUnchrootedFileSystem(dir, false)
+    root := Config.FileSystem.Root
+    check := NewGophermapCheck()
+    check.CheckRoot(root)
+
+    gophermap := root+"/"+GophermapFileStr
+    expected := []string{
+        gophermap+": line 3: reading include: "+root+"/missing.txt (not found)",
+        gophermap+": line 4: include target is access restricted: "+root+"/private/secret.txt",
+    }
+    if check.Checked != 2 {
+        t.Errorf("expected 2 gophermaps checked, got %d", check.Checked)
+    }
+    if strings.Join(check.Problems, "\n") != strings.Join(expected, "\n") {
+        t.Errorf("expected problems:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(check.Problems, "\n"))
+    }
+}
+
+func TestIncludeCycle(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    firstPath := writeTestFile(t, dir, "first/"+GophermapFileStr, "First\n="+dir+"/second/"+GophermapFileStr+"\n")
+    writeTestFile(t, dir, "second/"+GophermapFileStr, "Second\n="+dir+"/first/"+GophermapFileStr+"\n")
+
+    expected := string(buildInfoLine("First"))+string(buildInfoLine("Second"))+string(buildInfoLine("Error: include cycle: "+firstPath))
+    if output := renderTestGophermap(t, firstPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
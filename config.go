@@ -1,8 +1,11 @@
 package main
 
 import (
+    "net"
+    "time"
     "regexp"
     "log"
+    "sync/atomic"
 )
 
 /* ServerConfig:
@@ -15,19 +18,151 @@ type ServerConfig struct {
     /* Base settings */
     RootDir         string
 
+    /* Connection settings */
+    ReadTimeout     time.Duration
+    WriteTimeout    time.Duration
+    MaxSelectorLength int
+    SlowRequestThreshold time.Duration
+    RateLimiter     *RateLimiter
+    ClientCertACL   map[string][]string
+    NetworkAllow    map[string][]*net.IPNet
+    NetworkDeny     map[string][]*net.IPNet
+    ShutdownGrace   time.Duration
+    MaxConnectionsWait time.Duration
+    ReusePort       bool
+
+    /* Settings that may change on reload, see Current() */
+    Reloadable      atomic.Value
+    ConfigFile      *ConfigFile
+
     /* Content settings */
-    FooterText      []byte
-    PageWidth       int
-    RestrictedFiles []*regexp.Regexp
+    ListFullPaths   bool
+    ListingTemplate string
+    ListingDateFormat string
+
+    /* Last line terminating responses, by type */
+    OmitMenuLastLine bool
+    TextLastLine     bool
+    ItemTypes       *ItemTypeMap
+    ItemTypesFile   string
+    ItemTypesExtra  []string
+    TextEncodings   *TextEncodingMap
+
+    /* Policy file settings */
+    Description      string
+    AdminEmail       string
+    Geolocation      string
+    TLSPort          int
+    RobotsAllow      []string
+    RobotsDisallow   []string
+    RobotsCrawlDelay int
+    SecurityEncryption string
+    SecurityPolicy     string
+    SecurityExpiry     time.Duration
+    HumansCredits      string
+    StatusEnabled      bool
+
+    /* Generated sitemap.txt, 0 interval if disabled */
+    SitemapInterval    time.Duration
+
+    /* Generated type 2 phonebook, blank contacts path if disabled */
+    PhonebookContacts  string
+    PhonebookFields    []string
+
+    /* Parsed gophermaps included by others, nil if disabled */
+    SubmapCache *SubmapCache
+
+    /* Appended to included text lines cut short by reflow, blank if none */
+    WrapMarker string
+
+    /* Show gophermap comments as info lines, for debugging */
+    ShowComments bool
+
+    /* Variables allowed in gophermaps as '${NAME}', and whether unknown ones are removed */
+    GophermapVars             map[string]string
+    GophermapVarsUnknownEmpty bool
+
+    /* Max length of a line read from gophermaps and other scanned files */
+    MaxLineLength int
+
+    /* Tab stop width included text lines are expanded to */
+    TabWidth   int
+
+    /* Replaces control characters in info text, blank to strip them */
+    ControlCharMarker string
+
+    /* Gophermap file names tried in directories, in order */
+    GophermapNames []string
+
+    /* Gophermaps rendered before and after every gophermap, blank if none */
+    HeaderMap string
+    FooterMap string
+
+    /* Gophermap served for everything in maintenance mode, blank for a notice */
+    MaintenanceMap string
+
+    /* Error response lines, '$error' replaced by error description */
+    ErrorTemplate string
+
+    /* HTML redirects for 'URL:' selectors, nil if disabled */
+    HtmlRedirects        *HtmlRedirectCache
+    HtmlRedirectTemplate string
+
+    /* Remote gopher settings */
+    RemoteEnabled   bool
+    RemoteRewrite   bool
+    RemoteTTL       time.Duration
+
+    /* Search settings */
+    SearchSelector      string
+    SearchRoot          string
+    SearchCaseSensitive bool
+
+    /* Virtual hosts, each served from their own root */
+    VirtualHosts        []*VirtualHost
+
+    /* Old selectors rewritten to their new location */
+    SelectorRewrites    []*SelectorRewrite
+
+    /* Virtual selectors mapped to ordered list of gophermaps to merge */
+    MergedMaps          map[string][]string
+
+    /* Generated changelog, nil if disabled */
+    Changelog           *Changelog
+
+    /* Prometheus metrics, nil if disabled */
+    Metrics             *Metrics
 
     /* Logging */
     SystemLogger    *log.Logger
     AccessLogger    *log.Logger
+    RequestLogger   *RequestLogger
+    GeoDatabase     *GeoDatabase
 
     /* Filesystem access */
     FileSystem      *FileSystem
 }
 
+/* ReloadableConfig:
+ * Settings that can change on SIGHUP. These are swapped in
+ * all at once, so handlers reading them via Config.Current()
+ * never see half of an old and half of a new configuration.
+ */
+type ReloadableConfig struct {
+    Hostname        string
+    PageWidth       int
+    FooterText      []byte
+    RestrictedFiles []*regexp.Regexp
+}
+
+func (config *ServerConfig) Current() *ReloadableConfig {
+    return config.Reloadable.Load().(*ReloadableConfig)
+}
+
+func (config *ServerConfig) SetCurrent(current *ReloadableConfig) {
+    config.Reloadable.Store(current)
+}
+
 func (config *ServerConfig) LogSystem(fmt string, args ...interface{}) {
     config.SystemLogger.Printf(":: I :: "+fmt, args...)
 }
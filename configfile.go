@@ -0,0 +1,207 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "os"
+    "path"
+    "strings"
+    "syscall"
+)
+
+/* ConfigFile:
+ * Server configuration file of 'name=value' lines, using the
+ * same names as the command line flags. Like RotatingFile the
+ * containing directory is opened up-front, so the file can
+ * still be re-read on SIGHUP once we've chroot'd into the
+ * server root. Flags set on the command line always take
+ * precedence over the file.
+ */
+type ConfigFile struct {
+    Dir        *os.File
+    Name       string
+    Overridden map[string]bool
+}
+
+/* Flags that are safe to change while running, anything else changed
+ * in the config file on reload is ignored until restart
+ */
+var reloadableFlags = map[string]bool{
+    "hostname":            true,
+    "page-width":          true,
+    "footer":              true,
+    "no-footer-separator": true,
+    "restrict-files":      true,
+    "robots-allow":        true,
+    "robots-disallow":     true,
+    "robots-crawl-delay":  true,
+    "log-type":            true,
+    "cache-size":          true,
+    "cache-file-max":      true,
+}
+
+/* Open config file, noting which flags in set were set on the command line */
+func OpenConfigFile(filePath string, flags *flag.FlagSet) (*ConfigFile, error) {
+    dir, err := os.Open(path.Dir(filePath))
+    if err != nil {
+        return nil, err
+    }
+
+    overridden := make(map[string]bool)
+    flags.Visit(func(f *flag.Flag) {
+        overridden[f.Name] = true
+    })
+
+    return &ConfigFile{ dir, path.Base(filePath), overridden }, nil
+}
+
+/* Read and parse config file contents, relative to directory */
+func (c *ConfigFile) Read() (map[string]string, error) {
+    fd, err := syscall.Openat(int(c.Dir.Fd()), c.Name, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+    if err != nil {
+        return nil, &os.PathError{ Op: "open", Path: c.Name, Err: err }
+    }
+    file := os.NewFile(uintptr(fd), c.Name)
+    defer file.Close()
+
+    lines := make([]string, 0)
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        lines = append(lines, scanner.Text())
+    }
+    if scanner.Err() != nil {
+        return nil, scanner.Err()
+    }
+
+    return parseConfigLines(lines)
+}
+
+/* Apply config values to flags, skipping any set on the command line.
+ * When reloading only flags safe to change at runtime are applied, any
+ * other changed values are logged as ignored
+ */
+func (c *ConfigFile) Apply(values map[string]string, flags *flag.FlagSet, reloading bool) error {
+    for name, value := range values {
+        f := flags.Lookup(name)
+        switch {
+            case f == nil:
+                return errors.New("unknown config option: "+name)
+            case c.Overridden[name]:
+                continue
+            case reloading && !reloadableFlags[name]:
+                if value != f.Value.String() {
+                    Config.LogSystemError("Ignoring config change to %s, requires restart\n", name)
+                }
+                continue
+        }
+
+        err := flags.Set(name, value)
+        if err != nil {
+            return errors.New("invalid value for config option "+name+": "+err.Error())
+        }
+    }
+    return nil
+}
+
+/* Parse 'name=value' config lines, skipping blanks and '#' comments.
+ * Escaped '\n' in values become new-lines, for multi-line options
+ */
+func parseConfigLines(lines []string) (map[string]string, error) {
+    values := make(map[string]string)
+    for _, line := range lines {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        split := strings.SplitN(line, "=", 2)
+        if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+            return nil, errors.New("invalid config line: "+line)
+        }
+        values[strings.TrimSpace(split[0])] = strings.Replace(strings.TrimSpace(split[1]), "\\n", "\n", -1)
+    }
+    return values, nil
+}
+
+/* Build reloadable settings from current flag values */
+func buildReloadableConfig(flags *flag.FlagSet) (*ReloadableConfig, error) {
+    restrictedFiles, err := compileUserRestrictedFilesRegex(flagValue(flags, "restrict-files").(string))
+    if err != nil {
+        return nil, err
+    }
+
+    /* Hostname is only advertised in generated lines, never bound to */
+    hostname := strings.TrimSpace(flagValue(flags, "hostname").(string))
+    if hostname == "" {
+        return nil, errors.New("hostname must not be empty")
+    }
+
+    pageWidth := clampPageWidth(flagValue(flags, "page-width").(int))
+    return &ReloadableConfig{
+        Hostname:        hostname,
+        PageWidth:       pageWidth,
+        FooterText:      formatGophermapFooter(flagValue(flags, "footer").(string), !flagValue(flags, "no-footer-separator").(bool), pageWidth),
+        RestrictedFiles: restrictedFiles,
+    }, nil
+}
+
+/* Get current value of named flag in set */
+func flagValue(flags *flag.FlagSet, name string) interface{} {
+    return flags.Lookup(name).Value.(flag.Getter).Get()
+}
+
+/* Re-read config file, applying anything safe to change at runtime. On any
+ * failure we keep the current configuration
+ */
+func reloadConfigFile(flags *flag.FlagSet) {
+    if Config.ConfigFile == nil {
+        return
+    }
+
+    values, err := Config.ConfigFile.Read()
+    if err == nil {
+        err = Config.ConfigFile.Apply(values, flags, true)
+    }
+    if err != nil {
+        Config.LogSystemError("Error reloading config file, keeping current: %s\n", err.Error())
+        return
+    }
+
+    current, err := buildReloadableConfig(flags)
+    if err != nil {
+        Config.LogSystemError("Error reloading config file, keeping current: %s\n", err.Error())
+        return
+    }
+    /* Resolver config is outside the chroot, so the new hostname can't be
+     * checked against bind addresses like it is on startup
+     */
+    if current.Hostname != Config.Current().Hostname {
+        Config.LogSystem("Advertised hostname changed to %s, not checked against bind addresses until restart\n", current.Hostname)
+    }
+    Config.SetCurrent(current)
+
+    /* Regenerate robots.txt with any new rules */
+    Config.RobotsAllow      = splitNonEmpty(flagValue(flags, "robots-allow").(string), "\n")
+    Config.RobotsDisallow   = splitNonEmpty(flagValue(flags, "robots-disallow").(string), "\n")
+    Config.RobotsCrawlDelay = flagValue(flags, "robots-crawl-delay").(int)
+    for _, root := range virtualHostRoots() {
+        cachePolicyFile(path.Join(root, "robots.txt"), generateRobotsTxt)
+    }
+
+    /* Switch logging on or off */
+    err = setLoggingType(flagValue(flags, "log-type").(int))
+    if err != nil {
+        Config.LogSystemError("Error changing log type: %s\n", err.Error())
+    }
+
+    /* Cached files may have been formatted with the old settings, so drop
+     * them all, resizing the cache at the same time
+     */
+    if !flagValue(flags, "disable-cache").(bool) {
+        Config.FileSystem.Reset(flagValue(flags, "cache-size").(int), flagValue(flags, "cache-file-max").(float64))
+        Config.SubmapCache.Clear()
+    }
+
+    Config.LogSystem("Reloaded config file\n")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "flag"
+    "io/ioutil"
+    "path"
+    "sync"
+    "testing"
+)
+
+/* Flag set with the options a config file reload touches */
+func newTestFlagSet() *flag.FlagSet {
+    flags := flag.NewFlagSet("test", flag.ContinueOnError)
+    flags.String("hostname", "localhost", "")
+    flags.String("bind-addr", "127.0.0.1", "")
+    flags.Int("page-width", 80, "")
+    flags.String("footer", "", "")
+    flags.Bool("no-footer-separator", false, "")
+    flags.String("restrict-files", "", "")
+    flags.String("robots-allow", "", "")
+    flags.String("robots-disallow", "", "")
+    flags.Int("robots-crawl-delay", 0, "")
+    flags.Int("log-type", 0, "")
+    flags.Int("cache-size", 10, "")
+    flags.Float64("cache-file-max", 1, "")
+    flags.Bool("disable-cache", false, "")
+    return flags
+}
+
+/* Write config file contents under dir, opening it against flags */
+func openTestConfigFile(t *testing.T, dir, contents string, flags *flag.FlagSet) *ConfigFile {
+    filePath := path.Join(dir, "gophor.conf")
+    if err := ioutil.WriteFile(filePath, []byte(contents), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    configFile, err := OpenConfigFile(filePath, flags)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return configFile
+}
+
+func TestParseConfigLines(t *testing.T) {
+    values, err := parseConfigLines([]string{ "# comment", "", " page-width = 72 ", "footer=line one\\nline two", "hostname=a=b" })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := map[string]string{ "page-width": "72", "footer": "line one\nline two", "hostname": "a=b" }
+    if len(values) != len(expected) {
+        t.Fatalf("expected %d values, got %v", len(expected), values)
+    }
+    for name, value := range expected {
+        if values[name] != value {
+            t.Errorf("expected %s=%q, got %q", name, value, values[name])
+        }
+    }
+
+    for _, line := range []string{ "no-equals", "=value" } {
+        if _, err := parseConfigLines([]string{ line }); err == nil {
+            t.Errorf("expected error parsing config line %q", line)
+        }
+    }
+}
+
+func TestConfigFileCommandLinePrecedence(t *testing.T) {
+    setupTestConfig()
+    flags := newTestFlagSet()
+    flags.Parse([]string{ "-page-width", "100" })
+
+    configFile := openTestConfigFile(t, t.TempDir(), "page-width=72\nhostname=example.org\n", flags)
+    values, err := configFile.Read()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := configFile.Apply(values, flags, false); err != nil {
+        t.Fatal(err)
+    }
+
+    if width := flagValue(flags, "page-width").(int); width != 100 {
+        t.Errorf("expected command line page width 100 to take precedence, got %d", width)
+    }
+    if hostname := flagValue(flags, "hostname").(string); hostname != "example.org" {
+        t.Errorf("expected hostname from config file, got %s", hostname)
+    }
+}
+
+func TestConfigFileUnknownOption(t *testing.T) {
+    setupTestConfig()
+    flags := newTestFlagSet()
+    configFile := openTestConfigFile(t, t.TempDir(), "", flags)
+
+    if err := configFile.Apply(map[string]string{ "not-an-option": "1" }, flags, false); err == nil {
+        t.Errorf("expected error applying unknown config option")
+    }
+}
+
+func TestReloadConfigFile(t *testing.T) {
+    setupTestConfig()
+    flags := newTestFlagSet()
+    dir := t.TempDir()
+    Config.ConfigFile = openTestConfigFile(t, dir, "page-width=80\n", flags)
+
+    /* Cache something so we can check the reload drops it */
+    filePath := writeTestFile(t, dir, "file.txt", "contents\n")
+    if _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Safe to change options are applied, bind address is ignored */
+    writeTestFile(t, dir, "gophor.conf", "page-width=60\nhostname=example.org\nbind-addr=0.0.0.0\nrestrict-files=\\.bak$\n")
+    reloadConfigFile(flags)
+
+    current := Config.Current()
+    if current.PageWidth != 60 || current.Hostname != "example.org" || len(current.RestrictedFiles) != 1 {
+        t.Errorf("expected reloaded settings, got width=%d hostname=%s restricted=%d", current.PageWidth, current.Hostname, len(current.RestrictedFiles))
+    }
+    if addr := flagValue(flags, "bind-addr").(string); addr != "127.0.0.1" {
+        t.Errorf("expected bind address change to be ignored, got %s", addr)
+    }
+    if count := Config.FileSystem.CacheCount(); count != 0 {
+        t.Errorf("expected cache to be dropped on reload, got %d cached", count)
+    }
+
+    /* Invalid config keeps what we have */
+    writeTestFile(t, dir, "gophor.conf", "restrict-files=(\n")
+    reloadConfigFile(flags)
+    if Config.Current() != current {
+        t.Errorf("expected invalid config reload to keep current settings")
+    }
+
+    /* As does an empty advertised hostname */
+    writeTestFile(t, dir, "gophor.conf", "hostname= \n")
+    reloadConfigFile(flags)
+    if Config.Current() != current {
+        t.Errorf("expected empty hostname reload to keep current settings")
+    }
+}
+
+func TestReloadableConfigConcurrentReads(t *testing.T) {
+    setupTestConfig()
+
+    /* Handlers reading settings while they're swapped shouldn't race */
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 1000; j += 1 {
+                buildLine(TypeFile, "name", "/selector", Config.Current().Hostname, "70")
+            }
+        }()
+    }
+
+    for width := MinPageWidth; width < MinPageWidth+100; width += 1 {
+        Config.SetCurrent(&ReloadableConfig{ "localhost", width, formatGophermapFooter("", false, width), nil })
+    }
+    wg.Wait()
+}
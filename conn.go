@@ -2,36 +2,142 @@ package main
 
 import (
     "net"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "io/ioutil"
+    "errors"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
 )
 
-/* Data structure to hold specific host details */
+/* Connections accepted so far, also used to number them */
+var acceptedCount uint64
+
+/* Data structure to hold specific host details. Root and selector
+ * prefix are set when serving as a virtual host, see vhost.go
+ */
 type ConnHost struct {
-    Name string
-    Port string
+    Name   string
+    Port   string
+    Root   string
+    Prefix string
 }
 
 /* Simple wrapper to Listener that holds onto virtual
  * host information and generates GophorConn
- * instances on each accept
+ * instances on each accept. The advertised port is
+ * the one embedded in generated selector lines, which
+ * differs from the bound port behind a port-forward
  */
 type GophorListener struct {
-    Listener net.Listener
-    Host     *ConnHost
+    Listener       net.Listener
+    Host           *ConnHost
+    Scheme         string
+    AdvertisedPort string
 }
 
 func BeginGophorListen(bindAddr, hostname, port string) (*GophorListener, error) {
     gophorListener := new(GophorListener)
-    gophorListener.Host = &ConnHost{ hostname, port }
+    gophorListener.Host = &ConnHost{ hostname, port, "", "" }
+    gophorListener.Scheme = "gopher"
+    gophorListener.AdvertisedPort = port
 
     var err error
-    gophorListener.Listener, err = net.Listen("tcp", bindAddr+":"+port)
+    gophorListener.Listener, err = listenTCP(bindAddr, port)
+    if err != nil {
+        return nil, err
+    } else {
+        return gophorListener, nil
+    }
+}
+
+func BeginGophorListenTLS(bindAddr, hostname, port string, config *tls.Config) (*GophorListener, error) {
+    gophorListener := new(GophorListener)
+    gophorListener.Host = &ConnHost{ hostname, port, "", "" }
+    gophorListener.Scheme = "gophers"
+    gophorListener.AdvertisedPort = port
+
+    listener, err := listenTCP(bindAddr, port)
     if err != nil {
         return nil, err
     } else {
+        gophorListener.Listener = tls.NewListener(listener, config)
         return gophorListener, nil
     }
 }
 
+/* Listen on bind address and port, setting socket options first. The accept
+ * backlog is left to the OS maximum (e.g. net.core.somaxconn on Linux)
+ */
+func listenTCP(bindAddr, port string) (net.Listener, error) {
+    listenConfig := &net.ListenConfig{ Control: controlListenSocket }
+    return listenConfig.Listen(context.Background(), "tcp", net.JoinHostPort(bindAddr, port))
+}
+
+/* Set listening socket options before binding. SO_REUSEADDR lets a quick
+ * restart bind while old connections linger in TIME_WAIT, and SO_REUSEPORT
+ * (if enabled) lets several processes share the port, e.g. for zero-downtime
+ * deploys. Where SO_REUSEPORT is unsupported we log and listen without it
+ */
+func controlListenSocket(network, address string, c syscall.RawConn) error {
+    var sockErr error
+    err := c.Control(func(fd uintptr) {
+        sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+        if sockErr != nil || !Config.ReusePort {
+            return
+        }
+
+        if err := setReusePort(fd); err != nil {
+            Config.LogSystemError("Unable to set SO_REUSEPORT on %s, port won't be shared: %s\n", address, err.Error())
+        }
+    })
+    if err != nil {
+        return err
+    }
+    return sockErr
+}
+
+/* Load TLS configuration from new-line separated lists of certificate
+ * and key paths. With multiple certificates the correct one is chosen
+ * by SNI during the handshake. If a client CA is supplied, clients must
+ * present a certificate signed by it
+ */
+func loadTLSConfig(certPaths, keyPaths, clientCAPath string) (*tls.Config, error) {
+    certs := strings.Split(certPaths, "\n")
+    keys  := strings.Split(keyPaths, "\n")
+    if len(certs) != len(keys) {
+        return nil, errors.New("mismatched number of TLS certificates and keys")
+    }
+
+    config := &tls.Config{ MinVersion: tls.VersionTLS12 }
+    for i := range certs {
+        cert, err := tls.LoadX509KeyPair(certs[i], keys[i])
+        if err != nil {
+            return nil, err
+        }
+        config.Certificates = append(config.Certificates, cert)
+    }
+
+    if clientCAPath != "" {
+        pem, err := ioutil.ReadFile(clientCAPath)
+        if err != nil {
+            return nil, err
+        }
+
+        config.ClientCAs = x509.NewCertPool()
+        if !config.ClientCAs.AppendCertsFromPEM(pem) {
+            return nil, errors.New("no valid certificates in client CA file")
+        }
+        config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+
+    return config, nil
+}
+
 func (l *GophorListener) Accept() (*GophorConn, error) {
     conn, err := l.Listener.Accept()
     if err != nil {
@@ -40,20 +146,77 @@ func (l *GophorListener) Accept() (*GophorConn, error) {
 
     gophorConn := new(GophorConn)
     gophorConn.Conn = conn
-    gophorConn.Host = &ConnHost{ l.Host.Name, l.Host.Port }
+    gophorConn.Host = &ConnHost{ Config.Current().Hostname, l.AdvertisedPort, "", "" }
+    gophorConn.ID   = atomic.AddUint64(&acceptedCount, 1)
     return gophorConn, nil
 }
 
+/* Check advertised hostname resolves to an address we're bound to, else
+ * generated selector lines likely lead nowhere. Wildcard bind addresses
+ * count as every local interface address, and hostnames as every address
+ * they resolve to. Needs the system resolver config, so not after chroot
+ */
+func checkAdvertisedHostname(hostname string, bindAddrs []string) error {
+    resolved, err := net.LookupHost(hostname)
+    if err != nil {
+        return errors.New("advertised hostname "+hostname+" doesn't resolve: "+err.Error())
+    }
+
+    bound := make(map[string]bool)
+    for _, bindAddr := range bindAddrs {
+        ip := net.ParseIP(bindAddr)
+        if ip == nil {
+            /* Unresolvable bind addresses can't have been listened on */
+            bindResolved, _ := net.LookupHost(bindAddr)
+            for _, addr := range bindResolved {
+                bound[net.ParseIP(addr).String()] = true
+            }
+            continue
+        } else if !ip.IsUnspecified() {
+            bound[ip.String()] = true
+            continue
+        }
+
+        interfaceAddrs, err := net.InterfaceAddrs()
+        if err != nil {
+            return nil
+        }
+        for _, addr := range interfaceAddrs {
+            if ipNet, ok := addr.(*net.IPNet); ok {
+                bound[ipNet.IP.String()] = true
+            }
+        }
+    }
+
+    for _, addr := range resolved {
+        if bound[net.ParseIP(addr).String()] {
+            return nil
+        }
+    }
+    return errors.New("advertised hostname "+hostname+" resolves to "+strings.Join(resolved, ", ")+", none of which are bound")
+}
+
+/* Log warning if advertised hostname doesn't resolve to a bound address,
+ * which is expected behind NAT or a port-forward
+ */
+func warnAdvertisedHostname(hostname string, bindAddrs []string) {
+    if err := checkAdvertisedHostname(hostname, bindAddrs); err != nil {
+        Config.LogSystemError("Warning: %s, generated links may be dead (ignore if behind NAT)\n", err.Error())
+    }
+}
+
 func (l *GophorListener) Addr() net.Addr {
     return l.Listener.Addr()
 }
 
 /* Simple wrapper to Conn with easier acccess
- * to hostname / port information
+ * to hostname / port information. ID ties together
+ * log lines from the same connection
  */
 type GophorConn struct {
     Conn     net.Conn
     Host     *ConnHost
+    ID       uint64
 }
 
 func (c *GophorConn) Read(b []byte) (int, error) {
@@ -64,10 +227,56 @@ func (c *GophorConn) Write(b []byte) (int, error) {
     return c.Conn.Write(b)
 }
 
+func (c *GophorConn) SetReadDeadline(t time.Time) error {
+    return c.Conn.SetReadDeadline(t)
+}
+
+func (c *GophorConn) SetWriteDeadline(t time.Time) error {
+    return c.Conn.SetWriteDeadline(t)
+}
+
+/* Returns the verified TLS client certificate subject common name,
+ * or empty string if not TLS / no client certificate
+ */
+func (c *GophorConn) ClientSubject() string {
+    tlsConn, ok := c.Conn.(*tls.Conn)
+    if !ok {
+        return ""
+    }
+
+    state := tlsConn.ConnectionState()
+    if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+        return ""
+    }
+    return state.VerifiedChains[0][0].Subject.CommonName
+}
+
 func (c *GophorConn) RemoteAddr() net.Addr {
     return c.Conn.RemoteAddr()
 }
 
+/* Port the connection was accepted on. Host holds the advertised port for
+ * generated selectors instead, which differs behind a port-forward. Empty
+ * if the connection isn't over TCP
+ */
+func (c *GophorConn) LocalPort() string {
+    _, port, err := net.SplitHostPort(c.Conn.LocalAddr().String())
+    if err != nil {
+        return ""
+    }
+    return port
+}
+
+/* Remote address and connection ID, as shown in the access log */
+func (c *GophorConn) LogSource() string {
+    return c.RemoteAddr().String()+" #"+strconv.FormatUint(c.ID, 10)
+}
+
+/* Number of connections accepted, including any turned away as busy */
+func acceptedConnections() uint64 {
+    return atomic.LoadUint64(&acceptedCount)
+}
+
 func (c *GophorConn) Close() error {
     return c.Conn.Close()
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+/* Create certificate with common name, signed by parent (self-signed if nil) */
+func createTestCert(t *testing.T, commonName string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{ CommonName: commonName },
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth },
+        BasicConstraintsValid: true,
+        IsCA:                  isCA,
+        IPAddresses:           []net.IP{ net.ParseIP("127.0.0.1") },
+    }
+    if parent == nil {
+        parent, parentKey = template, key
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certPem := pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der })
+    keyPem  := pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyDer })
+    return cert, key, certPem, keyPem
+}
+
+/* Dial TLS listener with optional client certificate, returning the
+ * subject seen server side (or handshake error)
+ */
+func dialTestTLS(t *testing.T, listener *GophorListener, caPool *x509.CertPool, clientCert []tls.Certificate) (string, error) {
+    result := make(chan string, 1)
+    errs := make(chan error, 1)
+    go func() {
+        conn, err := listener.Accept()
+        if err != nil {
+            errs <- err
+            return
+        }
+        defer conn.Close()
+
+        /* Handshake happens on first read */
+        buf := make([]byte, 16)
+        if _, err = conn.Read(buf); err != nil {
+            errs <- err
+            return
+        }
+        result <- conn.ClientSubject()
+    }()
+
+    conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ RootCAs: caPool, Certificates: clientCert })
+    if err == nil {
+        _, err = conn.Write([]byte("/"+DOSLineEnd))
+        defer conn.Close()
+    }
+
+    select {
+        case subject := <-result:
+            return subject, nil
+        case err = <-errs:
+            return "", err
+        case <-time.After(5*time.Second):
+            t.Fatal("timed out waiting for handshake")
+            return "", nil
+    }
+}
+
+func TestTLSClientCertHandshake(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+
+    /* CA, server cert and a client cert signed by the CA */
+    ca, caKey, caPem, _ := createTestCert(t, "Test CA", true, nil, nil)
+    _, _, serverPem, serverKeyPem := createTestCert(t, "127.0.0.1", false, ca, caKey)
+    _, _, clientPem, clientKeyPem := createTestCert(t, "alice", false, ca, caKey)
+
+    config, err := loadTLSConfig(
+        writeTestFile(t, dir, "server.crt", string(serverPem)),
+        writeTestFile(t, dir, "server.key", string(serverKeyPem)),
+        writeTestFile(t, dir, "ca.crt", string(caPem)),
+    )
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    listener, err := BeginGophorListenTLS("127.0.0.1", "localhost", "0", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Listener.Close()
+
+    caPool := x509.NewCertPool()
+    caPool.AddCert(ca)
+
+    /* Without a client certificate the handshake must fail */
+    if _, err := dialTestTLS(t, listener, caPool, nil); err == nil {
+        t.Error("expected handshake without client certificate to fail")
+    }
+
+    /* With one, the verified subject is exposed */
+    clientCert, err := tls.X509KeyPair(clientPem, clientKeyPem)
+    if err != nil {
+        t.Fatal(err)
+    }
+    subject, err := dialTestTLS(t, listener, caPool, []tls.Certificate{ clientCert })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if subject != "alice" {
+        t.Errorf("expected client subject alice, got %q", subject)
+    }
+
+    /* Certificates from some other CA are rejected */
+    other, otherKey, _, _ := createTestCert(t, "Other CA", true, nil, nil)
+    _, _, roguePem, rogueKeyPem := createTestCert(t, "alice", false, other, otherKey)
+    rogueCert, _ := tls.X509KeyPair(roguePem, rogueKeyPem)
+    if _, err := dialTestTLS(t, listener, caPool, []tls.Certificate{ rogueCert }); err == nil {
+        t.Error("expected handshake with untrusted client certificate to fail")
+    }
+}
+
+func TestListenBindAddresses(t *testing.T) {
+    setupTestConfig()
+
+    for _, bindAddr := range []string{ "127.0.0.1", "::1" } {
+        l, err := BeginGophorListen(bindAddr, "gopher.example.org", "0")
+        if err != nil {
+            if bindAddr == "::1" {
+                t.Skipf("IPv6 loopback unavailable: %s", err)
+            }
+            t.Fatal(err)
+        }
+
+        /* Accepted connections advertise hostname, not bind address */
+        go func() {
+            conn, err := net.Dial("tcp", l.Addr().String())
+            if err == nil {
+                conn.Close()
+            }
+        }()
+        conn, err := l.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if conn.Host.Name != Config.Current().Hostname {
+            t.Errorf("expected connection on %s to advertise hostname %s, got %s", bindAddr, Config.Current().Hostname, conn.Host.Name)
+        }
+        conn.Close()
+        l.Listener.Close()
+    }
+}
+
+func TestListenAdvertisedPort(t *testing.T) {
+    setupTestConfig()
+
+    l, err := BeginGophorListen("127.0.0.1", "localhost", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Listener.Close()
+
+    /* Defaults to the bound port */
+    if l.AdvertisedPort != "0" {
+        t.Errorf("expected advertised port to default to bind port, got %s", l.AdvertisedPort)
+    }
+
+    /* Generated lines embed the advertised port, not the one connected to */
+    l.AdvertisedPort = "7070"
+    go func() {
+        conn, err := net.Dial("tcp", l.Addr().String())
+        if err == nil {
+            conn.Close()
+        }
+    }()
+    conn, err := l.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    if conn.Host.Port != "7070" {
+        t.Errorf("expected connection to advertise port 7070, got %s", conn.Host.Port)
+    }
+
+    /* While still knowing the port actually connected to */
+    _, boundPort, _ := net.SplitHostPort(l.Addr().String())
+    if conn.LocalPort() != boundPort {
+        t.Errorf("expected connection local port %s, got %s", boundPort, conn.LocalPort())
+    }
+    line := string(buildLine(TypeDirectory, "docs", "/docs", conn.Host.Name, conn.Host.Port))
+    if !strings.HasSuffix(line, "\t7070"+DOSLineEnd) {
+        t.Errorf("expected generated line to embed advertised port, got %q", line)
+    }
+}
+
+func TestCheckAdvertisedHostname(t *testing.T) {
+    setupTestConfig()
+
+    /* Address literals resolve to themselves, so no DNS needed */
+    if err := checkAdvertisedHostname("127.0.0.1", []string{ "127.0.0.1" }); err != nil {
+        t.Errorf("expected hostname resolving to bind address to pass, got %s", err)
+    }
+    if err := checkAdvertisedHostname("192.0.2.1", []string{ "127.0.0.1" }); err == nil {
+        t.Error("expected hostname not resolving to a bind address to fail")
+    }
+
+    /* Wildcard binds cover every interface, including loopback */
+    if err := checkAdvertisedHostname("127.0.0.1", []string{ "0.0.0.0" }); err != nil {
+        t.Errorf("expected loopback to count as bound by wildcard, got %s", err)
+    }
+
+    /* Hostname binds cover every address they resolve to */
+    if err := checkAdvertisedHostname("127.0.0.1", []string{ "localhost" }); err != nil {
+        t.Errorf("expected address of bound hostname to pass, got %s", err)
+    }
+    if err := checkAdvertisedHostname("192.0.2.1", []string{ "localhost" }); err == nil {
+        t.Error("expected hostname not resolving to bound hostname's addresses to fail")
+    }
+}
+
+func TestListenReusePort(t *testing.T) {
+    setupTestConfig()
+    first, err := BeginGophorListen("127.0.0.1", "localhost", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer first.Listener.Close()
+    _, port, _ := net.SplitHostPort(first.Addr().String())
+
+    /* Without SO_REUSEPORT the port can't be shared */
+    if second, err := BeginGophorListen("127.0.0.1", "localhost", port); err == nil {
+        second.Listener.Close()
+        t.Fatal("expected second listener on same port to fail without reuse-port")
+    }
+
+    /* Both listeners need it set to share */
+    Config.ReusePort = true
+    shared, err := BeginGophorListen("127.0.0.1", "localhost", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer shared.Listener.Close()
+    _, port, _ = net.SplitHostPort(shared.Addr().String())
+
+    second, err := BeginGophorListen("127.0.0.1", "localhost", port)
+    if err != nil {
+        t.Skipf("SO_REUSEPORT unsupported here: %s", err)
+    }
+    second.Listener.Close()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "sync/atomic"
+    "time"
+)
+
+/* Connection slots when limiting concurrent connections, nil if unlimited.
+ * A slot is taken by sending, and freed by receiving
+ */
+var connSlots chan struct{}
+
+/* Connections turned away as the server was busy */
+var rejectedCount int64
+
+/* Limit concurrent connections to max, 0 for unlimited */
+func setMaxConnections(max int) {
+    if max > 0 {
+        connSlots = make(chan struct{}, max)
+    } else {
+        connSlots = nil
+    }
+}
+
+/* Take a connection slot, waiting up to supplied time for one to free up */
+func acquireConnSlot(wait time.Duration) bool {
+    if connSlots == nil {
+        return true
+    }
+
+    select {
+        case connSlots <- struct{}{}:
+            return true
+        default:
+            if wait <= 0 {
+                return false
+            }
+    }
+
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+        case connSlots <- struct{}{}:
+            return true
+        case <-timer.C:
+            return false
+    }
+}
+
+/* Free connection slot taken by acquireConnSlot */
+func releaseConnSlot() {
+    if connSlots != nil {
+        <-connSlots
+    }
+}
+
+/* Tell client the server is busy, then close connection. Done from the
+ * accept loop so a flood can't spawn goroutines, hence the short deadline
+ */
+func rejectBusyConn(conn *GophorConn) {
+    atomic.AddInt64(&rejectedCount, 1)
+    Config.LogAccessError(conn.LogSource(), "Server busy, closing connection\n")
+
+    conn.SetWriteDeadline(time.Now().Add(BusyWriteTimeout))
+    conn.Write(generateGopherErrorResponse(ErrorResponse503))
+    conn.Close()
+}
+
+/* Current number of connections being served */
+func activeConnections() int32 {
+    return atomic.LoadInt32(&activeCount)
+}
+
+/* Number of connections turned away as the server was busy */
+func rejectedConnections() int64 {
+    return atomic.LoadInt64(&rejectedCount)
+}
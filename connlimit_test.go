@@ -0,0 +1,80 @@
+package main
+
+import (
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestConnSlots(t *testing.T) {
+    setupTestConfig()
+    setMaxConnections(2)
+    defer setMaxConnections(0)
+
+    if !acquireConnSlot(0) || !acquireConnSlot(0) {
+        t.Fatal("expected slots up to connection limit")
+    }
+    if acquireConnSlot(0) {
+        t.Errorf("expected no slot beyond connection limit")
+    }
+
+    /* Waiting gives up after the wait, or succeeds once a slot frees up */
+    start := time.Now()
+    if acquireConnSlot(20 * time.Millisecond) || time.Since(start) < 20 * time.Millisecond {
+        t.Errorf("expected wait for slot to time out")
+    }
+    go func() {
+        time.Sleep(10 * time.Millisecond)
+        releaseConnSlot()
+    }()
+    if !acquireConnSlot(time.Second) {
+        t.Errorf("expected slot once one was released")
+    }
+
+    /* Unlimited always has a slot */
+    setMaxConnections(0)
+    for i := 0; i < 10; i += 1 {
+        if !acquireConnSlot(0) {
+            t.Fatal("expected slot with no connection limit")
+        }
+        releaseConnSlot()
+    }
+}
+
+func TestConnSlotReleasedOnPanic(t *testing.T) {
+    setupTestConfig()
+    setMaxConnections(1)
+    defer setMaxConnections(0)
+
+    acquireConnSlot(0)
+    func() {
+        defer func() { recover() }()
+        defer releaseConnSlot()
+        panic("handler failed")
+    }()
+
+    if !acquireConnSlot(0) {
+        t.Errorf("expected slot released after handler panic")
+    }
+}
+
+func TestRejectBusyConn(t *testing.T) {
+    setupTestConfig()
+    server, client := net.Pipe()
+    before := rejectedConnections()
+
+    go rejectBusyConn(&GophorConn{ server, testHost, 0 })
+    response, err := io.ReadAll(client)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !strings.HasPrefix(string(response), "3") || !strings.Contains(string(response), "503") {
+        t.Errorf("expected server busy error line, got %q", response)
+    }
+    if rejectedConnections() != before+1 {
+        t.Errorf("expected rejected connection counted")
+    }
+}
@@ -1,13 +1,40 @@
 package main
 
+import (
+    "time"
+)
+
 const (
     /* Gophor */
     GophorVersion = "0.5-alpha"
 
     /* Socket settings */
-    SocketReadBufSize   = 256 /* Supplied selector shouldn't be longer than this anyways */
-    MaxSocketReadChunks = 1
+    SocketReadBufSize   = 256
+    DefaultMaxSelectorLength = 4096
     FileReadBufSize     = 1024
+    SocketWriteChunkSize = 32 * 1024
+
+    /* File cache */
+    CacheShardCount   = 16
+    SlowStatThreshold = 500 * time.Millisecond
+
+    /* Remote gopher servers */
+    RemoteDialTimeout = 5 * time.Second
+    RemoteReadTimeout = 10 * time.Second
+    RemoteMaxBytes    = 65536
+
+    /* Proxied remote resources */
+    ProxyTimeout      = 30 * time.Second
+    ProxyMaxBytes     = 16 * BytesInMegaByte
+
+    /* Access logging */
+    RequestLogFlushFreq = time.Second
+
+    /* Rate limiting */
+    RateLimiterCleanupFreq = time.Minute
+
+    /* Connection limiting */
+    BusyWriteTimeout = time.Second
 
     /* Parsing */
     DOSLineEnd = "\r\n"
@@ -17,6 +44,25 @@ const (
     Tab = "\t"
     LastLine = End+DOSLineEnd
 
+    /* Gopher+ request markers, and response headers for data ending with a
+     * last line or the connection closing
+     */
+    GopherPlusItem        = "+"
+    GopherPlusAttributes  = "!"
+    GopherPlusDirectory   = "$"
+    GopherPlusHeaderEnd   = "+-1"+DOSLineEnd
+    GopherPlusHeaderClose = "+-2"+DOSLineEnd
+
+    /* Page width limits, minimum has to fit the "..." truncation in buildLine() */
+    MinPageWidth = 10
+    MaxPageWidth = 1024
+
+    /* Tab stop width tabs in included text are expanded to by default */
+    DefaultTabWidth = 8
+
+    /* Item type detection, bytes read when sniffing contents */
+    ItemTypeSniffLen = 512
+
     /* Line creation */
     MaxUserNameLen = 70  /* RFC 1436 standard */
     MaxSelectorLen = 255 /* RFC 1436 standard */
@@ -27,15 +73,49 @@ const (
 
     SelectorErrorStr = "selector_length_error"
     GophermapRenderErrorStr = ""
+    MaintenanceNoticeStr = "Down for maintenance, please try again later."
+    MovedNoticeStr = "This has moved, please update any links to:"
 
     /* Replacement strings */
     ReplaceStrHostname = "$hostname"
     ReplaceStrPort = "$port"
+    ReplaceStrQuery = "$query"
+    ReplaceStrUrl  = "$url"
+    ReplaceStrError = "$error"
+
+    /* Selector prefix for web address links */
+    UrlSelectorPrefix = "URL:"
+
+    /* Gophermap directives */
+    DirectiveSort       = "sort"
+    DirectiveSortName   = "name"
+    DirectiveSortNewest = "newest"
+    DirectiveDirsFirst  = "dirs-first"
+    DirectiveRemote     = "remote"
+    DirectiveProxy      = "proxy"
+    DirectiveWidth      = "width"
+    DirectiveBeginInfo  = "begin-info"
+    DirectiveEndInfo    = "end-info"
+    DirectiveEmbed      = "embed"
+    DirectiveRaw        = "raw"
 
     /* Filesystem */
     GophermapFileStr = "gophermap"
     CapsTxtStr = "caps.txt"
     RobotsTxtStr = "robots.txt"
+    IgnoreFileStr = ".gophignore"
+    AclFileStr    = ".gophoracl"
+    CacheControlFileStr = ".cachecontrol"
+    AbstractFileStr = ".abstract"
+    PhonebookFileStr = "phonebook"
+    GzipSuffix = ".gz"
+
+    /* Search */
+    SearchMaxResults = 100
+
+    /* Changelog */
+    ChangelogMaxEntries = 100
+    ChangelogDateFormat = "2006-01-02"
 
     /* Misc */
     BytesInMegaByte = 1048576.0
@@ -92,6 +172,7 @@ const (
     TypeDefault       = TypeBin
 
     /* Gophor specific types */
+    TypeDirective     = ItemType('%') /* [SERVER ONLY] Gophermap directive, sets processing options for the rest of gophermap */
     TypeInfoNotStated = ItemType('z') /* [INTERNAL USE] */
     TypeUnknown       = ItemType('?') /* [INTERNAL USE] */
 )
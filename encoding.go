@@ -0,0 +1,175 @@
+package main
+
+import (
+    "errors"
+    "path"
+    "strings"
+    "unicode/utf8"
+)
+
+/* TextEncoding:
+ * A legacy single-byte text encoding, converted to UTF-8
+ * when served. Bytes below 0x80 are ASCII in all of these,
+ * so only the code points for the upper half are stored.
+ */
+type TextEncoding struct {
+    Name  string
+    Upper [128]rune
+}
+
+/* Decode contents into UTF-8 */
+func (e *TextEncoding) Decode(contents []byte) []byte {
+    ret := make([]byte, 0, len(contents))
+    for _, b := range contents {
+        if b < 0x80 {
+            ret = append(ret, b)
+        } else {
+            ret = utf8.AppendRune(ret, e.Upper[b-0x80])
+        }
+    }
+    return ret
+}
+
+/* ISO-8859-1 maps every byte straight to the same code point */
+func newLatin1Encoding() *TextEncoding {
+    e := &TextEncoding{ Name: "iso-8859-1" }
+    for i := range e.Upper {
+        e.Upper[i] = rune(0x80 + i)
+    }
+    return e
+}
+
+/* Windows-1252 is ISO-8859-1 with printable characters in place of most
+ * of the C1 controls. Undefined bytes keep their C1 control code point
+ */
+func newWindows1252Encoding() *TextEncoding {
+    e := newLatin1Encoding()
+    e.Name = "windows-1252"
+    copy(e.Upper[:32], []rune{
+        0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+        0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+        0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+        0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+    })
+    return e
+}
+
+/* Supported source encodings, by name */
+var textEncodings = map[string]*TextEncoding{
+    "iso-8859-1":   newLatin1Encoding(),
+    "latin1":       newLatin1Encoding(),
+    "windows-1252": newWindows1252Encoding(),
+    "cp1252":       newWindows1252Encoding(),
+}
+
+/* Multi-byte encodings asked for that aren't supported. Converting them
+ * needs conversion tables from golang.org/x/text, and Gophor has no
+ * external dependencies, so they're rejected with an explanation rather
+ * than as unknown
+ */
+var unsupportedTextEncodings = map[string]bool{
+    "shift-jis":   true,
+    "shift_jis":   true,
+    "sjis":        true,
+    "euc-jp":      true,
+    "iso-2022-jp": true,
+    "euc-kr":      true,
+    "gbk":         true,
+    "gb18030":     true,
+    "big5":        true,
+}
+
+/* TextEncodingMap:
+ * Source encodings of served text files, by file extension
+ * or by directory. Extensions take precedence, then the
+ * deepest directory containing the file.
+ */
+type TextEncodingMap struct {
+    Extensions map[string]*TextEncoding
+    Dirs       map[string]*TextEncoding
+}
+
+/* Get source encoding for file at path, nil if served as-is */
+func (m *TextEncodingMap) For(filePath string) *TextEncoding {
+    if m == nil {
+        return nil
+    }
+
+    if encoding, ok := m.Extensions[strings.ToLower(path.Ext(filePath))]; ok {
+        return encoding
+    }
+
+    var encoding *TextEncoding
+    longest := -1
+    for dir, dirEncoding := range m.Dirs {
+        if hasPathPrefix(filePath, dir) && len(dir) > longest {
+            encoding, longest = dirEncoding, len(dir)
+        }
+    }
+    return encoding
+}
+
+/* Parse new-line separated '.ext=encoding' or '/dir=encoding' entries,
+ * nil if there are none
+ */
+func parseTextEncodings(entries string) (*TextEncodingMap, error) {
+    lines := splitNonEmpty(entries, "\n")
+    if len(lines) == 0 {
+        return nil, nil
+    }
+
+    m := &TextEncodingMap{ make(map[string]*TextEncoding), make(map[string]*TextEncoding) }
+    for _, line := range lines {
+        split := strings.SplitN(line, "=", 2)
+        if len(split) != 2 {
+            return nil, errors.New("invalid text encoding mapping: "+line)
+        }
+
+        encoding, ok := textEncodings[strings.ToLower(split[1])]
+        if !ok && unsupportedTextEncodings[strings.ToLower(split[1])] {
+            return nil, errors.New("unsupported text encoding: "+split[1]+" (multi-byte encodings need golang.org/x/text, only iso-8859-1 and windows-1252 are supported)")
+        } else if !ok {
+            return nil, errors.New("unsupported text encoding: "+split[1])
+        }
+
+        switch {
+            case strings.HasPrefix(split[0], "."):
+                m.Extensions[strings.ToLower(split[0])] = encoding
+            case strings.HasPrefix(split[0], "/"):
+                m.Dirs[sanitizePath(split[0])] = encoding
+            default:
+                return nil, errors.New("invalid text encoding mapping: "+line)
+        }
+    }
+    return m, nil
+}
+
+/* Get configured source encoding of file at path, nil if not a text file
+ * or served as-is
+ */
+func textEncodingFor(filePath string) *TextEncoding {
+    encoding := Config.TextEncodings.For(filePath)
+    if encoding == nil || !isTextType(guessItemType(filePath)) {
+        return nil
+    }
+    return encoding
+}
+
+/* Convert contents of file at path to UTF-8 if it has a configured source
+ * encoding, else return as-is
+ */
+func transcodeText(filePath string, contents []byte) []byte {
+    encoding := textEncodingFor(filePath)
+    if encoding == nil {
+        return contents
+    }
+    return encoding.Decode(contents)
+}
+
+/* Encoding advertised in caps.txt */
+func serverDefaultEncoding() string {
+    if Config.TextEncodings != nil {
+        return "utf-8"
+    }
+    return "ascii"
+}
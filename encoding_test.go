@@ -0,0 +1,92 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestTextEncodingDecode(t *testing.T) {
+    tests := []struct {
+        Encoding string
+        Input    string
+        Expected string
+    }{
+        { "latin1",       "caf\xe9",         "café" },
+        { "iso-8859-1",   "\xa3100",         "£100" },
+        { "windows-1252", "\x93quoted\x94",  "“quoted”" },
+        { "cp1252",       "\x80 \x81",       "€ \u0081" },
+    }
+
+    for _, test := range tests {
+        if output := string(textEncodings[test.Encoding].Decode([]byte(test.Input))); output != test.Expected {
+            t.Errorf("%s: expected %q, got %q", test.Encoding, test.Expected, output)
+        }
+    }
+}
+
+func TestParseTextEncodings(t *testing.T) {
+    if m, err := parseTextEncodings(""); m != nil || err != nil {
+        t.Errorf("expected no mappings for empty entries, got %v %v", m, err)
+    }
+
+    for _, bad := range []string{ ".txt", ".txt=shift-jis", "txt=latin1" } {
+        if _, err := parseTextEncodings(bad); err == nil {
+            t.Errorf("expected error parsing %q", bad)
+        }
+    }
+
+    /* Multi-byte encodings say why they're unsupported */
+    if _, err := parseTextEncodings(".txt=Shift_JIS"); err == nil || !strings.Contains(err.Error(), "multi-byte") {
+        t.Errorf("expected multi-byte encoding explained as unsupported, got %v", err)
+    }
+
+    m, err := parseTextEncodings(".TXT=latin1\n/legacy=cp1252\n/legacy/old/=latin1")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := map[string]string{
+        "/notes.txt":             "iso-8859-1",
+        "/legacy/notes.txt":      "iso-8859-1",
+        "/legacy/readme.md":      "windows-1252",
+        "/legacy/old/readme.md":  "iso-8859-1",
+        "/legacyish/readme.md":   "",
+    }
+    for filePath, expected := range tests {
+        name := ""
+        if encoding := m.For(filePath); encoding != nil {
+            name = encoding.Name
+        }
+        if name != expected {
+            t.Errorf("For(%q) = %q, expected %q", filePath, name, expected)
+        }
+    }
+}
+
+func TestTranscodeServedTextFile(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    textPath := writeTestFile(t, dir, "legacy/notes.txt", "caf\xe9\n")
+    binPath := writeTestFile(t, dir, "legacy/data.bin", "\x00\xe9")
+    Config.TextEncodings, _ = parseTextEncodings(dir+"/legacy=latin1")
+
+    output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ textPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if string(output) != "café\n" {
+        t.Errorf("expected text file converted to UTF-8, got %q", output)
+    }
+
+    output, gophorErr = Config.FileSystem.FetchFile(&FileSystemRequest{ binPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if string(output) != "\x00\xe9" {
+        t.Errorf("expected binary file served as-is, got %q", output)
+    }
+
+    if !strings.Contains(string(generateCapsTxt()), "ServerDefaultEncoding=utf-8") {
+        t.Errorf("expected caps.txt to advertise utf-8")
+    }
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+    "os"
+    "bufio"
+    "errors"
+    "strings"
     "fmt"
 )
 
@@ -11,18 +15,24 @@ const (
     /* Filesystem */
     PathEnumerationErr  ErrorCode = iota
     IllegalPathErr      ErrorCode = iota
+    AccessDeniedErr     ErrorCode = iota
     FileStatErr         ErrorCode = iota
     FileOpenErr         ErrorCode = iota
     FileReadErr         ErrorCode = iota
     FileTypeErr         ErrorCode = iota
     DirListErr          ErrorCode = iota
+    FileCompressErr     ErrorCode = iota
+    FileOffsetErr       ErrorCode = iota
     
     /* Sockets */
     SocketWriteErr      ErrorCode = iota
     SocketWriteCountErr ErrorCode = iota
+    RemoteDialErr       ErrorCode = iota
+    RemoteReadErr       ErrorCode = iota
     
     /* Parsing */
     InvalidRequestErr   ErrorCode = iota
+    SelectorLengthErr   ErrorCode = iota
     EmptyItemTypeErr    ErrorCode = iota
     EntityPortParseErr  ErrorCode = iota
     InvalidGophermapErr ErrorCode = iota
@@ -35,6 +45,7 @@ const (
     ErrorResponse404 ErrorResponseCode = iota
     ErrorResponse408 ErrorResponseCode = iota
     ErrorResponse410 ErrorResponseCode = iota
+    ErrorResponse429 ErrorResponseCode = iota
     ErrorResponse500 ErrorResponseCode = iota
     ErrorResponse501 ErrorResponseCode = iota
     ErrorResponse503 ErrorResponseCode = iota
@@ -47,47 +58,82 @@ type GophorError struct {
     Err  error
 }
 
-/* Convert error code to string */
+/* Convert error to string, with the wrapped error if any */
 func (e *GophorError) Error() string {
-    var str string
-    switch e.Code {
+    if e.Err != nil {
+        return fmt.Sprintf("%s (%s)", e.Code.String(), e.Err.Error())
+    } else {
+        return e.Code.String()
+    }
+}
+
+/* Get wrapped error, so the cause can be inspected with errors.Is / errors.As */
+func (e *GophorError) Unwrap() error {
+    return e.Err
+}
+
+/* Terse reason for error, without paths or other detail that shouldn't
+ * reach clients
+ */
+func (e *GophorError) Reason() string {
+    switch {
+        case errors.Is(e.Err, os.ErrNotExist):
+            return "not found"
+        case errors.Is(e.Err, os.ErrPermission):
+            return "permission denied"
+        case errors.Is(e.Err, bufio.ErrTooLong):
+            return "line too long"
+        default:
+            return e.Code.String()
+    }
+}
+
+/* Convert error code to string */
+func (e ErrorCode) String() string {
+    switch e {
         case PathEnumerationErr:
-            str = "path enumeration fail"
+            return "path enumeration fail"
         case IllegalPathErr:
-            str = "illegal path requested"
+            return "illegal path requested"
+        case AccessDeniedErr:
+            return "access denied"
         case FileStatErr:
-            str = "file stat fail"
+            return "file stat fail"
         case FileOpenErr:
-            str = "file open fail"
+            return "file open fail"
         case FileReadErr:
-            str = "file read fail"
+            return "file read fail"
         case FileTypeErr:
-            str = "invalid file type"
+            return "invalid file type"
         case DirListErr:
-            str = "directory read fail"
+            return "directory read fail"
+        case FileCompressErr:
+            return "file compress fail"
+        case FileOffsetErr:
+            return "file offset out of range"
 
         case SocketWriteErr:
-            str = "socket write fail"
+            return "socket write fail"
         case SocketWriteCountErr:
-            str = "socket write count mismatch"
+            return "socket write count mismatch"
+        case RemoteDialErr:
+            return "remote server connect fail"
+        case RemoteReadErr:
+            return "remote server read fail"
 
         case InvalidRequestErr:
-            str = "invalid request data"
+            return "invalid request data"
+        case SelectorLengthErr:
+            return "selector too long"
         case EmptyItemTypeErr:
-            str = "line string provides no dir entity type"
+            return "line string provides no dir entity type"
         case EntityPortParseErr:
-            str = "parsing dir entity port"
+            return "parsing dir entity port"
         case InvalidGophermapErr:
-            str = "invalid gophermap"
+            return "invalid gophermap"
 
         default:
-            str = "Unknown"
-    }
-
-    if e.Err != nil {
-        return fmt.Sprintf("%s (%s)", str, e.Err.Error())
-    } else {
-        return fmt.Sprintf("%s", str)
+            return "Unknown"
     }
 }
 
@@ -98,6 +144,8 @@ func gophorErrorToResponseCode(code ErrorCode) ErrorResponseCode {
             return ErrorResponse400
         case IllegalPathErr:
             return ErrorResponse403
+        case AccessDeniedErr:
+            return ErrorResponse403
         case FileStatErr:
             return ErrorResponse404
         case FileOpenErr:
@@ -109,6 +157,10 @@ func gophorErrorToResponseCode(code ErrorCode) ErrorResponseCode {
             return ErrorResponse404
         case DirListErr:
             return ErrorResponse404
+        case FileCompressErr:
+            return ErrorResponse500
+        case FileOffsetErr:
+            return ErrorResponse400
 
         /* These are errors _while_ sending, no point trying to send error  */
         case SocketWriteErr:
@@ -116,8 +168,15 @@ func gophorErrorToResponseCode(code ErrorCode) ErrorResponseCode {
         case SocketWriteCountErr:
             return NoResponse
 
+        case RemoteDialErr:
+            return ErrorResponse503
+        case RemoteReadErr:
+            return ErrorResponse503
+
         case InvalidRequestErr:
             return ErrorResponse400
+        case SelectorLengthErr:
+            return ErrorResponse400
         case EmptyItemTypeErr:
             return ErrorResponse500
         case EntityPortParseErr:
@@ -139,9 +198,15 @@ func generateGopherErrorResponseFromCode(code ErrorCode) []byte {
     return generateGopherErrorResponse(responseCode)
 }
 
-/* Generates gopher protocol compatible error response for response code */
+/* Generates gopher protocol compatible error response for response code,
+ * formatted using the operator's error template
+ */
 func generateGopherErrorResponse(code ErrorResponseCode) []byte {
-    return buildError(code.String())
+    template := Config.ErrorTemplate
+    if template == "" {
+        template = ReplaceStrError
+    }
+    return errorResponse(strings.Replace(template, ReplaceStrError, code.String(), -1))
 }
 
 /* Error response code to string */
@@ -161,6 +226,8 @@ func (e ErrorResponseCode) String() string {
             return "408 Request Time-out"
         case ErrorResponse410:
             return "410 Gone"
+        case ErrorResponse429:
+            return "429 Too Many Requests"
         case ErrorResponse500:
             return "500 Internal Server Error"
         case ErrorResponse501:
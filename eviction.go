@@ -0,0 +1,81 @@
+package main
+
+import (
+    "container/list"
+    "sync/atomic"
+)
+
+/* EvictionPolicy:
+ * Decides which file a FixedMap pushes out once over its
+ * size limit. Accessed is called on every Get, which may
+ * happen concurrently under a cache shard read lock, so
+ * must only touch the element atomically. Victim is called
+ * under the write lock, returning the list element of a
+ * file not in use to evict, or nil if there are none.
+ */
+type EvictionPolicy interface {
+    Accessed(*MapElement)
+    Victim(*FixedMap) *list.Element
+}
+
+/* Create eviction policy by name, false if unknown */
+func NewEvictionPolicy(name string) (EvictionPolicy, bool) {
+    switch name {
+        case "lru":
+            return &LRUPolicy{}, true
+        case "lfu":
+            return &LFUPolicy{}, true
+        default:
+            return nil, false
+    }
+}
+
+/* LRUPolicy:
+ * Evicts the file that has been in the map longest,
+ * walking back from the end of the list past files
+ * currently in use. The default. Accesses never move
+ * files in the list, so hits (even on the same hot file)
+ * don't need anything beyond the shard read lock.
+ */
+type LRUPolicy struct {}
+
+func (p *LRUPolicy) Accessed(elem *MapElement) {}
+
+func (p *LRUPolicy) Victim(fm *FixedMap) *list.Element {
+    for element := fm.List.Back(); element != nil; element = element.Prev() {
+        key, _ := element.Value.(string)
+        if !fm.Map[key].Value.InUse() {
+            return element
+        }
+    }
+    return nil
+}
+
+/* LFUPolicy:
+ * Evicts the file with fewest accesses, so a few hot
+ * files survive bursts of one-off requests. Ties go to
+ * the file that has been in the map longest.
+ */
+type LFUPolicy struct {}
+
+func (p *LFUPolicy) Accessed(elem *MapElement) {
+    atomic.AddInt64(&elem.Hits, 1)
+}
+
+func (p *LFUPolicy) Victim(fm *FixedMap) *list.Element {
+    var victim *list.Element
+    var victimHits int64
+    for element := fm.List.Back(); element != nil; element = element.Prev() {
+        key, _ := element.Value.(string)
+        elem := fm.Map[key]
+        if elem.Value.InUse() {
+            continue
+        }
+
+        hits := atomic.LoadInt64(&elem.Hits)
+        if victim == nil || hits < victimHits {
+            victim, victimHits = element, hits
+        }
+    }
+    return victim
+}
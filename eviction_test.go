@@ -0,0 +1,68 @@
+package main
+
+import (
+    "testing"
+)
+
+func newTestFile() *File {
+    return NewFile(&GeneratedFileContents{ nil })
+}
+
+func TestLRUPolicyEviction(t *testing.T) {
+    setupTestConfig()
+    fm := NewFixedMap(2, &LRUPolicy{})
+    fm.Put("/a", newTestFile())
+    fm.Put("/b", newTestFile())
+    fm.Get("/a")
+    fm.Put("/c", newTestFile())
+
+    /* Longest cached goes first, regardless of accesses */
+    if fm.Get("/a") != nil || fm.Get("/b") == nil || fm.Get("/c") == nil {
+        t.Errorf("expected /a evicted by LRU policy, got %v", fm.Map)
+    }
+}
+
+func TestLFUPolicyEviction(t *testing.T) {
+    setupTestConfig()
+    fm := NewFixedMap(2, &LFUPolicy{})
+    fm.Put("/hot", newTestFile())
+    for i := 0; i < 5; i += 1 {
+        fm.Get("/hot")
+    }
+
+    /* Burst of one-off files never pushes out the hot file. Like fetch,
+     * hold a reference while putting so the new file isn't the victim
+     */
+    for _, key := range []string{ "/a", "/b", "/c" } {
+        file := newTestFile()
+        file.Acquire()
+        fm.Put(key, file)
+        file.Release()
+        if fm.Get("/hot") == nil {
+            t.Fatalf("expected hot file kept by LFU policy after %s", key)
+        }
+    }
+    if fm.Get("/c") == nil || fm.List.Len() != 2 {
+        t.Errorf("expected latest file cached alongside hot file, got %v", fm.Map)
+    }
+}
+
+func TestEvictionPolicySkipsInUse(t *testing.T) {
+    setupTestConfig()
+    for _, name := range []string{ "lru", "lfu" } {
+        policy, _ := NewEvictionPolicy(name)
+        fm := NewFixedMap(1, policy)
+        inUse := newTestFile()
+        inUse.Acquire()
+        fm.Put("/a", inUse)
+        fm.Put("/b", newTestFile())
+
+        if fm.Get("/a") == nil || fm.Get("/b") != nil {
+            t.Errorf("%s: expected in use file kept, got %v", name, fm.Map)
+        }
+    }
+
+    if _, ok := NewEvictionPolicy("random"); ok {
+        t.Errorf("expected unknown eviction policy to be rejected")
+    }
+}
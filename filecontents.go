@@ -1,9 +1,14 @@
 package main
 
 import (
+    "os"
     "bytes"
+    "compress/gzip"
     "bufio"
+    "sort"
+    "strconv"
     "strings"
+    "path/filepath"
 )
 
 /* GeneratedFileContents:
@@ -45,16 +50,102 @@ func (fc *RegularFileContents) Render(request *FileSystemRequest) []byte {
 }
 
 func (fc *RegularFileContents) Load() *GophorError {
-    /* Load the file into memory */
-    var gophorErr *GophorError
-    fc.contents, gophorErr = bufferedRead(fc.path)
-    return gophorErr
+    /* Load the file into memory, converting text to UTF-8 if configured */
+    contents, gophorErr := bufferedRead(fc.path)
+    if gophorErr != nil {
+        return gophorErr
+    }
+    fc.contents = transcodeText(fc.path, contents)
+
+    /* Text files terminated with last line if configured */
+    if Config.TextLastLine && guessItemType(fc.path) == TypeFile {
+        fc.contents = terminateText(fc.contents)
+    }
+    return nil
 }
 
 func (fc *RegularFileContents) Clear() {
     fc.contents = nil
 }
 
+/* BinaryFileContents:
+ * Implementation of FileContents for binary files, e.g.
+ * images and archives. Contents are read and returned
+ * byte-for-byte, never passed through text processing.
+ */
+type BinaryFileContents struct {
+    path     string
+    contents []byte
+}
+
+func (fc *BinaryFileContents) Render(request *FileSystemRequest) []byte {
+    return fc.contents
+}
+
+func (fc *BinaryFileContents) Load() *GophorError {
+    contents, gophorErr := bufferedRead(fc.path)
+    if gophorErr != nil {
+        return gophorErr
+    }
+    fc.contents = contents
+    return nil
+}
+
+func (fc *BinaryFileContents) Clear() {
+    fc.contents = nil
+}
+
+/* Create new contents for a non-gophermap file, binary files kept apart
+ * from the text processing done by regular file contents
+ */
+func newRegularFileContents(filePath string) FileContents {
+    if !isTextType(guessItemType(filePath)) {
+        return &BinaryFileContents{ filePath, nil }
+    }
+    return &RegularFileContents{ filePath, nil }
+}
+
+/* GzipFileContents:
+ * Implementation of FileContents that reads the file at
+ * the stored path and stores a gzip compressed copy of
+ * its contents, so repeated requests don't recompress.
+ */
+type GzipFileContents struct {
+    path     string
+    contents []byte
+}
+
+func (fc *GzipFileContents) Render(request *FileSystemRequest) []byte {
+    return fc.contents
+}
+
+func (fc *GzipFileContents) Load() *GophorError {
+    /* Load the source file into memory */
+    raw, gophorErr := bufferedRead(fc.path)
+    if gophorErr != nil {
+        return gophorErr
+    }
+    raw = transcodeText(fc.path, raw)
+
+    /* Compress into buffer */
+    var buf bytes.Buffer
+    writer := gzip.NewWriter(&buf)
+    _, err := writer.Write(raw)
+    if err == nil {
+        err = writer.Close()
+    }
+    if err != nil {
+        return &GophorError{ FileCompressErr, err }
+    }
+
+    fc.contents = buf.Bytes()
+    return nil
+}
+
+func (fc *GzipFileContents) Clear() {
+    fc.contents = nil
+}
+
 /* GophermapContents:
  * Implementation of FileContents that reads and
  * parses a gophermap file into a slice of gophermap
@@ -67,7 +158,8 @@ type GophermapContents struct {
 }
 
 func (gc *GophermapContents) Render(request *FileSystemRequest) []byte {
-    returnContents := make([]byte, 0)
+    /* Start with the header gophermap, if any */
+    returnContents := gc.renderInjectedMap(Config.HeaderMap, request)
 
     /* We don't just want to read the contents, each section
      * in the sections slice needs a call to render() to
@@ -82,22 +174,86 @@ func (gc *GophermapContents) Render(request *FileSystemRequest) []byte {
         returnContents = append(returnContents, content...)
     }
 
-    /* The footer added later contains last line, don't need to worry */
+    /* Then the footer gophermap, if any. The footer text added later
+     * contains last line, don't need to worry
+     */
+    returnContents = append(returnContents, gc.renderInjectedMap(Config.FooterMap, request)...)
 
     return returnContents
 }
 
+/* Render the header or footer gophermap at mapPath, fetched through the
+ * file cache like any other gophermap. Nothing is injected into the header
+ * and footer gophermaps themselves, else they'd recurse, nor into embedded
+ * gophermaps as the page embedding them already has them
+ */
+func (gc *GophermapContents) renderInjectedMap(mapPath string, request *FileSystemRequest) []byte {
+    if mapPath == "" || gc.path == Config.HeaderMap || gc.path == Config.FooterMap || len(request.Embedders) > 0 {
+        return []byte{}
+    }
+
+    output, gophorErr := Config.FileSystem.fetch(&FileSystemRequest{ mapPath, request.Host, request.Query, nil, request.GopherPlus }, mapPath, func(path string) FileContents {
+        return &GophermapContents{ path, nil }
+    })
+    if gophorErr != nil {
+        Config.LogSystemError("Error rendering gophermap %s: %s\n", mapPath, gophorErr.Error())
+        return []byte{}
+    }
+    return output
+}
+
 func (gc *GophermapContents) Load() *GophorError {
-    /* Load the gophermap into memory as gophermap sections */
-    var gophorErr *GophorError
-    gc.sections, gophorErr = readGophermap(gc.path)
-    return gophorErr
+    /* Load the gophermap into memory as gophermap sections, logging any
+     * problems rendered as error lines
+     */
+    sections, errs, gophorErr := readGophermapWithErrors(gc.path)
+    if gophorErr != nil {
+        return gophorErr
+    }
+    if len(errs) > 0 {
+        Config.LogSystemError("Problems reading gophermap %s: %s\n", gc.path, errs.Error())
+    }
+    gc.sections = sections
+    return nil
 }
 
 func (gc *GophermapContents) Clear() {
     gc.sections = nil
 }
 
+/* MergedGophermapContents:
+ * Implementation of FileContents that reads and parses
+ * an ordered list of gophermaps, concatenating all of
+ * their sections into one menu.
+ */
+type MergedGophermapContents struct {
+    paths    []string
+    sections []GophermapSection
+}
+
+func (mc *MergedGophermapContents) Render(request *FileSystemRequest) []byte {
+    /* Render exactly as any other gophermap */
+    return (&GophermapContents{ "", mc.sections }).Render(request)
+}
+
+func (mc *MergedGophermapContents) Load() *GophorError {
+    /* Load each gophermap and append its sections */
+    sections := make([]GophermapSection, 0)
+    for _, path := range mc.paths {
+        mapSections, gophorErr := readGophermap(path)
+        if gophorErr != nil {
+            return gophorErr
+        }
+        sections = append(sections, mapSections...)
+    }
+    mc.sections = sections
+    return nil
+}
+
+func (mc *MergedGophermapContents) Clear() {
+    mc.sections = nil
+}
+
 /* GophermapSection:
  * Provides an interface for different stored sections
  * of a gophermap file, whether it's static text that we
@@ -122,34 +278,169 @@ func NewGophermapText(contents []byte) *GophermapText {
 }
 
 func (s *GophermapText) Render(request *FileSystemRequest) ([]byte, *GophorError) {
-    return replaceStrings(string(s.Contents), request.Host), nil
+    return replaceStrings(string(s.Contents), request), nil
+}
+
+/* GophermapError:
+ * Implementation of GophermapSection for a problem found
+ * while reading a gophermap. Rendered as an info line in
+ * place of whatever was intended, so authors can spot it,
+ * and collected for anyone wanting to report them. Path
+ * and line are of the gophermap line it was found on.
+ */
+type GophermapError struct {
+    Text string
+    Path string
+    Line int
+}
+
+func NewGophermapError(text string) *GophermapError {
+    return &GophermapError{ text, "", 0 }
+}
+
+func (s *GophermapError) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    return buildInfoLine(s.Text), nil
+}
+
+func (s *GophermapError) Error() string {
+    return s.Path+":"+strconv.Itoa(s.Line)+": "+s.Text
+}
+
+/* Note gophermap path and line on problems found reading that line. Those
+ * already noted were found within an included gophermap, so are left as-is
+ */
+func markGophermapErrors(sections []GophermapSection, path string, line int) {
+    for _, section := range sections {
+        if s, ok := section.(*GophermapError); ok && s.Path == "" {
+            s.Path, s.Line = path, line
+        }
+    }
+}
+
+/* GophermapErrors:
+ * Problems found reading a gophermap, in the order
+ * they'd be rendered.
+ */
+type GophermapErrors []*GophermapError
+
+func (errs GophermapErrors) Error() string {
+    strs := make([]string, len(errs))
+    for i, err := range errs {
+        strs[i] = err.Error()
+    }
+    return strings.Join(strs, "; ")
 }
 
 /* GophermapDirListing:
  * An implementation of GophermapSection that holds onto a
- * path and a requested list of hidden files, then enumerates
- * the supplied paths (ignoring hidden files) when the content
- * Render() call is received.
+ * path, a requested list of hidden files and the requested
+ * sort order, then enumerates the supplied paths (ignoring
+ * hidden files) when the content Render() call is received.
  */
 type GophermapDirListing struct {
     Path   string
     Hidden map[string]bool
+    Sort   *DirSort
 }
 
 func NewGophermapDirListing(path string) *GophermapDirListing {
-    return &GophermapDirListing{ path, nil }
+    return &GophermapDirListing{ path, nil, DefaultDirSort }
 }
 
 func (s *GophermapDirListing) Render(request *FileSystemRequest) ([]byte, *GophorError) {
     /* We could just pass the request directly, but in case the request
      * path happens to differ for whatever reason we create a new one
      */
-    return listDir(&FileSystemRequest{ s.Path, request.Host }, s.Hidden)
+    return listDir(&FileSystemRequest{ s.Path, request.Host, "", nil, request.GopherPlus }, s.Hidden, s.Sort)
+}
+
+/* GophermapEmbed:
+ * An implementation of GophermapSection that embeds the
+ * output of another file, fetched through the file cache
+ * on each render rather than re-read from disk. Text is
+ * embedded as info lines, menus as they're rendered.
+ */
+type GophermapEmbed struct {
+    Source    string
+    Target    string
+    Menu      bool
+    PageWidth int
+}
+
+func (s *GophermapEmbed) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    /* Never embed a gophermap within itself, however indirectly */
+    embedders := append(append([]string{}, request.Embedders...), s.Source)
+    for _, embedder := range embedders {
+        if embedder == s.Target {
+            Config.LogSystemError("Embed cycle in %s: %s\n", s.Source, s.Target)
+            return buildInfoLine("Error: embed cycle: "+s.Target), nil
+        }
+    }
+
+    output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ s.Target, request.Host, "", embedders, request.GopherPlus })
+    if gophorErr != nil {
+        Config.LogSystemError("Error reading embed in %s: %s: %s\n", s.Source, s.Target, gophorErr.Error())
+        return buildInfoLine("Error reading embed: "+s.Target+" ("+gophorErr.Reason()+")"), nil
+    }
+
+    /* Whatever we embed into, it isn't finished yet */
+    output = bytes.TrimSuffix(output, []byte(LastLine))
+    if s.Menu {
+        return output, nil
+    }
+
+    ret := make([]byte, 0, len(output))
+    for _, line := range strings.SplitAfter(string(output), "\n") {
+        if line == "" {
+            continue
+        }
+
+        line = strings.TrimRight(line, "\r\n")
+        if Config.TextLastLine && strings.HasPrefix(line, End+End) {
+            line = line[1:]
+        }
+        ret = append(ret, reflowInfoLine(expandTabs(line, Config.TabWidth), s.PageWidth)...)
+    }
+    return ret, nil
 }
 
 func readGophermap(path string) ([]GophermapSection, *GophorError) {
-    /* Create return slice */
+    return readGophermapIncluded(path, nil)
+}
+
+/* Read gophermap at path, also returning problems found reading it (and
+ * anything it includes) that were rendered as error lines
+ */
+func readGophermapWithErrors(path string) ([]GophermapSection, GophermapErrors, *GophorError) {
+    sections, gophorErr := readGophermap(path)
+    if gophorErr != nil {
+        return nil, nil, gophorErr
+    }
+
+    errs := make(GophermapErrors, 0)
+    for _, section := range sections {
+        if s, ok := section.(*GophermapError); ok {
+            errs = append(errs, s)
+        }
+    }
+    return sections, errs, nil
+}
+
+/* Read gophermap at path, included by (in order) the gophermaps in including */
+func readGophermapIncluded(path string, including []string) ([]GophermapSection, *GophorError) {
+    sections, _, gophorErr := readGophermapSources(path, including)
+    return sections, gophorErr
+}
+
+/* Read gophermap at path, included by (in order) the gophermaps in including,
+ * also returning the paths of everything else read into its sections: files
+ * it includes (however indirectly, whether they exist or not) and directories
+ * glob includes were matched in
+ */
+func readGophermapSources(path string, including []string) ([]GophermapSection, []string, *GophorError) {
+    /* Create return slices */
     sections := make([]GophermapSection, 0)
+    sources := make([]string, 0)
 
     /* _Create_ hidden files map now in case dir listing requested */
     hidden := make(map[string]bool)
@@ -157,20 +448,55 @@ func readGophermap(path string) ([]GophermapSection, *GophorError) {
     /* Keep track of whether we've already come across a title line (only 1 allowed!) */
     titleAlready := false
 
+    /* Page width included text is reflowed at, 0 until set by directive */
+    pageWidth := 0
+
+    /* Directory listing sort order, may be changed by directives */
+    dirSort := &DirSort{ DirSortName, false }
+
     /* Reference directory listing now in case requested */
     var dirListing *GophermapDirListing
 
+    /* Whether we're within a block of lines all rendered as info text */
+    infoBlock := false
+
+    /* Line number, so problems can be traced back to the line */
+    lineNo := 0
+
     /* Perform buffered scan with our supplied splitter and iterators */
     gophorErr := bufferedScan(path,
         func(scanner *bufio.Scanner) bool {
             line := scanner.Text()
+            lineNo += 1
+
+            /* Note where any problems with this line were found */
+            defer func(before int) {
+                markGophermapErrors(sections[before:], path, lineNo)
+            }(len(sections))
 
             /* Parse the line item type and handle */
             lineType := parseLineType(line)
+
+            /* Within an info block every line is text, until the end marker */
+            if infoBlock {
+                if lineType == TypeDirective {
+                    switch strings.Fields(line[1:])[0] {
+                        case DirectiveEndInfo:
+                            infoBlock = false
+                            return true
+                        case DirectiveBeginInfo:
+                            sections = append(sections, NewGophermapError("Error: info blocks can't be nested"))
+                            return true
+                    }
+                }
+                sections = append(sections, NewGophermapText(reflowInfoLine(substituteGophermapVars(line), pageWidth)))
+                return true
+            }
+
             switch lineType {
                 case TypeInfoNotStated:
                     /* Append TypeInfo to the beginning of line */
-                    sections = append(sections, NewGophermapText(buildInfoLine(line)))
+                    sections = append(sections, NewGophermapText(buildInfoLine(substituteGophermapVars(line))))
 
                 case TypeTitle:
                     /* Reformat title line to send as info line with appropriate selector */
@@ -180,46 +506,127 @@ func readGophermap(path string) ([]GophermapSection, *GophorError) {
                     }
 
                 case TypeComment:
-                    /* We ignore this line */
-                    break
+                    /* We ignore this line, unless debugging rendering where
+                     * it's shown with placeholders substituted
+                     */
+                    if Config.ShowComments {
+                        sections = append(sections, NewGophermapText(buildInfoLine("# "+substituteGophermapVars(line[1:]))))
+                    }
 
                 case TypeHiddenFile:
                     /* Add to hidden files map */
                     hidden[line[1:]] = true
 
+                case TypeDirective:
+                    /* Parse directive arguments */
+                    args := strings.Fields(line[1:])
+
+                    switch args[0] {
+                        case DirectiveSort:
+                            if len(args) != 2 {
+                                sections = append(sections, NewGophermapError("Error: sort directive requires a sort order"))
+                            } else if args[1] == DirectiveSortName {
+                                dirSort.Type = DirSortName
+                            } else if args[1] == DirectiveSortNewest {
+                                dirSort.Type = DirSortNewest
+                            } else {
+                                sections = append(sections, NewGophermapError("Error: unrecognized sort order: "+args[1]))
+                            }
+
+                        case DirectiveDirsFirst:
+                            dirSort.DirsFirst = true
+
+                        case DirectiveWidth:
+                            /* Reflow this gophermap's included text at a different width */
+                            width, err := strconv.Atoi(strings.Join(args[1:], " "))
+                            if err != nil || width < MinPageWidth || width > MaxPageWidth {
+                                sections = append(sections, NewGophermapError("Error: width directive requires a page width from "+strconv.Itoa(MinPageWidth)+" to "+strconv.Itoa(MaxPageWidth)))
+                            } else {
+                                pageWidth = width
+                            }
+
+                        case DirectiveBeginInfo:
+                            infoBlock = true
+
+                        case DirectiveEndInfo:
+                            sections = append(sections, NewGophermapError("Error: end-info without begin-info"))
+
+                        case DirectiveEmbed:
+                            /* Embed another file's output, through the file cache */
+                            if len(args) != 2 {
+                                sections = append(sections, NewGophermapError("Error: embed directive requires a selector"))
+                            } else {
+                                sections = append(sections, readGophermapEmbed(path, args[1], pageWidth)...)
+                            }
+
+                        case DirectiveRaw:
+                            /* Include a hand-formatted file's bytes verbatim */
+                            if len(args) != 2 {
+                                sections = append(sections, NewGophermapError("Error: raw directive requires a file path"))
+                            } else {
+                                sections = append(sections, readGophermapRaw(path, args[1])...)
+                                sources = append(sources, Config.FileSystem.DiskPath(args[1]))
+                            }
+
+                        case DirectiveRemote:
+                            /* Inline a remote server's menu, if allowed */
+                            if !Config.RemoteEnabled {
+                                sections = append(sections, NewGophermapError("Error: remote listings disabled"))
+                            } else if len(args) < 3 || len(args) > 4 {
+                                sections = append(sections, NewGophermapError("Error: remote directive requires host, port and optional selector"))
+                            } else {
+                                selector := ""
+                                if len(args) == 4 {
+                                    selector = args[3]
+                                }
+                                sections = append(sections, NewGophermapRemoteListing(args[1], args[2], selector))
+                            }
+
+                        case DirectiveProxy:
+                            /* Proxy a remote resource at name in this directory, if allowed */
+                            proxy, ok := NewGophermapProxy(args)
+                            if !Config.RemoteEnabled {
+                                sections = append(sections, NewGophermapError("Error: remote listings disabled"))
+                            } else if !ok {
+                                sections = append(sections, NewGophermapError("Error: proxy directive requires name, host, port and optional selector"))
+                            } else {
+                                sections = append(sections, proxy)
+                            }
+                    }
+
                 case TypeSubGophermap:
-                    /* Check if we've been supplied subgophermap or regular file */
-                    if strings.HasSuffix(line[1:], GophermapFileStr) {
-                        /* Ensure we haven't been passed the current gophermap. Recursion bad! */
-                        if line[1:] == path {
+                    /* Never include anything from outside the server root */
+                    if !isWithinRoot(line[1:]) {
+                        Config.LogSystemError("Include target outside server root in %s: %s\n", path, line[1:])
+                        sections = append(sections, NewGophermapError("Error: include target outside server root: "+line[1:]))
+                        break
+                    }
+
+                    /* Expand glob includes, reading each match in sorted order */
+                    target := Config.FileSystem.DiskPath(line[1:])
+                    if isIncludeGlob(target) {
+                        sources = append(sources, filepath.Dir(target))
+                        matches, err := filepath.Glob(target)
+                        if err != nil || len(matches) == 0 {
+                            sections = append(sections, NewGophermapError("Error: no files match include pattern: "+line[1:]))
                             break
                         }
 
-                        /* Treat as any other gopher map! */
-                        submapSections, gophorErr := readGophermap(line[1:])
-                        if gophorErr != nil {
-                            /* Failed to read subgophermap, insert error line */
-                            sections = append(sections, NewGophermapText(buildInfoLine("Error reading subgophermap: "+line[1:])))
-                        } else {
-                            sections = append(sections, submapSections...)
+                        sort.Strings(matches)
+                        for _, match := range matches {
+                            includeSections, includeSources := readGophermapInclude(path, match, pageWidth, including)
+                            sections = append(sections, includeSections...)
+                            sources = append(sources, includeSources...)
                         }
                     } else {
-                        /* Treat as regular file, but we need to replace Unix line endings
-                         * with gophermap line endings
-                         */
-                        fileContents, gophorErr := readIntoGophermap(line[1:])
-                        if gophorErr != nil {
-                            /* Failed to read file, insert error line */
-                            Config.LogSystem("Error: %s\n", gophorErr)
-                            sections = append(sections, NewGophermapText(buildInfoLine("Error reading subgophermap: "+line[1:])))
-                        } else {
-                            sections = append(sections, NewGophermapText(fileContents))
-                        }
+                        includeSections, includeSources := readGophermapInclude(path, target, pageWidth, including)
+                        sections = append(sections, includeSections...)
+                        sources = append(sources, includeSources...)
                     }
 
                 case TypeExec:
                     /* Try executing supplied line */
-                    sections = append(sections, NewGophermapText(buildInfoLine("Error: inline shell commands not yet supported")))
+                    sections = append(sections, NewGophermapError("Error: inline shell commands not yet supported"))
 
                 case TypeEnd:
                     /* Lastline, break out at end of loop. Interface method Contents()
@@ -230,10 +637,16 @@ func readGophermap(path string) ([]GophermapSection, *GophorError) {
 
                 case TypeEndBeginList:
                     /* Create GophermapDirListing object then break out at end of loop */
-                    dirListing = NewGophermapDirListing(strings.TrimSuffix(path, GophermapFileStr))
+                    dirListing = NewGophermapDirListing(strings.TrimSuffix(path, filepath.Base(path)))
                     return false
 
                 default:
+                    /* Substitute any variables, before the line's used at all */
+                    line = substituteGophermapVars(line)
+
+                    /* Web address links get their HTML redirect page cached */
+                    cacheGophermapUrlRedirect(line)
+
                     /* Just append to sections slice as gophermap text */
                     sections = append(sections, NewGophermapText([]byte(line+DOSLineEnd)))
             }
@@ -244,7 +657,7 @@ func readGophermap(path string) ([]GophermapSection, *GophorError) {
 
     /* Check the bufferedScan didn't exit with error */
     if gophorErr != nil {
-        return nil, gophorErr
+        return nil, nil, gophorErr
     }
 
     /* If dir listing requested, append the hidden files map then add
@@ -254,38 +667,203 @@ func readGophermap(path string) ([]GophermapSection, *GophorError) {
      */
     if dirListing != nil {
         dirListing.Hidden = hidden
+        dirListing.Sort   = dirSort
         sections = append(sections, dirListing)
     }
 
-    return sections, nil
+    return sections, sources, nil
 }
 
-func readIntoGophermap(path string) ([]byte, *GophorError) {
-    /* Create return slice */
-    fileContents := make([]byte, 0)
+/* Read only the hidden files from gophermap at path, returns empty
+ * map if gophermap doesn't exist or can't be read
+ */
+func readGophermapHidden(path string) map[string]bool {
+    hidden := make(map[string]bool)
 
-    /* Perform buffered scan with our supplied splitter and iterators */
-    gophorErr := bufferedScan(path,
+    bufferedScan(path,
         func(scanner *bufio.Scanner) bool {
             line := scanner.Text()
 
-            if line == "" {
-                fileContents = append(fileContents, buildInfoLine("")...)
-                return true
+            switch parseLineType(line) {
+                case TypeHiddenFile:
+                    hidden[line[1:]] = true
+
+                case TypeEnd, TypeEndBeginList:
+                    /* Nothing of interest after these lines */
+                    return false
             }
 
-            /* Replace the newline character */
-            line = strings.Replace(line, "\n", "", -1)
+            return true
+        },
+    )
 
-            /* Iterate through returned str, reflowing to new line
-             * until all lines < PageWidth
-             */
-            for len(line) > 0 {
-                length := minWidth(len(line))
-                fileContents = append(fileContents, buildInfoLine(line[:length])...)
-                line = line[length:]
+    return hidden
+}
+
+/* Read sections for a single include target within gophermap at path,
+ * reflowing regular files at page width (0 for the global page width).
+ * Also returns the paths read, the target and anything it includes
+ */
+func readGophermapInclude(path, target string, pageWidth int, including []string) ([]GophermapSection, []string) {
+    sources := []string{ target }
+
+    if errorSections := checkIncludeTarget(path, target, "include"); errorSections != nil {
+        return errorSections, sources
+    }
+
+    /* Check if we've been supplied subgophermap or regular file */
+    if isGophermapName(filepath.Base(target)) {
+        /* Ensure we haven't been passed the current gophermap. Recursion bad! */
+        if target == path {
+            return nil, nil
+        }
+
+        /* Nor one already including us, however indirectly */
+        for _, includer := range including {
+            if includer == target {
+                Config.LogSystemError("Include cycle in %s: %s\n", path, target)
+                return []GophermapSection{ NewGophermapError("Error: include cycle: "+target) }, sources
             }
-            
+        }
+
+        /* Treat as any other gopher map! Parsed submaps are cached, and all
+         * come before any dir listing of the parent, which is still last
+         */
+        submapSections, submapSources, gophorErr := Config.SubmapCache.Read(target, append(append([]string{}, including...), path))
+        if gophorErr != nil {
+            /* Failed to read subgophermap, insert error line */
+            return includeErrorSections(path, target, gophorErr), sources
+        }
+        return submapSections, append(sources, submapSources...)
+    }
+
+    /* Treat as regular file, but we need to replace Unix line endings
+     * with gophermap line endings
+     */
+    fileContents, gophorErr := readIntoGophermap(target, pageWidth)
+    if gophorErr != nil {
+        /* Failed to read file, insert error line */
+        return includeErrorSections(path, target, gophorErr), sources
+    }
+    return []GophermapSection{ NewGophermapText(fileContents) }, sources
+}
+
+/* Check target can be included (or embedded, as kind) in gophermap at path,
+ * returning an error line if not or nil if it can
+ */
+func checkIncludeTarget(path, target, kind string) []GophermapSection {
+    title := strings.ToUpper(kind[:1])+kind[1:]
+
+    /* Never leak access restricted files into a gophermap */
+    if !isIncludeAllowed(path, target) {
+        Config.LogSystemError("%s target is access restricted in %s: %s\n", title, path, target)
+        return []GophermapSection{ NewGophermapError("Error: "+kind+" target is access restricted: "+target) }
+    }
+
+    /* Symlinks are held to the same policy as requests */
+    if !Config.FileSystem.isSymlinkAllowed(target) {
+        Config.LogSystemError("%s target is a disallowed symlink in %s: %s\n", title, path, target)
+        return []GophermapSection{ NewGophermapError("Error: "+kind+" target is a disallowed symlink: "+target) }
+    }
+
+    /* Directories can't be included, most likely an author error */
+    if isIncludeDir(target) {
+        Config.LogSystemError("%s target is a directory in %s: %s\n", title, path, target)
+        return []GophermapSection{ NewGophermapError("Error: "+kind+" target is a directory: "+target) }
+    }
+
+    return nil
+}
+
+/* Read embed section for selector within gophermap at path. Only gophermaps
+ * (or anything else served as a menu) and text files can be embedded, text
+ * reflowed at page width (0 for the global page width)
+ */
+func readGophermapEmbed(path, selector string, pageWidth int) []GophermapSection {
+    /* Never embed anything from outside the server root */
+    if !isWithinRoot(selector) {
+        Config.LogSystemError("Embed target outside server root in %s: %s\n", path, selector)
+        return []GophermapSection{ NewGophermapError("Error: embed target outside server root: "+selector) }
+    }
+
+    target := Config.FileSystem.DiskPath(sanitizePath(selector))
+    if errorSections := checkIncludeTarget(path, target, "embed"); errorSections != nil {
+        return errorSections
+    }
+
+    itemType := guessItemType(target)
+    menu := isGophermapName(filepath.Base(target)) || itemType == TypeDirectory
+    if !menu && !isTextType(itemType) {
+        Config.LogSystemError("Embed target is not a menu or text in %s: %s\n", path, target)
+        return []GophermapSection{ NewGophermapError("Error: embed target is not a menu or text: "+target) }
+    }
+
+    return []GophermapSection{ &GophermapEmbed{ path, target, menu, pageWidth } }
+}
+
+/* Read raw include of target within gophermap at path, the file's bytes
+ * included as-is without reflowing or line ending conversion. For snippets
+ * already formatted as gophermap output
+ */
+func readGophermapRaw(path, target string) []GophermapSection {
+    /* Never include anything from outside the server root */
+    if !isWithinRoot(target) {
+        Config.LogSystemError("Raw include target outside server root in %s: %s\n", path, target)
+        return []GophermapSection{ NewGophermapError("Error: raw include target outside server root: "+target) }
+    }
+
+    target = Config.FileSystem.DiskPath(target)
+    if errorSections := checkIncludeTarget(path, target, "raw include"); errorSections != nil {
+        return errorSections
+    }
+
+    contents, gophorErr := bufferedRead(target)
+    if gophorErr != nil {
+        return includeErrorSections(path, target, gophorErr)
+    }
+    return []GophermapSection{ NewGophermapText(contents) }
+}
+
+/* Log full error reading include target within gophermap at path, returning
+ * an error line with just the reason for clients
+ */
+func includeErrorSections(path, target string, gophorErr *GophorError) []GophermapSection {
+    Config.LogSystemError("Error reading include in %s: %s: %s\n", path, target, gophorErr.Error())
+    return []GophermapSection{ NewGophermapError("Error reading include: "+target+" ("+gophorErr.Reason()+")") }
+}
+
+/* Check if include target contains glob pattern characters */
+func isIncludeGlob(target string) bool {
+    return strings.ContainsAny(target, "*?[")
+}
+
+/* Check if include path refers to a directory, either by trailing
+ * separator or by what's actually on disk
+ */
+func isIncludeDir(path string) bool {
+    if strings.HasSuffix(path, "/") {
+        return true
+    }
+
+    stat, err := os.Stat(path)
+    return err == nil && stat.IsDir()
+}
+
+func readIntoGophermap(path string, pageWidth int) ([]byte, *GophorError) {
+    /* Create return slice */
+    fileContents := make([]byte, 0)
+
+    /* Perform buffered scan with our supplied splitter and iterators. Very
+     * long lines are just reflowed in chunks
+     */
+    gophorErr := bufferedScanChunked(path,
+        func(scanner *bufio.Scanner) bool {
+            /* Replace the newline character, and expand tabs before
+             * reflowing so the widths are right
+             */
+            line := strings.Replace(scanner.Text(), "\n", "", -1)
+            line = expandTabs(line, Config.TabWidth)
+            fileContents = append(fileContents, reflowInfoLine(line, pageWidth)...)
             return true
         },
     )
@@ -303,16 +881,68 @@ func readIntoGophermap(path string) ([]byte, *GophorError) {
     return fileContents, nil
 }
 
-func minWidth(w int) int {
-    if w <= Config.PageWidth {
+/* Build info lines for line of text reflowed at page width (0 for the
+ * global page width)
+ */
+func reflowInfoLine(line string, pageWidth int) []byte {
+    /* Sanitize first, so the widths are right */
+    line = sanitizeInfoText(line)
+    if line == "" {
+        return buildInfoLine("")
+    }
+
+    if pageWidth == 0 {
+        pageWidth = Config.Current().PageWidth
+    }
+
+    /* Marker appended to hard-cut lines, only if it leaves room for text */
+    marker := Config.WrapMarker
+    if len(marker) >= pageWidth {
+        marker = ""
+    }
+
+    /* Iterate through line, reflowing to new line until all lines <
+     * PageWidth. Lines cut short are marked as continuing, the marker
+     * counting towards the width
+     */
+    ret := make([]byte, 0)
+    for len(line) > 0 {
+        length := minWidth(len(line), pageWidth)
+        suffix := ""
+        if length < len(line) && marker != "" {
+            length = pageWidth-len(marker)
+            suffix = marker
+        }
+        ret = append(ret, buildLineWidth(TypeInfo, line[:length]+suffix, NullSelector, NullHost, NullPort, pageWidth)...)
+        line = line[length:]
+    }
+    return ret
+}
+
+func minWidth(w, pageWidth int) int {
+    /* Guard against bad page width, else reflow loops forever */
+    if w <= pageWidth || pageWidth < 1 {
         return w
     } else {
-        return Config.PageWidth
+        return pageWidth
     }
 }
 
-func replaceStrings(str string, connHost *ConnHost) []byte {
-    str = strings.Replace(str, ReplaceStrHostname, connHost.Name, -1)
-    str = strings.Replace(str, ReplaceStrPort, connHost.Port, -1)
+func replaceStrings(str string, request *FileSystemRequest) []byte {
+    str = strings.Replace(str, ReplaceStrHostname, request.Host.Name, -1)
+    str = strings.Replace(str, ReplaceStrPort, request.Host.Port, -1)
+    str = strings.Replace(str, ReplaceStrQuery, sanitizeQuery(request.Query), -1)
     return []byte(str)
 }
+
+/* Strip tabs and line endings from query, so substituting it into a
+ * gophermap line can't add fields or lines
+ */
+func sanitizeQuery(query string) string {
+    return strings.Map(func(r rune) rune {
+        if r == '\t' || r == '\r' || r == '\n' {
+            return -1
+        }
+        return r
+    }, query)
+}
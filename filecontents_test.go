@@ -0,0 +1,461 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+/* Read and render gophermap at path, failing test on error */
+func renderTestGophermap(t *testing.T, gophermapPath string) string {
+    sections, gophorErr := readGophermap(gophermapPath)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    output := ""
+    for _, section := range sections {
+        b, gophorErr := section.Render(&FileSystemRequest{ gophermapPath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        output += string(b)
+    }
+    return output
+}
+
+func TestIncludeDirectoryTarget(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    writeTestFile(t, dir, "sub/file.txt", "contents")
+
+    for _, target := range []string{ dir+"/sub", dir+"/sub/" } {
+        gophermapPath := writeTestFile(t, dir, GophermapFileStr, "="+target+"\n")
+        output := renderTestGophermap(t, gophermapPath)
+        if !strings.Contains(output, "Error: include target is a directory: "+target) {
+            t.Errorf("expected directory include error for %s, got %q", target, output)
+        }
+    }
+}
+
+func TestReadIntoGophermapInvalidPageWidth(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", "a line longer than no width at all\n")
+
+    /* Must not loop forever reflowing with a zero / negative width */
+    for _, width := range []int{ 0, -1 } {
+        Config.Current().PageWidth = width
+        contents, gophorErr := readIntoGophermap(filePath, 0)
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if len(contents) == 0 {
+            t.Errorf("expected contents with page width %d", width)
+        }
+    }
+}
+
+func TestReadIntoGophermapReflow(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MinPageWidth
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", strings.Repeat("x", MinPageWidth*2+1)+"\n")
+
+    contents, gophorErr := readIntoGophermap(filePath, 0)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if lines := strings.Count(string(contents), DOSLineEnd); lines != 3 {
+        t.Errorf("expected line reflowed into 3 lines at boundary width, got %d", lines)
+    }
+}
+
+func TestReadIntoGophermapWrapMarker(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MinPageWidth
+    dir := t.TempDir()
+
+    tests := []struct {
+        Marker   string
+        Line     string
+        Expected []string
+    }{
+        /* Fits exactly, never marked */
+        { "\\", strings.Repeat("x", MinPageWidth), []string{ strings.Repeat("x", MinPageWidth) } },
+        /* One over, cut short of the width to fit the marker */
+        { "\\", strings.Repeat("x", MinPageWidth+1), []string{ strings.Repeat("x", MinPageWidth-1)+"\\", "xx" } },
+        /* Multi-byte marker counts all its bytes */
+        { "…", strings.Repeat("x", MinPageWidth+1), []string{ strings.Repeat("x", MinPageWidth-3)+"…", "xxxx" } },
+        /* Marker leaving no room for text is dropped */
+        { strings.Repeat("~", MinPageWidth), strings.Repeat("x", MinPageWidth+1), []string{ strings.Repeat("x", MinPageWidth), "x" } },
+    }
+
+    for _, test := range tests {
+        Config.WrapMarker = test.Marker
+        filePath := writeTestFile(t, dir, "file.txt", test.Line+"\n")
+        contents, gophorErr := readIntoGophermap(filePath, 0)
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+
+        expected := ""
+        for _, line := range test.Expected {
+            expected += string(buildInfoLine(line))
+        }
+        if string(contents) != expected {
+            t.Errorf("marker %q: expected %q, got %q", test.Marker, expected, contents)
+        }
+    }
+}
+
+func TestReadIntoGophermapLongLine(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    line := strings.Repeat("x", 100*1024)
+    filePath := writeTestFile(t, t.TempDir(), "long.txt", line+"\n")
+
+    /* Longer than the default max line length, reflowed all the same */
+    contents, gophorErr := readIntoGophermap(filePath, 0)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if count := strings.Count(string(contents), "x"); count != len(line) {
+        t.Errorf("expected all %d bytes of line included, got %d", len(line), count)
+    }
+    if lines := strings.Count(string(contents), DOSLineEnd); lines != len(line)/MaxPageWidth {
+        t.Errorf("expected line reflowed into %d lines, got %d", len(line)/MaxPageWidth, lines)
+    }
+}
+
+func TestReadIntoGophermapTabs(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = 20
+    Config.TabWidth = 4
+    filePath := writeTestFile(t, t.TempDir(), "snippet.txt", "func main() {\n\tif ok {\n\t\treturn\n\t}\n}\nx\ty\tlonger text!!\n")
+
+    contents, gophorErr := readIntoGophermap(filePath, 0)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Tabs expanded to the next tab stop, counting towards the reflow width */
+    expected := ""
+    for _, line := range []string{ "func main() {", "    if ok {", "        return", "    }", "}", "x   y   longer text!", "!" } {
+        expected += string(buildInfoLine(line))
+    }
+    if string(contents) != expected {
+        t.Errorf("expected %q, got %q", expected, contents)
+    }
+}
+
+func TestReadIntoGophermapControlChars(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "text\r1Fake entry\t/evil\tevil.host\t70\nnul\x00byte\x1b[31m\n")
+
+    for marker, expected := range map[string][]string{
+        "":  []string{ "text1Fake entry        /evil   evil.host       70", "nulbyte[31m" },
+        "?": []string{ "text?1Fake entry        /evil   evil.host       70", "nul?byte?[31m" },
+    } {
+        Config.ControlCharMarker = marker
+        contents, gophorErr := readIntoGophermap(filePath, 0)
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+
+        /* Only ever the expected info lines, never a menu entry */
+        expectedContents := ""
+        for _, line := range expected {
+            expectedContents += string(buildInfoLine(line))
+        }
+        if string(contents) != expectedContents {
+            t.Errorf("marker %q: expected %q, got %q", marker, expectedContents, contents)
+        }
+    }
+
+    /* Info lines built directly are sanitized too */
+    Config.ControlCharMarker = ""
+    if line := string(buildInfoLine("a\r\nib\tc")); line != "iaibc"+Tab+NullSelector+Tab+NullHost+Tab+NullPort+DOSLineEnd {
+        t.Errorf("expected control characters stripped from info line, got %q", line)
+    }
+}
+
+func TestInfoBlock(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MinPageWidth
+    gophermapPath := writeTestFile(t, t.TempDir(), GophermapFileStr,
+        "%begin-info\n"+
+        "#text\n"+
+        "=text\n"+
+        strings.Repeat("x", MinPageWidth+1)+"\n"+
+        "%begin-info\n"+
+        "%end-info\n"+
+        "#comment\n"+
+        "%end-info\n",
+    )
+
+    expected := string(buildInfoLine("#text"))+
+        string(buildInfoLine("=text"))+
+        string(buildInfoLine(strings.Repeat("x", MinPageWidth)))+
+        string(buildInfoLine("x"))+
+        string(buildInfoLine("Error: info blocks can't be nested"))+
+        string(buildInfoLine("Error: end-info without begin-info"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
+
+func TestExecLinesNotYetSupported(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    gophermapPath := writeTestFile(t, t.TempDir(), GophermapFileStr, "$date\n& more to come\n")
+
+    output := renderTestGophermap(t, gophermapPath)
+    if strings.Count(output, "Error: inline shell commands not yet supported") != 1 {
+        t.Errorf("expected exec line reported unsupported, got %q", output)
+    }
+
+    /* '&' isn't reserved until exec is supported, so is still just text */
+    if !strings.Contains(output, string(buildInfoLine("& more to come"))) {
+        t.Errorf("expected '&' line served as info text, got %q", output)
+    }
+}
+
+func TestIncludeOutsideRoot(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "=../../../../etc/passwd\n=../../../../etc/*\n")
+
+    output := renderTestGophermap(t, gophermapPath)
+    if strings.Count(output, "include target outside server root") != 2 {
+        t.Errorf("expected traversing includes to be rejected, got:\n%s", output)
+    }
+    if strings.Contains(output, "root:x:") {
+        t.Errorf("expected no contents from outside root, got:\n%s", output)
+    }
+}
+
+func TestHeaderFooterMaps(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    Config.HeaderMap = writeTestFile(t, dir, "header.map", "Welcome to $hostname\n")
+    Config.FooterMap = writeTestFile(t, dir, "footer.map", "Contact admin@example.org\n")
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "Body\n")
+
+    output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ gophermapPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    expected := string(buildInfoLine("Welcome to localhost"))+string(buildInfoLine("Body"))+string(buildInfoLine("Contact admin@example.org"))
+    if string(output) != expected {
+        t.Errorf("expected header and footer around gophermap %q, got %q", expected, output)
+    }
+
+    /* Header and footer are cached like any other gophermap */
+    if Config.FileSystem.shardFor(Config.HeaderMap).Map.Get(Config.HeaderMap) == nil {
+        t.Errorf("expected header gophermap cached")
+    }
+
+    /* Nothing injected into the header itself */
+    output, gophorErr = Config.FileSystem.fetch(&FileSystemRequest{ Config.HeaderMap, testHost, "", nil, "" }, Config.HeaderMap, func(path string) FileContents {
+        return &GophermapContents{ path, nil }
+    })
+    if gophorErr != nil || string(output) != string(buildInfoLine("Welcome to localhost")) {
+        t.Errorf("expected header rendered alone, got %v %q", gophorErr, output)
+    }
+}
+
+func TestWidthDirective(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = 20
+    dir := t.TempDir()
+    textPath := writeTestFile(t, dir, "code.txt", strings.Repeat("x", 30)+"\n")
+    widePath := writeTestFile(t, dir, "wide/"+GophermapFileStr, "%width 40\n="+textPath+"\n")
+    plainPath := writeTestFile(t, dir, "plain/"+GophermapFileStr, "="+textPath+"\n")
+
+    /* Override reflows the map's included text without truncating it */
+    if output := renderTestGophermap(t, widePath); output != string(buildLineWidth(TypeInfo, strings.Repeat("x", 30), NullSelector, NullHost, NullPort, 40)) {
+        t.Errorf("expected included text kept on one line at width 40, got %q", output)
+    }
+
+    /* Other maps keep the global width */
+    if output := renderTestGophermap(t, plainPath); strings.Count(output, DOSLineEnd) != 2 {
+        t.Errorf("expected included text reflowed at global width, got %q", output)
+    }
+
+    /* Invalid widths are reported, not applied */
+    for _, width := range []string{ "0", "5000", "wide" } {
+        badPath := writeTestFile(t, dir, "bad/"+GophermapFileStr, "%width "+width+"\n="+textPath+"\n")
+        output := renderTestGophermap(t, badPath)
+        if !strings.HasPrefix(output, "iError: width") || strings.Count(output, DOSLineEnd) != 3 {
+            t.Errorf("expected error and global width for %%width %s, got %q", width, output)
+        }
+    }
+}
+
+func TestShowComments(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "#served from $hostname\nHello\n")
+
+    if output := renderTestGophermap(t, gophermapPath); output != string(buildInfoLine("Hello")) {
+        t.Errorf("expected comments ignored, got %q", output)
+    }
+
+    Config.ShowComments = true
+    gophermapPath = writeTestFile(t, dir, "debug", "#served from $hostname\nHello\n")
+    expected := string(buildInfoLine("# served from "+testHost.Name))+string(buildInfoLine("Hello"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
+
+func TestIncludeErrorReason(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "=missing.txt\n")
+
+    expected := string(buildInfoLine("Error reading include: missing.txt (not found)"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
+
+func TestEmbedDirective(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "snippets/"+GophermapFileStr, "Shared snippet\n")
+    writeTestFile(t, dir, "notes.txt", "hello\tworld\n")
+    writeTestFile(t, dir, "image.png", "\x89PNG")
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "%embed "+dir+"/snippets/"+GophermapFileStr+"\n%embed "+dir+"/notes.txt\n%embed "+dir+"/image.png\n%embed\n")
+
+    expected := string(buildInfoLine("Shared snippet"))+
+        string(buildInfoLine("hello   world"))+
+        string(buildInfoLine("Error: embed target is not a menu or text: "+dir+"/image.png"))+
+        string(buildInfoLine("Error: embed directive requires a selector"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+
+    /* Embedded through the cache, so a snippet shared by many is read once */
+    if _, ok := Config.FileSystem.shardFor(dir+"/snippets/"+GophermapFileStr).Map.Get(dir+"/snippets/"+GophermapFileStr).contents.(*GophermapContents); !ok {
+        t.Errorf("expected embedded gophermap cached")
+    }
+}
+
+func TestEmbedCycle(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    firstPath := writeTestFile(t, dir, "first/"+GophermapFileStr, "First\n%embed "+dir+"/second/"+GophermapFileStr+"\n")
+    writeTestFile(t, dir, "second/"+GophermapFileStr, "Second\n%embed "+dir+"/first/"+GophermapFileStr+"\n")
+
+    expected := string(buildInfoLine("First"))+string(buildInfoLine("Second"))+string(buildInfoLine("Error: embed cycle: "+firstPath))
+    if output := renderTestGophermap(t, firstPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+
+    selfPath := writeTestFile(t, dir, "self/"+GophermapFileStr, "%embed "+dir+"/self/"+GophermapFileStr+"\n")
+    expected = string(buildInfoLine("Error: embed cycle: "+selfPath))
+    if output := renderTestGophermap(t, selfPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
+
+func TestReadGophermapWithErrors(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    submapPath := writeTestFile(t, dir, "sub/"+GophermapFileStr, "Fine\n%sort sideways\n")
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "Hello\n$echo hi\n="+submapPath+"\n%width\n")
+
+    sections, errs, gophorErr := readGophermapWithErrors(gophermapPath)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Problems still rendered, and traced back to where they were found */
+    expected := []string{
+        gophermapPath+":2: Error: inline shell commands not yet supported",
+        submapPath+":2: Error: unrecognized sort order: sideways",
+        gophermapPath+":4: Error: width directive requires a page width from 10 to 1024",
+    }
+    if len(errs) != len(expected) || errs.Error() != strings.Join(expected, "; ") {
+        t.Errorf("expected errors %q, got %q", strings.Join(expected, "; "), errs.Error())
+    }
+    if len(sections) != 5 {
+        t.Errorf("expected error lines kept as sections, got %d sections", len(sections))
+    }
+
+    /* Nothing to report for a clean gophermap */
+    if _, errs, _ = readGophermapWithErrors(writeTestFile(t, dir, "clean", "Hello\n")); len(errs) != 0 {
+        t.Errorf("expected no errors, got %q", errs.Error())
+    }
+}
+
+func TestRawIncludeDirective(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    snippet := "1A menu line much longer than the page width of this gophermap, left as it is\t/docs\texample.org\t70\r\n"
+    writeTestFile(t, dir, "snippet.txt", snippet)
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "%width 20\n%raw "+dir+"/snippet.txt\n%raw "+dir+"/missing.txt\n%raw\n")
+
+    expected := snippet+
+        string(buildInfoLine("Error reading include: "+dir+"/missing.txt (not found)"))+
+        string(buildInfoLine("Error: raw directive requires a file path"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+
+    /* Regular includes of the same file are still reflowed */
+    gophermapPath = writeTestFile(t, dir, "other/"+GophermapFileStr, "%width 20\n="+dir+"/snippet.txt\n")
+    if output := renderTestGophermap(t, gophermapPath); output == snippet {
+        t.Errorf("expected regular include reflowed, got %q", output)
+    }
+}
+
+func TestGophermapVars(t *testing.T) {
+    setupTestConfig()
+    t.Setenv("GOPHOR_TEST_ENV", "from\tenv")
+    t.Setenv("GOPHOR_TEST_SECRET", "hunter2")
+    Config.GophermapVars = parseGophermapVars("GOPHOR_TEST_ENV\nSITE=Example Site\n")
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "Welcome to ${SITE}\n0${SITE} notes\t/notes.txt\t$hostname\t70\n%begin-info\n${GOPHOR_TEST_ENV} ${GOPHOR_TEST_SECRET}\n%end-info\n")
+
+    /* Only allowed variables substituted, unknown ones left alone */
+    expected := string(buildInfoLine("Welcome to Example Site"))+
+        "0Example Site notes\t/notes.txt\tlocalhost\t70\r\n"+
+        string(buildInfoLine("fromenv ${GOPHOR_TEST_SECRET}"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+
+    /* Or removed if configured */
+    Config.GophermapVarsUnknownEmpty = true
+    if line := substituteGophermapVars("${SITE}: ${GOPHOR_TEST_SECRET}"); line != "Example Site: " {
+        t.Errorf("expected unknown variable removed, got %q", line)
+    }
+}
+
+func TestGlobInclude(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+
+    /* Written out of order, included in sorted order */
+    for _, name := range []string{ "c", "a", "b" } {
+        writeTestFile(t, dir, "parts/"+name+".txt", "Part "+name+"\n")
+    }
+    writeTestFile(t, dir, "parts/skipped.md", "Not matched\n")
+
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "Before\n="+dir+"/parts/*.txt\nAfter\n")
+    expected := string(buildInfoLine("Before"))+string(buildInfoLine("Part a"))+string(buildInfoLine("Part b"))+string(buildInfoLine("Part c"))+string(buildInfoLine("After"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected glob matches included in sorted order %q, got %q", expected, output)
+    }
+
+    /* No matches is a single error line, the rest of the gophermap still served */
+    gophermapPath = writeTestFile(t, dir, GophermapFileStr, "Before\n="+dir+"/parts/*.gph\nAfter\n")
+    expected = string(buildInfoLine("Before"))+string(buildInfoLine("Error: no files match include pattern: "+dir+"/parts/*.gph"))+string(buildInfoLine("After"))
+    if output := renderTestGophermap(t, gophermapPath); output != expected {
+        t.Errorf("expected single error line for glob without matches %q, got %q", expected, output)
+    }
+}
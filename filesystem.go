@@ -2,10 +2,16 @@ package main
 
 import (
     "os"
+    "io"
+    "compress/gzip"
     "sync"
+    "sync/atomic"
     "path"
+    "path/filepath"
     "time"
+    "strconv"
     "strings"
+    "hash/fnv"
 )
 
 type FileType int
@@ -17,43 +23,198 @@ const (
 )
 
 /* FileSystem:
- * Object to hold and help manage our file cache. Uses a fixed map
- * as a means of easily collecting files by path, but also being able
- * to remove cached files in a LRU style. Uses a RW mutex to lock the
- * cache map for appropriate functions and ensure thread safety.
+ * Object to hold and help manage our file cache. The cache is split
+ * into shards by hashed path, each shard a fixed map (to easily collect
+ * files by path, but also be able to remove cached files in a LRU style)
+ * with its own RW mutex. This way cache misses for different paths
+ * don't all contend on a single global write lock.
  */
 type FileSystem struct {
-    CacheMap     *FixedMap
-    CacheMutex   sync.RWMutex
+    CacheShards  []*CacheShard
     CacheFileMax int64
+    CachePolicy  EvictionPolicy
+
+    /* Generated policy files, kept outside the cache so never evicted */
+    PolicyFiles  map[string]*File
+    PolicyMutex  sync.RWMutex
+
+    /* Freshness check stat settings */
+    StatWorkers  int
+    StatTimeout  time.Duration
+
+    /* Reload stale files during freshness check, not on next request */
+    BackgroundRefresh bool
+
+    /* On the fly gzip compression of regular files */
+    GzipEnabled  bool
+    GzipMinSize  int64
+
+    /* Recently requested paths found missing, nil if disabled */
+    Missing      *NegativeCache
+
+    /* Regular files larger than this (in bytes) are streamed from disk
+     * instead of read into memory, 0 to disable
+     */
+    StreamFileMin int64
+
+    /* Follow symlinks in listings and requests, so long as they resolve
+     * within root ('/' once chroot'd)
+     */
+    FollowSymlinks bool
+    Root           string
+
+    /* Load every file afresh, never caching. For development only */
+    NoCache        bool
 }
 
-func (fs *FileSystem) Init(size int, fileSizeMax float64) {
-    fs.CacheMap     = NewFixedMap(size)
-    fs.CacheMutex   = sync.RWMutex{}
+/* CacheShard:
+ * A single partition of the file cache, guarding its
+ * fixed map with its own RW mutex.
+ */
+type CacheShard struct {
+    Map   *FixedMap
+    Mutex sync.RWMutex
+}
+
+/* Init():
+ * Splits the cache size between supplied number of shards (at least
+ * one), each holding ceil(size / shards) files (at least one). Eviction
+ * happens per-shard, so in total the cache can hold slightly more than
+ * size files, but a single hot shard evicts once it reaches its own share.
+ */
+func (fs *FileSystem) Init(size, shards int, fileSizeMax float64) {
+    if shards < 1 {
+        shards = 1
+    }
+    if fs.CachePolicy == nil {
+        fs.CachePolicy = &LRUPolicy{}
+    }
+    fs.initShards(size, shards)
     fs.CacheFileMax = int64(BytesInMegaByte * fileSizeMax)
+    fs.PolicyFiles  = make(map[string]*File)
+}
+
+func (fs *FileSystem) initShards(size, count int) {
+    shardSize := cacheShardSize(size, count)
+    fs.CacheShards = make([]*CacheShard, count)
+    for i := range fs.CacheShards {
+        fs.CacheShards[i] = &CacheShard{ NewFixedMap(shardSize, fs.CachePolicy), sync.RWMutex{} }
+    }
 }
 
-func (fs *FileSystem) HandleRequest(requestPath string, host *ConnHost) ([]byte, *GophorError) {
+/* Reset():
+ * Drops all cached files (e.g. after a reload changed how they're
+ * formatted), resizing each shard for the new cache size. Policy
+ * files are unaffected.
+ */
+func (fs *FileSystem) Reset(size int, fileSizeMax float64) {
+    shardSize := cacheShardSize(size, len(fs.CacheShards))
+    for _, shard := range fs.CacheShards {
+        shard.Mutex.Lock()
+        shard.Map = NewFixedMap(shardSize, fs.CachePolicy)
+        shard.Mutex.Unlock()
+    }
+    atomic.StoreInt64(&fs.CacheFileMax, int64(BytesInMegaByte * fileSizeMax))
+}
+
+/* Split cache size between shards, each getting at least one slot */
+func cacheShardSize(size, count int) int {
+    shardSize := (size + count - 1) / count
+    if shardSize < 1 {
+        shardSize = 1
+    }
+    return shardSize
+}
+
+/* Get cache shard responsible for path */
+func (fs *FileSystem) shardFor(path string) *CacheShard {
+    hash := fnv.New32a()
+    hash.Write([]byte(path))
+    return fs.CacheShards[hash.Sum32() % uint32(len(fs.CacheShards))]
+}
+
+/* Check if shard responsible for path holds its share of the cache */
+func (fs *FileSystem) shardFull(path string) bool {
+    shard := fs.shardFor(path)
+    shard.Mutex.RLock()
+    defer shard.Mutex.RUnlock()
+    return shard.Map.List.Len() >= shard.Map.Size
+}
+
+func (fs *FileSystem) CacheCount() int {
+    count := 0
+    for _, shard := range fs.CacheShards {
+        shard.Mutex.RLock()
+        count += shard.Map.List.Len()
+        shard.Mutex.RUnlock()
+    }
+    return count
+}
+
+func (fs *FileSystem) HandleRequest(request *FileSystemRequest) ([]byte, *GophorError) {
+    requestPath := request.Path
+
+    /* Check for merged gophermap at this selector first, these are purely virtual */
+    if sources, ok := Config.MergedMaps[requestPath]; ok {
+        output, gophorErr := fs.fetch(request, sources[0], func(path string) FileContents {
+            return &MergedGophermapContents{ sources, nil }
+        })
+        if gophorErr != nil {
+            return nil, gophorErr
+        }
+
+        /* Append footer text (contains last line) and return */
+        return append(output, Config.Current().FooterText...), nil
+    }
+
     /* Stat filesystem for request's file type */
     fileType := FileTypeDir;
     if requestPath != "/" {
+        /* Don't bother the filesystem about paths we know are missing */
+        if fs.Missing.Contains(requestPath) {
+            return nil, &GophorError{ FileStatErr, os.ErrNotExist }
+        }
+
         stat, err := os.Stat(requestPath)
         if err != nil {
+            /* Check if we can serve a compressed version of a regular file */
+            if sourcePath, _, ok := fs.gzipSource(requestPath); ok {
+                return fs.FetchGzipFile(request, sourcePath)
+            }
+
+            /* Check for a generated policy file */
+            fs.PolicyMutex.RLock()
+            policyFile, ok := fs.PolicyFiles[requestPath]
+            fs.PolicyMutex.RUnlock()
+            if ok {
+                return policyFile.Contents(request), nil
+            }
+
             /* Check file isn't in cache before throwing in the towel */
-            fs.CacheMutex.RLock()
-            file := fs.CacheMap.Get(requestPath)
+            shard := fs.shardFor(requestPath)
+            shard.Mutex.RLock()
+            file := shard.Map.Get(requestPath)
             if file == nil {
-                fs.CacheMutex.RUnlock()
+                shard.Mutex.RUnlock()
+
+                /* Nothing to serve here, remember that for a while */
+                if os.IsNotExist(err) {
+                    fs.Missing.Add(requestPath)
+                }
+
                 return nil, &GophorError{ FileStatErr, err }
             }
 
-            /* It's there! Get contents, unlock and return */
+            /* It's there! Take a reference so it isn't evicted, unlock cache */
+            file.Acquire()
+            shard.Mutex.RUnlock()
+
+            /* Get contents, drop reference and return */
             file.Mutex.RLock()
-            b := file.Contents(&FileSystemRequest{ requestPath, host })
+            b := file.Contents(request)
             file.Mutex.RUnlock()
+            file.Release()
 
-            fs.CacheMutex.RUnlock()
             return b, nil
         }
 
@@ -75,17 +236,16 @@ func (fs *FileSystem) HandleRequest(requestPath string, host *ConnHost) ([]byte,
         /* Directory */
         case FileTypeDir:
             /* Check Gophermap exists */
-            gophermapPath := path.Join(requestPath, GophermapFileStr)
-            _, err := os.Stat(gophermapPath)
+            gophermapPath, ok := findGophermap(requestPath)
 
             var output []byte
             var gophorErr *GophorError
-            if err == nil {
+            if ok {
                 /* Gophermap exists, serve this! */
-                output, gophorErr = fs.FetchFile(&FileSystemRequest{ gophermapPath, host })
+                output, gophorErr = fs.FetchFile(&FileSystemRequest{ gophermapPath, request.Host, request.Query, nil, request.GopherPlus })
             } else {
-                /* No gophermap, serve directory listing */
-                output, gophorErr = listDir(&FileSystemRequest{ requestPath, host }, map[string]bool{})
+                /* No gophermap, serve generated directory listing */
+                output, gophorErr = autoListDir(request)
             }
 
             if gophorErr != nil {
@@ -94,12 +254,12 @@ func (fs *FileSystem) HandleRequest(requestPath string, host *ConnHost) ([]byte,
             }
 
             /* Append footer text (contains last line) and return */
-            output = append(output, Config.FooterText...)
+            output = append(output, Config.Current().FooterText...)
             return output, nil
 
         /* Regular file */
         case FileTypeRegular:
-            return fs.FetchFile(&FileSystemRequest{ requestPath, host })
+            return fs.FetchFile(request)
 
         /* Unsupported type */
         default:
@@ -108,108 +268,392 @@ func (fs *FileSystem) HandleRequest(requestPath string, host *ConnHost) ([]byte,
 }
 
 func (fs *FileSystem) FetchFile(request *FileSystemRequest) ([]byte, *GophorError) {
-    /* Get cache map read lock then check if file in cache map */
-    fs.CacheMutex.RLock()
-    file := fs.CacheMap.Get(request.Path)
+    return fs.fetch(request, request.Path, newFileContents)
+}
 
-    if file != nil {
-        /* File in cache -- before doing anything get file read lock */
-        file.Mutex.RLock()
+/* Check if path is served as a generated policy file */
+func (fs *FileSystem) isPolicyFile(filePath string) bool {
+    fs.PolicyMutex.RLock()
+    defer fs.PolicyMutex.RUnlock()
+    _, ok := fs.PolicyFiles[filePath]
+    return ok
+}
 
-        /* Check file is marked as fresh */
-        if !file.Fresh {
-            /* File not fresh! Swap file read for write-lock */
-            file.Mutex.RUnlock()
-            file.Mutex.Lock()
+/* Map path within the server root, e.g. a gophermap include target, to
+ * where it is on disk. Once chroot'd the root is '/' and they're the same,
+ * only without chroot (checking or previewing gophermaps) are they under
+ * the real root
+ */
+func (fs *FileSystem) DiskPath(filePath string) string {
+    if fs.Root == "" || fs.Root == "/" || !path.IsAbs(filePath) {
+        return filePath
+    }
+    return path.Join(fs.Root, filePath)
+}
 
-            /* Reload file contents from disk */
-            gophorErr := file.LoadContents()
-            if gophorErr != nil {
-                /* Error loading contents, unlock all mutex then return error */
-                file.Mutex.Unlock()
-                fs.CacheMutex.RUnlock()
-                return nil, gophorErr
-            }
+/* Check path is allowed by the symlink policy. Without following symlinks
+ * no part of the path may be one, else it must resolve within the root.
+ * Paths that don't exist are left for the caller to find out about
+ */
+func (fs *FileSystem) isSymlinkAllowed(filePath string) bool {
+    resolved, err := filepath.EvalSymlinks(filePath)
+    if err != nil {
+        return true
+    }
 
-            /* Updated! Swap back file write for read lock */
-            file.Mutex.Unlock()
-            file.Mutex.RLock()
+    if !fs.FollowSymlinks {
+        return resolved == filepath.Clean(filePath)
+    }
+    return hasPathPrefix(resolved, fs.Root)
+}
+
+/* Check if request should be streamed straight from disk, bypassing the
+ * cache. That's regular files larger than the stream threshold, or any
+ * regular file requested from a resume offset. Only files served as-is
+ * are streamed, gophermaps and registered types (e.g. Markdown) are always
+ * rendered, and files needing converting to UTF-8 always loaded
+ */
+func (fs *FileSystem) isStreamable(requestPath, query string) bool {
+    if requestPath == "/" || fs.Missing.Contains(requestPath) {
+        return false
+    }
+
+    _, isOffset := parseFileOffset(query)
+    if fs.StreamFileMin <= 0 && !isOffset {
+        return false
+    }
+
+    stat, err := os.Stat(requestPath)
+    if err != nil || stat.Mode() & os.ModeType != 0 || !isServedAsIs(requestPath) || textEncodingFor(requestPath) != nil {
+        return false
+    }
+    return isOffset || (fs.StreamFileMin > 0 && stat.Size() > fs.StreamFileMin)
+}
+
+/* Check file at path would be cached as a plain regular or binary file,
+ * rather than rendered by its registered contents type
+ */
+func isServedAsIs(filePath string) bool {
+    switch newFileContents(filePath).(type) {
+        case *RegularFileContents, *BinaryFileContents:
+            return true
+        default:
+            return false
+    }
+}
+
+/* Parse query as a byte offset to resume a file transfer from */
+func parseFileOffset(query string) (int64, bool) {
+    offset, err := strconv.ParseInt(query, 10, 64)
+    return offset, err == nil
+}
+
+/* Copy file at path straight to writer from supplied offset, never entering
+ * the cache. Once anything has been written a failure can only truncate the
+ * response, so errors are treated as write errors
+ */
+func (fs *FileSystem) StreamFile(requestPath string, offset int64, w io.Writer) *GophorError {
+    fd, err := os.Open(requestPath)
+    if err != nil {
+        return &GophorError{ FileOpenErr, err }
+    }
+    defer fd.Close()
+
+    /* Offset must fall within the file, its size meaning nothing left to send */
+    if offset != 0 {
+        stat, err := fd.Stat()
+        if err != nil {
+            return &GophorError{ FileStatErr, err }
         }
-    } else {
-        /* Perform filesystem stat ready for checking file size later.
-         * Doing this now allows us to weed-out non-existent files early
-         */
-        stat, err := os.Stat(request.Path)
+        if offset < 0 || offset > stat.Size() {
+            return &GophorError{ FileOffsetErr, nil }
+        }
+
+        _, err = fd.Seek(offset, io.SeekStart)
         if err != nil {
-            /* Error stat'ing file, unlock read mutex then return error */
-            fs.CacheMutex.RUnlock()
-            return nil, &GophorError{ FileStatErr, err }
+            return &GophorError{ FileReadErr, err }
         }
+    }
+
+    _, err = io.Copy(w, fd)
+    if err != nil {
+        return &GophorError{ SocketWriteErr, err }
+    }
+    return nil
+}
 
-        /* Create new file contents object using supplied function */
-        var contents FileContents
-        if strings.HasSuffix(request.Path, "/"+GophermapFileStr) {
-            contents = &GophermapContents{ request.Path, nil }
-        } else {
-            contents = &RegularFileContents{ request.Path, nil }
+/* Fetch gzip compressed contents of file at sourcePath, cached separately
+ * under the requested (.gz suffixed) path
+ */
+func (fs *FileSystem) FetchGzipFile(request *FileSystemRequest, sourcePath string) ([]byte, *GophorError) {
+    return fs.fetch(request, sourcePath, func(path string) FileContents {
+        return &GzipFileContents{ path, nil }
+    })
+}
+
+/* Get path and stat of the regular file a '.gz' suffixed request path can
+ * be served as a gzip compressed copy of, ok false if none
+ */
+func (fs *FileSystem) gzipSource(requestPath string) (string, os.FileInfo, bool) {
+    if !fs.GzipEnabled || !strings.HasSuffix(requestPath, GzipSuffix) {
+        return "", nil, false
+    }
+
+    sourcePath := strings.TrimSuffix(requestPath, GzipSuffix)
+    stat, err := os.Stat(sourcePath)
+    if err != nil || stat.Mode() & os.ModeType != 0 || stat.Size() < fs.GzipMinSize || !isGzipServable(sourcePath) || !fs.isSymlinkAllowed(sourcePath) {
+        return "", nil, false
+    }
+    return sourcePath, stat, true
+}
+
+/* Get source path of a gzip request too large to cache, or with caching
+ * disabled, so compressed as it's streamed instead of held in memory.
+ * Empty if a file exists at the requested path, or no source to compress
+ */
+func (fs *FileSystem) gzipStreamSource(requestPath string) string {
+    if _, err := os.Stat(requestPath); err == nil {
+        return ""
+    }
+
+    sourcePath, stat, ok := fs.gzipSource(requestPath)
+    if !ok || (!fs.NoCache && stat.Size() <= atomic.LoadInt64(&fs.CacheFileMax)) {
+        return ""
+    }
+    return sourcePath
+}
+
+/* Compress file at sourcePath straight to writer, never entering the cache.
+ * Text with a configured source encoding is converted to UTF-8 as it goes,
+ * all supported encodings being single-byte so safe to convert in chunks
+ */
+func (fs *FileSystem) StreamGzipFile(sourcePath string, w io.Writer) *GophorError {
+    fd, err := os.Open(sourcePath)
+    if err != nil {
+        return &GophorError{ FileOpenErr, err }
+    }
+    defer fd.Close()
+
+    encoding := textEncodingFor(sourcePath)
+    writer := gzip.NewWriter(w)
+    buf := make([]byte, FileReadBufSize)
+    for {
+        count, err := fd.Read(buf)
+        if count > 0 {
+            chunk := buf[:count]
+            if encoding != nil {
+                chunk = encoding.Decode(chunk)
+            }
+            if _, writeErr := writer.Write(chunk); writeErr != nil {
+                return &GophorError{ SocketWriteErr, writeErr }
+            }
         }
+        if err == io.EOF {
+            break
+        } else if err != nil {
+            return &GophorError{ FileReadErr, err }
+        }
+    }
 
-        /* Create new file wrapper around contents */
-        file = NewFile(contents)
+    /* Flush remaining compressed data and the gzip footer */
+    err = writer.Close()
+    if err != nil {
+        return &GophorError{ SocketWriteErr, err }
+    }
+    return nil
+}
 
-        /* File isn't in cache yet so no need to get file lock mutex */
-        gophorErr := file.LoadContents()
-        if gophorErr != nil {
-            /* Error loading contents, unlock read mutex then return error */
-            fs.CacheMutex.RUnlock()
-            return nil, gophorErr
+/* Check file can be served gzip compressed. Gophermaps, ignore and access
+ * files are server-side only, serving them compressed would leak their source
+ */
+func isGzipServable(sourcePath string) bool {
+    name := path.Base(sourcePath)
+    return !isGophermapName(name) && name != IgnoreFileStr && name != AclFileStr && name != CacheControlFileStr
+}
+
+/* Get configured gophermap file names, in the order tried */
+func gophermapNames() []string {
+    if len(Config.GophermapNames) == 0 {
+        return []string{ GophermapFileStr }
+    }
+    return Config.GophermapNames
+}
+
+/* Check if file name is one of the configured gophermap names */
+func isGophermapName(name string) bool {
+    for _, gophermapName := range gophermapNames() {
+        if name == gophermapName {
+            return true
         }
+    }
+    return false
+}
 
-        /* Compare file size (in MB) to CacheFileSizeMax, if larger just get file
-         * contents, unlock all mutex and don't bother caching. 
-         */
-        if stat.Size() > fs.CacheFileMax {
-            b := file.Contents(request)
-            fs.CacheMutex.RUnlock()
-            return b, nil
+/* Find gophermap in directory, trying each configured name in order */
+func findGophermap(dir string) (string, bool) {
+    for _, name := range gophermapNames() {
+        gophermapPath := path.Join(dir, name)
+        stat, err := os.Stat(gophermapPath)
+        if err == nil && stat.Mode() & os.ModeType == 0 {
+            return gophermapPath, true
         }
+    }
+    return "", false
+}
 
-        /* File not in cache -- Swap cache map read for write lock. */
-        fs.CacheMutex.RUnlock()
-        fs.CacheMutex.Lock()
+func (fs *FileSystem) fetch(request *FileSystemRequest, sourcePath string, newContents func(string) FileContents) ([]byte, *GophorError) {
+    /* Caching disabled, skip the cache altogether */
+    if fs.NoCache {
+        _, err := os.Stat(sourcePath)
+        if err != nil {
+            return nil, &GophorError{ FileStatErr, err }
+        }
+        return loadUncachedFile(request, sourcePath, newContents)
+    }
 
-        /* Put file in the FixedMap */
-        fs.CacheMap.Put(request.Path, file)
+    /* Get cache shard read lock then check if file in cache map */
+    shard := fs.shardFor(request.Path)
+    shard.Mutex.RLock()
+    file := shard.Map.Get(request.Path)
 
-        /* Before unlocking cache mutex, lock file read for upcoming call to .Contents() */
-        file.Mutex.RLock()
+    if file != nil {
+        /* File in cache -- take a reference so it won't be evicted while we
+         * read, at which point we no longer need the cache map read lock
+         */
+        file.Acquire()
+        shard.Mutex.RUnlock()
+        Config.Metrics.CacheHit()
+        defer file.Release()
+        return readCachedFile(file, request)
+    }
 
-        /* Swap cache lock back to read */
-        fs.CacheMutex.Unlock()
-        fs.CacheMutex.RLock()
+    /* Perform filesystem stat ready for checking file size later.
+     * Doing this now allows us to weed-out non-existent files early
+     */
+    shard.Mutex.RUnlock()
+    Config.Metrics.CacheMiss()
+    stat, err := os.Stat(sourcePath)
+    if err != nil {
+        return nil, &GophorError{ FileStatErr, err }
     }
 
-    /* Read file contents into new variable for return, then unlock file read lock */
-    b := file.Contents(request)
-    file.Mutex.RUnlock()
+    /* Compare file size (in MB) to CacheFileSizeMax, if larger just get file
+     * contents and don't bother caching.
+     */
+    if stat.Size() > atomic.LoadInt64(&fs.CacheFileMax) {
+        return loadUncachedFile(request, sourcePath, newContents)
+    }
 
-    /* Finally we can unlock the cache map read lock, we are done :) */
-    fs.CacheMutex.RUnlock()
+    /* File not in cache -- get cache shard write lock, then look again in
+     * case someone else cached the file while we weren't holding any lock.
+     * Without this, concurrent misses on the same path would each load it
+     */
+    shard.Mutex.Lock()
+    file = shard.Map.Get(request.Path)
+    if file != nil {
+        file.Acquire()
+        shard.Mutex.Unlock()
+        defer file.Release()
+        return readCachedFile(file, request)
+    }
+
+    /* Put new (not yet loaded) file in the FixedMap, taking a reference before
+     * it becomes visible to eviction. We hold the file write lock while loading
+     * so anyone else fetching it in the meantime waits for us, instead of
+     * loading it themselves
+     */
+    file = NewFile(newContents(sourcePath))
+    file.Fresh = false
+    file.Mutex.Lock()
+    file.Acquire()
+    defer file.Release()
+    shard.Map.Put(request.Path, file)
+
+    /* Our reference keeps the file safe, we're done with the cache map */
+    shard.Mutex.Unlock()
+
+    gophorErr := file.LoadContents()
+    if gophorErr != nil {
+        /* Error loading contents, drop the file from cache (unless already
+         * replaced) then unlock file mutex and return error. Anyone left
+         * waiting on it sees it isn't fresh and tries loading it themselves
+         */
+        shard.Mutex.Lock()
+        if shard.Map.Get(request.Path) == file {
+            shard.Map.Remove(request.Path)
+        }
+        shard.Mutex.Unlock()
+        file.Mutex.Unlock()
+        return nil, gophorErr
+    }
+
+    /* Read file contents into new variable for return, then unlock file write lock */
+    b := file.Contents(request)
+    file.Mutex.Unlock()
 
     return b, nil
 }
 
+/* Load file contents just for this request, never entering the cache */
+func loadUncachedFile(request *FileSystemRequest, sourcePath string, newContents func(string) FileContents) ([]byte, *GophorError) {
+    file := NewFile(newContents(sourcePath))
+    gophorErr := file.LoadContents()
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+    return file.Contents(request), nil
+}
+
+/* Read contents of cached file, reloading first if no longer fresh. Caller
+ * must hold a reference to the file
+ */
+func readCachedFile(file *File, request *FileSystemRequest) ([]byte, *GophorError) {
+    /* Before doing anything get file read lock */
+    file.Mutex.RLock()
+
+    /* Check file is marked as fresh */
+    if !file.Fresh {
+        /* File not fresh! Swap file read for write-lock */
+        file.Mutex.RUnlock()
+        file.Mutex.Lock()
+
+        /* Reload file contents from disk, unless someone beat us to it */
+        if !file.Fresh {
+            gophorErr := file.LoadContents()
+            if gophorErr != nil {
+                /* Error loading contents, unlock file mutex then return error */
+                file.Mutex.Unlock()
+                return nil, gophorErr
+            }
+        }
+
+        /* Updated! Swap back file write for read lock */
+        file.Mutex.Unlock()
+        file.Mutex.RLock()
+    }
+
+    /* Unlock deferred so a panic while rendering can't leave file locked */
+    defer file.Mutex.RUnlock()
+    return file.Contents(request), nil
+}
+
 /* FileSystemRequest:
  * Makes a request to the filesystem either through
  * the FileCache or directly to a function like listDir().
  * It carries the requested filesystem path and any extra
- * needed information, for the moment just a set of details
- * about the virtual host.. Opens things up a lot more for
- * the future :)
+ * needed information, for the moment a set of details
+ * about the virtual host, the query sent after the
+ * selector (if any), the gophermaps embedding this
+ * request's output (if any) and the Gopher+ marker sent
+ * with it (blank for plain gopher). Opens things up a lot
+ * more for the future :)
  */
 type FileSystemRequest struct {
-    Path string
-    Host *ConnHost
+    Path       string
+    Host       *ConnHost
+    Query      string
+    Embedders  []string
+    GopherPlus string
 }
 
 /* File:
@@ -222,6 +666,7 @@ type File struct {
     Mutex       sync.RWMutex
     Fresh       bool
     LastRefresh int64
+    refs        int32
 }
 
 func NewFile(contents FileContents) *File {
@@ -230,9 +675,28 @@ func NewFile(contents FileContents) *File {
         sync.RWMutex{},
         true,
         0,
+        0,
     }
 }
 
+/* Take a reference to the file, preventing it from being evicted
+ * from the cache while in use. Must be called while holding the
+ * cache map lock.
+ */
+func (f *File) Acquire() {
+    atomic.AddInt32(&f.refs, 1)
+}
+
+/* Drop a reference to the file */
+func (f *File) Release() {
+    atomic.AddInt32(&f.refs, -1)
+}
+
+/* Check if file currently has any readers */
+func (f *File) InUse() bool {
+    return atomic.LoadInt32(&f.refs) > 0
+}
+
 func (f *File) Contents(request *FileSystemRequest) []byte {
     return f.contents.Render(request)
 }
@@ -267,52 +731,271 @@ type FileContents interface {
     Clear()
 }
 
-func startFileMonitor(sleepTime time.Duration) {
+/* File monitor stop and done signals, nil if monitor not running */
+var (
+    fileMonitorStop chan struct{}
+    fileMonitorDone chan struct{}
+)
+
+func startFileMonitor(sleepTime time.Duration, statBudget int) {
+    fileMonitorStop = make(chan struct{})
+    fileMonitorDone = make(chan struct{})
+
     go func() {
+        defer close(fileMonitorDone)
+
         for {
-            /* Sleep so we don't take up all the precious CPU time :) */
-            time.Sleep(sleepTime)
+            /* Sleep so we don't take up all the precious CPU time :), waking early to stop */
+            select {
+                case <-fileMonitorStop:
+                    return
+                case <-time.After(fileMonitorInterval(sleepTime, Config.FileSystem.CacheCount(), statBudget)):
+            }
 
             /* Check global file cache freshness */
             checkCacheFreshness()
         }
-
-        /* We shouldn't have reached here */
-        Config.LogSystemFatal("FileCache monitor escaped run loop!\n")
     }()
 }
 
+/* Signal file monitor to stop, waiting for any sweep in progress to finish */
+func stopFileMonitor() {
+    if fileMonitorStop == nil {
+        return
+    }
+    close(fileMonitorStop)
+    <-fileMonitorDone
+    fileMonitorStop = nil
+}
+
+/* Calculate the file monitor sleep time. With a stat budget of zero we just
+ * use the fixed sleep time, otherwise (adaptive mode) we lengthen the interval
+ * so a full sweep of the cache never exceeds budget stats-per-second
+ */
+func fileMonitorInterval(sleepTime time.Duration, cacheCount, statBudget int) time.Duration {
+    if statBudget <= 0 {
+        return sleepTime
+    }
+
+    adaptive := time.Duration(cacheCount) * time.Second / time.Duration(statBudget)
+    if adaptive > sleepTime {
+        return adaptive
+    }
+    return sleepTime
+}
+
 func checkCacheFreshness() {
-    /* Before anything, get cache write lock (in case we have to delete) */
-    Config.FileSystem.CacheMutex.Lock()
+    fs := Config.FileSystem
 
-    /* Iterate through paths in cache map to query file last modified times */
-    for path := range Config.FileSystem.CacheMap.Map {
-        /* Get file pointer, no need for lock as we have write lock */
-        file := Config.FileSystem.CacheMap.Get(path)
+    /* Take a snapshot of cached files under read lock, so that (potentially
+     * slow) stats don't hold up requests while we sweep
+     */
+    entries := make([]*cacheStatResult, 0)
+    for _, shard := range fs.CacheShards {
+        shard.Mutex.RLock()
+        for path, elem := range shard.Map.Map {
+            /* If this is a generated file, we skip */
+            if isGeneratedType(elem.Value) {
+                continue
+            }
+            entries = append(entries, &cacheStatResult{ Path: path, File: elem.Value })
+        }
+        shard.Mutex.RUnlock()
+    }
 
-        /* If this is a generated file, we skip */
-        if isGeneratedType(file) {
+    /* Skip files still within the max-age of their directory's cache control */
+    now := time.Now().UnixNano()
+    controls := make(map[string]*DirCacheControl)
+    checked := entries[:0]
+    for _, entry := range entries {
+        maxAge := cacheMaxAgeFor(entry.Path, controls)
+        entry.File.Mutex.RLock()
+        lastRefresh := entry.File.LastRefresh
+        entry.File.Mutex.RUnlock()
+        if maxAge > 0 && now-lastRefresh < int64(maxAge) {
             continue
         }
+        checked = append(checked, entry)
+    }
+    entries = checked
 
-        stat, err := os.Stat(path)
-        if err != nil {
-            /* Log file as not in cache, then delete */
-            Config.LogSystemError("Failed to stat file in cache: %s\n", path)
-            Config.FileSystem.CacheMap.Remove(path)
-            continue
+    /* Stat cached files, spread across stat workers */
+    jobs := make(chan *cacheStatResult)
+    var wg sync.WaitGroup
+    for i := 0; i < fs.StatWorkers; i += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for entry := range jobs {
+                statCacheEntry(entry, fs.StatTimeout)
+            }
+        }()
+    }
+    for _, entry := range entries {
+        jobs <- entry
+    }
+    close(jobs)
+    wg.Wait()
+
+    /* Iterate through results to check file last modified times */
+    for _, entry := range entries {
+        switch {
+            case entry.TimedOut:
+                /* Don't let a slow filesystem drop files, keep as-is */
+                Config.LogSystemError("Timed out stat'ing file in cache, keeping: %s\n", entry.Path)
+
+            case entry.Err != nil:
+                /* Log file as not in cache, then delete (if not since replaced) */
+                Config.LogSystemError("Failed to stat file in cache: %s\n", entry.Path)
+                shard := fs.shardFor(entry.Path)
+                shard.Mutex.Lock()
+                if shard.Map.Get(entry.Path) == entry.File {
+                    shard.Map.Remove(entry.Path)
+                }
+                shard.Mutex.Unlock()
+
+            default:
+                /* If the file is marked as fresh, but file on disk newer, mark as unfresh */
+                entry.File.Mutex.Lock()
+                stale := entry.File.Fresh && entry.File.LastRefresh < entry.ModTime
+                if stale && !fs.BackgroundRefresh {
+                    entry.File.Fresh = false
+                }
+                entry.File.Mutex.Unlock()
+
+                /* Reload now instead, so next request isn't kept waiting */
+                if stale && fs.BackgroundRefresh {
+                    fs.refreshCachedFile(entry.Path, entry.File)
+                }
         }
-        timeModified := stat.ModTime().UnixNano()
+    }
+}
+
+/* Reload stale cached file's contents without holding its lock, serving
+ * the old contents until the new are swapped in. On failure, or if the
+ * contents can't be reloaded here, the file is marked unfresh, leaving the
+ * next request to reload it
+ */
+func (fs *FileSystem) refreshCachedFile(path string, file *File) {
+    file.Mutex.RLock()
+    contents := newContentsLike(file)
+    file.Mutex.RUnlock()
+    if contents == nil {
+        file.Mutex.Lock()
+        file.Fresh = false
+        file.Mutex.Unlock()
+        return
+    }
+
+    /* Note time before loading, so changes made during load aren't missed */
+    refreshed := time.Now().UnixNano()
+    gophorErr := contents.Load()
+
+    /* Take the file lock before the cache shard lock, same as fetch does
+     * on a failed load. The shard lock is needed as the freshness check
+     * reads contents type while only holding that
+     */
+    shard := fs.shardFor(path)
+    file.Mutex.Lock()
+    shard.Mutex.Lock()
+    if gophorErr != nil {
+        Config.LogSystemError("Failed to refresh file in cache: %s\n", path)
+        file.Fresh = false
+    } else {
+        file.contents    = contents
+        file.LastRefresh = refreshed
+        file.Fresh       = true
+    }
+    shard.Mutex.Unlock()
+    file.Mutex.Unlock()
+}
 
-        /* If the file is marked as fresh, but file on disk newer, mark as unfresh */
-        if file.Fresh && file.LastRefresh < timeModified {
-            file.Fresh = false
+/* Result of stat'ing a cached file during a freshness check */
+type cacheStatResult struct {
+    Path     string
+    File     *File
+    ModTime  int64
+    Err      error
+    TimedOut bool
+}
+
+/* Stat a cached file's source(s), noting the latest modified time */
+func statCacheEntry(entry *cacheStatResult, timeout time.Duration) {
+    for _, statPath := range sourcePathsOf(entry.Path, entry.File) {
+        stat, err, timedOut := statWithTimeout(statPath, timeout)
+        if timedOut {
+            entry.TimedOut = true
+            return
+        } else if err != nil {
+            entry.Err = err
+            return
+        }
+
+        if modTime := stat.ModTime().UnixNano(); modTime > entry.ModTime {
+            entry.ModTime = modTime
+        }
+    }
+}
+
+/* Function used to stat cached files during freshness checks, swappable
+ * so slow filesystems can be simulated
+ */
+var statFunc = os.Stat
+
+/* Paths with a timed out stat still blocked in the filesystem. On a hung
+ * network mount a stat may never return, so rather than piling up another
+ * goroutine on every sweep we skip paths until their last stat returns
+ */
+var pendingStats = struct {
+    Paths map[string]bool
+    Mutex sync.Mutex
+}{ make(map[string]bool), sync.Mutex{} }
+
+/* Stat file at path, giving up after timeout (if non-zero) */
+func statWithTimeout(statPath string, timeout time.Duration) (os.FileInfo, error, bool) {
+    start := time.Now()
+    defer func() {
+        if taken := time.Since(start); taken > SlowStatThreshold {
+            Config.LogSystemError("Slow stat of file in cache (%s): %s\n", taken, statPath)
         }
+    }()
+
+    if timeout <= 0 {
+        stat, err := statFunc(statPath)
+        return stat, err, false
+    }
+
+    /* If previous stat still hasn't returned, treat as timed out */
+    pendingStats.Mutex.Lock()
+    if pendingStats.Paths[statPath] {
+        pendingStats.Mutex.Unlock()
+        return nil, nil, true
     }
+    pendingStats.Paths[statPath] = true
+    pendingStats.Mutex.Unlock()
 
-    /* Done! We can release cache read lock */
-    Config.FileSystem.CacheMutex.Unlock()
+    /* Buffered so a timed out stat can still send and exit */
+    type statResult struct {
+        Stat os.FileInfo
+        Err  error
+    }
+    done := make(chan *statResult, 1)
+    go func() {
+        stat, err := statFunc(statPath)
+
+        pendingStats.Mutex.Lock()
+        delete(pendingStats.Paths, statPath)
+        pendingStats.Mutex.Unlock()
+
+        done <- &statResult{ stat, err }
+    }()
+
+    select {
+        case result := <-done:
+            return result.Stat, result.Err, false
+        case <-time.After(timeout):
+            return nil, nil, true
+    }
 }
 
 func isGeneratedType(file *File) bool {
@@ -324,3 +1007,36 @@ func isGeneratedType(file *File) bool {
            return false 
     }
 }
+
+/* Create new, unloaded, contents of the same kind as the file's, nil if
+ * not reloadable. Registered types aren't known here, so are reloaded on
+ * next request rather than in the background
+ */
+func newContentsLike(file *File) FileContents {
+    switch contents := file.contents.(type) {
+        case *GzipFileContents:
+            return &GzipFileContents{ contents.path, nil }
+        case *MergedGophermapContents:
+            return &MergedGophermapContents{ contents.paths, nil }
+        case *GophermapContents:
+            return &GophermapContents{ contents.path, nil }
+        case *RegularFileContents:
+            return &RegularFileContents{ contents.path, nil }
+        case *BinaryFileContents:
+            return &BinaryFileContents{ contents.path, nil }
+        default:
+            return nil
+    }
+}
+
+func sourcePathsOf(path string, file *File) []string {
+    /* Some file contents are stored under a different path to their source(s) */
+    switch contents := file.contents.(type) {
+        case *GzipFileContents:
+            return []string{ contents.path }
+        case *MergedGophermapContents:
+            return contents.paths
+        default:
+            return []string{ path }
+    }
+}
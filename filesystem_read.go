@@ -7,6 +7,7 @@ import (
     "io"
     "sort"
     "bufio"
+    "strings"
 )
 
 /* Perform simple buffered read on a file at path */
@@ -47,8 +48,21 @@ func bufferedRead(path string) ([]byte, *GophorError) {
     return contents, nil
 }
 
-/* Perform buffered read on file at path, then scan through with supplied iterator func */
+/* Perform buffered read on file at path, then scan through with supplied
+ * iterator func. Lines longer than the max line length fail the scan
+ */
 func bufferedScan(path string, scanIterator func(*bufio.Scanner) bool) *GophorError {
+    return _bufferedScan(path, false, scanIterator)
+}
+
+/* Perform buffered scan as above, but lines longer than the max line length
+ * are passed to the iterator in chunks of that length instead of failing
+ */
+func bufferedScanChunked(path string, scanIterator func(*bufio.Scanner) bool) *GophorError {
+    return _bufferedScan(path, true, scanIterator)
+}
+
+func _bufferedScan(path string, chunked bool, scanIterator func(*bufio.Scanner) bool) *GophorError {
     /* First, read raw file contents */
     contents, gophorErr := bufferedRead(path)
     if gophorErr != nil {
@@ -60,11 +74,18 @@ func bufferedScan(path string, scanIterator func(*bufio.Scanner) bool) *GophorEr
     scanner := bufio.NewScanner(reader)
 
     /* If contains DOS line-endings, split by DOS! Else, split by Unix */
+    splitter := unixLineEndSplitter
     if bytes.Contains(contents, []byte(DOSLineEnd)) {
-        scanner.Split(dosLineEndSplitter)
-    } else {
-        scanner.Split(unixLineEndSplitter)
+        splitter = dosLineEndSplitter
+    }
+
+    /* Allow lines up to the max line length */
+    maxLen := maxLineLength()
+    scanner.Buffer(make([]byte, 0, minWidth(maxLen, bufio.MaxScanTokenSize)), maxLen)
+    if chunked {
+        splitter = chunkLongLines(splitter, maxLen)
     }
+    scanner.Split(splitter)
 
     /* Scan through file contents using supplied iterator */
     for scanner.Scan() && scanIterator(scanner) {}
@@ -77,6 +98,27 @@ func bufferedScan(path string, scanIterator func(*bufio.Scanner) bool) *GophorEr
     return nil
 }
 
+/* Get max length of a scanned line, the scanner default if not set */
+func maxLineLength() int {
+    if Config.MaxLineLength < 1 {
+        return bufio.MaxScanTokenSize
+    }
+    return Config.MaxLineLength
+}
+
+/* Wrap splitter so lines longer than max are split into chunks of max
+ * length, rather than failing the scan once the buffer is full
+ */
+func chunkLongLines(splitter bufio.SplitFunc, max int) bufio.SplitFunc {
+    return func(data []byte, atEOF bool) (int, []byte, error) {
+        advance, token, err := splitter(data, atEOF)
+        if advance == 0 && token == nil && err == nil && len(data) >= max {
+            return max, data[:max], nil
+        }
+        return advance, token, err
+    }
+}
+
 func dosLineEndSplitter(data []byte, atEOF bool) (advance int, token []byte, err error) {
     if atEOF && len(data) == 0  {
         /* At EOF, no more data */
@@ -113,69 +155,132 @@ func unixLineEndSplitter(data []byte, atEOF bool) (advance int, token []byte, er
  * This negates need to check if RestrictedFilesRegex is nil every
  * single call.
  */
-var listDir func(request *FileSystemRequest, hidden map[string]bool) ([]byte, *GophorError)
+var listDir func(request *FileSystemRequest, hidden map[string]bool, sortBy *DirSort) ([]byte, *GophorError)
 
-func _listDir(request *FileSystemRequest, hidden map[string]bool) ([]byte, *GophorError) {
-    return _listDirBase(request, func(dirContents *[]byte, file os.FileInfo) {
+func _listDir(request *FileSystemRequest, hidden map[string]bool, sortBy *DirSort) ([]byte, *GophorError) {
+    return _listDirBase(request, sortBy, func(file os.FileInfo) bool {
         /* If requested hidden */
-        if _, ok := hidden[file.Name()]; ok {
-            return
-        }
-
-        /* Handle file, directory or ignore others */
-        switch {
-            case file.Mode() & os.ModeDir != 0:
-                /* Directory -- create directory listing */
-                itemPath := path.Join(request.Path, file.Name())
-                *dirContents = append(*dirContents, buildLine(TypeDirectory, file.Name(), itemPath, request.Host.Name, request.Host.Port)...)
-
-            case file.Mode() & os.ModeType == 0:
-                /* Regular file -- find item type and creating listing */
-                itemPath := path.Join(request.Path, file.Name())
-                itemType := getItemType(itemPath)
-                *dirContents = append(*dirContents, buildLine(itemType, file.Name(), itemPath, request.Host.Name, request.Host.Port)...)
-
-            default:
-                /* Ignore */
-        }
+        _, ok := hidden[file.Name()]
+        return !ok
     })
 }
 
-func _listDirRegexMatch(request *FileSystemRequest, hidden map[string]bool) ([]byte, *GophorError) {
-    return _listDirBase(request, func(dirContents *[]byte, file os.FileInfo) {
+func _listDirRegexMatch(request *FileSystemRequest, hidden map[string]bool, sortBy *DirSort) ([]byte, *GophorError) {
+    return _listDirBase(request, sortBy, func(file os.FileInfo) bool {
         /* If regex match in restricted files || requested hidden */
         if isRestrictedFile(file.Name()) {
-            return
-        } else if _, ok := hidden[file.Name()]; ok {
-            return
+            return false
         }
+        _, ok := hidden[file.Name()]
+        return !ok
+    })
+}
 
-        /* Handle file, directory or ignore others */
-        switch {
-            case file.Mode() & os.ModeDir != 0:
-                /* Directory -- create directory listing */
-                itemPath := path.Join(request.Path, file.Name())
-                *dirContents = append(*dirContents, buildLine(TypeDirectory, file.Name(), itemPath, request.Host.Name, request.Host.Port)...)
-
-            case file.Mode() & os.ModeType == 0:
-                /* Regular file -- find item type and creating listing */
-                itemPath := path.Join(request.Path, file.Name())
-                itemType := getItemType(itemPath)
-                *dirContents = append(*dirContents, buildLine(itemType, file.Name(), itemPath, request.Host.Name, request.Host.Port)...)
-
-            default:
-                /* Ignore */
+/* Build a directory listing line for file, or nil for unsupported file types.
+ * Gopher+ menu requests get lines flagged as having attributes, and requests
+ * for attributes of the whole directory the file's attribute block instead,
+ * from the same stat
+ */
+func buildDirEntryLine(request *FileSystemRequest, file os.FileInfo) []byte {
+    itemPath := path.Join(request.Path, file.Name())
+
+    /* Symlinks are listed as their target, if allowed to be followed */
+    if file.Mode() & os.ModeSymlink != 0 {
+        if !Config.FileSystem.FollowSymlinks || !Config.FileSystem.isSymlinkAllowed(itemPath) {
+            return nil
         }
-    })
+
+        target, err := os.Stat(itemPath)
+        if err != nil {
+            return nil
+        }
+        file = target
+    }
+
+    if isGopherPlusDirectory(request.GopherPlus) {
+        if !file.IsDir() && file.Mode() & os.ModeType != 0 {
+            return nil
+        }
+        return buildGopherPlusAttributes(request.Host, itemPath, file)
+    }
+
+    selector := request.Host.SelectorFor(itemPath)
+
+    /* Display either just the name, or full path from server root */
+    display := file.Name()
+    if Config.ListFullPaths {
+        display = selector
+    }
+    display = formatListingDisplay(display, itemPath, file)
+
+    /* Handle file, directory or ignore others */
+    var line []byte
+    switch {
+        case file.Mode() & os.ModeDir != 0:
+            /* Directory -- create directory listing */
+            line = buildLine(TypeDirectory, display, selector, request.Host.Name, request.Host.Port)
+
+        case file.Mode() & os.ModeType == 0:
+            /* Regular file -- guess item type and creating listing */
+            itemType := guessItemType(itemPath)
+            line = buildLine(itemType, display, selector, request.Host.Name, request.Host.Port)
+
+        default:
+            /* Ignore */
+            return nil
+    }
+
+    if request.GopherPlus != "" {
+        line = flagGopherPlusLine(line)
+    }
+    return line
+}
+
+/* Format display text of a listing entry at path using the listing template,
+ * if set. Tabs and line ends would break the gopher line so become spaces
+ */
+func formatListingDisplay(name, itemPath string, file os.FileInfo) string {
+    display := name
+    if Config.ListingTemplate != "" {
+        /* Directories have no meaningful size */
+        size := "-"
+        if !file.IsDir() {
+            size = formatFileSize(file.Size())
+        }
+        /* Modification time may be unknown, show it as such rather than epoch */
+        date := "-"
+        if !file.ModTime().IsZero() {
+            date = file.ModTime().Format(Config.ListingDateFormat)
+        }
+
+        /* Abstract files are only looked for if the template shows them */
+        abstract := ""
+        if strings.Contains(Config.ListingTemplate, "{abstract}") {
+            abstract = abstractFor(itemPath, file.IsDir())
+        }
+
+        display = strings.NewReplacer("{name}", name, "{size}", size, "{date}", date, "{abstract}", abstract).Replace(Config.ListingTemplate)
+    }
+    return listingDisplayEscaper.Replace(display)
 }
 
-func _listDirBase(request *FileSystemRequest, iterFunc func(dirContents *[]byte, file os.FileInfo)) ([]byte, *GophorError) {
+var listingDisplayEscaper = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+/* _listDirBase():
+ * Generates the directory listing. Order of operations is always:
+ * read directory, filter out hidden / restricted files with the
+ * supplied keep function, THEN sort what remains. This way we never
+ * sort entries that get dropped, and the sort itself falls back to
+ * name ordering so output is deterministic for every sort type.
+ */
+func _listDirBase(request *FileSystemRequest, sortBy *DirSort, keep func(file os.FileInfo) bool) ([]byte, *GophorError) {
     /* Open directory file descriptor */
     fd, err := os.Open(request.Path)
     if err != nil {
         Config.LogSystemError("failed to open %s: %s\n", request.Path, err.Error())
         return nil, &GophorError{ FileOpenErr, err }
     }
+    defer fd.Close()
 
     /* Read files in directory */
     files, err := fd.Readdir(-1)
@@ -184,27 +289,189 @@ func _listDirBase(request *FileSystemRequest, iterFunc func(dirContents *[]byte,
         return nil, &GophorError{ DirListErr, err }
     }
 
-    /* Sort the files by name */
-    sort.Sort(byName(files))
+    /* Load directory ignore file patterns, if any */
+    ignored := readIgnorePatterns(path.Join(request.Path, IgnoreFileStr))
+
+    /* Filter out hidden files first... */
+    kept := make([]os.FileInfo, 0, len(files))
+    for _, file := range files {
+        if keep(file) && !isIgnoredFile(file.Name(), ignored) {
+            kept = append(kept, file)
+        }
+    }
+
+    /* ...then sort the files as requested */
+    sortBy.Sort(kept)
 
     /* Create directory content slice, ready */
     dirContents := make([]byte, 0)
 
-    /* First add a title + a space */
-    dirContents = append(dirContents, buildLine(TypeInfo, "[ "+request.Host.Name+request.Path+" ]", "TITLE", NullHost, NullPort)...)
-    dirContents = append(dirContents, buildInfoLine("")...)
-
-    /* Add a 'back' entry. GoLang Readdir() seems to miss this */
-    dirContents = append(dirContents, buildLine(TypeDirectory, "..", path.Join(fd.Name(), ".."), request.Host.Name, request.Host.Port)...)
+    /* First add a 'back' entry. GoLang Readdir() seems to miss this. Not
+     * for Gopher+ attributes, they're only of what's in the directory
+     */
+    if !isGopherPlusDirectory(request.GopherPlus) {
+        back := buildLine(TypeDirectory, "..", request.Host.SelectorFor(path.Join(fd.Name(), "..")), request.Host.Name, request.Host.Port)
+        if request.GopherPlus != "" {
+            back = flagGopherPlusLine(back)
+        }
+        dirContents = append(dirContents, back...)
+    }
 
     /* Walk through files :D */
-    for _, file := range files { iterFunc(&dirContents, file) }
+    for _, file := range kept {
+        dirContents = append(dirContents, buildDirEntryLine(request, file)...)
+    }
 
     return dirContents, nil
 }
 
+/* Generate listing for directory without a gophermap, headed by a title
+ * from the directory name (or hostname at the root). Hidden rules from
+ * the directory's ignore file still apply
+ */
+func autoListDir(request *FileSystemRequest) ([]byte, *GophorError) {
+    title := path.Base(request.Host.SelectorFor(request.Path))
+    if title == "/" {
+        title = request.Host.Name
+    }
+
+    listing, gophorErr := listDir(request, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+
+    dirContents := buildLine(TypeInfo, "[ "+title+" ]", "TITLE", NullHost, NullPort)
+    dirContents = append(dirContents, buildInfoLine("")...)
+    return append(dirContents, listing...), nil
+}
+
+/* Check if file at path is hidden when walking the tree, either by restricted
+ * files regex or as a hidden file in directory's gophermap
+ */
+func isHiddenFromWalk(itemPath, name string, hiddenByDir map[string]map[string]bool) bool {
+    if isRestrictedFile(name) {
+        return true
+    }
+
+    dir := path.Dir(itemPath)
+    hidden, ok := hiddenByDir[dir]
+    if !ok {
+        gophermapPath, _ := findGophermap(dir)
+        hidden = readGophermapHidden(gophermapPath)
+        for _, pattern := range readIgnorePatterns(path.Join(dir, IgnoreFileStr)) {
+            hidden[pattern] = true
+        }
+        hiddenByDir[dir] = hidden
+    }
+
+    if _, ok = hidden[name]; ok {
+        return true
+    }
+
+    /* Hidden may also contain glob patterns from the ignore file */
+    for pattern := range hidden {
+        if matched, _ := path.Match(pattern, name); matched {
+            return true
+        }
+    }
+    return false
+}
+
+/* Read glob patterns from a directory ignore file, one per line
+ * with '#' comments. The ignore, access, cache control and abstract
+ * files are always ignored
+ */
+func readIgnorePatterns(path string) []string {
+    patterns := []string{ IgnoreFileStr, AclFileStr, CacheControlFileStr, "*"+AbstractFileStr }
+
+    bufferedScan(path,
+        func(scanner *bufio.Scanner) bool {
+            line := strings.TrimSpace(scanner.Text())
+            if line != "" && !strings.HasPrefix(line, "#") {
+                patterns = append(patterns, line)
+            }
+            return true
+        },
+    )
+
+    return patterns
+}
+
+/* Check if file name matches any of the supplied ignore glob patterns */
+func isIgnoredFile(name string, patterns []string) bool {
+    for _, pattern := range patterns {
+        if matched, _ := path.Match(pattern, name); matched {
+            return true
+        }
+    }
+    return false
+}
+
+/* DirSort:
+ * Describes the order that entries are listed in for
+ * a generated directory listing, and whether directories
+ * should be grouped together before regular files.
+ */
+type DirSortType int
+const (
+    DirSortName    DirSortType = iota
+    DirSortNewest  DirSortType = iota
+)
+
+type DirSort struct {
+    Type      DirSortType
+    DirsFirst bool
+}
+
+/* Default directory listing sort is just by name */
+var DefaultDirSort = &DirSort{ DirSortName, false }
+
+func (s *DirSort) Sort(files []os.FileInfo) {
+    /* Pick the base sort order */
+    var sorter sort.Interface
+    switch s.Type {
+        case DirSortNewest:
+            sorter = byModTimeDesc(files)
+        default:
+            sorter = byName(files)
+    }
+
+    /* Group directories before files if requested */
+    if s.DirsFirst {
+        sorter = &dirsFirst{ files, sorter }
+    }
+
+    sort.Sort(sorter)
+}
+
 /* Took a leaf out of go-gopher's book here. */
 type byName []os.FileInfo
 func (s byName) Len() int           { return len(s) }
 func (s byName) Less(i, j int) bool { return s[i].Name() < s[j].Name() }
 func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/* Newest first, ideal for phlogs. Ties fall back to name so order is deterministic */
+type byModTimeDesc []os.FileInfo
+func (s byModTimeDesc) Len() int           { return len(s) }
+func (s byModTimeDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byModTimeDesc) Less(i, j int) bool {
+    if !s[i].ModTime().Equal(s[j].ModTime()) {
+        return s[i].ModTime().After(s[j].ModTime())
+    }
+    return s[i].Name() < s[j].Name()
+}
+
+/* Wraps another sort, placing directories before anything else */
+type dirsFirst struct {
+    files  []os.FileInfo
+    sorter sort.Interface
+}
+func (s *dirsFirst) Len() int      { return len(s.files) }
+func (s *dirsFirst) Swap(i, j int) { s.sorter.Swap(i, j) }
+func (s *dirsFirst) Less(i, j int) bool {
+    iDir, jDir := s.files[i].IsDir(), s.files[j].IsDir()
+    if iDir != jDir {
+        return iDir
+    }
+    return s.sorter.Less(i, j)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+    "bufio"
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+/* Parse listing output into 'display\tselector' for each entry, skipping
+ * info lines and the '..' back entry
+ */
+func listingEntries(t *testing.T, output []byte) []string {
+    entries := make([]string, 0)
+    for _, line := range strings.Split(string(output), DOSLineEnd) {
+        if line == "" || ItemType(line[0]) == TypeInfo {
+            continue
+        }
+
+        split := strings.Split(line[1:], Tab)
+        if len(split) != 4 {
+            t.Fatalf("malformed listing line: %q", line)
+        }
+        if split[0] == ".." {
+            continue
+        }
+        entries = append(entries, split[0]+Tab+split[1])
+    }
+    return entries
+}
+
+func TestListDirDisplayBasename(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "notes.txt", "notes")
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    entries := listingEntries(t, output)
+    if len(entries) != 1 || entries[0] != "notes.txt"+Tab+filePath {
+        t.Errorf("expected basename display with full selector, got %q", entries)
+    }
+}
+
+func TestListDirDisplayFullPath(t *testing.T) {
+    setupTestConfig()
+    Config.ListFullPaths = true
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "notes.txt", "notes")
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    entries := listingEntries(t, output)
+    if len(entries) != 1 || entries[0] != filePath+Tab+filePath {
+        t.Errorf("expected full path display with full selector, got %q", entries)
+    }
+}
+
+/* Listing display names only, in listed order */
+func listingNames(t *testing.T, output []byte) []string {
+    names := make([]string, 0)
+    for _, entry := range listingEntries(t, output) {
+        names = append(names, strings.SplitN(entry, Tab, 2)[0])
+    }
+    return names
+}
+
+func TestListDirHiddenWithSorts(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+
+    /* Distinct modified times, same-time pair to check name tie-break */
+    now := time.Now()
+    for name, age := range map[string]time.Duration{
+        "b.txt":       1*time.Hour,
+        "a.txt":       2*time.Hour,
+        "c.txt":       2*time.Hour,
+        "hidden.txt":  0,
+        "ignored.bak": 0,
+        "sub":         3*time.Hour,
+    } {
+        itemPath := dir+"/"+name
+        if name == "sub" {
+            os.Mkdir(itemPath, 0755)
+        } else {
+            writeTestFile(t, dir, name, name)
+        }
+        os.Chtimes(itemPath, now.Add(-age), now.Add(-age))
+    }
+    writeTestFile(t, dir, IgnoreFileStr, "*.bak\n")
+    hidden := map[string]bool{ "hidden.txt": true }
+
+    tests := []struct {
+        Sort     *DirSort
+        Expected string
+    }{
+        { &DirSort{ DirSortName, false },   "a.txt b.txt c.txt sub" },
+        { &DirSort{ DirSortNewest, false }, "b.txt a.txt c.txt sub" },
+        { &DirSort{ DirSortName, true },    "sub a.txt b.txt c.txt" },
+        { &DirSort{ DirSortNewest, true },  "sub b.txt a.txt c.txt" },
+    }
+
+    for _, test := range tests {
+        /* Repeat to check output is deterministic */
+        for i := 0; i < 5; i += 1 {
+            output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, hidden, test.Sort)
+            if gophorErr != nil {
+                t.Fatal(gophorErr)
+            }
+            if names := strings.Join(listingNames(t, output), " "); names != test.Expected {
+                t.Errorf("sort %+v: expected %q, got %q", *test.Sort, test.Expected, names)
+                break
+            }
+        }
+    }
+}
+
+func TestAutoListDir(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "docs/notes.txt", "notes")
+    writeTestFile(t, dir, "docs/secret.txt", "secret")
+    writeTestFile(t, dir, "docs/"+IgnoreFileStr, "secret.txt\n")
+
+    /* No gophermap, so listing is generated with a title from directory name */
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Join(dir, "docs"), testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    title := string(buildLine(TypeInfo, "[ docs ]", "TITLE", NullHost, NullPort))
+    if !strings.HasPrefix(string(output), title) || strings.Count(string(output), "TITLE") != 1 {
+        t.Errorf("expected single title line %q, got %q", title, output)
+    }
+    listing := strings.TrimSuffix(string(output), string(Config.Current().FooterText))
+    if names := listingNames(t, []byte(listing)); len(names) != 1 || names[0] != "notes.txt" {
+        t.Errorf("expected ignored files hidden from generated listing, got %q", names)
+    }
+
+    /* Root listing is titled with the hostname */
+    output, gophorErr = autoListDir(&FileSystemRequest{ dir, &ConnHost{ "localhost", "70", dir, "" }, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.HasPrefix(string(output), string(buildLine(TypeInfo, "[ localhost ]", "TITLE", NullHost, NullPort))) {
+        t.Errorf("expected hostname title for root listing, got %q", output)
+    }
+}
+
+func TestListDirTemplate(t *testing.T) {
+    setupTestConfig()
+    Config.ListingTemplate = "[{name}]\t{name}"
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "notes.txt", "notes")
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Tabs in the template mustn't split the display text from the selector */
+    entries := listingEntries(t, output)
+    if len(entries) != 1 || entries[0] != "[notes.txt] notes.txt"+Tab+filePath {
+        t.Errorf("expected templated display with full selector, got %q", entries)
+    }
+}
+
+func TestListDirTemplateSize(t *testing.T) {
+    setupTestConfig()
+    Config.ListingTemplate = "{name} ({size})"
+    dir := t.TempDir()
+    writeTestFile(t, dir, "empty.txt", "")
+    writeTestFile(t, dir, "notes.txt", "notes")
+    os.Mkdir(path.Join(dir, "sub"), 0755)
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    names := listingNames(t, output)
+    expected := []string{ "empty.txt (0 B)", "notes.txt (5 B)", "sub (-)" }
+    if strings.Join(names, "|") != strings.Join(expected, "|") {
+        t.Errorf("expected %q, got %q", expected, names)
+    }
+}
+
+func TestListDirTemplateDate(t *testing.T) {
+    setupTestConfig()
+    Config.ListingTemplate = "{date} {name}"
+    Config.ListingDateFormat = "2006-01-02\t15:04"
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "notes.txt", "notes")
+    modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+    os.Chtimes(filePath, modTime, modTime)
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Tab in the layout mustn't break the gopher line */
+    names := listingNames(t, output)
+    if len(names) != 1 || names[0] != "2020-01-02 03:04 notes.txt" {
+        t.Errorf("expected dated display, got %q", names)
+    }
+}
+
+func TestBufferedScanMaxLineLength(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "long.txt", strings.Repeat("x", 100*1024)+"\n")
+    scanLength := func() (int, *GophorError) {
+        length := 0
+        gophorErr := bufferedScan(filePath, func(scanner *bufio.Scanner) bool {
+            length += len(scanner.Text())
+            return true
+        })
+        return length, gophorErr
+    }
+
+    if _, gophorErr := scanLength(); gophorErr == nil {
+        t.Errorf("expected line over default max line length to fail scan")
+    }
+
+    Config.MaxLineLength = 200*1024
+    if length, gophorErr := scanLength(); gophorErr != nil || length != 100*1024 {
+        t.Errorf("expected whole line scanned with raised max line length, got %d bytes: %v", length, gophorErr)
+    }
+}
+
+func TestListDirTemplateAbstract(t *testing.T) {
+    setupTestConfig()
+    Config.ListingTemplate = "{name} {abstract}"
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", "notes")
+    abstractPath := writeTestFile(t, dir, "notes.txt.abstract", "  My notes\tso far  \nmore detail\n")
+    writeTestFile(t, dir, "plain.txt", "plain")
+    writeTestFile(t, dir, "sub/.abstract", "Sub directory\n")
+
+    output, gophorErr := listDir(&FileSystemRequest{ dir, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* First line only, abstract files themselves hidden and missing abstracts blank */
+    names := listingNames(t, output)
+    expected := []string{ "notes.txt My notes so far", "plain.txt ", "sub Sub directory" }
+    if strings.Join(names, "|") != strings.Join(expected, "|") {
+        t.Errorf("expected %q, got %q", expected, names)
+    }
+
+    /* Edits picked up, removal degrades to blank */
+    modTime := time.Now().Add(time.Minute)
+    writeTestFile(t, dir, "notes.txt.abstract", "Updated\n")
+    os.Chtimes(abstractPath, modTime, modTime)
+    if abstract := abstractFor(path.Join(dir, "notes.txt"), false); abstract != "Updated" {
+        t.Errorf("expected edited abstract reloaded, got %q", abstract)
+    }
+    os.Remove(abstractPath)
+    if abstract := abstractFor(path.Join(dir, "notes.txt"), false); abstract != "" {
+        t.Errorf("expected removed abstract blank, got %q", abstract)
+    }
+}
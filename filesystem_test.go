@@ -0,0 +1,685 @@
+package main
+
+import (
+    "os"
+    "bytes"
+    "compress/gzip"
+    "io/ioutil"
+    "io"
+    "net"
+    "fmt"
+    "path"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestFileMonitorIntervalFixed(t *testing.T) {
+    /* Small cache within budget sticks to the base sleep time */
+    if interval := fileMonitorInterval(time.Minute, 10, 100); interval != time.Minute {
+        t.Errorf("expected fixed interval %s, got %s", time.Minute, interval)
+    }
+}
+
+func TestFileMonitorIntervalAdaptive(t *testing.T) {
+    /* Interval should grow with cache size once over budget */
+    small := fileMonitorInterval(time.Second, 1000, 100)
+    large := fileMonitorInterval(time.Second, 10000, 100)
+    if small != 10*time.Second {
+        t.Errorf("expected 10s interval for 1000 files at 100/s, got %s", small)
+    }
+    if large <= small {
+        t.Errorf("expected interval to grow with cache size, got %s then %s", small, large)
+    }
+}
+
+func TestFileMonitorIntervalZeroBudget(t *testing.T) {
+    /* Zero budget disables adaptive mode, regardless of cache size */
+    if interval := fileMonitorInterval(time.Minute, 1000000, 0); interval != time.Minute {
+        t.Errorf("expected fixed interval %s with zero budget, got %s", time.Minute, interval)
+    }
+}
+
+func TestStopFileMonitor(t *testing.T) {
+    setupTestConfig()
+    startFileMonitor(time.Millisecond, 0)
+
+    /* Stop should return once the monitor loop has exited */
+    done := make(chan struct{})
+    go func() {
+        stopFileMonitor()
+        close(done)
+    }()
+
+    select {
+        case <-done:
+        case <-time.After(5*time.Second):
+            t.Fatal("file monitor did not stop")
+    }
+
+    /* Stopping again is a no-op */
+    stopFileMonitor()
+}
+
+func TestGzipExcludesServerFiles(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.GzipEnabled = true
+
+    dir := t.TempDir()
+    writeTestFile(t, dir, GophermapFileStr, "-secret.txt\n")
+    writeTestFile(t, dir, IgnoreFileStr, "*.bak\n")
+    writeTestFile(t, dir, "notes.txt", "notes")
+
+    for _, name := range []string{ GophermapFileStr, IgnoreFileStr } {
+        _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Join(dir, name+GzipSuffix), testHost, "", nil, "" })
+        if gophorErr == nil {
+            t.Errorf("expected %s%s not to be served", name, GzipSuffix)
+        }
+    }
+
+    if _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Join(dir, "notes.txt"+GzipSuffix), testHost, "", nil, "" }); gophorErr != nil {
+        t.Errorf("expected regular file to be served gzipped: %s", gophorErr)
+    }
+}
+
+/* Decompress gzip data, failing test if invalid */
+func gunzipTest(t *testing.T, b []byte) string {
+    reader, err := gzip.NewReader(bytes.NewReader(b))
+    if err != nil {
+        t.Fatalf("invalid gzip data: %s", err)
+    }
+    raw, err := ioutil.ReadAll(reader)
+    if err != nil {
+        t.Fatalf("invalid gzip data: %s", err)
+    }
+    return string(raw)
+}
+
+func TestGzipFileCached(t *testing.T) {
+    setupTestConfig()
+    Config.Metrics = NewMetrics("")
+    Config.FileSystem.GzipEnabled = true
+    Config.FileSystem.GzipMinSize = 10
+
+    dir := t.TempDir()
+    writeTestFile(t, dir, "small.txt", "tiny")
+    writeTestFile(t, dir, "large.txt", strings.Repeat("compress me ", 100))
+
+    /* Files under the minimum size aren't served compressed */
+    if _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Join(dir, "small.txt"+GzipSuffix), testHost, "", nil, "" }); gophorErr == nil {
+        t.Error("expected file under gzip-min-size not to be served compressed")
+    }
+
+    requestPath := path.Join(dir, "large.txt"+GzipSuffix)
+    for i := 0; i < 2; i += 1 {
+        b, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ requestPath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if raw := gunzipTest(t, b); raw != strings.Repeat("compress me ", 100) {
+            t.Errorf("unexpected decompressed contents: %q", raw)
+        }
+    }
+
+    /* Second request served from the cache, not compressed again */
+    if Config.Metrics.CacheMisses != 1 || Config.Metrics.CacheHits != 1 {
+        t.Errorf("expected 1 cache miss then 1 hit, got %d misses %d hits", Config.Metrics.CacheMisses, Config.Metrics.CacheHits)
+    }
+}
+
+func TestGzipFileStreamed(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.GzipEnabled = true
+    atomic.StoreInt64(&Config.FileSystem.CacheFileMax, 100)
+
+    dir := t.TempDir()
+    writeTestFile(t, dir, "small.txt", "cache me")
+    contents := strings.Repeat("stream me ", FileReadBufSize)
+    writeTestFile(t, dir, "large.txt", contents)
+
+    /* Files small enough to cache aren't streamed */
+    if sourcePath := Config.FileSystem.gzipStreamSource(path.Join(dir, "small.txt"+GzipSuffix)); sourcePath != "" {
+        t.Errorf("expected cacheable file not to be streamed, got %s", sourcePath)
+    }
+
+    sourcePath := Config.FileSystem.gzipStreamSource(path.Join(dir, "large.txt"+GzipSuffix))
+    if sourcePath != path.Join(dir, "large.txt") {
+        t.Fatalf("expected file larger than cache-file-max to be streamed, got %q", sourcePath)
+    }
+
+    var buf bytes.Buffer
+    if gophorErr := Config.FileSystem.StreamGzipFile(sourcePath, &buf); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if gunzipTest(t, buf.Bytes()) != contents {
+        t.Error("streamed compressed contents don't match source")
+    }
+
+    /* Nothing ends up cached */
+    if Config.FileSystem.CacheCount() != 0 {
+        t.Errorf("expected streamed file not to be cached, cache count %d", Config.FileSystem.CacheCount())
+    }
+}
+
+func TestCacheFreshnessSlowStat(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.StatTimeout = 10*time.Millisecond
+
+    filePath := writeTestFile(t, t.TempDir(), "slow.txt", "slow")
+    if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Inject a stat that blocks until released, counting calls */
+    var calls int32
+    release := make(chan struct{})
+    statFunc = func(name string) (os.FileInfo, error) {
+        atomic.AddInt32(&calls, 1)
+        <-release
+        return os.Stat(name)
+    }
+    defer func() { statFunc = os.Stat }()
+
+    /* Timed out stats keep the entry, and a still blocked stat isn't repeated */
+    checkCacheFreshness()
+    checkCacheFreshness()
+
+    if count := Config.FileSystem.CacheCount(); count != 1 {
+        t.Errorf("expected slow file kept in cache, count %d", count)
+    }
+    if n := atomic.LoadInt32(&calls); n != 1 {
+        t.Errorf("expected single in-flight stat across sweeps, got %d", n)
+    }
+
+    /* Once released, stats resume as normal */
+    close(release)
+    for i := 0; i < 100; i += 1 {
+        pendingStats.Mutex.Lock()
+        pending := len(pendingStats.Paths)
+        pendingStats.Mutex.Unlock()
+        if pending == 0 {
+            break
+        }
+        time.Sleep(time.Millisecond)
+    }
+    checkCacheFreshness()
+    if n := atomic.LoadInt32(&calls); n != 2 {
+        t.Errorf("expected stat retried once previous returned, got %d calls", n)
+    }
+}
+
+/* Stress concurrent fetches against a tiny cache, forcing constant eviction
+ * alongside freshness checks. Run with 'go test -race'
+ */
+func TestFetchEvictRace(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.initShards(3, 1)
+
+    dir := t.TempDir()
+    paths := make([]string, 10)
+    for i := range paths {
+        paths[i] = writeTestFile(t, dir, fmt.Sprintf("%d.txt", i), fmt.Sprintf("file %d", i))
+    }
+
+    var wg sync.WaitGroup
+    for g := 0; g < 16; g += 1 {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 200; i += 1 {
+                n := (i*7 + g) % len(paths)
+                b, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ paths[n], testHost, "", nil, "" })
+                if gophorErr != nil || string(b) != fmt.Sprintf("file %d", n) {
+                    t.Errorf("bad fetch of %s: %v %q", paths[n], gophorErr, b)
+                    return
+                }
+                if i % 50 == 0 {
+                    checkCacheFreshness()
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+
+    /* Map and list must agree once everyone has let go */
+    for _, shard := range Config.FileSystem.CacheShards {
+        if shard.Map.List.Len() != len(shard.Map.Map) {
+            t.Fatalf("cache list length %d != map length %d", shard.Map.List.Len(), len(shard.Map.Map))
+        }
+    }
+}
+
+/* Concurrent fetches of distinct paths, with a cache smaller than the
+ * number of paths so fetches keep missing and taking the write lock
+ */
+func benchmarkFetchDistinct(b *testing.B, shards int) {
+    setupTestConfig()
+    Config.FileSystem.initShards(64, shards)
+
+    dir := b.TempDir()
+    paths := make([]string, 256)
+    for i := range paths {
+        paths[i] = writeTestFile(b, dir, fmt.Sprintf("%d.txt", i), "contents")
+    }
+
+    var next uint32
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            i := atomic.AddUint32(&next, 1) % uint32(len(paths))
+            _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ paths[i], testHost, "", nil, "" })
+            if gophorErr != nil {
+                b.Error(gophorErr)
+            }
+        }
+    })
+}
+
+func BenchmarkFetchSharded(b *testing.B) {
+    benchmarkFetchDistinct(b, CacheShardCount)
+}
+
+func BenchmarkFetchSingleLock(b *testing.B) {
+    benchmarkFetchDistinct(b, 1)
+}
+
+/* Concurrent fetches of the same cached file under each eviction policy.
+ * Hits only take the shard read lock, the list is never reordered
+ */
+func benchmarkFetchHot(b *testing.B, policy EvictionPolicy) {
+    setupTestConfig()
+    Config.FileSystem.CachePolicy = policy
+    Config.FileSystem.initShards(64, CacheShardCount)
+
+    filePath := writeTestFile(b, b.TempDir(), "hot.txt", "contents")
+    if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+        b.Fatal(gophorErr)
+    }
+
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+            if gophorErr != nil {
+                b.Error(gophorErr)
+            }
+        }
+    })
+}
+
+func BenchmarkFetchHotLRU(b *testing.B) {
+    benchmarkFetchHot(b, &LRUPolicy{})
+}
+
+func BenchmarkFetchHotLFU(b *testing.B) {
+    benchmarkFetchHot(b, &LFUPolicy{})
+}
+
+/* File contents counting loads, slowed down so concurrent misses overlap */
+type countingContents struct {
+    RegularFileContents
+    Loads *int32
+}
+
+func (c *countingContents) Load() *GophorError {
+    atomic.AddInt32(c.Loads, 1)
+    time.Sleep(time.Millisecond)
+    return c.RegularFileContents.Load()
+}
+
+/* Fetch same uncached path from count goroutines at once, returning loads */
+func fetchConcurrentMisses(tb testing.TB, filePath string, count int) int32 {
+    var loads int32
+    newContents := func(path string) FileContents {
+        return &countingContents{ RegularFileContents{ path, nil }, &loads }
+    }
+
+    var wg sync.WaitGroup
+    for g := 0; g < count; g += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            b, gophorErr := Config.FileSystem.fetch(&FileSystemRequest{ filePath, testHost, "", nil, "" }, filePath, newContents)
+            if gophorErr != nil || string(b) != "contents" {
+                tb.Errorf("bad fetch of %s: %v %q", filePath, gophorErr, b)
+            }
+        }()
+    }
+    wg.Wait()
+    return loads
+}
+
+func TestFetchConcurrentMissLoadsOnce(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", "contents")
+
+    if loads := fetchConcurrentMisses(t, filePath, 16); loads != 1 {
+        t.Errorf("expected concurrent misses to load file once, got %d loads", loads)
+    }
+}
+
+func TestFetchLoadErrorNotCached(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", "contents")
+
+    /* File passes the stat but fails to load, shouldn't be left in cache */
+    _, gophorErr := Config.FileSystem.fetch(&FileSystemRequest{ filePath, testHost, "", nil, "" }, filePath, func(path string) FileContents {
+        return &RegularFileContents{ path+".missing", nil }
+    })
+    if gophorErr == nil {
+        t.Fatal("expected load error")
+    }
+    if count := Config.FileSystem.CacheCount(); count != 0 {
+        t.Errorf("expected failed load not cached, got %d cached files", count)
+    }
+}
+
+/* Concurrent misses on a single path, reporting loads per miss burst.
+ * Re-checking the cache after taking the write lock keeps this at 1
+ */
+func BenchmarkFetchConcurrentMiss(b *testing.B) {
+    setupTestConfig()
+    filePath := writeTestFile(b, b.TempDir(), "file.txt", "contents")
+
+    var loads int32
+    for i := 0; i < b.N; i += 1 {
+        Config.FileSystem.Reset(10, 1)
+        loads += fetchConcurrentMisses(b, filePath, 16)
+    }
+    b.ReportMetric(float64(loads) / float64(b.N), "loads/op")
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.BackgroundRefresh = true
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "old")
+
+    if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Freshness check reloads the changed file itself, leaving it fresh */
+    writeTestFile(t, dir, "file.txt", "new")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(filePath, modTime, modTime)
+    checkCacheFreshness()
+
+    file := Config.FileSystem.shardFor(filePath).Map.Get(filePath)
+    if !file.Fresh || string(file.Contents(&FileSystemRequest{ filePath, testHost, "", nil, "" })) != "new" {
+        t.Errorf("expected file refreshed in background, fresh=%v", file.Fresh)
+    }
+
+    /* Failed refresh (now a directory, so stat is fine but load fails)
+     * leaves reload to the next request
+     */
+    os.Remove(filePath)
+    os.Mkdir(filePath, 0755)
+    os.Chtimes(filePath, modTime.Add(time.Hour), modTime.Add(time.Hour))
+    checkCacheFreshness()
+    if file.Fresh {
+        t.Errorf("expected failed refresh to mark file unfresh")
+    }
+}
+
+/* Fetches racing background refreshes must only ever see whole contents.
+ * Run with 'go test -race'
+ */
+func TestBackgroundRefreshRace(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.BackgroundRefresh = true
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "contents")
+
+    done := make(chan struct{})
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                    case <-done:
+                        return
+                    default:
+                }
+                b, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+                if gophorErr != nil || string(b) != "contents" {
+                    t.Errorf("bad fetch during refresh: %v %q", gophorErr, b)
+                    return
+                }
+            }
+        }()
+    }
+
+    for i := 1; i <= 20; i += 1 {
+        modTime := time.Now().Add(time.Duration(i)*time.Hour)
+        os.Chtimes(filePath, modTime, modTime)
+        checkCacheFreshness()
+    }
+    close(done)
+    wg.Wait()
+}
+
+func TestMergedGophermaps(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    first := writeTestFile(t, dir, "a/"+GophermapFileStr, "first\n")
+    second := writeTestFile(t, dir, "b/"+GophermapFileStr, "second\n")
+    Config.MergedMaps = map[string][]string{ "/merged": []string{ first, second } }
+
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ "/merged", testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if expected := string(buildInfoLine("first"))+string(buildInfoLine("second"))+LastLine; string(output) != expected {
+        t.Errorf("expected merged output %q, got %q", expected, output)
+    }
+
+    /* Update second source, freshness check should invalidate merged map */
+    writeTestFile(t, dir, "b/"+GophermapFileStr, "updated\n")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(second, modTime, modTime)
+    checkCacheFreshness()
+
+    output, gophorErr = Config.FileSystem.HandleRequest(&FileSystemRequest{ "/merged", testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if expected := string(buildInfoLine("first"))+string(buildInfoLine("updated"))+LastLine; string(output) != expected {
+        t.Errorf("expected updated merged output %q, got %q", expected, output)
+    }
+}
+
+func TestInitShardCount(t *testing.T) {
+    setupTestConfig()
+    fs := new(FileSystem)
+
+    /* Shards each get their share of the cache size */
+    fs.Init(50, 4, 1)
+    if len(fs.CacheShards) != 4 || fs.CacheShards[0].Map.Size != 13 {
+        t.Errorf("expected 4 shards of 13 files, got %d shards of %d", len(fs.CacheShards), fs.CacheShards[0].Map.Size)
+    }
+
+    /* Invalid shard count falls back to a single shard */
+    fs.Init(50, 0, 1)
+    if len(fs.CacheShards) != 1 || fs.CacheShards[0].Map.Size != 50 {
+        t.Errorf("expected 1 shard of 50 files, got %d shards of %d", len(fs.CacheShards), fs.CacheShards[0].Map.Size)
+    }
+}
+
+func TestGophermapNames(t *testing.T) {
+    setupTestConfig()
+    Config.GophermapNames = []string{ ".gophermap", "gophermap.txt" }
+    dir := t.TempDir()
+    writeTestFile(t, dir, "gophermap.txt", "Second choice\n")
+    writeTestFile(t, dir, "gophermap", "Not a gophermap name\n")
+    writeTestFile(t, dir, "sub/.gophermap", "Listing\n*\n")
+    writeTestFile(t, dir, "sub/notes.txt", "notes")
+
+    /* Names are tried in order, anything else is a regular file */
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ dir, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.HasPrefix(string(output), string(buildInfoLine("Second choice"))) {
+        t.Errorf("expected gophermap.txt served, got %q", output)
+    }
+
+    /* Directory listing after gophermap resolves to gophermap's directory */
+    output, gophorErr = Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Join(dir, "sub"), testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.Contains(string(output), "notes.txt"+Tab+path.Join(dir, "sub/notes.txt")) {
+        t.Errorf("expected listing of gophermap directory, got %q", output)
+    }
+}
+
+/* Request selector over a pipe, returning response and any error */
+func respondTestRequest(request string) (string, *GophorError) {
+    server, client := net.Pipe()
+    output := make(chan string)
+    go func() {
+        b, _ := io.ReadAll(client)
+        output <- string(b)
+    }()
+
+    gophorErr := NewWorker(&GophorConn{ server, testHost, 0 }).RespondGopher([]byte(request+DOSLineEnd))
+    server.Close()
+    return <-output, gophorErr
+}
+
+func TestStreamLargeFileNotCached(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.StreamFileMin = 16
+    dir := t.TempDir()
+    largePath := writeTestFile(t, dir, "large.bin", strings.Repeat("x", 64))
+    smallPath := writeTestFile(t, dir, "small.txt", "small")
+
+    for _, filePath := range []string{ largePath, smallPath } {
+        response, gophorErr := respondTestRequest(filePath)
+        if gophorErr != nil {
+            t.Fatalf("%s: %v", filePath, gophorErr)
+        }
+
+        contents, _ := os.ReadFile(filePath)
+        if response != string(contents) {
+            t.Errorf("%s: expected file contents, got %q", filePath, response)
+        }
+    }
+
+    if Config.FileSystem.shardFor(largePath).Map.Get(largePath) != nil {
+        t.Errorf("expected streamed large file not to enter cache")
+    }
+    if Config.FileSystem.shardFor(smallPath).Map.Get(smallPath) == nil {
+        t.Errorf("expected small file to be cached")
+    }
+}
+
+func TestStreamFileOffset(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", "0123456789")
+
+    tests := []struct {
+        Offset   string
+        Expected string
+        Code     ErrorCode
+    }{
+        { "4",  "456789",     -1 },
+        { "10", "",           -1 },
+        { "11", "",           FileOffsetErr },
+        { "-1", "",           FileOffsetErr },
+        { "abc", "0123456789", -1 },
+    }
+
+    for _, test := range tests {
+        response, gophorErr := respondTestRequest(filePath+Tab+test.Offset)
+        switch {
+            case test.Code >= 0 && (gophorErr == nil || gophorErr.Code != test.Code):
+                t.Errorf("offset %q: expected error %d, got %v", test.Offset, test.Code, gophorErr)
+            case test.Code < 0 && gophorErr != nil:
+                t.Errorf("offset %q: unexpected error %v", test.Offset, gophorErr)
+            case response != test.Expected:
+                t.Errorf("offset %q: expected %q, got %q", test.Offset, test.Expected, response)
+        }
+    }
+
+    /* Resumed transfers are streamed, leaving the cache alone */
+    if Config.FileSystem.shardFor(filePath).Map.Get(filePath) == nil {
+        t.Errorf("expected non-offset request to cache file")
+    }
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+    setupTestConfig()
+    root := t.TempDir()
+    outside := t.TempDir()
+    writeTestFile(t, root, "file.txt", "inside")
+    writeTestFile(t, outside, "secret.txt", "outside")
+    for name, target := range map[string]string{ "inside.txt": root+"/file.txt", "outside.txt": outside+"/secret.txt", "outsidedir": outside } {
+        if err := os.Symlink(target, root+"/"+name); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    tests := []struct {
+        Follow   bool
+        Selector string
+        Allowed  bool
+    }{
+        { false, "file.txt",              true },
+        { false, "inside.txt",            false },
+        { false, "outside.txt",           false },
+        { false, "outsidedir/secret.txt", false },
+        { true,  "inside.txt",            true },
+        { true,  "outside.txt",           false },
+        { true,  "outsidedir/secret.txt", false },
+    }
+
+    for _, test := range tests {
+        Config.FileSystem.FollowSymlinks = test.Follow
+        Config.FileSystem.Root = root
+        response, gophorErr := respondTestRequest(path.Join(root, test.Selector))
+        if test.Allowed && (gophorErr != nil || response != "inside") {
+            t.Errorf("follow=%t %s: expected served, got %q %v", test.Follow, test.Selector, response, gophorErr)
+        } else if !test.Allowed && (gophorErr == nil || gophorErr.Code != IllegalPathErr) {
+            t.Errorf("follow=%t %s: expected refused, got %q %v", test.Follow, test.Selector, response, gophorErr)
+        }
+    }
+
+    for _, follow := range []bool{ false, true } {
+        Config.FileSystem.FollowSymlinks = follow
+        listing, gophorErr := listDir(&FileSystemRequest{ root, testHost, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if strings.Contains(string(listing), "outside") || strings.Contains(string(listing), "inside.txt") != follow {
+            t.Errorf("follow=%t: unexpected symlinks in listing %q", follow, listing)
+        }
+    }
+}
+
+func TestNoCacheLoadsAfresh(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.NoCache = true
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "before")
+
+    for _, contents := range []string{ "before", "after" } {
+        writeTestFile(t, dir, "file.txt", contents)
+        output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if string(output) != contents {
+            t.Errorf("expected edit served straight away as %q, got %q", contents, output)
+        }
+    }
+
+    if count := Config.FileSystem.CacheCount(); count != 0 {
+        t.Errorf("expected nothing cached, got %d files", count)
+    }
+}
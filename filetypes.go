@@ -0,0 +1,73 @@
+package main
+
+import (
+    "path"
+    "sync"
+)
+
+/* FileContentsType:
+ * Creates new, unloaded file contents for files with
+ * names matching. Registered types are consulted when
+ * a file is first cached, so new kinds of file can be
+ * served without touching the cache itself.
+ */
+type FileContentsType struct {
+    Match func(name string) bool
+    New   func(filePath string) FileContents
+}
+
+/* Registered file contents types, most recently registered taking precedence.
+ * Defaults to regular (or binary) files for anything not otherwise handled, then
+ * gophermaps, whose names are configurable so are checked at the time
+ */
+var (
+    fileContentsTypes = []*FileContentsType{
+        &FileContentsType{
+            func(name string) bool { return true },
+            newRegularFileContents,
+        },
+        &FileContentsType{
+            isGophermapName,
+            func(filePath string) FileContents { return &GophermapContents{ filePath, nil } },
+        },
+    }
+    fileContentsTypesMutex sync.RWMutex
+)
+
+/* Register file contents constructor for file names matching glob pattern,
+ * e.g. '*.md'. Takes precedence over anything registered before, including
+ * the default gophermap and regular file handling
+ */
+func RegisterFileContents(pattern string, newContents func(filePath string) FileContents) {
+    registerFileContentsType(&FileContentsType{
+        func(name string) bool {
+            matched, _ := path.Match(pattern, name)
+            return matched
+        },
+        newContents,
+    })
+}
+
+func registerFileContentsType(contentsType *FileContentsType) {
+    fileContentsTypesMutex.Lock()
+    fileContentsTypes = append(fileContentsTypes, contentsType)
+    fileContentsTypesMutex.Unlock()
+}
+
+/* Create new file contents object for file at path, using the most recently
+ * registered type matching its name
+ */
+func newFileContents(filePath string) FileContents {
+    name := path.Base(filePath)
+
+    fileContentsTypesMutex.RLock()
+    defer fileContentsTypesMutex.RUnlock()
+    for i := len(fileContentsTypes)-1; i >= 0; i -= 1 {
+        if fileContentsTypes[i].Match(name) {
+            return fileContentsTypes[i].New(filePath)
+        }
+    }
+
+    /* Not reached while the regular file default is registered */
+    return newRegularFileContents(filePath)
+}
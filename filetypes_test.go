@@ -0,0 +1,124 @@
+package main
+
+import (
+    "os"
+    "bytes"
+    "crypto/sha256"
+    "testing"
+    "time"
+)
+
+/* File contents rendering the file's contents upper cased */
+type upperFileContents struct {
+    RegularFileContents
+}
+
+func (fc *upperFileContents) Render(request *FileSystemRequest) []byte {
+    return bytes.ToUpper(fc.contents)
+}
+
+func TestRegisterFileContents(t *testing.T) {
+    setupTestConfig()
+    defaults := fileContentsTypes
+    defer func() {
+        fileContentsTypes = defaults
+    }()
+
+    RegisterFileContents("*.upper", func(filePath string) FileContents {
+        return &upperFileContents{ RegularFileContents{ filePath, nil } }
+    })
+
+    dir := t.TempDir()
+    tests := map[string]string{
+        writeTestFile(t, dir, "shout.upper", "hello"): "HELLO",
+        writeTestFile(t, dir, "plain.txt", "hello"):   "hello",
+    }
+    for filePath, expected := range tests {
+        output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if string(output) != expected {
+            t.Errorf("expected %s rendered as %q, got %q", filePath, expected, output)
+        }
+    }
+
+    /* Gophermaps still handled by default */
+    if _, ok := newFileContents(dir+"/"+GophermapFileStr).(*GophermapContents); !ok {
+        t.Errorf("expected gophermap contents for gophermap")
+    }
+}
+
+func TestBinaryFilesUnchanged(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+
+    /* Everything text processing might touch: tabs, line endings, leading
+     * periods, control characters and invalid UTF-8
+     */
+    raw := make([]byte, 0, 1024)
+    for i := 0; i < 4; i += 1 {
+        for b := 0; b < 256; b += 1 {
+            raw = append(raw, byte(b))
+        }
+    }
+    raw = append(raw, []byte("\n.\r\n\t.png\n")...)
+
+    Config.TextLastLine = true
+    Config.TextEncodings, _ = parseTextEncodings(".png=latin1\n.zip=latin1")
+
+    for _, name := range []string{ "image.png", "archive.zip" } {
+        filePath := writeTestFile(t, dir, name, string(raw))
+        if _, ok := newFileContents(filePath).(*BinaryFileContents); !ok {
+            t.Errorf("expected binary contents for %s", name)
+        }
+
+        output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if sha256.Sum256(output) != sha256.Sum256(raw) {
+            t.Errorf("expected %s served byte-for-byte, got %d bytes differing from %d", name, len(output), len(raw))
+        }
+    }
+
+    /* Text files still processed */
+    if _, ok := newFileContents(writeTestFile(t, dir, "notes.txt", "hello")).(*RegularFileContents); !ok {
+        t.Errorf("expected regular contents for text file")
+    }
+}
+
+func TestRegisteredContentsBackgroundRefresh(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.BackgroundRefresh = true
+    defaults := fileContentsTypes
+    defer func() {
+        fileContentsTypes = defaults
+    }()
+
+    RegisterFileContents("*.upper", func(filePath string) FileContents {
+        return &upperFileContents{ RegularFileContents{ filePath, nil } }
+    })
+
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "shout.upper", "old")
+    if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" }); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Registered types can't be reloaded in the background, so are left
+     * unfresh for the next request to reload
+     */
+    writeTestFile(t, dir, "shout.upper", "new")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(filePath, modTime, modTime)
+    checkCacheFreshness()
+
+    output, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if string(output) != "NEW" {
+        t.Errorf("expected edited registered type reloaded, got %q", output)
+    }
+}
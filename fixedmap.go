@@ -7,30 +7,34 @@ import (
 /* TODO: work on efficiency. use our own lower level data structure? */
 
 /* FixedMap:
- * A fixed size map that pushes the last
- * used value from the stack if size limit
- * is reached.
+ * A fixed size map that pushes a value chosen
+ * by its eviction policy from the stack if size
+ * limit is reached.
  */
 type FixedMap struct {
-    Map  map[string]*MapElement
-    List *list.List
-    Size int
+    Map    map[string]*MapElement
+    List   *list.List
+    Size   int
+    Policy EvictionPolicy
 }
 
 /* MapElement:
  * Simple structure to wrap pointer to list
- * element and stored map value together.
+ * element and stored map value together, with
+ * a count of accesses for eviction policies.
  */
 type MapElement struct {
     Element *list.Element
     Value   *File
+    Hits    int64
 }
 
-func NewFixedMap(size int) *FixedMap {
+func NewFixedMap(size int, policy EvictionPolicy) *FixedMap {
     return &FixedMap{
         make(map[string]*MapElement),
         list.New(),
         size,
+        policy,
     }
 }
 
@@ -38,21 +42,37 @@ func NewFixedMap(size int) *FixedMap {
 func (fm *FixedMap) Get(key string) *File {
     elem, ok := fm.Map[key]
     if ok {
+        fm.Policy.Accessed(elem)
         return elem.Value
     } else {
         return nil
     }
 }
 
-/* Put file in map as key, pushing out last file
- * if size limit reached */
+/* Put file in map as key, pushing out a file not
+ * currently in use if size limit reached */
 func (fm *FixedMap) Put(key string, value *File) {
+    /* If key already exists, replace value and move to front rather
+     * than leaving a duplicate list element behind
+     */
+    if elem, ok := fm.Map[key]; ok {
+        elem.Value = value
+        fm.List.MoveToFront(elem.Element)
+        return
+    }
+
     element := fm.List.PushFront(key)
-    fm.Map[key] = &MapElement{ element, value }
+    fm.Map[key] = &MapElement{ element, value, 0 }
 
-    if fm.List.Len() > fm.Size {
-        /* We're at capacity! SIR! */
-        element = fm.List.Back()
+    /* We're at capacity! SIR! Ask the policy for files without readers
+     * to evict. If they're all in use we sit over capacity until the
+     * next Put()
+     */
+    for fm.List.Len() > fm.Size {
+        element = fm.Policy.Victim(fm)
+        if element == nil {
+            break
+        }
 
         /* We don't check here as we know this is ALWAYS a string */
         key, _ := element.Value.(string)
@@ -62,6 +82,7 @@ func (fm *FixedMap) Put(key string, value *File) {
         fm.List.Remove(element)
 
         Config.LogSystem("Popped key: %s\n", key)
+        Config.Metrics.CacheEvicted()
     }
 }
 
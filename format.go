@@ -1,7 +1,16 @@
 package main
 
 import (
+    "os"
+    "io"
+    "path"
+    "bufio"
+    "errors"
     "strings"
+    "sync"
+    "strconv"
+    "unicode"
+    "net/http"
 )
 
 var FileExtMap = map[string]ItemType{
@@ -81,20 +90,64 @@ var FileExtMap = map[string]ItemType{
     ".webm":         TypeVideo,
 }
 
-func buildError(selector string) []byte {
-    ret := string(TypeError)
-    ret += selector + DOSLineEnd
-    ret += LastLine
-    return []byte(ret)
+/* Build gopher error resource, a type 3 line for each line of message
+ * followed by the last line
+ */
+func errorResponse(msg string) []byte {
+    ret := make([]byte, 0)
+    for _, line := range strings.Split(msg, "\n") {
+        ret = append(ret, buildLine(TypeError, line, NullSelector, NullHost, NullPort)...)
+    }
+    return terminateMenu(ret)
+}
+
+/* Terminate menu with the last line, unless configured to omit it for
+ * clients that choke on it
+ */
+func terminateMenu(menu []byte) []byte {
+    if Config.OmitMenuLastLine {
+        return menu
+    }
+    return append(menu, LastLine...)
+}
+
+/* Terminate text file contents with the last line, if configured. Lines
+ * starting with a period are doubled so none can be mistaken for it, and
+ * it always starts on its own line
+ */
+func terminateText(contents []byte) []byte {
+    if !Config.TextLastLine {
+        return contents
+    }
+
+    ret := make([]byte, 0, len(contents)+len(DOSLineEnd)+len(LastLine))
+    lineStart := true
+    for _, b := range contents {
+        if lineStart && b == End[0] {
+            ret = append(ret, End[0])
+        }
+        ret = append(ret, b)
+        lineStart = b == '\n'
+    }
+
+    if !lineStart {
+        ret = append(ret, DOSLineEnd...)
+    }
+    return append(ret, LastLine...)
 }
 
 /* Build gopher compliant line with supplied information */
 func buildLine(t ItemType, name, selector, host string, port string) []byte {
+    return buildLineWidth(t, name, selector, host, port, Config.Current().PageWidth)
+}
+
+/* Build gopher compliant line, truncating name to supplied page width */
+func buildLineWidth(t ItemType, name, selector, host string, port string, pageWidth int) []byte {
     ret := string(t)
 
-    /* Add name, truncate name if too long */    
-    if len(name) > Config.PageWidth {
-        ret += name[:Config.PageWidth-5]+"...\t"
+    /* Add name, truncate name if too long (and page width fits the truncation) */
+    if len(name) > pageWidth && pageWidth >= MinPageWidth {
+        ret += name[:pageWidth-5]+"...\t"
     } else {
         ret += name+"\t"
     }
@@ -115,7 +168,27 @@ func buildLine(t ItemType, name, selector, host string, port string) []byte {
 
 /* Build gopher compliant info line */
 func buildInfoLine(content string) []byte {
-    return buildLine(TypeInfo, content, NullSelector, NullHost, NullPort)
+    return buildLine(TypeInfo, sanitizeInfoText(content), NullSelector, NullHost, NullPort)
+}
+
+/* Strip control characters from info line text, or replace each with the
+ * configured marker. Stray tabs, carriage returns or NULs could otherwise
+ * break the line or inject fake menu entries
+ */
+func sanitizeInfoText(text string) string {
+    if strings.IndexFunc(text, unicode.IsControl) < 0 {
+        return text
+    }
+
+    var ret strings.Builder
+    for _, r := range text {
+        if unicode.IsControl(r) {
+            ret.WriteString(Config.ControlCharMarker)
+        } else {
+            ret.WriteRune(r)
+        }
+    }
+    return ret.String()
 }
 
 /* Get item type for named file on disk */
@@ -141,6 +214,175 @@ func getItemType(name string) ItemType {
     }
 }
 
+/* Guess item type for file at path. Extension is checked first against
+ * user supplied mappings then the built-in FileExtMap, falling back to
+ * sniffing the first few bytes of the file's contents
+ */
+func guessItemType(filePath string) ItemType {
+    ext := strings.ToLower(path.Ext(filePath))
+    if itemType, ok := Config.ItemTypes.Get(ext); ok {
+        return itemType
+    } else if itemType, ok := FileExtMap[ext]; ok {
+        return itemType
+    }
+    return sniffItemType(filePath)
+}
+
+/* Detect item type from the first bytes of file contents */
+func sniffItemType(filePath string) ItemType {
+    fd, err := os.Open(filePath)
+    if err != nil {
+        return TypeDefault
+    }
+    defer fd.Close()
+
+    buf := make([]byte, ItemTypeSniffLen)
+    count, err := io.ReadFull(fd, buf)
+    if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+        return TypeDefault
+    }
+
+    /* Empty files may as well be text */
+    if count == 0 {
+        return TypeFile
+    }
+
+    contentType := http.DetectContentType(buf[:count])
+    switch {
+        case strings.HasPrefix(contentType, "text/html"):
+            return TypeHtml
+        case strings.HasPrefix(contentType, "text/xml"):
+            return TypeXml
+        case strings.HasPrefix(contentType, "text/"):
+            return TypeFile
+        case strings.HasPrefix(contentType, "image/"):
+            return TypeImage
+        case strings.HasPrefix(contentType, "audio/"):
+            return TypeAudio
+        case strings.HasPrefix(contentType, "video/"):
+            return TypeVideo
+        case contentType == "application/pdf":
+            return TypeDoc
+        case contentType == "application/zip", contentType == "application/x-gzip", contentType == "application/x-rar-compressed":
+            return TypeBinArchive
+        default:
+            return TypeBin
+    }
+}
+
+/* Check if item type is some form of text file */
+func isTextType(itemType ItemType) bool {
+    switch itemType {
+        case TypeFile, TypeMarkup, TypeHtml, TypeXml:
+            return true
+        default:
+            return false
+    }
+}
+
+/* ItemTypeMap:
+ * User supplied file extension to item type mappings,
+ * guarded so they can be swapped out on reload while
+ * handlers are still reading them.
+ */
+type ItemTypeMap struct {
+    Map   map[string]ItemType
+    Mutex sync.RWMutex
+}
+
+func (m *ItemTypeMap) Get(ext string) (ItemType, bool) {
+    if m == nil {
+        return TypeUnknown, false
+    }
+
+    m.Mutex.RLock()
+    defer m.Mutex.RUnlock()
+    itemType, ok := m.Map[ext]
+    return itemType, ok
+}
+
+func (m *ItemTypeMap) Set(itemTypes map[string]ItemType) {
+    m.Mutex.Lock()
+    m.Map = itemTypes
+    m.Mutex.Unlock()
+}
+
+/* Load item type mappings from file at path (if supplied), with any
+ * extra mappings taking precedence
+ */
+func loadItemTypes(filePath string, extra []string) (map[string]ItemType, error) {
+    lines := make([]string, 0)
+    if filePath != "" {
+        gophorErr := bufferedScan(filePath,
+            func(scanner *bufio.Scanner) bool {
+                line := strings.TrimSpace(scanner.Text())
+                if line != "" && !strings.HasPrefix(line, "#") {
+                    lines = append(lines, line)
+                }
+                return true
+            },
+        )
+        if gophorErr != nil {
+            return nil, gophorErr
+        }
+    }
+
+    return parseItemTypes(append(lines, extra...))
+}
+
+/* Parse 'ext=type' item type mappings, e.g. '.gmi=0' */
+func parseItemTypes(lines []string) (map[string]ItemType, error) {
+    itemTypes := make(map[string]ItemType)
+    for _, line := range lines {
+        split := strings.SplitN(line, "=", 2)
+        if len(split) != 2 || len(split[1]) != 1 || !strings.HasPrefix(split[0], ".") {
+            return nil, errors.New("invalid item type mapping: "+line)
+        }
+        itemTypes[strings.ToLower(split[0])] = ItemType(split[1][0])
+    }
+    return itemTypes, nil
+}
+
+/* Format byte count for display, e.g. '512 B' or '1.5 MB'. Tenths are
+ * truncated so a size never shows as 1024 of a smaller unit
+ */
+func formatFileSize(size int64) string {
+    if size < 1024 {
+        return strconv.FormatInt(size, 10)+" B"
+    }
+
+    unit := int64(1024)
+    suffixes := []string{ "KB", "MB", "GB", "TB" }
+    i := 0
+    for ; i < len(suffixes)-1 && size >= unit*1024; i += 1 {
+        unit *= 1024
+    }
+
+    return strconv.FormatInt(size/unit, 10)+"."+strconv.FormatInt(size%unit*10/unit, 10)+" "+suffixes[i]
+}
+
+/* Expand tabs in line to spaces, up to the next multiple of tab width (the
+ * default if below 1), so text keeps its layout without breaking gopher lines
+ */
+func expandTabs(line string, tabWidth int) string {
+    if !strings.Contains(line, "\t") {
+        return line
+    }
+    if tabWidth < 1 {
+        tabWidth = DefaultTabWidth
+    }
+
+    ret := make([]byte, 0, len(line))
+    for i := 0; i < len(line); i += 1 {
+        if line[i] == '\t' {
+            ret = append(ret, strings.Repeat(" ", tabWidth-len(ret)%tabWidth)...)
+        } else {
+            ret = append(ret, line[i])
+        }
+    }
+    return string(ret)
+}
+
 /* Build a line separator of supplied width */
 func buildLineSeparator(count int) string {
     ret := ""
@@ -150,20 +392,19 @@ func buildLineSeparator(count int) string {
     return ret
 }
 
-/* Formats an info-text footer from string. Add last line as we use the footer to contain last line (regardless if empty) */
-func formatGophermapFooter(text string, useSeparator bool) []byte {
+/* Formats an info-text footer from string. Add last line (if not omitted) as we use the footer to contain last line (regardless if empty) */
+func formatGophermapFooter(text string, useSeparator bool, pageWidth int) []byte {
     ret := make([]byte, 0)
     if text != "" {
         ret = append(ret, buildInfoLine("")...)
         if useSeparator {
-            ret = append(ret, buildInfoLine(buildLineSeparator(Config.PageWidth))...)
+            ret = append(ret, buildInfoLine(buildLineSeparator(pageWidth))...)
         }
         for _, line := range strings.Split(text, "\n") {
             ret = append(ret, buildInfoLine(line)...)
         }
     }
-    ret = append(ret, []byte(LastLine)...)
-    return ret
+    return terminateMenu(ret)
 }
 
 /* Parse line type from contents */
@@ -203,6 +444,12 @@ func parseLineType(line string) ItemType {
                 return TypeSubGophermap
             case TypeExec:
                 return TypeExec
+            case TypeDirective:
+                /* Only known directive names, else it's just text e.g. '%50 off' */
+                if isDirectiveLine(line) {
+                    return TypeDirective
+                }
+                return TypeInfoNotStated
             default:
                 return TypeInfoNotStated
         }
@@ -210,3 +457,18 @@ func parseLineType(line string) ItemType {
 
     return ItemType(line[0])
 }
+
+/* Check if '%' prefixed line names a recognized gophermap directive */
+func isDirectiveLine(line string) bool {
+    args := strings.Fields(line[1:])
+    if len(args) == 0 {
+        return false
+    }
+
+    switch args[0] {
+        case DirectiveSort, DirectiveDirsFirst, DirectiveRemote, DirectiveProxy, DirectiveWidth, DirectiveBeginInfo, DirectiveEndInfo, DirectiveEmbed, DirectiveRaw:
+            return true
+        default:
+            return false
+    }
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "errors"
+    "os"
+    "testing"
+)
+
+func TestParseLineTypeDirective(t *testing.T) {
+    tests := []struct {
+        Line string
+        Type ItemType
+    }{
+        { "%sort newest",       TypeDirective },
+        { "%dirs-first",        TypeDirective },
+        { "%remote host 70",    TypeDirective },
+        { "%50 off sale today", TypeInfoNotStated },
+    }
+
+    for _, test := range tests {
+        if lineType := parseLineType(test.Line); lineType != test.Type {
+            t.Errorf("parseLineType(%q) = %q, expected %q", test.Line, lineType, test.Type)
+        }
+    }
+}
+
+func TestGuessItemType(t *testing.T) {
+    setupTestConfig()
+    Config.ItemTypes = &ItemTypeMap{ Map: map[string]ItemType{ ".gmi": TypeFile, ".txt": TypeMarkup } }
+    dir := t.TempDir()
+
+    tests := []struct {
+        Name     string
+        Contents string
+        Type     ItemType
+    }{
+        { "page.html",  "",                             TypeHtml },
+        { "image.png",  "",                             TypeImage },
+        { "notes.gmi",  "\x00\x01",                     TypeFile },
+        { "notes.txt",  "",                             TypeMarkup },
+        { "README",     "plain old text\n",             TypeFile },
+        { "index",      "<!DOCTYPE html><html></html>", TypeHtml },
+        { "picture",    "\x89PNG\r\n\x1a\n\x00\x00",       TypeImage },
+        { "program",    "\x7fELF\x02\x01\x01\x00\x00",      TypeBin },
+        { "empty",      "",                             TypeFile },
+    }
+
+    for _, test := range tests {
+        filePath := writeTestFile(t, dir, test.Name, test.Contents)
+        if itemType := guessItemType(filePath); itemType != test.Type {
+            t.Errorf("guessItemType(%q) = %q, expected %q", test.Name, itemType, test.Type)
+        }
+    }
+}
+
+func TestParseItemTypes(t *testing.T) {
+    itemTypes, err := parseItemTypes([]string{ ".GMI=0", ".log=p" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if itemTypes[".gmi"] != TypeFile || itemTypes[".log"] != TypeMarkup {
+        t.Errorf("unexpected item types parsed: %v", itemTypes)
+    }
+
+    for _, bad := range []string{ "gmi=0", ".gmi=", ".gmi=01", ".gmi" } {
+        if _, err := parseItemTypes([]string{ bad }); err == nil {
+            t.Errorf("expected error parsing %q", bad)
+        }
+    }
+}
+
+func TestLoadItemTypes(t *testing.T) {
+    setupTestConfig()
+    filePath := writeTestFile(t, t.TempDir(), "itemtypes", "# comment\n.gmi=0\n\n.log=p\n")
+
+    /* Extra mappings take precedence over file */
+    itemTypes, err := loadItemTypes(filePath, []string{ ".log=0" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if itemTypes[".gmi"] != TypeFile || itemTypes[".log"] != TypeFile {
+        t.Errorf("unexpected item types loaded: %v", itemTypes)
+    }
+
+    /* Swapping mappings is picked up by detection */
+    Config.ItemTypes = &ItemTypeMap{}
+    Config.ItemTypes.Set(itemTypes)
+    if itemType := guessItemType("/notes.gmi"); itemType != TypeFile {
+        t.Errorf("expected loaded mapping used, got %q", itemType)
+    }
+
+    if _, err := loadItemTypes(filePath+".missing", nil); err == nil {
+        t.Error("expected error loading missing file")
+    }
+}
+
+func TestErrorResponse(t *testing.T) {
+    setupTestConfig()
+
+    expected := "3404 Not Found\t"+NullSelector+"\t"+NullHost+"\t"+NullPort+DOSLineEnd+LastLine
+    if response := string(generateGopherErrorResponse(ErrorResponse404)); response != expected {
+        t.Errorf("expected error resource %q, got %q", expected, response)
+    }
+
+    /* Template lines each become an error line */
+    Config.ErrorTemplate = "Oops: "+ReplaceStrError+"\nContact admin@example.org"
+    response := string(generateGopherErrorResponse(ErrorResponse403))
+    expected = string(buildLine(TypeError, "Oops: 403 Forbidden", NullSelector, NullHost, NullPort))+string(buildLine(TypeError, "Contact admin@example.org", NullSelector, NullHost, NullPort))+LastLine
+    if response != expected {
+        t.Errorf("expected templated error resource %q, got %q", expected, response)
+    }
+}
+
+func TestFormatFileSize(t *testing.T) {
+    tests := map[int64]string{
+        0:                  "0 B",
+        1023:               "1023 B",
+        1024:               "1.0 KB",
+        1536:               "1.5 KB",
+        1024*1024 - 1:      "1023.9 KB",
+        1024*1024:          "1.0 MB",
+        1024*1024*1024 - 1: "1023.9 MB",
+        1024*1024*1024:     "1.0 GB",
+        5*1024*1024*1024*1024*1024: "5120.0 TB",
+    }
+
+    for size, expected := range tests {
+        if formatted := formatFileSize(size); formatted != expected {
+            t.Errorf("formatFileSize(%d) = %q, expected %q", size, formatted, expected)
+        }
+    }
+}
+
+func TestGophorErrorUnwrap(t *testing.T) {
+    _, err := bufferedRead(t.TempDir()+"/missing")
+    if !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("expected cause of %v to be inspectable", err)
+    }
+    if reason := err.Reason(); reason != "not found" {
+        t.Errorf("expected reason 'not found', got %q", reason)
+    }
+    if reason := (&GophorError{ FileTypeErr, nil }).Reason(); reason != "invalid file type" {
+        t.Errorf("expected reason from error code without cause, got %q", reason)
+    }
+}
+
+func TestMenuLastLine(t *testing.T) {
+    setupTestConfig()
+
+    Config.OmitMenuLastLine = true
+    expected := string(buildLine(TypeError, "404 Not Found", NullSelector, NullHost, NullPort))
+    if response := string(generateGopherErrorResponse(ErrorResponse404)); response != expected {
+        t.Errorf("expected error resource without last line %q, got %q", expected, response)
+    }
+}
+
+func TestTextLastLine(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", ".hidden\nplain\n..dots\nno newline")
+
+    Config.TextLastLine = true
+    fc := &RegularFileContents{ dir+"/notes.txt", nil }
+    if gophorErr := fc.Load(); gophorErr != nil {
+        t.Fatalf("unexpected error loading text file: %s", gophorErr.Error())
+    }
+
+    expected := "..hidden\nplain\n...dots\nno newline"+DOSLineEnd+LastLine
+    if contents := string(fc.Render(nil)); contents != expected {
+        t.Errorf("expected terminated text %q, got %q", expected, contents)
+    }
+
+    /* Binary files are left alone */
+    writeTestFile(t, dir, "image.png", ".png")
+    fc = &RegularFileContents{ dir+"/image.png", nil }
+    fc.Load()
+    if contents := string(fc.Render(nil)); contents != ".png" {
+        t.Errorf("expected binary file as-is, got %q", contents)
+    }
+}
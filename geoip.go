@@ -0,0 +1,261 @@
+package main
+
+import (
+    "io"
+    "os"
+    "net"
+    "sort"
+    "bufio"
+    "bytes"
+    "errors"
+    "strings"
+    "path/filepath"
+    "encoding/csv"
+)
+
+/* Location logged for clients that can't be located */
+const UnknownLocation = "unknown"
+
+/* GeoRange:
+ * A range of IP addresses (inclusive, in 16 byte form)
+ * and the location they're found in.
+ */
+type GeoRange struct {
+    Start    net.IP
+    End      net.IP
+    Location string
+}
+
+/* GeoDatabase:
+ * Client IP to location lookups, from ranges sorted by
+ * start address so lookups are a binary search. Never
+ * changed once loaded, so safe for concurrent lookups.
+ */
+type GeoDatabase struct {
+    Ranges []*GeoRange
+}
+
+/* Get location of client IP, blank if lookups disabled (nil database) and
+ * unknown if not found
+ */
+func (db *GeoDatabase) Lookup(ip string) string {
+    if db == nil {
+        return ""
+    }
+
+    clientIP := net.ParseIP(ip).To16()
+    if clientIP == nil {
+        return UnknownLocation
+    }
+
+    /* Last range starting at or before the IP, if it reaches that far */
+    i := sort.Search(len(db.Ranges), func(i int) bool {
+        return bytes.Compare(db.Ranges[i].Start, clientIP) > 0
+    })
+    if i == 0 || bytes.Compare(db.Ranges[i-1].End, clientIP) < 0 {
+        return UnknownLocation
+    }
+    return db.Ranges[i-1].Location
+}
+
+/* Read database at path, either a directory of MaxMind GeoLite2 CSV files or
+ * a file of 'network,location' lines
+ */
+func loadGeoDatabase(dbPath string) (*GeoDatabase, *GophorError) {
+    stat, err := os.Stat(dbPath)
+    if err != nil {
+        return nil, &GophorError{ FileStatErr, err }
+    } else if stat.IsDir() {
+        return loadGeoLite2Database(dbPath)
+    }
+    return loadGeoNetworkFile(dbPath)
+}
+
+/* Read database of 'network,location' lines, e.g. '81.2.69.0/24,GB/England',
+ * with '#' comments. Networks are CIDRs or single IPs, and mustn't overlap.
+ * Invalid lines are logged and skipped
+ */
+func loadGeoNetworkFile(dbPath string) (*GeoDatabase, *GophorError) {
+    db := &GeoDatabase{ make([]*GeoRange, 0) }
+    lineNo := 0
+
+    gophorErr := bufferedScan(dbPath,
+        func(scanner *bufio.Scanner) bool {
+            lineNo += 1
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                return true
+            }
+
+            geoRange, err := parseGeoRange(line)
+            if err != nil {
+                Config.LogSystemError("Skipped invalid geolocation line %d in %s: %s\n", lineNo, dbPath, err.Error())
+            } else {
+                db.Ranges = append(db.Ranges, geoRange)
+            }
+            return true
+        },
+    )
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+
+    db.sortRanges(dbPath)
+    return db, nil
+}
+
+/* Sort ranges by start address for lookups, dropping any overlapping */
+func (db *GeoDatabase) sortRanges(dbPath string) {
+    sort.Slice(db.Ranges, func(i, j int) bool {
+        return bytes.Compare(db.Ranges[i].Start, db.Ranges[j].Start) < 0
+    })
+
+    /* Overlaps would make lookups ambiguous, keep the first of any */
+    ranges := db.Ranges[:0]
+    for _, geoRange := range db.Ranges {
+        if len(ranges) > 0 && bytes.Compare(ranges[len(ranges)-1].End, geoRange.Start) >= 0 {
+            Config.LogSystemError("Skipped overlapping geolocation network in %s: %s - %s\n", dbPath, geoRange.Start, geoRange.End)
+            continue
+        }
+        ranges = append(ranges, geoRange)
+    }
+    db.Ranges = ranges
+}
+
+/* Read MaxMind GeoLite2 (or GeoIP2) Country or City CSV database from the
+ * directory it's unzipped to, joining the IPv4 and IPv6 blocks files to the
+ * English locations file on geoname ID. Locations are logged as country ISO
+ * code, then for City databases subdivision and city name where known, e.g.
+ * 'GB/England/London'. Blocks only located by registered country fall back
+ * to that, others are skipped
+ */
+func loadGeoLite2Database(dir string) (*GeoDatabase, *GophorError) {
+    locationPaths, _ := filepath.Glob(filepath.Join(dir, "*-Locations-en.csv"))
+    blocksPaths, _ := filepath.Glob(filepath.Join(dir, "*-Blocks-IPv[46].csv"))
+    if len(locationPaths) != 1 || len(blocksPaths) == 0 {
+        return nil, &GophorError{ FileReadErr, errors.New("expected one *-Locations-en.csv and *-Blocks-IPv4.csv / *-Blocks-IPv6.csv files in "+dir) }
+    }
+
+    locations := make(map[string]string)
+    gophorErr := scanGeoLite2CSV(locationPaths[0], []string{ "geoname_id", "continent_code", "country_iso_code" }, func(get func(string) string) {
+        parts := []string{ get("country_iso_code") }
+        if parts[0] == "" {
+            parts[0] = get("continent_code")
+        }
+        for _, part := range []string{ get("subdivision_1_name"), get("city_name") } {
+            if part != "" {
+                parts = append(parts, part)
+            }
+        }
+        locations[get("geoname_id")] = strings.Join(parts, "/")
+    })
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+
+    db := &GeoDatabase{ make([]*GeoRange, 0) }
+    for _, blocksPath := range blocksPaths {
+        gophorErr := scanGeoLite2CSV(blocksPath, []string{ "network", "geoname_id", "registered_country_geoname_id" }, func(get func(string) string) {
+            location, ok := locations[get("geoname_id")]
+            if !ok {
+                location, ok = locations[get("registered_country_geoname_id")]
+            }
+            if !ok {
+                return
+            }
+
+            geoRange, err := parseGeoRange(get("network")+","+location)
+            if err != nil {
+                Config.LogSystemError("Skipped invalid geolocation block in %s: %s\n", blocksPath, err.Error())
+                return
+            }
+            db.Ranges = append(db.Ranges, geoRange)
+        })
+        if gophorErr != nil {
+            return nil, gophorErr
+        }
+    }
+
+    db.sortRanges(dir)
+    return db, nil
+}
+
+/* Scan CSV file at path with a header row naming its columns, which must
+ * include required, passing each row to iterator as a lookup of values by
+ * column name (blank if no such column). Streamed, as City blocks files run
+ * to hundreds of megabytes
+ */
+func scanGeoLite2CSV(csvPath string, required []string, iterator func(get func(string) string)) *GophorError {
+    fd, err := os.Open(csvPath)
+    if err != nil {
+        return &GophorError{ FileOpenErr, err }
+    }
+    defer fd.Close()
+
+    reader := csv.NewReader(bufio.NewReader(fd))
+    reader.ReuseRecord = true
+    header, err := reader.Read()
+    if err != nil {
+        return &GophorError{ FileReadErr, err }
+    }
+
+    columns := make(map[string]int)
+    for i, name := range header {
+        columns[strings.TrimPrefix(name, "\ufeff")] = i
+    }
+    for _, name := range required {
+        if _, ok := columns[name]; !ok {
+            return &GophorError{ FileReadErr, errors.New("missing column "+name+" in "+csvPath) }
+        }
+    }
+
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            return &GophorError{ FileReadErr, err }
+        }
+
+        iterator(func(name string) string {
+            i, ok := columns[name]
+            if !ok || i >= len(record) {
+                return ""
+            }
+            return record[i]
+        })
+    }
+}
+
+/* Parse 'network,location' line into the range of addresses it covers */
+func parseGeoRange(line string) (*GeoRange, error) {
+    split := strings.SplitN(line, ",", 2)
+    if len(split) != 2 || strings.TrimSpace(split[1]) == "" {
+        return nil, errors.New("expected network,location: "+line)
+    }
+
+    network, err := parseNetwork(strings.TrimSpace(split[0]))
+    if err != nil {
+        return nil, err
+    }
+
+    start := network.IP.Mask(network.Mask)
+    end := make(net.IP, len(start))
+    for i := range start {
+        end[i] = start[i] | ^network.Mask[i]
+    }
+    return &GeoRange{ start.To16(), end.To16(), strings.TrimSpace(split[1]) }, nil
+}
+
+/* Setup client geolocation from database at path, failing open to logging
+ * every client as unknown if it can't be read
+ */
+func setupGeoDatabase(dbPath string) *GeoDatabase {
+    db, gophorErr := loadGeoDatabase(dbPath)
+    if gophorErr != nil {
+        Config.LogSystemError("Error loading geolocation database %s, clients logged as %s: %s\n", dbPath, UnknownLocation, gophorErr.Error())
+        return &GeoDatabase{ make([]*GeoRange, 0) }
+    }
+    Config.LogSystem("Loaded geolocation database %s with %d networks\n", dbPath, len(db.Ranges))
+    return db
+}
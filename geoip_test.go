@@ -0,0 +1,80 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestGeoDatabaseLookup(t *testing.T) {
+    setupTestConfig()
+    dbPath := writeTestFile(t, t.TempDir(), "geo.csv", "# network,location\n81.2.69.0/24,GB/England\n10.0.0.0/8,Private\n10.1.0.0/16,Overlap\n2001:db8::/32,Documentation\n192.0.2.7,Single\nnot-a-network,Nowhere\n")
+
+    db, gophorErr := loadGeoDatabase(dbPath)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    tests := map[string]string{
+        "81.2.69.142":   "GB/England",
+        "81.2.70.1":     UnknownLocation,
+        "10.1.2.3":      "Private",
+        "10.255.255.255": "Private",
+        "2001:db8::1":   "Documentation",
+        "192.0.2.7":     "Single",
+        "192.0.2.8":     UnknownLocation,
+        "1.1.1.1":       UnknownLocation,
+        "garbage":       UnknownLocation,
+    }
+    for ip, expected := range tests {
+        if location := db.Lookup(ip); location != expected {
+            t.Errorf("expected %s located in %q, got %q", ip, expected, location)
+        }
+    }
+
+    /* Disabled logs nothing, missing database fails open */
+    if location := (*GeoDatabase)(nil).Lookup("81.2.69.142"); location != "" {
+        t.Errorf("expected no location when disabled, got %q", location)
+    }
+    if location := setupGeoDatabase(dbPath+".missing").Lookup("81.2.69.142"); location != UnknownLocation {
+        t.Errorf("expected unknown location with missing database, got %q", location)
+    }
+}
+
+func TestGeoLite2Database(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "GeoLite2-City-Locations-en.csv", "geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone,is_in_european_union\n"+
+        "2643743,en,EU,Europe,GB,\"United Kingdom\",ENG,England,,,London,,Europe/London,0\n"+
+        "2635167,en,EU,Europe,GB,\"United Kingdom\",,,,,,,Europe/London,0\n"+
+        "6255148,en,EU,Europe,,,,,,,,,,0\n")
+    writeTestFile(t, dir, "GeoLite2-City-Blocks-IPv4.csv", "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius\n"+
+        "81.2.69.0/24,2643743,2635167,,0,0,EC1A,51.5,-0.09,5\n"+
+        "81.2.70.0/24,,2635167,,0,0,,,,100\n"+
+        "81.2.71.0/24,,,,1,0,,,,\n"+
+        "5.0.0.0/8,6255148,6255148,,0,0,,,,\n")
+    writeTestFile(t, dir, "GeoLite2-City-Blocks-IPv6.csv", "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius\n"+
+        "2a02:c7f::/32,2643743,2635167,,0,0,,,,\n")
+
+    db, gophorErr := loadGeoDatabase(dir)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    tests := map[string]string{
+        "81.2.69.142": "GB/England/London",
+        "81.2.70.1":   "GB",
+        "81.2.71.1":   UnknownLocation,
+        "5.1.2.3":     "EU",
+        "2a02:c7f::1": "GB/England/London",
+        "1.1.1.1":     UnknownLocation,
+    }
+    for ip, expected := range tests {
+        if location := db.Lookup(ip); location != expected {
+            t.Errorf("expected %s located in %q, got %q", ip, expected, location)
+        }
+    }
+
+    /* Directory without the expected files can't be read */
+    if _, gophorErr := loadGeoDatabase(t.TempDir()); gophorErr == nil {
+        t.Error("expected error loading directory without GeoLite2 files")
+    }
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+    "os"
+    "bytes"
+    "mime"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/* Gopher+ date format, within '<>' after the human readable date */
+const GopherPlusDateFormat = "20060102150405"
+
+/* Get Gopher+ marker following the selector, or the query for searches.
+ * Blank for plain gopher requests. A lone marker after the selector is only
+ * taken as one if exactly '+', '!' or '$', so searches aren't mistaken for them
+ */
+func readGopherPlus(data []byte) string {
+    line := string(data)
+    if i := strings.Index(line, DOSLineEnd); i >= 0 {
+        line = line[:i]
+    }
+
+    fields := strings.Split(line, Tab)
+    switch {
+        case len(fields) >= 3:
+            return fields[2]
+        case len(fields) == 2 && (fields[1] == GopherPlusItem || fields[1] == GopherPlusAttributes || fields[1] == GopherPlusDirectory):
+            return fields[1]
+        default:
+            return ""
+    }
+}
+
+/* Check if marker is a Gopher+ one. The '!' attribute marker gets the
+ * item's attributes, as does the '+' item marker for anything but menus
+ * (serving items with Gopher+ headers isn't supported)
+ */
+func isGopherPlusRequest(marker string) bool {
+    return isGopherPlusItem(marker) || strings.HasPrefix(marker, GopherPlusAttributes) || isGopherPlusDirectory(marker)
+}
+
+/* Check if Gopher+ marker requests the item itself, for menus the menu with
+ * each line flagged as having attributes
+ */
+func isGopherPlusItem(marker string) bool {
+    return strings.HasPrefix(marker, GopherPlusItem)
+}
+
+/* Check if Gopher+ marker requests attributes of everything in a directory */
+func isGopherPlusDirectory(marker string) bool {
+    return strings.HasPrefix(marker, GopherPlusDirectory)
+}
+
+/* Render Gopher+ attribute block of item at path, with +INFO, +ADMIN and
+ * +VIEWS attributes from the file's stat and config. Sent after a header
+ * saying it ends with the usual last line
+ */
+func renderGopherPlusAttributes(host *ConnHost, requestPath string) ([]byte, *GophorError) {
+    stat, err := os.Stat(requestPath)
+    if err != nil {
+        return nil, &GophorError{ FileStatErr, err }
+    }
+    return append([]byte(GopherPlusHeaderEnd), append(buildGopherPlusAttributes(host, requestPath, stat), LastLine...)...), nil
+}
+
+/* Render Gopher+ attribute blocks of each item in directory at path, in
+ * name order, leaving out files hidden by '-' lines in its gophermap, its
+ * ignore file and restricted files. Anything but a directory gets its own
+ * attribute block
+ */
+func renderGopherPlusDirectory(host *ConnHost, requestPath string) ([]byte, *GophorError) {
+    stat, err := os.Stat(requestPath)
+    if err != nil {
+        return nil, &GophorError{ FileStatErr, err }
+    } else if !stat.IsDir() {
+        return renderGopherPlusAttributes(host, requestPath)
+    }
+
+    gophermapPath, _ := findGophermap(requestPath)
+    listing, gophorErr := listDir(&FileSystemRequest{ requestPath, host, "", nil, GopherPlusDirectory }, readGophermapHidden(gophermapPath), DefaultDirSort)
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+    return append([]byte(GopherPlusHeaderEnd), append(listing, LastLine...)...), nil
+}
+
+/* Render menu for Gopher+ request, as served to plain gopher clients but
+ * with generated listing lines flagged as having attributes. The header
+ * says it ends with the connection, as the last line may be omitted
+ */
+func renderGopherPlusMenu(request *FileSystemRequest) ([]byte, *GophorError) {
+    menu, gophorErr := Config.FileSystem.HandleRequest(request)
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+    return append([]byte(GopherPlusHeaderClose), menu...), nil
+}
+
+/* Flag menu line as a Gopher+ item with attributes available, by a '+'
+ * field following the port
+ */
+func flagGopherPlusLine(line []byte) []byte {
+    line = bytes.TrimSuffix(line, []byte(DOSLineEnd))
+    return append(append(line, Tab+GopherPlusItem...), DOSLineEnd...)
+}
+
+/* Build Gopher+ attribute block of item at path from its stat */
+func buildGopherPlusAttributes(host *ConnHost, requestPath string, stat os.FileInfo) []byte {
+    itemType := TypeDirectory
+    if !stat.IsDir() {
+        itemType = guessItemType(requestPath)
+    }
+
+    name := path.Base(requestPath)
+    if requestPath == host.PathFor("/") {
+        name = host.Name
+    }
+
+    text := "+INFO: "+string(itemType)+name+Tab+host.SelectorFor(requestPath)+Tab+host.Name+Tab+host.Port+Tab+GopherPlusItem+DOSLineEnd
+    text += "+ADMIN:"+DOSLineEnd
+    if Config.AdminEmail != "" {
+        text += " Admin: <"+Config.AdminEmail+">"+DOSLineEnd
+    }
+    text += " Mod-Date: "+stat.ModTime().Format(time.RFC1123)+" <"+stat.ModTime().Format(GopherPlusDateFormat)+">"+DOSLineEnd
+    text += "+VIEWS:"+DOSLineEnd
+    if stat.IsDir() {
+        text += " application/gopher-menu:"+DOSLineEnd
+    } else {
+        text += " "+gopherPlusMimeType(itemType, requestPath)+": <"+formatGopherPlusSize(stat.Size())+">"+DOSLineEnd
+    }
+    return []byte(text)
+}
+
+/* Get MIME type of file at path for Gopher+ views, by extension then item type */
+func gopherPlusMimeType(itemType ItemType, filePath string) string {
+    if mimeType := mime.TypeByExtension(path.Ext(filePath)); mimeType != "" {
+        return strings.SplitN(mimeType, ";", 2)[0]
+    }
+
+    switch {
+        case itemType == TypeDirectory:
+            return "application/gopher-menu"
+        case isTextType(itemType):
+            return "text/plain"
+        default:
+            return "application/octet-stream"
+    }
+}
+
+/* Format size for Gopher+ views, in kilobytes rounded up */
+func formatGopherPlusSize(size int64) string {
+    return strconv.FormatInt((size+1023)/1024, 10)+"k"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestReadGopherPlus(t *testing.T) {
+    tests := []struct {
+        Request string
+        Marker  string
+    }{
+        { "/file.txt\r\n",             "" },
+        { "/file.txt\t+\r\n",          "+" },
+        { "/file.txt\t!\r\n",          "!" },
+        { "/search\tterms\r\n",        "" },
+        { "/search\t+terms\r\n",       "" },
+        { "/search\tterms\t!\r\n",     "!" },
+        { "/file.txt\t\t+text/plain",  "+text/plain" },
+    }
+
+    for _, test := range tests {
+        if marker := readGopherPlus([]byte(test.Request)); marker != test.Marker {
+            t.Errorf("expected %q to have Gopher+ marker %q, got %q", test.Request, test.Marker, marker)
+        }
+    }
+}
+
+func TestGopherPlusAttributes(t *testing.T) {
+    setupTestConfig()
+    Config.AdminEmail = "admin@example.com"
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "notes.txt", strings.Repeat("x", 1500))
+    modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+    os.Chtimes(filePath, modTime, modTime)
+
+    expected := GopherPlusHeaderEnd+
+        "+INFO: 0notes.txt\t"+filePath+"\tlocalhost\t70\t+\r\n"+
+        "+ADMIN:\r\n"+
+        " Admin: <admin@example.com>\r\n"+
+        " Mod-Date: "+modTime.Local().Format(time.RFC1123)+" <"+modTime.Local().Format(GopherPlusDateFormat)+">\r\n"+
+        "+VIEWS:\r\n"+
+        " text/plain: <2k>\r\n"+
+        LastLine
+    for _, marker := range []string{ GopherPlusItem, GopherPlusAttributes } {
+        if response, _ := respondTestRequest(filePath+Tab+marker); response != expected {
+            t.Errorf("expected attributes for %q request %q, got %q", marker, expected, response)
+        }
+    }
+
+    /* Plain requests still get the contents */
+    if response, _ := respondTestRequest(filePath); response != strings.Repeat("x", 1500) {
+        t.Errorf("expected contents for plain request, got %q", response)
+    }
+
+    /* Directories are menus, without a size */
+    response, _ := respondTestRequest(dir+Tab+GopherPlusAttributes)
+    if !strings.HasPrefix(response, GopherPlusHeaderEnd+"+INFO: 1") || !strings.Contains(response, "+VIEWS:\r\n application/gopher-menu:\r\n") {
+        t.Errorf("unexpected directory attributes %q", response)
+    }
+
+    if _, gophorErr := respondTestRequest(dir+"/missing.txt"+Tab+GopherPlusItem); gophorErr == nil || gophorErr.Code != FileStatErr {
+        t.Errorf("expected stat error for missing item, got %v", gophorErr)
+    }
+}
+
+func TestGopherPlusDirectory(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "gophermap", "-secret.txt\n*\n")
+    writeTestFile(t, dir, "a.txt", "aaa")
+    writeTestFile(t, dir, "secret.txt", "shh")
+    os.Mkdir(dir+"/sub", 0755)
+
+    /* Plain listing is unchanged, without Gopher+ flags */
+    response, _ := respondTestRequest(dir)
+    if strings.Contains(response, "\t+\r\n") {
+        t.Errorf("expected plain listing without Gopher+ flags, got %q", response)
+    }
+
+    /* Each entry's attributes from the stat it was listed with, hidden
+     * files still hidden and no '..' entry
+     */
+    response, gophorErr := respondTestRequest(dir+Tab+GopherPlusDirectory)
+    if gophorErr != nil {
+        t.Fatalf("unexpected error: %s", gophorErr.Error())
+    }
+
+    stat, _ := os.Stat(dir+"/a.txt")
+    expected := GopherPlusHeaderEnd+
+        string(buildGopherPlusAttributes(testHost, dir+"/a.txt", stat))+
+        "+INFO: 0gophermap"
+    if !strings.HasPrefix(response, expected) {
+        t.Errorf("expected listing to start %q, got %q", expected, response)
+    }
+    if strings.Count(response, "+INFO: ") != 3 || !strings.Contains(response, "+INFO: 1sub\t"+dir+"/sub\tlocalhost\t70\t+\r\n") {
+        t.Errorf("expected attributes of a.txt, gophermap and sub, got %q", response)
+    }
+    if strings.Contains(response, "secret.txt") || strings.Contains(response, "+INFO: 1..") {
+        t.Errorf("expected hidden and '..' entries left out, got %q", response)
+    }
+    if !strings.HasSuffix(response, LastLine) {
+        t.Errorf("expected listing to end with last line, got %q", response)
+    }
+}
+
+func TestGopherPlusMenu(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "a.txt", "aaa")
+    writeTestFile(t, dir, "listed/b.txt", "bbb")
+    writeTestFile(t, dir, "listed/"+GophermapFileStr, "Hand written\n*\n")
+
+    /* Generated listing lines flagged as having attributes, '..' too */
+    response, gophorErr := respondTestRequest(dir+Tab+GopherPlusItem)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    entries := []string{
+        string(flagGopherPlusLine(buildLine(TypeDirectory, "..", path.Dir(dir), "localhost", "70"))),
+        string(flagGopherPlusLine(buildLine(TypeFile, "a.txt", dir+"/a.txt", "localhost", "70"))),
+        string(flagGopherPlusLine(buildLine(TypeDirectory, "listed", dir+"/listed", "localhost", "70"))),
+    }
+    if !strings.HasPrefix(response, GopherPlusHeaderClose) || !strings.Contains(response, strings.Join(entries, "")) {
+        t.Errorf("expected flagged listing lines %q, got %q", entries, response)
+    }
+
+    /* Gophermap lines as written, its listing flagged */
+    response, _ = respondTestRequest(dir+"/listed"+Tab+GopherPlusItem)
+    listed := string(flagGopherPlusLine(buildLine(TypeFile, "b.txt", dir+"/listed/b.txt", "localhost", "70")))
+    if !strings.Contains(response, "iHand written\t") || !strings.Contains(response, listed) {
+        t.Errorf("expected gophermap with flagged listing line %q, got %q", listed, response)
+    }
+
+    /* Plain requests unflagged */
+    if response, _ = respondTestRequest(dir+"/listed"); strings.Contains(response, Tab+GopherPlusItem+DOSLineEnd) {
+        t.Errorf("expected plain menu without Gopher+ flags, got %q", response)
+    }
+}
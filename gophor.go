@@ -2,11 +2,18 @@ package main
 
 import (
     "os"
+    "crypto/tls"
     "os/user"
+    "path"
+    "path/filepath"
     "strconv"
+    "strings"
     "syscall"
     "os/signal"
     "flag"
+    "log"
+    "sync"
+    "sync/atomic"
     "time"
 )
 
@@ -25,6 +32,7 @@ import (
  
 /*
 #include <unistd.h>
+#include <grp.h>
 */
 import "C"
 
@@ -36,88 +44,550 @@ func main() {
     /* Setup the entire server, getting slice of listeners in return */
     listeners := setupServer()
 
-    /* Handle signals so we can _actually_ shutdowm */
-    signals := make(chan os.Signal)
-    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    /* Handle signals so we can _actually_ shutdowm, or reload. Buffered with
+     * room for one of each, as signals arriving while we're busy reloading
+     * are otherwise dropped (and shutdown with them)
+     */
+    handledSignals := []os.Signal{ syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1 }
+    signals := make(chan os.Signal, len(handledSignals))
+    signal.Notify(signals, handledSignals...)
 
     /* Start accepting connections on any supplied listeners */
     for _, l := range listeners {
-        go func() {
-            Config.LogSystem("Listening on: gopher://%s\n", l.Addr())
+        go func(l *GophorListener) {
+            Config.LogSystem("Listening on: %s://%s\n", l.Scheme, l.Addr())
 
             for {
                 newConn, err := l.Accept()
                 if err != nil {
+                    /* Listener closed for shutdown, stop accepting */
+                    if atomic.LoadInt32(&shuttingDown) == 1 {
+                        return
+                    }
                     Config.LogSystemError("Error accepting connection: %s\n", err.Error())
                     continue
                 }
 
-                /* Run this in it's own goroutine so we can go straight back to accepting */
+                /* At connection limit, wait briefly for a slot else turn them away */
+                if !acquireConnSlot(Config.MaxConnectionsWait) {
+                    rejectBusyConn(newConn)
+                    continue
+                }
+
+                /* Run this in it's own goroutine so we can go straight back to accepting,
+                 * tracking it so shutdown can wait for it to finish
+                 */
+                activeConns.Add(1)
+                atomic.AddInt32(&activeCount, 1)
                 go func() {
+                    defer func() {
+                        atomic.AddInt32(&activeCount, -1)
+                        releaseConnSlot()
+                        activeConns.Done()
+                    }()
                     NewWorker(newConn).Serve()
                 }()
             }
-        }()
+        }(l)
     }
 
-    /* When OS signal received, we close-up */
-    sig := <-signals
-    Config.LogSystem("Signal received: %v. Shutting down...\n", sig)
-    os.Exit(0)
+    /* When OS signal received, we reload or close-up */
+    for {
+        sig := <-signals
+        if sig == syscall.SIGHUP {
+            Config.LogSystem("Signal received: %v. Reloading...\n", sig)
+            reloadServer()
+            continue
+        }
+        if sig == syscall.SIGUSR1 {
+            toggleMaintenance()
+            continue
+        }
+
+        Config.LogSystem("Signal received: %v. Shutting down...\n", sig)
+        shutdownServer(listeners, Config.ShutdownGrace)
+        os.Exit(0)
+    }
+}
+
+/* In-flight connection tracking for graceful shutdown */
+var (
+    activeConns  sync.WaitGroup
+    activeCount  int32
+    shuttingDown int32
+)
+
+/* Stop accepting connections, then wait up to grace period for those in-flight
+ * to finish. Anything left is forcibly closed when we exit
+ */
+func shutdownServer(listeners []*GophorListener, grace time.Duration) {
+    atomic.StoreInt32(&shuttingDown, 1)
+    for _, l := range listeners {
+        l.Listener.Close()
+    }
+
+    /* Let the file monitor finish any sweep in progress */
+    stopFileMonitor()
+
+    active := atomic.LoadInt32(&activeCount)
+    done := make(chan struct{})
+    go func() {
+        activeConns.Wait()
+        close(done)
+    }()
+
+    select {
+        case <-done:
+        case <-time.After(grace):
+    }
+
+    forced := atomic.LoadInt32(&activeCount)
+    Config.LogSystem("Drained %d connections, forcibly closing %d\n", active-forced, forced)
+
+    if Config.RequestLogger != nil {
+        Config.RequestLogger.Flush()
+    }
+}
+
+/* Reload anything that can safely change while running */
+func reloadServer() {
+    /* Flush and reopen log files, e.g. after external logrotate */
+    if Config.RequestLogger != nil {
+        Config.RequestLogger.Flush()
+    }
+    reopenLogFiles()
+
+    /* Config file settings safe to change at runtime */
+    reloadConfigFile(flag.CommandLine)
+
+    /* Item type mappings. After chroot the mappings file path is looked up
+     * under the server root, on failure keep using what we have
+     */
+    itemTypeMap, err := loadItemTypes(Config.ItemTypesFile, Config.ItemTypesExtra)
+    if err != nil {
+        Config.LogSystemError("Error reloading item types, keeping current: %s\n", err.Error())
+    } else {
+        Config.ItemTypes.Set(itemTypeMap)
+        Config.LogSystem("Reloaded item types\n")
+    }
+
+    /* Contacts may have changed, regenerate phonebook */
+    cachePhonebookFiles()
 }
 
 func setupServer() []*GophorListener {
     /* First we setup all the flags and parse them... */
 
+    var err error
+
     /* Base server settings */
     serverRoot        := flag.String("root", "/var/gopher", "Change server root directory.")
-    serverHostname    := flag.String("hostname", "127.0.0.1", "Change server hostname (FQDN).")
+    serverHostname    := flag.String("hostname", "127.0.0.1", "Change server hostname (FQDN) advertised in generated selector lines, independent of bind address.")
     serverPort        := flag.Int("port", 70, "Change server port (0 to disable unencrypted traffic).")
-    serverBindAddr    := flag.String("bind-addr", "127.0.0.1", "Change server socket bind address")
+    advertisedPort    := flag.Int("advertised-port", 0, "Change port advertised in generated selector lines, e.g. when behind a port-forward (0 for same as -port).")
+    serverBindAddr    := flag.String("bind-addr", "127.0.0.1", "New-line separated list of server socket bind addresses, IPv4 or IPv6 (e.g. '0.0.0.0' and '::').")
+    reusePort         := flag.Bool("reuse-port", false, "Enable SO_REUSEPORT on listening sockets, so multiple server processes can share ports (where supported).")
+    shutdownGrace     := flag.String("shutdown-grace", "30s", "Change how long in-flight connections are given to finish on shutdown.")
     execAs            := flag.String("user", "", "Drop to supplied user's UID and GID permissions before execution.")
 
+    /* Connection settings */
+    readTimeout       := flag.String("read-timeout", "5s", "Change client connection read timeout.")
+    writeTimeout      := flag.String("write-timeout", "5m", "Change client connection write timeout, for each chunk of a response sent.")
+    maxSelectorLen    := flag.Int("max-selector-length", DefaultMaxSelectorLength, "Change maximum request line length (selector and any query) in bytes, longer requests are rejected.")
+    rateLimit         := flag.Float64("rate-limit", 0, "Change per-client request rate limit, in requests per second (0 to disable).")
+    rateBurst         := flag.Int("rate-burst", 10, "Change per-client request burst size allowed by rate limiter.")
+    maxConns          := flag.Int("max-connections", 0, "Change maximum concurrent client connections, beyond which clients are told the server is busy (0 for unlimited).")
+    maxConnsWait      := flag.String("max-connections-wait", "0s", "Change how long a new connection waits for a free slot when at the connection limit.")
+
+    /* TLS settings */
+    tlsPort           := flag.Int("tls-port", 0, "Change server TLS listening port (0 to disable TLS, e.g. 105).")
+    tlsCert           := flag.String("tls-cert", "", "New-line separated list of TLS certificate paths (multiple supported via SNI).")
+    tlsKey            := flag.String("tls-key", "", "New-line separated list of TLS key paths, in same order as certificates.")
+    tlsClientCA       := flag.String("tls-client-ca", "", "Require TLS clients present a certificate signed by CA at supplied path.")
+    tlsClientACL      := flag.String("tls-client-acl", "", "New-line separated list of selector prefixes mapped to comma separated allowed client certificate subjects, e.g. '/private=alice,bob'.")
+    networkAllow      := flag.String("allow-networks", "", "New-line separated list of selector prefixes mapped to comma separated client networks allowed access, e.g. '/private=192.168.1.0/24'.")
+    networkDeny       := flag.String("deny-networks", "", "New-line separated list of selector prefixes mapped to comma separated client networks denied access, taking precedence over allowed networks.")
+
     /* User supplied caps.txt information */
     serverDescription := flag.String("description", "Gophor: a Gopher server in GoLang", "Change server description in generated caps.txt.")
     serverAdmin       := flag.String("admin-email", "", "Change admin email in generated caps.txt.")
     serverGeoloc      := flag.String("geoloc", "", "Change server gelocation string in generated caps.txt.")
 
-    /* Content settings */
-    footerText        := flag.String("footer", "", "Change gophermap footer text (Unix new-line separated lines).")
-    footerSeparator   := flag.Bool("no-footer-separator", false, "Disable footer line separator.")
-
-    pageWidth         := flag.Int("page-width", 80, "Change page width used when formatting output.")
+    /* User supplied robots.txt information */
+    robotsAllow       := flag.String("robots-allow", "", "New-line separated list of paths allowed to crawlers in generated robots.txt.")
+    robotsDisallow    := flag.String("robots-disallow", "", "New-line separated list of paths disallowed to crawlers in generated robots.txt (no allow or disallow rules disallows everything).")
+    robotsCrawlDelay  := flag.Int("robots-crawl-delay", 0, "Change crawl delay in generated robots.txt (0 to omit).")
+
+    /* User supplied security.txt information */
+    securityEncryption := flag.String("security-encryption", "", "Change encryption key URL in generated security.txt.")
+    securityPolicy    := flag.String("security-policy", "", "Change security policy URL in generated security.txt.")
+    securityExpiry    := flag.String("security-expiry", "8760h", "Change how far in the future generated security.txt expires.")
+
+    /* User supplied humans.txt information */
+    humansCredits     := flag.String("humans-credits", "", "Change credits in generated humans.txt (Unix new-line separated lines).")
+
+    /* Server status page */
+    statusEnabled     := flag.Bool("enable-status", false, "Enable generated status.txt showing uptime, request counts, cache and runtime stats.")
+
+    /* Generated sitemap */
+    sitemapEnabled    := flag.Bool("enable-sitemap", false, "Enable generated sitemap.txt listing every selector anyone may access.")
+    sitemapInterval   := flag.String("sitemap-interval", "1h", "Change how long generated sitemap.txt is cached before walking the tree again.")
+
+    /* Generated CSO phonebook */
+    phonebookContacts := flag.String("phonebook-contacts", "", "Change contacts file (path within server root) queried by generated type 2 phonebook served as 'phonebook' (blank disables).")
+    phonebookFields   := flag.String("phonebook-fields", "name\nemail", "New-line separated list of contact fields searched by phonebook queries.")
+
+    /* Content settings, the first few read by name as they may change on reload */
+    flag.String("footer", "", "Change gophermap footer text (Unix new-line separated lines).")
+    flag.Bool("no-footer-separator", false, "Disable footer line separator.")
+
+    gophermapNames    := flag.String("gophermap-names", GophermapFileStr, "New-line separated list of gophermap file names, tried in order when serving a directory (e.g. 'gophermap' and '.gophermap').")
+    headerMap         := flag.String("header-map", "", "Change gophermap (path within server root) rendered at the top of every gophermap.")
+    footerMap         := flag.String("footer-map", "", "Change gophermap (path within server root) rendered at the bottom of every gophermap, before footer text.")
+    maintenanceMap    := flag.String("maintenance-map", "", "Change gophermap (path within server root) served for every selector in maintenance mode (blank for a built-in notice).")
+    maintenance       := flag.Bool("maintenance", false, "Enable maintenance mode from startup, toggled by SIGUSR1.")
+    flag.Int("page-width", 80, "Change page width used when formatting output.")
+    gophermapVars     := flag.String("gophermap-vars", "", "New-line separated list of variables substituted for '${NAME}' in gophermap lines, either 'NAME' taken from the environment or 'NAME=value'.")
+    gophermapVarsEmpty := flag.Bool("gophermap-vars-unknown-empty", false, "Enable removing '${NAME}' placeholders for variables not in -gophermap-vars, instead of leaving them as-is.")
+    showComments      := flag.Bool("show-comments", false, "Enable showing gophermap comment lines as informational text prefixed '# ', for debugging rendering.")
+    controlCharMarker := flag.String("control-char-marker", "", "Change marker replacing control characters in informational text, e.g. '?' (blank strips them).")
+    maxLineLength     := flag.Int("max-line-length", 1048576, "Change maximum length (in bytes) of a line read from gophermaps and other scanned files, text included into gophermaps is reflowed in chunks of this length.")
+    tabWidth          := flag.Int("tab-width", DefaultTabWidth, "Change tab stop width tabs in text included into gophermaps are expanded to.")
+    wrapMarker        := flag.String("wrap-marker", "", "Change marker appended to included text lines cut short by reflowing at page width, e.g. '\\' (blank for none).")
+    listFullPaths     := flag.Bool("list-full-paths", false, "Display full paths from server root in directory listings, instead of file names.")
+    listingTemplate   := flag.String("listing-template", "", "Change display text of directory listing entries, '{name}' replaced by the file name, '{size}' by its size, '{date}' by its modification date and '{abstract}' by the first line of its abstract file (blank for just the name).")
+    listingDateFormat := flag.String("listing-date-format", "2006-01-02", "Change Go time layout of '{date}' in directory listing template.")
+    omitMenuLastLine  := flag.Bool("omit-menu-last-line", false, "Omit the '.' line terminating menus, for clients and proxies that choke on it.")
+    textLastLine      := flag.Bool("text-last-line", false, "Enable terminating text files with a '.' line, doubling any leading periods in their lines (streamed files are sent as-is).")
+    itemTypes         := flag.String("item-types", "", "New-line separated list of file extensions mapped to item types, overriding built-in detection, e.g. '.gmi=0'.")
+    itemTypesFile     := flag.String("item-types-file", "", "Change file of new-line separated extension to item type mappings, reloaded on SIGHUP (entries in -item-types take precedence).")
+    renderMarkdown    := flag.Bool("render-markdown", false, "Enable serving Markdown documents ('.md' and '.markdown') rendered as menus, with links listed as menu entries.")
+    textEncodings     := flag.String("text-encodings", "", "New-line separated list of file extensions or directories mapped to the source encoding of text files, converted to UTF-8 when served, e.g. '.txt=latin1' or '/legacy=windows-1252'. Only iso-8859-1 (latin1) and windows-1252 (cp1252) are supported, multi-byte encodings such as Shift-JIS are not.")
+    virtualHosts      := flag.String("vhosts", "", "New-line separated list of virtual hostnames (and optionally port) mapped to their own root within server root, e.g. 'example.org=/example' or 'example.org:7070=/example'.")
+    rewrites          := flag.String("rewrites", "", "New-line separated list of old selectors mapped to new, e.g. '/old=/new'. Old selectors ending '/*' match as a prefix, new selectors starting '>' are redirected to with a menu instead of served in place.")
+    mergedMaps        := flag.String("merge-maps", "", "New-line separated list of virtual selectors mapped to comma separated gophermaps merged into one menu, e.g. 'selector=map1,map2'.")
+    errorTemplate     := flag.String("error-template", ReplaceStrError, "Change error response text (Unix new-line separated lines), '$error' replaced by the error description, e.g. to add contact details.")
+    urlRedirectOff    := flag.Bool("disable-url-redirect", false, "Disable serving HTML redirect pages for 'URL:' selectors.")
+    urlRedirectTmpl   := flag.String("url-redirect-template", "", "Change file used as HTML redirect page template, '$url' replaced by the escaped URL (blank uses built-in).")
     restrictedFiles   := flag.String("restrict-files", "", "New-line separated list of regex statements restricting files from showing in directory listings.")
 
+    /* Remote gopher settings */
+    remoteEnabled     := flag.Bool("enable-remote", false, "Enable gophermap directives fetching content from remote gopher servers.")
+    remoteRewrite     := flag.Bool("remote-rewrite", false, "Rewrite remote listing entries to point at the remote host and port dialled.")
+    remoteTTL         := flag.String("remote-ttl", "1m", "Change how long fetched remote listings are kept before fetching again.")
+
+    /* Search settings */
+    searchSelector    := flag.String("search-selector", "", "Change selector serving type 7 full-text search (blank disables search).")
+    searchRoot        := flag.String("search-root", "/", "Change directory searched by full-text search.")
+    searchCase        := flag.Bool("search-case-sensitive", false, "Enable case-sensitive full-text search.")
+
+    /* Changelog settings */
+    changelogSelector := flag.String("changelog-selector", "", "Change selector serving generated recent changes menu (blank disables changelog).")
+    changelogDays     := flag.Int("changelog-days", 7, "Change number of days of changes listed in generated changelog.")
+    changelogDepth    := flag.Int("changelog-depth", 8, "Change maximum directory depth walked for generated changelog.")
+    changelogTTL      := flag.String("changelog-ttl", "10m", "Change how long generated changelog is cached before regenerating.")
+
+    /* Metrics settings */
+    metricsSelector   := flag.String("metrics-selector", "", "Change selector serving Prometheus text format metrics (blank disables metrics).")
+    slowRequest       := flag.String("slow-request", "0s", "Change how long handling a request may take before a warning is logged (0 to disable).")
+
     /* Logging settings */
-    systemLogPath     := flag.String("system-log", "", "Change server system log file (blank outputs to stderr).")
-    accessLogPath     := flag.String("access-log", "", "Change server access log file (blank outputs to stderr).")
+    systemLogPath     := flag.String("system-log", "", "Change server system log target -- stdout, stderr or a file path (blank outputs to stderr).")
+    accessLogPath     := flag.String("access-log", "", "Change server access log target -- stdout, stderr or a file path (blank outputs to stderr).")
+    logMaxSize        := flag.Float64("log-max-size", 0, "Change size at which log files are rotated (in megabytes, 0 disables rotation).")
+    logKeep           := flag.Int("log-keep", 5, "Change number of rotated log files kept.")
     logType           := flag.Int("log-type", 0, "Change server log file handling -- 0:default 1:disable")
+    geoipDatabase     := flag.String("geoip-db", "", "Enable logging client locations in structured access log lines, looked up in supplied database, either a directory of unzipped MaxMind GeoLite2 Country or City CSV files or a file of 'network,location' lines (clients not found, or all if unreadable, logged as unknown).")
+    requestLogFormat  := flag.String("request-log-format", "", "Enable structured per-request access log lines in supplied format -- text or json (blank disables).")
 
     /* Cache settings */
     cacheCheckFreq    := flag.String("cache-check", "60s", "Change file cache freshness check frequency.")
+    cacheCheckBudget  := flag.Int("cache-check-budget", 0, "Enable adaptive cache freshness check frequency, limiting sweeps to supplied file stats per second (0 for fixed frequency).")
+    cacheStatWorkers  := flag.Int("cache-check-workers", 1, "Change number of parallel file stats during cache freshness check.")
+    cacheStatTimeout  := flag.String("cache-check-timeout", "0s", "Change timeout for each file stat during cache freshness check, files timing out are kept fresh (0 to disable).")
+    cacheRefresh      := flag.Bool("cache-refresh-background", false, "Enable reloading changed files during cache freshness check, serving old contents meanwhile, instead of on next request.")
     cacheSize         := flag.Int("cache-size", 50, "Change file cache size, measured in file count.")
+    cachePolicy       := flag.String("cache-policy", "lru", "Change file cache eviction policy -- lru (longest cached) or lfu (least frequently requested).")
+    cacheShards       := flag.Int("cache-shards", CacheShardCount, "Change number of file cache shards, each with their own lock (1 for a single shared lock).")
     cacheFileSizeMax  := flag.Float64("cache-file-max", 0.5, "Change maximum file size to be cached (in megabytes).")
-    cacheDisabled     := flag.Bool("disable-cache", false, "Disable file caching.")
+    streamFileMin     := flag.Float64("stream-file-min", 1, "Change size above which regular files are streamed from disk instead of read into memory, never cached (in megabytes, 0 to disable).")
+    followSymlinks    := flag.Bool("follow-symlinks", false, "Enable following symlinks in directory listings and requests, so long as they resolve within the server root.")
+    cacheDisabled     := flag.Bool("disable-cache", false, "Disable file caching, loading every file afresh on each request (for development only).")
+    cacheWarmup       := flag.Bool("cache-warmup", false, "Enable preloading gophermaps and files into the file cache on startup.")
+    cacheWarmupPaths  := flag.String("cache-warmup-paths", "/", "New-line separated list of paths within server root walked for cache warmup.")
+    missingCacheSize  := flag.Int("missing-cache-size", 1024, "Change number of recently requested missing paths remembered, skipping the filesystem (0 to disable).")
+    missingCacheTTL   := flag.String("missing-cache-ttl", "2s", "Change how long a missing path is remembered before checking the filesystem again.")
+
+    /* Compression settings */
+    gzipDisabled      := flag.Bool("disable-gzip", false, "Disable serving gzip compressed regular files on request for '.gz' suffixed selectors.")
+    gzipMinSize       := flag.Int64("gzip-min-size", 4096, "Change minimum file size to be served gzip compressed (in bytes).")
+
+    /* Config file */
+    configPath        := flag.String("config", "", "Change config file of flag=value lines, safe to change options reloaded on SIGHUP (command line flags take precedence).")
 
     /* Version string */
     version           := flag.Bool("version", false, "Print version information.")
 
+    /* Check mode */
+    checkMaps         := flag.Bool("check", false, "Check gophermaps within server root for problems (bad includes, cycles, malformed lines), printing any found, then exit without serving. Exits non-zero if there were problems.")
+
+    /* Preview mode */
+    previewMap        := flag.String("preview", "", "Print gophermap at supplied path (within server root) rendered exactly as served, then exit without serving.")
+    previewSections   := flag.Bool("preview-sections", false, "Mark each section of previewed gophermap with its type and size.")
+
     /* Parse parse parse!! */
     flag.Parse()
     if *version {
         printVersionExit()
     }
 
+    /* Apply config file if supplied, before anything reads the flags */
+    var configFile *ConfigFile
+    if *configPath != "" {
+        var values map[string]string
+        configFile, err = OpenConfigFile(*configPath, flag.CommandLine)
+        if err == nil {
+            values, err = configFile.Read()
+        }
+        if err == nil {
+            err = configFile.Apply(values, flag.CommandLine, false)
+        }
+        if err != nil {
+            log.Fatalf("Failed to load config file: %s\n", err.Error())
+        }
+    }
+
     /* Setup the server configuration instance and enter as much as we can right now */
     Config = new(ServerConfig)
+    Config.ConfigFile  = configFile
     Config.RootDir     = *serverRoot
-    Config.PageWidth   = *pageWidth
+    Config.ListFullPaths = *listFullPaths
+    Config.ListingTemplate = *listingTemplate
+    Config.ListingDateFormat = *listingDateFormat
+    Config.OmitMenuLastLine = *omitMenuLastLine
+    Config.TextLastLine = *textLastLine
+
+    /* Policy file settings */
+    Config.Description      = *serverDescription
+    Config.AdminEmail       = *serverAdmin
+    Config.Geolocation      = *serverGeoloc
+    Config.TLSPort          = *tlsPort
+    Config.RobotsAllow      = splitNonEmpty(*robotsAllow, "\n")
+    Config.RobotsDisallow   = splitNonEmpty(*robotsDisallow, "\n")
+    Config.RobotsCrawlDelay = *robotsCrawlDelay
+    Config.SecurityEncryption = *securityEncryption
+    Config.SecurityPolicy   = *securityPolicy
+    Config.HumansCredits    = *humansCredits
+    Config.StatusEnabled    = *statusEnabled
+
+    /* Parse sitemap regeneration interval if enabled */
+    if *sitemapEnabled {
+        Config.SitemapInterval, err = time.ParseDuration(*sitemapInterval)
+        if err != nil || Config.SitemapInterval <= 0 {
+            Config.LogSystemFatal("Error parsing supplied sitemap interval %s: %v\n", *sitemapInterval, err)
+        }
+    }
 
-    /* Have to be set AFTER page width variable set */
-    Config.FooterText  = formatGophermapFooter(*footerText, !*footerSeparator)
+    /* Phonebook contacts are read once chroot'd, so resolve within server root */
+    if *phonebookContacts != "" {
+        Config.PhonebookContacts = path.Join("/", *phonebookContacts)
+    }
+    Config.PhonebookFields, err = parsePhonebookFields(*phonebookFields)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied phonebook fields: %s\n", err.Error())
+    }
+
+    /* Remote gopher settings */
+    Config.RemoteEnabled = *remoteEnabled
+    Config.RemoteRewrite = *remoteRewrite
+
+    /* Search settings, selectors sanitized the same as requests */
+    if *searchSelector != "" {
+        Config.SearchSelector = sanitizePath(*searchSelector)
+    }
+    Config.SearchRoot          = sanitizePath(*searchRoot)
+    Config.SearchCaseSensitive = *searchCase
 
     /* Setup Gophor logging system */
-    Config.SystemLogger, Config.AccessLogger = setupLogging(*logType, *systemLogPath, *accessLogPath)
+    Config.SystemLogger, Config.AccessLogger = setupLogging(*logType, *systemLogPath, *accessLogPath, int64(*logMaxSize * BytesInMegaByte), *logKeep)
+
+    /* Setup structured request logging, written alongside access log */
+    if *requestLogFormat != "" {
+        format, ok := parseRequestLogFormat(*requestLogFormat)
+        if !ok {
+            Config.LogSystemFatal("Unrecognized request log format: %s\n", *requestLogFormat)
+        }
+        Config.RequestLogger = NewRequestLogger(format, Config.AccessLogger.Writer())
+        startRequestLogFlusher(Config.RequestLogger, RequestLogFlushFreq)
+    }
+
+    /* Setup client geolocation for request logging (before chroot, database may be outside root) */
+    if *geoipDatabase != "" {
+        Config.GeoDatabase = setupGeoDatabase(*geoipDatabase)
+    }
+
+    /* Parse security.txt expiry */
+    Config.SecurityExpiry, err = time.ParseDuration(*securityExpiry)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied security.txt expiry %s: %s\n", *securityExpiry, err)
+    }
+
+    /* Parse remote listing TTL */
+    Config.RemoteTTL, err = time.ParseDuration(*remoteTTL)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied remote TTL %s: %s\n", *remoteTTL, err)
+    }
+
+    /* Setup settings that may change on reload (page width, footer,
+     * restricted files, hostname). Has to be AFTER logging setup
+     */
+    current, err := buildReloadableConfig(flag.CommandLine)
+    if err != nil {
+        Config.LogSystemFatal("Error setting up server config: %s\n", err.Error())
+    }
+    Config.SetCurrent(current)
+
+    /* Parse connection timeouts */
+    Config.ReadTimeout, err = time.ParseDuration(*readTimeout)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied read timeout %s: %s\n", *readTimeout, err)
+    } else if Config.ReadTimeout <= 0 {
+        Config.LogSystemFatal("Invalid read timeout, must be positive: %s\n", *readTimeout)
+    }
+    Config.WriteTimeout, err = time.ParseDuration(*writeTimeout)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied write timeout %s: %s\n", *writeTimeout, err)
+    } else if Config.WriteTimeout <= 0 {
+        Config.LogSystemFatal("Invalid write timeout, must be positive: %s\n", *writeTimeout)
+    }
+
+    /* Parse slow request warning threshold */
+    Config.SlowRequestThreshold, err = time.ParseDuration(*slowRequest)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied slow request threshold %s: %s\n", *slowRequest, err)
+    }
+
+    /* Bound request line length, so clients can't hold unbounded memory */
+    if *maxSelectorLen <= 0 {
+        Config.LogSystemFatal("Invalid max selector length: %d\n", *maxSelectorLen)
+    }
+    Config.MaxSelectorLength = *maxSelectorLen
+
+    /* Listening socket options, used when we start listening below */
+    Config.ReusePort = *reusePort
+
+    /* Parse shutdown grace period */
+    Config.ShutdownGrace, err = time.ParseDuration(*shutdownGrace)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied shutdown grace period %s: %s\n", *shutdownGrace, err)
+    }
+
+    /* Setup concurrent connection limit */
+    Config.MaxConnectionsWait, err = time.ParseDuration(*maxConnsWait)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied max connections wait %s: %s\n", *maxConnsWait, err)
+    }
+    setMaxConnections(*maxConns)
+    if *maxConns > 0 {
+        Config.LogSystem("Connection limit enabled with: max=%d wait=%s\n", *maxConns, Config.MaxConnectionsWait)
+    }
+
+    /* Load user supplied item type mappings (before chroot, file may be outside root) */
+    Config.ItemTypesFile  = *itemTypesFile
+    Config.ItemTypesExtra = splitNonEmpty(*itemTypes, "\n")
+
+    /* Rendered Markdown is listed as a menu, unless mapped otherwise */
+    if *renderMarkdown {
+        Config.ItemTypesExtra = append(enableMarkdownRendering(), Config.ItemTypesExtra...)
+        Config.LogSystem("Markdown rendering enabled\n")
+    }
+    itemTypeMap, err := loadItemTypes(Config.ItemTypesFile, Config.ItemTypesExtra)
+    if err != nil {
+        Config.LogSystemFatal("Error loading supplied item types: %s\n", err.Error())
+    }
+    Config.ItemTypes = &ItemTypeMap{ itemTypeMap, sync.RWMutex{} }
+
+    /* Parse text file source encodings */
+    Config.TextEncodings, err = parseTextEncodings(*textEncodings)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied text encodings: %s\n", err.Error())
+    }
+
+    Config.ErrorTemplate = *errorTemplate
+    Config.WrapMarker = *wrapMarker
+    Config.TabWidth = *tabWidth
+    Config.MaxLineLength = *maxLineLength
+    Config.ShowComments = *showComments
+
+    /* Parse allowed gophermap variables, reading any from environment */
+    Config.GophermapVars = parseGophermapVars(*gophermapVars)
+    Config.GophermapVarsUnknownEmpty = *gophermapVarsEmpty
+    Config.ControlCharMarker = *controlCharMarker
+    Config.GophermapNames = splitNonEmpty(*gophermapNames, "\n")
+
+    /* Header and footer gophermaps are read once chroot'd, so resolve
+     * within server root
+     */
+    if *headerMap != "" {
+        Config.HeaderMap = path.Join("/", *headerMap)
+    }
+    if *footerMap != "" {
+        Config.FooterMap = path.Join("/", *footerMap)
+    }
+    if *maintenanceMap != "" {
+        Config.MaintenanceMap = path.Join("/", *maintenanceMap)
+    }
+    setMaintenance(*maintenance)
+
+    /* Setup HTML redirects if enabled, loading template before chroot */
+    if !*urlRedirectOff {
+        if *urlRedirectTmpl != "" {
+            template, gophorErr := bufferedRead(*urlRedirectTmpl)
+            if gophorErr != nil {
+                Config.LogSystemFatal("Error reading URL redirect template %s: %s\n", *urlRedirectTmpl, gophorErr.Error())
+            }
+            Config.HtmlRedirectTemplate = string(template)
+        }
+        Config.HtmlRedirects = NewHtmlRedirectCache()
+    }
+
+    /* Parse TLS client certificate ACLs */
+    Config.ClientCertACL = parseSelectorListMap(*tlsClientACL, false)
+
+    /* Parse selector network access lists */
+    Config.NetworkAllow = parseSelectorNetworkMap(*networkAllow)
+    Config.NetworkDeny  = parseSelectorNetworkMap(*networkDeny)
+
+    /* Parse virtual hosts */
+    Config.VirtualHosts = parseVirtualHosts(*virtualHosts)
+
+    /* Parse selector rewrites */
+    Config.SelectorRewrites = parseSelectorRewrites(*rewrites)
+
+    /* Parse merged gophermaps */
+    Config.MergedMaps = parseSelectorListMap(*mergedMaps, true)
+
+    /* Setup changelog if requested */
+    if *changelogSelector != "" {
+        ttl, err := time.ParseDuration(*changelogTTL)
+        if err != nil {
+            Config.LogSystemFatal("Error parsing supplied changelog TTL %s: %s\n", *changelogTTL, err)
+        }
+        Config.Changelog = NewChangelog(sanitizePath(*changelogSelector), time.Duration(*changelogDays) * 24 * time.Hour, *changelogDepth, ttl)
+        Config.LogSystem("Changelog enabled at: %s\n", Config.Changelog.Selector)
+    }
+
+    /* Setup metrics if requested */
+    if *metricsSelector != "" {
+        Config.Metrics = NewMetrics(sanitizePath(*metricsSelector))
+        Config.LogSystem("Metrics enabled at: %s\n", Config.Metrics.Selector)
+    }
+
+    /* Setup rate limiter if requested */
+    if *rateLimit > 0 {
+        Config.RateLimiter = NewRateLimiter(*rateLimit, *rateBurst)
+        Config.LogSystem("Rate limiting enabled with: rate=%.2f/s burst=%d\n", *rateLimit, *rateBurst)
+    }
 
     /* Get UID + GID for requested user. Has to be done BEFORE chroot or it fails */
     var uid, gid int
@@ -140,45 +610,140 @@ func setupServer() []*GophorListener {
         gid, _ = strconv.Atoi(user.Gid)
     }
 
+    /* Load TLS certificates if requested. Has to be done BEFORE chroot */
+    var tlsConfig *tls.Config
+    if *tlsPort != 0 {
+        var err error
+        tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+        if err != nil {
+            Config.LogSystemFatal("Error loading TLS certificates: %s\n", err.Error())
+        }
+    }
+
+    /* Check advertised hostname leads here while we can still resolve it,
+     * the resolver's config is outside the chroot. Not when only checking
+     * or previewing gophermaps, nothing's served
+     */
+    if !*checkMaps && *previewMap == "" {
+        warnAdvertisedHostname(Config.Current().Hostname, splitNonEmpty(*serverBindAddr, "\n"))
+    }
+
     /* Enter server dir */
     enterServerDir(*serverRoot)
     Config.LogSystem("Entered server directory: %s\n", *serverRoot)
 
+    /* Use regex matching if restricted files supplied, or they may be on reload */
+    if *restrictedFiles != "" || Config.ConfigFile != nil {
+        /* Setup the listDir function to use regex matching */
+        listDir = _listDirRegexMatch
+    } else {
+        /* Setup the listDir function to skip regex matching */
+        listDir = _listDir
+    }
+
+    /* In check mode, check gophermaps as they'd be served then exit. Done
+     * without chroot, so it needs no privileges, resolving under server root
+     */
+    if *checkMaps {
+        setupUnchrootedFileSystem(*serverRoot, *followSymlinks)
+        os.Exit(runGophermapCheck(Config.FileSystem.Root))
+    }
+
+    /* In preview mode, render gophermap as it'd be served then exit. Done
+     * without chroot like check mode. Nothing cached, so there's no need for
+     * the file cache's goroutines
+     */
+    if *previewMap != "" {
+        setupUnchrootedFileSystem(*serverRoot, *followSymlinks)
+        Config.FileSystem.Init(1, 1, 0)
+        Config.FileSystem.NoCache = true
+
+        port := strconv.Itoa(*serverPort)
+        if *advertisedPort != 0 {
+            port = strconv.Itoa(*advertisedPort)
+        }
+        root := Config.FileSystem.Root
+        os.Exit(runGophermapPreview(Config.FileSystem.DiskPath(path.Join("/", *previewMap)), &ConnHost{ Config.Current().Hostname, port, root, "" }, *previewSections, os.Stdout))
+    }
+
     /* Try enter chroot if requested */
     chrootServerDir(*serverRoot)
     Config.LogSystem("Chroot success, new root: %s\n", *serverRoot)
 
-    /* Setup listeners */
+    /* Setup listeners on each bind address. Hostname advertised in listings is
+     * independent of these, and a failed bind is logged rather than fatal so long
+     * as we can listen somewhere
+     */
     listeners := make([]*GophorListener, 0)
+    for _, bindAddr := range splitNonEmpty(*serverBindAddr, "\n") {
+        /* If requested, setup unencrypted listener */
+        if *serverPort != 0 {
+            l, err := BeginGophorListen(bindAddr, *serverHostname, strconv.Itoa(*serverPort))
+            if err != nil {
+                Config.LogSystemError("Error setting up (unencrypted) listener on %s: %s\n", bindAddr, err.Error())
+            } else {
+                if *advertisedPort != 0 {
+                    l.AdvertisedPort = strconv.Itoa(*advertisedPort)
+                }
+                listeners = append(listeners, l)
+            }
+        }
 
-    /* If requested, setup unencrypted listener */
-    if *serverPort != 0 {
-        l, err := BeginGophorListen(*serverBindAddr, *serverHostname, strconv.Itoa(*serverPort))
-        if err != nil {
-            Config.LogSystemFatal("Error setting up (unencrypted) listener: %s\n", err.Error())
+        /* If requested, setup TLS listener */
+        if *tlsPort != 0 {
+            l, err := BeginGophorListenTLS(bindAddr, *serverHostname, strconv.Itoa(*tlsPort), tlsConfig)
+            if err != nil {
+                Config.LogSystemError("Error setting up TLS listener on %s: %s\n", bindAddr, err.Error())
+            } else {
+                listeners = append(listeners, l)
+            }
         }
-        listeners = append(listeners, l)
-    } else {
+
+        /* Setup unencrypted listeners for any virtual host ports not already listened on */
+        listening := map[string]bool{ strconv.Itoa(*serverPort): true, strconv.Itoa(*tlsPort): true }
+        for _, vhost := range Config.VirtualHosts {
+            if vhost.Port == "" || listening[vhost.Port] {
+                continue
+            }
+            listening[vhost.Port] = true
+
+            l, err := BeginGophorListen(bindAddr, vhost.Name, vhost.Port)
+            if err != nil {
+                Config.LogSystemError("Error setting up listener for virtual host %s on %s: %s\n", vhost.Name, bindAddr, err.Error())
+            } else {
+                listeners = append(listeners, l)
+            }
+        }
+    }
+
+    if len(listeners) == 0 {
         Config.LogSystemFatal("No valid port to listen on :(\n")
     }
 
-    /* Drop privileges to retrieved UID + GID */
+    /* Drop privileges to retrieved UID + GID, handing log files over first */
+    chownLogFiles(uid, gid)
     setPrivileges(uid, gid)
     Config.LogSystem("Successfully dropped privileges to UID:%d GID:%d\n", uid, gid)
 
-    /* Compile user restricted files regex if supplied */
-    if *restrictedFiles != "" {
-        Config.RestrictedFiles = compileUserRestrictedFilesRegex(*restrictedFiles)
-
-        /* Setup the listDir function to use regex matching */
-        listDir = _listDirRegexMatch
-    } else {
-        /* Setup the listDir function to skip regex matching */
-        listDir = _listDir
-    }
-
     /* Setup file cache */
     Config.FileSystem = new(FileSystem)
+    Config.FileSystem.GzipEnabled = !*gzipDisabled
+    Config.FileSystem.GzipMinSize = *gzipMinSize
+    Config.FileSystem.StreamFileMin = int64(BytesInMegaByte * *streamFileMin)
+    Config.FileSystem.FollowSymlinks = *followSymlinks
+    Config.FileSystem.Root = "/"
+
+    /* Setup missing path cache, unless caching disabled altogether */
+    missingTTL, err := time.ParseDuration(*missingCacheTTL)
+    if err != nil {
+        Config.LogSystemFatal("Error parsing supplied missing cache TTL %s: %s\n", *missingCacheTTL, err)
+    }
+    if !*cacheDisabled {
+        Config.FileSystem.Missing = NewNegativeCache(*missingCacheSize, missingTTL)
+    }
+    if Config.FileSystem.Missing != nil {
+        Config.LogSystem("Missing path caching enabled with: maxcount=%d ttl=%s\n", *missingCacheSize, missingTTL)
+    }
 
     if !*cacheDisabled {
         /* Parse suppled cache check frequency time */
@@ -187,25 +752,63 @@ func setupServer() []*GophorListener {
             Config.LogSystemFatal("Error parsing supplied cache check frequency %s: %s\n", *cacheCheckFreq, err)
         }
 
-        /* Init file cache */
-        Config.FileSystem.Init(*cacheSize, *cacheFileSizeMax)
-        Config.LogSystem("File caching enabled with: maxcount=%d maxsize=%.3fMB\n", *cacheSize, *cacheFileSizeMax)
+        /* Parse supplied cache check stat timeout */
+        Config.FileSystem.StatTimeout, err = time.ParseDuration(*cacheStatTimeout)
+        if err != nil {
+            Config.LogSystemFatal("Error parsing supplied cache check timeout %s: %s\n", *cacheStatTimeout, err)
+        }
+        Config.FileSystem.StatWorkers = *cacheStatWorkers
+        if Config.FileSystem.StatWorkers < 1 {
+            Config.FileSystem.StatWorkers = 1
+        }
+        Config.FileSystem.BackgroundRefresh = *cacheRefresh
+
+        /* Parse supplied cache eviction policy */
+        policy, ok := NewEvictionPolicy(*cachePolicy)
+        if !ok {
+            Config.LogSystemFatal("Unknown cache eviction policy: %s\n", *cachePolicy)
+        }
+        Config.FileSystem.CachePolicy = policy
+
+        /* Init file cache, caching included submaps too */
+        Config.FileSystem.Init(*cacheSize, *cacheShards, *cacheFileSizeMax)
+        Config.SubmapCache = NewSubmapCache()
+        Config.LogSystem("File caching enabled with: maxcount=%d shards=%d maxsize=%.3fMB policy=%s\n", *cacheSize, len(Config.FileSystem.CacheShards), *cacheFileSizeMax, *cachePolicy)
 
         /* Before file monitor or any kind of new goroutines started,
          * check if we need to cache generated policy files
          */
-        cachePolicyFiles(*serverDescription, *serverAdmin, *serverGeoloc)
+        cachePolicyFiles()
+
+        /* Preload cache, before freshness checker starts walking it */
+        if *cacheWarmup {
+            loaded := warmFileCache(splitNonEmpty(*cacheWarmupPaths, "\n"))
+            Config.LogSystem("File cache warmed with %d files\n", loaded)
+        }
 
         /* Start file cache freshness checker */
-        go startFileMonitor(fileMonitorSleepTime)
-        Config.LogSystem("File cache freshness monitor started with frequency: %s\n", fileMonitorSleepTime)
+        startFileMonitor(fileMonitorSleepTime, *cacheCheckBudget)
+        if *cacheCheckBudget > 0 {
+            Config.LogSystem("File cache freshness monitor started with minimum frequency: %s, stat budget: %d/s\n", fileMonitorSleepTime, *cacheCheckBudget)
+        } else {
+            Config.LogSystem("File cache freshness monitor started with frequency: %s\n", fileMonitorSleepTime)
+        }
     } else {
-        /* File caching disabled, init with zero max size so nothing gets cached */
-        Config.FileSystem.Init(2, 0)
-        Config.LogSystem("File caching disabled\n")
+        /* File caching disabled, every file loaded afresh on each request
+         * and missing paths not remembered, so edits show straight away.
+         * Policy files are kept separately so are unaffected
+         */
+        Config.FileSystem.Init(1, 1, 0)
+        Config.FileSystem.NoCache = true
+        Config.LogSystem("File caching disabled, for development only\n")
 
         /* Safe to cache policy files now */
-        cachePolicyFiles(*serverDescription, *serverAdmin, *serverGeoloc)
+        cachePolicyFiles()
+    }
+
+    /* Start rate limiter stale bucket cleanup */
+    if Config.RateLimiter != nil {
+        startRateLimiterCleanup(Config.RateLimiter, RateLimiterCleanupFreq)
     }
 
     /* Return the created listeners slice :) */
@@ -219,6 +822,32 @@ func enterServerDir(path string) {
     }
 }
 
+/* Setup file system for reading gophermaps without chroot, as when only
+ * checking or previewing them. Paths within the server root, from access controls and
+ * header / footer gophermaps to include targets, are resolved under it
+ */
+func setupUnchrootedFileSystem(serverRoot string, followSymlinks bool) {
+    root, err := filepath.Abs(serverRoot)
+    if err == nil {
+        root, err = filepath.EvalSymlinks(root)
+    }
+    if err != nil {
+        Config.LogSystemFatal("Error resolving server root %s: %s\n", serverRoot, err.Error())
+    }
+
+    Config.FileSystem = new(FileSystem)
+    Config.FileSystem.FollowSymlinks = followSymlinks
+    Config.FileSystem.Root = root
+
+    if Config.HeaderMap != "" {
+        Config.HeaderMap = Config.FileSystem.DiskPath(Config.HeaderMap)
+    }
+    if Config.FooterMap != "" {
+        Config.FooterMap = Config.FileSystem.DiskPath(Config.FooterMap)
+    }
+    rerootAccessControls(root)
+}
+
 func chrootServerDir(path string) {
     err := syscall.Chroot(path)
     if err != nil {
@@ -241,21 +870,98 @@ func setPrivileges(execUid, execGid int) {
     /* Get currently running user info */
     uid, gid := syscall.Getuid(), syscall.Getgid()
 
-    /* Set GID if necessary */
-    if gid != execUid {
+    /* Drop supplementary groups (e.g. root's), only possible while still root */
+    if uid == 0 {
+        /* C-bind setgroups */
+        result := C.setgroups(0, nil)
+        if result != 0 {
+            Config.LogSystemFatal("Failed dropping supplementary groups: %d\n", result)
+        }
+    }
+
+    /* Set GID if necessary. Has to be done BEFORE UID, else we no longer
+     * have permission to
+     */
+    if gid != execGid {
         /* C-bind setgid */
-        result := C.setgid(C.uint(execGid))
+        result := C.setgid(C.gid_t(execGid))
         if result != 0 {
             Config.LogSystemFatal("Failed setting GID %d: %d\n", execGid, result)
         }
     }
 
     /* Set UID if necessary */
-    if uid != execGid {
+    if uid != execUid {
         /* C-bind setuid */
-        result := C.setuid(C.uint(execUid))
+        result := C.setuid(C.uid_t(execUid))
         if result != 0 {
             Config.LogSystemFatal("Failed setting UID %d: %d\n", execUid, result)
         }
     }
+
+    /* Fail closed, never continue unless the drop definitely took */
+    verifyPrivileges(execUid, execGid)
+}
+
+/* Check real and effective IDs match those requested, and root can't be regained */
+func verifyPrivileges(execUid, execGid int) {
+    uid, euid := syscall.Getuid(), syscall.Geteuid()
+    gid, egid := syscall.Getgid(), syscall.Getegid()
+    if uid != execUid || euid != execUid || gid != execGid || egid != execGid {
+        Config.LogSystemFatal("Failed dropping privileges, running with UID:%d EUID:%d GID:%d EGID:%d\n", uid, euid, gid, egid)
+    }
+
+    if C.setuid(0) == 0 {
+        Config.LogSystemFatal("Regained root privileges after dropping them, refusing to continue\n")
+    }
+}
+
+func clampPageWidth(width int) int {
+    switch {
+        case width < MinPageWidth:
+            Config.LogSystemError("Page width %d too small, using: %d\n", width, MinPageWidth)
+            return MinPageWidth
+        case width > MaxPageWidth:
+            Config.LogSystemError("Page width %d too large, using: %d\n", width, MaxPageWidth)
+            return MaxPageWidth
+        default:
+            return width
+    }
+}
+
+/* Parse new-line separated 'selector=value1,value2' entries, sanitizing
+ * values as paths if requested
+ */
+func parseSelectorListMap(entries string, valuesArePaths bool) map[string][]string {
+    ret := make(map[string][]string)
+    for _, entry := range splitNonEmpty(entries, "\n") {
+        split := strings.SplitN(entry, "=", 2)
+        if len(split) != 2 {
+            Config.LogSystemFatal("Invalid selector entry: %s\n", entry)
+        }
+
+        values := splitNonEmpty(split[1], ",")
+        if len(values) == 0 {
+            Config.LogSystemFatal("No values supplied for selector entry: %s\n", split[0])
+        }
+        if valuesArePaths {
+            for i := range values {
+                values[i] = sanitizePath(values[i])
+            }
+        }
+
+        ret[sanitizePath(split[0])] = values
+    }
+    return ret
+}
+
+/* Split string by separator, skipping empty entries */
+func splitNonEmpty(str, sep string) []string {
+    ret := make([]string, 0)
+    for _, entry := range strings.Split(str, sep) {
+        if entry != "" {
+            ret = append(ret, entry)
+        }
+    }
+    return ret
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "os"
+    "log"
+    "io/ioutil"
+    "path"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+/* Reset global server config to sane defaults for testing */
+func setupTestConfig() {
+    Config = new(ServerConfig)
+    Config.SystemLogger = log.New(ioutil.Discard, "", 0)
+    Config.AccessLogger = Config.SystemLogger
+    Config.MaxSelectorLength = DefaultMaxSelectorLength
+    Config.ReadTimeout = 5*time.Second
+    Config.WriteTimeout = 5*time.Second
+    Config.SetCurrent(&ReloadableConfig{ "localhost", 80, formatGophermapFooter("", false, 80), nil })
+
+    Config.FileSystem = new(FileSystem)
+    Config.FileSystem.StatWorkers = 1
+    Config.FileSystem.Init(10, CacheShardCount, 1)
+
+    listDir = _listDir
+}
+
+/* Write file with contents under dir, creating parent directories */
+func writeTestFile(t testing.TB, dir, name, contents string) string {
+    filePath := path.Join(dir, name)
+    err := os.MkdirAll(path.Dir(filePath), 0755)
+    if err == nil {
+        err = ioutil.WriteFile(filePath, []byte(contents), 0644)
+    }
+    if err != nil {
+        t.Fatalf("failed to write test file %s: %s", filePath, err)
+    }
+    return filePath
+}
+
+/* ConnHost used for all test requests */
+var testHost = &ConnHost{ "localhost", "70", "", "" }
+
+func TestClampPageWidth(t *testing.T) {
+    setupTestConfig()
+
+    tests := []struct {
+        Width    int
+        Expected int
+    }{
+        { -5,               MinPageWidth },
+        { 0,                MinPageWidth },
+        { MinPageWidth-1,   MinPageWidth },
+        { MinPageWidth,     MinPageWidth },
+        { 80,               80 },
+        { MaxPageWidth,     MaxPageWidth },
+        { MaxPageWidth+1,   MaxPageWidth },
+    }
+
+    for _, test := range tests {
+        if width := clampPageWidth(test.Width); width != test.Expected {
+            t.Errorf("clampPageWidth(%d) = %d, expected %d", test.Width, width, test.Expected)
+        }
+    }
+}
+
+func TestShutdownServer(t *testing.T) {
+    setupTestConfig()
+    defer atomic.StoreInt32(&shuttingDown, 0)
+
+    /* Connection finishing shortly after shutdown starts is drained */
+    l, err := BeginGophorListen("127.0.0.1", "localhost", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    activeConns.Add(1)
+    atomic.AddInt32(&activeCount, 1)
+    go func() {
+        time.Sleep(10*time.Millisecond)
+        atomic.AddInt32(&activeCount, -1)
+        activeConns.Done()
+    }()
+
+    start := time.Now()
+    shutdownServer([]*GophorListener{ l }, 5*time.Second)
+    if time.Since(start) >= 5*time.Second {
+        t.Errorf("expected shutdown to return once connections drained")
+    }
+    if count := atomic.LoadInt32(&activeCount); count != 0 {
+        t.Errorf("expected no active connections after drain, got %d", count)
+    }
+
+    /* Listener should be closed */
+    if _, err := l.Listener.Accept(); err == nil {
+        t.Errorf("expected listener to be closed after shutdown")
+    }
+
+    /* Connection that never finishes is left after the grace period. This
+     * has to come last, waiting on the connections outlives shutdown
+     */
+    l, err = BeginGophorListen("127.0.0.1", "localhost", "0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    activeConns.Add(1)
+    atomic.AddInt32(&activeCount, 1)
+    defer func() {
+        atomic.AddInt32(&activeCount, -1)
+        activeConns.Done()
+    }()
+
+    start = time.Now()
+    shutdownServer([]*GophorListener{ l }, 50*time.Millisecond)
+    if time.Since(start) < 50*time.Millisecond {
+        t.Errorf("expected shutdown to wait out grace period for active connection")
+    }
+    if count := atomic.LoadInt32(&activeCount); count != 1 {
+        t.Errorf("expected 1 connection left to force close, got %d", count)
+    }
+}
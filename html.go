@@ -1,21 +1,81 @@
 package main
 
+import (
+    "html"
+    "strings"
+    "sync"
+)
+
+/* Default HTML redirect page template, '$url' is replaced by the escaped URL */
+const DefaultHtmlRedirectTemplate =
+    "<html>\n"+
+    "<head>\n"+
+    "<meta http-equiv=\"refresh\" content=\"1;URL="+ReplaceStrUrl+"\">"+
+    "</head>\n"+
+    "<body>\n"+
+    "You are following an external link to a web site.\n"+
+    "You will be automatically taken to the site shortly.\n"+
+    "If you do not get sent there, please click <A HREF=\""+ReplaceStrUrl+"\">here</A> to go to the web site.\n"+
+    "<p>\n"+
+    "The URL linked is <A HREF=\""+ReplaceStrUrl+"\">"+ReplaceStrUrl+"</A>\n"+
+    "<p>\n"+
+    "Thanks for using Gophor!\n"+
+    "</body>\n"+
+    "</html>\n"
+
 func generateHtmlRedirect(url string) []byte {
-    content :=
-        "<html>\n"+
-        "<head>\n"+
-        "<meta http-equiv=\"refresh\" content=\"1;URL="+url+"\">"+
-        "</head>\n"+
-        "<body>\n"+
-        "You are following an external link to a web site.\n"+
-        "You will be automatically taken to the site shortly.\n"+
-        "If you do not get sent there, please click <A HREF=\""+url+"\">here</A> to go to the web site.\n"+
-        "<p>\n"+
-        "The URL linked is <A HREF=\""+url+"\">"+url+"</A>\n"+
-        "<p>\n"+
-        "Thanks for using Gophor!\n"+
-        "</body>\n"+
-        "</html>\n"
-
-    return []byte(content)
+    template := Config.HtmlRedirectTemplate
+    if template == "" {
+        template = DefaultHtmlRedirectTemplate
+    }
+
+    /* Escape so the URL can't break out of attributes or inject markup */
+    return []byte(strings.Replace(template, ReplaceStrUrl, html.EscapeString(url), -1))
+}
+
+/* HtmlRedirectCache:
+ * Generated HTML redirect pages for 'URL:' selectors found
+ * in gophermaps, so the links we serve aren't regenerated on
+ * every request. Other requested URLs are generated on the
+ * fly but never cached, so clients can't grow the cache.
+ */
+type HtmlRedirectCache struct {
+    Pages map[string][]byte
+    Mutex sync.RWMutex
+}
+
+func NewHtmlRedirectCache() *HtmlRedirectCache {
+    return &HtmlRedirectCache{ Pages: make(map[string][]byte) }
+}
+
+/* Get redirect page for URL, from cache if there */
+func (c *HtmlRedirectCache) Get(url string) []byte {
+    c.Mutex.RLock()
+    page, ok := c.Pages[url]
+    c.Mutex.RUnlock()
+    if ok {
+        return page
+    }
+    return generateHtmlRedirect(url)
+}
+
+/* Generate and cache redirect page for URL, if not already */
+func (c *HtmlRedirectCache) Add(url string) {
+    c.Mutex.Lock()
+    if _, ok := c.Pages[url]; !ok {
+        c.Pages[url] = generateHtmlRedirect(url)
+    }
+    c.Mutex.Unlock()
+}
+
+/* Cache redirect page if gophermap line links to a 'URL:' selector */
+func cacheGophermapUrlRedirect(line string) {
+    if Config.HtmlRedirects == nil {
+        return
+    }
+
+    fields := strings.Split(line, Tab)
+    if len(fields) > 1 && strings.HasPrefix(fields[1], UrlSelectorPrefix) {
+        Config.HtmlRedirects.Add(strings.TrimPrefix(fields[1], UrlSelectorPrefix))
+    }
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestHtmlRedirectEscapesUrl(t *testing.T) {
+    setupTestConfig()
+
+    page := string(generateHtmlRedirect(`https://example.org/"><script>alert(1)</script>`))
+    if strings.Contains(page, "<script>") || strings.Contains(page, `/"`) {
+        t.Errorf("expected URL to be escaped, got:\n%s", page)
+    }
+    if !strings.Contains(page, "https://example.org/&#34;&gt;&lt;script&gt;") {
+        t.Errorf("expected escaped URL in page, got:\n%s", page)
+    }
+}
+
+func TestHtmlRedirectTemplate(t *testing.T) {
+    setupTestConfig()
+    Config.HtmlRedirectTemplate = "go to "+ReplaceStrUrl+" now"
+
+    if page := string(generateHtmlRedirect("https://example.org/?a=1&b=2")); page != "go to https://example.org/?a=1&amp;b=2 now" {
+        t.Errorf("unexpected templated redirect page: %q", page)
+    }
+}
+
+func TestHtmlRedirectCacheFromGophermap(t *testing.T) {
+    setupTestConfig()
+    Config.HtmlRedirects = NewHtmlRedirectCache()
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "hMy site\tURL:https://example.org\tlocalhost\t70\n")
+
+    if _, gophorErr := readGophermap(gophermapPath); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    /* Linked URLs are cached, anything else generated on the fly but not cached */
+    if _, ok := Config.HtmlRedirects.Pages["https://example.org"]; !ok {
+        t.Errorf("expected redirect page for gophermap link to be cached")
+    }
+    if page := Config.HtmlRedirects.Get("https://other.org"); !strings.Contains(string(page), "https://other.org") {
+        t.Errorf("expected redirect page generated for uncached URL")
+    }
+    if len(Config.HtmlRedirects.Pages) != 1 {
+        t.Errorf("expected only gophermap links cached, got %d pages", len(Config.HtmlRedirects.Pages))
+    }
+}
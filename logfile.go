@@ -0,0 +1,195 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "path"
+    "strconv"
+    "sync"
+    "syscall"
+)
+
+/* RotatingFile:
+ * Log file writer rotating by size, keeping a number of old
+ * files around as name.1, name.2 etc. The containing directory
+ * is opened up-front and all file operations are performed
+ * relative to it, so rotating and reopening (e.g. for external
+ * logrotate) still work once we've chroot'd into the server root.
+ * A new file is only swapped in once opened, so failing to rotate
+ * or reopen (e.g. after dropping privileges) never loses logs.
+ */
+type RotatingFile struct {
+    Dir     *os.File
+    Name    string
+    MaxSize int64
+    Keep    int
+
+    File    *os.File
+    Size    int64
+    Failed  bool
+    Mutex   sync.Mutex
+}
+
+/* Files that get reopened on SIGHUP */
+var rotatingFiles = make([]*RotatingFile, 0)
+
+func OpenRotatingFile(filePath string, maxSize int64, keep int) (*RotatingFile, error) {
+    dir, err := os.Open(path.Dir(filePath))
+    if err != nil {
+        return nil, err
+    }
+
+    f := &RotatingFile{ Dir: dir, Name: path.Base(filePath), MaxSize: maxSize, Keep: keep }
+    f.File, f.Size, err = f.open()
+    if err != nil {
+        dir.Close()
+        return nil, err
+    }
+
+    rotatingFiles = append(rotatingFiles, f)
+    return f, nil
+}
+
+/* Open (or create) the log file for appending, relative to directory,
+ * returning it with its current size. Left to the caller to swap in
+ */
+func (f *RotatingFile) open() (*os.File, int64, error) {
+    fd, err := syscall.Openat(int(f.Dir.Fd()), f.Name, syscall.O_APPEND|syscall.O_CREAT|syscall.O_WRONLY|syscall.O_CLOEXEC, 0600)
+    if err != nil {
+        return nil, 0, &os.PathError{ Op: "open", Path: f.Name, Err: err }
+    }
+    file := os.NewFile(uintptr(fd), f.Name)
+
+    stat, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return nil, 0, err
+    }
+
+    return file, stat.Size(), nil
+}
+
+/* Swap in newly opened file, closing the current one */
+func (f *RotatingFile) swap(file *os.File, size int64) {
+    f.File.Sync()
+    f.File.Close()
+    f.File = file
+    f.Size = size
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+    f.Mutex.Lock()
+    defer f.Mutex.Unlock()
+
+    /* Rotate first if this write would take us over max size. On failure
+     * keep writing to the current file rather than losing logs, reporting
+     * it on stderr (once, not every write) as the log is what's failing
+     */
+    if f.MaxSize > 0 && f.Size > 0 && f.Size+int64(len(b)) > f.MaxSize {
+        err := f.rotate()
+        if err != nil && !f.Failed {
+            fmt.Fprintf(os.Stderr, "Failed to rotate log file %s, still writing to it: %s\n", f.Name, err.Error())
+        }
+        f.Failed = err != nil
+    }
+
+    count, err := f.File.Write(b)
+    f.Size += int64(count)
+    return count, err
+}
+
+/* Shuffle old files along, dropping the oldest, then open a fresh file.
+ * The current file is only closed once its replacement is open, so if
+ * either moving it aside or opening the new one fails writes carry on
+ * to it (under whichever name it ended up)
+ */
+func (f *RotatingFile) rotate() error {
+    dirFd := int(f.Dir.Fd())
+
+    syscall.Unlinkat(dirFd, f.rotatedName(f.Keep))
+    for i := f.Keep-1; i >= 1; i -= 1 {
+        syscall.Renameat(dirFd, f.rotatedName(i), dirFd, f.rotatedName(i+1))
+    }
+
+    var err error
+    if f.Keep > 0 {
+        err = syscall.Renameat(dirFd, f.Name, dirFd, f.rotatedName(1))
+    } else {
+        err = syscall.Unlinkat(dirFd, f.Name)
+    }
+    if err != nil {
+        return &os.PathError{ Op: "rotate", Path: f.Name, Err: err }
+    }
+
+    file, size, err := f.open()
+    if err != nil {
+        return err
+    }
+    f.swap(file, size)
+    return nil
+}
+
+/* Name of nth rotated file, 0 being the current file */
+func (f *RotatingFile) rotatedName(n int) string {
+    if n == 0 {
+        return f.Name
+    }
+    return f.Name+"."+strconv.Itoa(n)
+}
+
+/* Reopen log file, picking up any external rotation. On failure the
+ * current file is kept open and written to
+ */
+func (f *RotatingFile) Reopen() error {
+    f.Mutex.Lock()
+    defer f.Mutex.Unlock()
+
+    file, size, err := f.open()
+    if err != nil {
+        return err
+    }
+    f.swap(file, size)
+    return nil
+}
+
+/* Change owner of log file and its rotated files, so they can still be
+ * reopened and rotated once privileges are dropped. Rotating also needs
+ * the containing directory to be writable by the user, left to the admin
+ */
+func (f *RotatingFile) Chown(uid, gid int) error {
+    f.Mutex.Lock()
+    defer f.Mutex.Unlock()
+
+    err := f.File.Chown(uid, gid)
+    if err != nil {
+        return err
+    }
+
+    for i := 1; i <= f.Keep; i += 1 {
+        err = syscall.Fchownat(int(f.Dir.Fd()), f.rotatedName(i), uid, gid, 0)
+        if err != nil && err != syscall.ENOENT {
+            return &os.PathError{ Op: "chown", Path: f.rotatedName(i), Err: err }
+        }
+    }
+    return nil
+}
+
+/* Change owner of all log files to user privileges are dropped to */
+func chownLogFiles(uid, gid int) {
+    for _, f := range rotatingFiles {
+        err := f.Chown(uid, gid)
+        if err != nil {
+            Config.LogSystemError("Failed to change owner of log file %s: %s\n", f.Name, err.Error())
+        }
+    }
+}
+
+/* Reopen all log files */
+func reopenLogFiles() {
+    for _, f := range rotatingFiles {
+        err := f.Reopen()
+        if err != nil {
+            Config.LogSystemError("Failed to reopen log file %s: %s\n", f.Name, err.Error())
+        }
+    }
+}
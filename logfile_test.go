@@ -0,0 +1,142 @@
+package main
+
+import (
+    "os"
+    "io/ioutil"
+    "path"
+    "strings"
+    "testing"
+)
+
+func TestRotatingFileRotation(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    logPath := path.Join(dir, "gophor.log")
+
+    f, err := OpenRotatingFile(logPath, 10, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    /* Each write fills the file, so each following write rotates */
+    for _, line := range []string{ "first....\n", "second...\n", "third....\n", "fourth...\n" } {
+        if _, err := f.Write([]byte(line)); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    expected := map[string]string{
+        "gophor.log":   "fourth...\n",
+        "gophor.log.1": "third....\n",
+        "gophor.log.2": "second...\n",
+    }
+    for name, contents := range expected {
+        b, err := ioutil.ReadFile(path.Join(dir, name))
+        if err != nil || string(b) != contents {
+            t.Errorf("expected %s to contain %q, got %q (%v)", name, contents, b, err)
+        }
+    }
+
+    /* Oldest beyond keep count is dropped */
+    if _, err := os.Stat(path.Join(dir, "gophor.log.3")); err == nil {
+        t.Error("expected no more than 2 rotated files kept")
+    }
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    logPath := path.Join(dir, "gophor.log")
+
+    f, err := OpenRotatingFile(logPath, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte("before\n"))
+
+    /* Simulate external logrotate moving the file away */
+    os.Rename(logPath, logPath+".old")
+    if err := f.Reopen(); err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte("after\n"))
+
+    b, _ := ioutil.ReadFile(logPath)
+    old, _ := ioutil.ReadFile(logPath+".old")
+    if string(b) != "after\n" || !strings.HasPrefix(string(old), "before") {
+        t.Errorf("expected writes to go to reopened file, got %q and %q", b, old)
+    }
+}
+
+func TestRotatingFileReopenFailure(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    logPath := path.Join(dir, "gophor.log")
+
+    f, err := OpenRotatingFile(logPath, 0, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    f.Write([]byte("before\n"))
+
+    /* Moved away with something that can't be opened left in its place */
+    os.Rename(logPath, logPath+".old")
+    os.Mkdir(logPath, 0755)
+    if err := f.Reopen(); err == nil {
+        t.Fatal("expected reopen to fail")
+    }
+
+    if _, err := f.Write([]byte("after\n")); err != nil {
+        t.Fatalf("expected writes to carry on after failed reopen, got %s", err)
+    }
+    old, _ := ioutil.ReadFile(logPath+".old")
+    if string(old) != "before\nafter\n" {
+        t.Errorf("expected writes to go to current file, got %q", old)
+    }
+}
+
+func TestRotatingFileRotateFailure(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    logPath := path.Join(dir, "gophor.log")
+
+    f, err := OpenRotatingFile(logPath, 10, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    /* Rotated name taken by a non-empty directory, so rotating can't
+     * move the current file aside
+     */
+    os.MkdirAll(path.Join(logPath+".1", "taken"), 0755)
+
+    for _, line := range []string{ "first....\n", "second...\n" } {
+        if _, err := f.Write([]byte(line)); err != nil {
+            t.Fatalf("expected writes to carry on after failed rotation, got %s", err)
+        }
+    }
+
+    b, _ := ioutil.ReadFile(logPath)
+    if string(b) != "first....\nsecond...\n" || !f.Failed {
+        t.Errorf("expected writes kept in current file after failed rotation, got %q", b)
+    }
+}
+
+func TestRotatingFileChown(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    logPath := path.Join(dir, "gophor.log")
+
+    f, err := OpenRotatingFile(logPath, 0, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ioutil.WriteFile(logPath+".1", []byte("old\n"), 0600)
+
+    /* Chowning to ourselves works whoever we're running as, missing
+     * rotated files are skipped
+     */
+    if err := f.Chown(os.Getuid(), os.Getgid()); err != nil {
+        t.Errorf("unexpected error changing owner: %s", err)
+    }
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+    "errors"
     "log"
     "os"
     "io"
     "io/ioutil"
+    "strconv"
 )
 
-func setupLogging(loggingType int, systemLogPath, accessLogPath string) (*log.Logger, *log.Logger) {
+/* Log targets opened at startup, kept so logging can be switched back on */
+var systemLogWriter, accessLogWriter io.Writer
+
+func setupLogging(loggingType int, systemLogPath, accessLogPath string, maxSize int64, keep int) (*log.Logger, *log.Logger) {
     /* Setup global logger */
     log.SetOutput(os.Stderr)
     log.SetFlags(0)
@@ -21,36 +26,27 @@ func setupLogging(loggingType int, systemLogPath, accessLogPath string) (*log.Lo
         case 0:
             /* Default */
 
-            /* Setup system logger to output to file, or stderr if none supplied */
-            var systemWriter io.Writer
-            if systemLogPath != "" {
-                fd, err := os.OpenFile(systemLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-                if err != nil {
-                    log.Fatalf("Failed to create system logger: %s\n", err.Error())
-                }
-                systemWriter = fd        
-            } else {
-                systemWriter = os.Stderr
+            /* Setup system logger to output to target */
+            systemWriter, err := openLogTarget(systemLogPath, maxSize, keep)
+            if err != nil {
+                log.Fatalf("Failed to create system logger: %s\n", err.Error())
             }
             systemLogger = log.New(systemWriter, "", log.LstdFlags)
+            systemLogWriter = systemWriter
 
             /* If both output to same, may as well use same logger for both */
             if useSame {
                 accessLogger = systemLogger
+                break
             }
 
-            /* Setup access logger to output to file, or stderr if none supplied */
-            var accessWriter io.Writer
-            if accessLogPath != "" {
-                fd, err := os.OpenFile(accessLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-                if err != nil {
-                    log.Fatalf("Failed to create access logger: %s\n", err.Error())
-                }
-                accessWriter = fd
-            } else {
-                accessWriter = os.Stderr
+            /* Setup access logger to output to target */
+            accessWriter, err := openLogTarget(accessLogPath, maxSize, keep)
+            if err != nil {
+                log.Fatalf("Failed to create access logger: %s\n", err.Error())
             }
             accessLogger = log.New(accessWriter, "", log.LstdFlags)
+            accessLogWriter = accessWriter
 
         case 1:
             /* Disable -- pipe logs to "discard". May as well use same for both */
@@ -64,6 +60,46 @@ func setupLogging(loggingType int, systemLogPath, accessLogPath string) (*log.Lo
     return systemLogger, accessLogger
 }
 
+/* Switch logging type at runtime. Going back to default only works if
+ * log targets were opened at startup, we can't open them after chroot
+ */
+func setLoggingType(loggingType int) error {
+    switch loggingType {
+        case 0:
+            if systemLogWriter == nil {
+                return errors.New("logging disabled at startup, requires restart")
+            }
+            Config.SystemLogger.SetOutput(systemLogWriter)
+            Config.SystemLogger.SetFlags(log.LstdFlags)
+            if accessLogWriter != nil {
+                Config.AccessLogger.SetOutput(accessLogWriter)
+                Config.AccessLogger.SetFlags(log.LstdFlags)
+            }
+
+        case 1:
+            Config.SystemLogger.SetOutput(ioutil.Discard)
+            Config.AccessLogger.SetOutput(ioutil.Discard)
+
+        default:
+            return errors.New("unrecognized logging type: "+strconv.Itoa(loggingType))
+    }
+    return nil
+}
+
+/* Open log output target, either stdout, stderr (default) or a file path
+ * rotated by size
+ */
+func openLogTarget(target string, maxSize int64, keep int) (io.Writer, error) {
+    switch target {
+        case "", "stderr":
+            return os.Stderr, nil
+        case "stdout":
+            return os.Stdout, nil
+        default:
+            return OpenRotatingFile(target, maxSize, keep)
+    }
+}
+
 func printVersionExit() {
     /* Reset the flags before printing version */
     log.SetFlags(0)
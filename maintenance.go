@@ -0,0 +1,53 @@
+package main
+
+import (
+    "sync/atomic"
+)
+
+/* Set while in maintenance mode, serving the maintenance menu for everything */
+var maintenanceMode int32
+
+/* Check if in maintenance mode */
+func inMaintenance() bool {
+    return atomic.LoadInt32(&maintenanceMode) == 1
+}
+
+/* Enter or exit maintenance mode, logging if it changed */
+func setMaintenance(enabled bool) {
+    var value int32
+    if enabled {
+        value = 1
+    }
+
+    if atomic.SwapInt32(&maintenanceMode, value) != value {
+        if enabled {
+            Config.LogSystem("Entered maintenance mode\n")
+        } else {
+            Config.LogSystem("Exited maintenance mode\n")
+        }
+    }
+}
+
+/* Switch maintenance mode on if off, else off (on SIGUSR1) */
+func toggleMaintenance() {
+    setMaintenance(!inMaintenance())
+}
+
+/* Render menu served for every request while in maintenance mode. The
+ * configured maintenance gophermap is fetched through the file cache like
+ * any other, falling back to a built-in notice if there's none or it can't
+ * be read
+ */
+func renderMaintenanceMenu(request *FileSystemRequest) []byte {
+    if Config.MaintenanceMap != "" {
+        output, gophorErr := Config.FileSystem.fetch(&FileSystemRequest{ Config.MaintenanceMap, request.Host, request.Query, nil, "" }, Config.MaintenanceMap, func(path string) FileContents {
+            return &GophermapContents{ path, nil }
+        })
+        if gophorErr == nil {
+            return append(output, Config.Current().FooterText...)
+        }
+        Config.LogSystemError("Error rendering maintenance gophermap %s: %s\n", Config.MaintenanceMap, gophorErr.Error())
+    }
+
+    return terminateMenu(buildInfoLine(MaintenanceNoticeStr))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+    setupTestConfig()
+    defer setMaintenance(false)
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "contents")
+    robotsPath := dir+"/robots.txt"
+    storePolicyFile(robotsPath, &GeneratedFileContents{ []byte("User-agent: *") })
+
+    /* Built-in notice without a maintenance gophermap */
+    toggleMaintenance()
+    expected := string(buildInfoLine(MaintenanceNoticeStr))+LastLine
+    if response, _ := respondTestRequest(filePath); response != expected {
+        t.Errorf("expected maintenance notice %q, got %q", expected, response)
+    }
+
+    /* Configured gophermap served for any selector, even missing ones */
+    Config.MaintenanceMap = writeTestFile(t, dir, "maintenance", "Back soon!\n")
+    expected = string(buildInfoLine("Back soon!"))+string(Config.Current().FooterText)
+    for _, selector := range []string{ filePath, dir+"/missing.txt", "/" } {
+        if response, _ := respondTestRequest(selector); response != expected {
+            t.Errorf("expected maintenance menu for %s %q, got %q", selector, expected, response)
+        }
+    }
+
+    /* Policy files still served */
+    if response, _ := respondTestRequest(robotsPath); response != "User-agent: *" {
+        t.Errorf("expected policy file served in maintenance mode, got %q", response)
+    }
+
+    toggleMaintenance()
+    if response, _ := respondTestRequest(filePath); response != "contents" {
+        t.Errorf("expected file served after maintenance, got %q", response)
+    }
+}
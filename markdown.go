@@ -0,0 +1,289 @@
+package main
+
+import (
+    "bufio"
+    "net/url"
+    "path"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+/* Markdown links and images, e.g. '[text](url)' or '![alt](url)' */
+var markdownLinkRegex = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+
+/* Markdown document file extensions, rendered when enabled */
+var markdownExtensions = []string{ ".md", ".markdown" }
+
+var (
+    markdownHeadingRegex = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+    markdownListRegex    = regexp.MustCompile(`^\s*([-*+]|[0-9]+\.)\s+(.*)$`)
+)
+
+/* MarkdownContents:
+ * Implementation of FileContents that renders a Markdown
+ * document as a menu. Headings are underlined, paragraphs
+ * reflowed at page width and links listed as menu entries
+ * after the paragraph they're found in.
+ */
+type MarkdownContents struct {
+    path     string
+    sections []GophermapSection
+}
+
+func (mc *MarkdownContents) Render(request *FileSystemRequest) []byte {
+    returnContents := make([]byte, 0)
+    for _, section := range mc.sections {
+        content, gophorErr := section.Render(request)
+        if gophorErr != nil {
+            content = buildInfoLine(GophermapRenderErrorStr)
+        }
+        returnContents = append(returnContents, content...)
+    }
+    return terminateMenu(returnContents)
+}
+
+func (mc *MarkdownContents) Load() *GophorError {
+    var gophorErr *GophorError
+    mc.sections, gophorErr = readMarkdown(mc.path)
+    return gophorErr
+}
+
+func (mc *MarkdownContents) Clear() {
+    mc.sections = nil
+}
+
+/* MarkdownText:
+ * Gophermap section of already built lines, sent as-is
+ * so document text is never treated as placeholders.
+ */
+type MarkdownText struct {
+    Contents []byte
+}
+
+func (s *MarkdownText) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    return s.Contents, nil
+}
+
+/* MarkdownLink:
+ * Gophermap section for a link found in a Markdown
+ * document. Remote links carry their own host and port,
+ * else they're served from the requested host.
+ */
+type MarkdownLink struct {
+    Type     ItemType
+    Text     string
+    Selector string
+    Host     string
+    Port     string
+    Local    bool
+}
+
+func (s *MarkdownLink) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    switch {
+        case s.Host != "":
+            return buildLine(s.Type, s.Text, s.Selector, s.Host, s.Port), nil
+        case s.Local:
+            return buildLine(s.Type, s.Text, request.Host.SelectorFor(s.Selector), request.Host.Name, request.Host.Port), nil
+        default:
+            return buildLine(s.Type, s.Text, s.Selector, request.Host.Name, request.Host.Port), nil
+    }
+}
+
+/* Create link to target from document at path. Gopher URLs link straight
+ * to the remote item, relative paths to local files and anything else is
+ * linked as a web address
+ */
+func newMarkdownLink(docPath, text, target string) *MarkdownLink {
+    parsed, err := url.Parse(target)
+    if err != nil || parsed.Scheme == "" {
+        /* Relative to the document, or absolute from server root */
+        linkPath := strings.SplitN(target, "#", 2)[0]
+        if !strings.HasPrefix(linkPath, "/") {
+            linkPath = path.Join(path.Dir(docPath), linkPath)
+        }
+        return &MarkdownLink{ requestItemType(linkPath), text, sanitizePath(linkPath), "", "", true }
+    }
+
+    if parsed.Scheme == "gopher" && parsed.Hostname() != "" {
+        port := parsed.Port()
+        if port == "" {
+            port = "70"
+        }
+
+        /* Path is '/' then item type then selector, a bare host is a menu */
+        itemType, selector := TypeDirectory, ""
+        if len(parsed.Path) > 1 {
+            itemType, selector = ItemType(parsed.Path[1]), parsed.Path[2:]
+        }
+        return &MarkdownLink{ itemType, text, selector, parsed.Hostname(), port, false }
+    }
+
+    return &MarkdownLink{ TypeHtml, text, UrlSelectorPrefix+target, "", "", false }
+}
+
+/* Read Markdown document at path into gophermap sections */
+func readMarkdown(docPath string) ([]GophermapSection, *GophorError) {
+    pageWidth := Config.Current().PageWidth
+    sections := make([]GophermapSection, 0)
+    text := make([]byte, 0)
+
+    /* Flush built text lines into a section, before adding a link */
+    flushText := func() {
+        if len(text) > 0 {
+            sections = append(sections, &MarkdownText{ text })
+            text = make([]byte, 0)
+        }
+    }
+
+    /* Paragraph (or list item) lines being collected, and links numbered
+     * across the whole document
+     */
+    paragraph := make([]string, 0)
+    indent := ""
+    linkCount := 0
+    inCode := false
+
+    endParagraph := func() {
+        if len(paragraph) == 0 {
+            return
+        }
+
+        /* Replace links with their text and a reference number */
+        links := make([]*MarkdownLink, 0)
+        joined := markdownLinkRegex.ReplaceAllStringFunc(strings.Join(paragraph, " "), func(match string) string {
+            split := markdownLinkRegex.FindStringSubmatch(match)
+            linkCount += 1
+            linkText := split[1]
+            if linkText == "" {
+                linkText = split[2]
+            }
+            links = append(links, newMarkdownLink(docPath, "["+strconv.Itoa(linkCount)+"] "+linkText, split[2]))
+            return linkText+"["+strconv.Itoa(linkCount)+"]"
+        })
+
+        for i, line := range wrapWords(joined, pageWidth-len(indent)) {
+            if i > 0 {
+                line = strings.Repeat(" ", len(indent))+line
+            } else {
+                line = indent+line
+            }
+            text = append(text, buildInfoLine(line)...)
+        }
+
+        if len(links) > 0 {
+            flushText()
+            for _, link := range links {
+                sections = append(sections, link)
+            }
+        }
+
+        paragraph = paragraph[:0]
+        indent = ""
+    }
+
+    gophorErr := bufferedScan(docPath,
+        func(scanner *bufio.Scanner) bool {
+            line := strings.TrimRight(scanner.Text(), " \t\r")
+
+            /* Code blocks are kept as they are, just cut at page width */
+            if strings.HasPrefix(strings.TrimSpace(line), "```") {
+                endParagraph()
+                inCode = !inCode
+                return true
+            }
+            if inCode {
+                text = append(text, reflowInfoLine(expandTabs(line, Config.TabWidth), pageWidth)...)
+                return true
+            }
+
+            if line == "" {
+                if len(paragraph) > 0 {
+                    endParagraph()
+                    text = append(text, buildInfoLine("")...)
+                }
+                return true
+            }
+
+            if split := markdownHeadingRegex.FindStringSubmatch(line); split != nil {
+                endParagraph()
+                underline := "-"
+                if len(split[1]) == 1 {
+                    underline = "="
+                }
+                text = append(text, buildInfoLine(split[2])...)
+                text = append(text, buildInfoLine(strings.Repeat(underline, minWidth(len(split[2]), pageWidth)))...)
+                text = append(text, buildInfoLine("")...)
+                return true
+            }
+
+            /* List items start their own paragraph, wrapped lines indented */
+            if split := markdownListRegex.FindStringSubmatch(line); split != nil {
+                endParagraph()
+                indent = split[1]+" "
+                paragraph = append(paragraph, split[2])
+                return true
+            }
+
+            paragraph = append(paragraph, strings.TrimSpace(line))
+            return true
+        },
+    )
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+
+    endParagraph()
+    flushText()
+    return sections, nil
+}
+
+/* Wrap text at word boundaries to lines no longer than width, cutting words
+ * that are longer still
+ */
+func wrapWords(text string, width int) []string {
+    if width < 1 {
+        width = 1
+    }
+
+    lines := make([]string, 0)
+    line := ""
+    for _, word := range strings.Fields(text) {
+        for len(word) > width {
+            if line != "" {
+                lines = append(lines, line)
+                line = ""
+            }
+            lines = append(lines, word[:width])
+            word = word[width:]
+        }
+
+        switch {
+            case line == "":
+                line = word
+            case len(line)+1+len(word) <= width:
+                line += " "+word
+            default:
+                lines = append(lines, line)
+                line = word
+        }
+    }
+    if line != "" {
+        lines = append(lines, line)
+    }
+    return lines
+}
+
+/* Serve Markdown documents rendered as menus. Returns item type mappings
+ * listing them as such
+ */
+func enableMarkdownRendering() []string {
+    itemTypes := make([]string, 0)
+    for _, ext := range markdownExtensions {
+        RegisterFileContents("*"+ext, func(filePath string) FileContents {
+            return &MarkdownContents{ filePath, nil }
+        })
+        itemTypes = append(itemTypes, ext+"="+string(TypeDirectory))
+    }
+    return itemTypes
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestMarkdownRender(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "next.txt", "")
+    docPath := writeTestFile(t, dir, "post.md", "# Gophers\n\nRead about [burrows](next.txt) and\n[the web](https://example.org).\n\n- see [this](gopher://example.net/0/about.txt)\n\n```\ncode  $hostname\n```\n")
+
+    contents := &MarkdownContents{ docPath, nil }
+    if gophorErr := contents.Load(); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    output := contents.Render(&FileSystemRequest{ docPath, testHost, "", nil, "" })
+
+    expected := []string{
+        string(buildInfoLine("Gophers")),
+        string(buildInfoLine("=======")),
+        string(buildInfoLine("")),
+        string(buildInfoLine("Read about burrows[1] and the web[2].")),
+        string(buildLine(TypeFile, "[1] burrows", dir+"/next.txt", testHost.Name, testHost.Port)),
+        string(buildLine(TypeHtml, "[2] the web", "URL:https://example.org", testHost.Name, testHost.Port)),
+        string(buildInfoLine("")),
+        string(buildInfoLine("- see this[3]")),
+        string(buildLine(TypeFile, "[3] this", "/about.txt", "example.net", "70")),
+        string(buildInfoLine("")),
+        string(buildInfoLine("code  $hostname")),
+        LastLine,
+    }
+    if string(output) != strings.Join(expected, "") {
+        t.Errorf("expected:\n%q\ngot:\n%q", strings.Join(expected, ""), output)
+    }
+}
+
+func TestWrapWords(t *testing.T) {
+    lines := wrapWords("the quick brown fox jumped", 10)
+    expected := []string{ "the quick", "brown fox", "jumped" }
+    if strings.Join(lines, "|") != strings.Join(expected, "|") {
+        t.Errorf("expected %q, got %q", expected, lines)
+    }
+
+    /* Words longer than width are cut */
+    lines = wrapWords("abcdefghijkl", 5)
+    expected = []string{ "abcde", "fghij", "kl" }
+    if strings.Join(lines, "|") != strings.Join(expected, "|") {
+        t.Errorf("expected %q, got %q", expected, lines)
+    }
+}
+
+func TestMarkdownNeverStreamed(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.StreamFileMin = 16
+    defaults := fileContentsTypes
+    defer func() {
+        fileContentsTypes = defaults
+    }()
+    enableMarkdownRendering()
+
+    docPath := writeTestFile(t, t.TempDir(), "post.md", "# "+strings.Repeat("x", 64)+"\n")
+    if Config.FileSystem.isStreamable(docPath, "") || Config.FileSystem.isStreamable(docPath, "0") {
+        t.Errorf("expected Markdown rendered rather than streamed, however large or whatever the query")
+    }
+
+    /* Large or offset requests still get the rendered menu */
+    for _, request := range []string{ docPath, docPath+Tab+"0" } {
+        response, gophorErr := respondTestRequest(request)
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if !strings.HasPrefix(response, string(buildInfoLine(strings.Repeat("x", 64)))) {
+            t.Errorf("%q: expected rendered Markdown, got %q", request, response)
+        }
+    }
+}
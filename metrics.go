@@ -0,0 +1,132 @@
+package main
+
+import (
+    "os"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+/* Upper bounds of request duration histogram buckets */
+var RequestDurationBuckets = [...]time.Duration{
+    5 * time.Millisecond,
+    25 * time.Millisecond,
+    100 * time.Millisecond,
+    250 * time.Millisecond,
+    time.Second,
+    5 * time.Second,
+    30 * time.Second,
+}
+
+/* Metrics:
+ * Counters exported in Prometheus text exposition format at
+ * a generated selector. Updated from request handlers and
+ * the file cache concurrently, so only ever touched with
+ * atomics. A nil Metrics (disabled) ignores all updates.
+ * Requests by item type are counted with the status page
+ * counters, as they're shown there too.
+ */
+type Metrics struct {
+    Selector        string
+    BytesServed     int64
+    DurationBuckets [len(RequestDurationBuckets)]int64
+    DurationSum     int64
+    DurationCount   int64
+    CacheHits      int64
+    CacheMisses    int64
+    CacheEvictions int64
+}
+
+func NewMetrics(selector string) *Metrics {
+    return &Metrics{ Selector: selector }
+}
+
+/* Count bytes sent in response to a handled request */
+func (m *Metrics) CountSent(sent int) {
+    if m == nil {
+        return
+    }
+    atomic.AddInt64(&m.BytesServed, int64(sent))
+}
+
+/* Observe time taken handling a request, counted in every histogram
+ * bucket it fits within
+ */
+func (m *Metrics) ObserveDuration(duration time.Duration) {
+    if m == nil {
+        return
+    }
+    for i, bound := range RequestDurationBuckets {
+        if duration <= bound {
+            atomic.AddInt64(&m.DurationBuckets[i], 1)
+        }
+    }
+    atomic.AddInt64(&m.DurationSum, int64(duration))
+    atomic.AddInt64(&m.DurationCount, 1)
+}
+
+func (m *Metrics) CacheHit() {
+    if m != nil {
+        atomic.AddInt64(&m.CacheHits, 1)
+    }
+}
+
+func (m *Metrics) CacheMiss() {
+    if m != nil {
+        atomic.AddInt64(&m.CacheMisses, 1)
+    }
+}
+
+func (m *Metrics) CacheEvicted() {
+    if m != nil {
+        atomic.AddInt64(&m.CacheEvictions, 1)
+    }
+}
+
+/* Get item type of resource at request path, as it would be listed */
+func requestItemType(requestPath string) ItemType {
+    if _, ok := Config.MergedMaps[requestPath]; ok {
+        return TypeDirectory
+    }
+
+    stat, err := os.Stat(requestPath)
+    if err == nil && stat.IsDir() {
+        return TypeDirectory
+    }
+    return guessItemType(requestPath)
+}
+
+/* Render metrics in Prometheus text exposition format */
+func (m *Metrics) Render() []byte {
+    text := "# HELP gophor_requests_total Requests handled, by item type of the resource requested.\n"
+    text += "# TYPE gophor_requests_total counter\n"
+    for i := range requestsByType {
+        if count := atomic.LoadInt64(&requestsByType[i]); count > 0 {
+            text += "gophor_requests_total{type="+strconv.Quote(string(rune(i)))+"} "+strconv.FormatInt(count, 10)+"\n"
+        }
+    }
+    text += "# HELP gophor_request_duration_seconds Time taken handling requests, from selector read to response sent.\n"
+    text += "# TYPE gophor_request_duration_seconds histogram\n"
+    for i, bound := range RequestDurationBuckets {
+        text += "gophor_request_duration_seconds_bucket{le="+strconv.Quote(strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))+"} "+strconv.FormatInt(atomic.LoadInt64(&m.DurationBuckets[i]), 10)+"\n"
+    }
+    count := atomic.LoadInt64(&m.DurationCount)
+    text += "gophor_request_duration_seconds_bucket{le=\"+Inf\"} "+strconv.FormatInt(count, 10)+"\n"
+    text += "gophor_request_duration_seconds_sum "+strconv.FormatFloat(time.Duration(atomic.LoadInt64(&m.DurationSum)).Seconds(), 'g', -1, 64)+"\n"
+    text += "gophor_request_duration_seconds_count "+strconv.FormatInt(count, 10)+"\n"
+    text += formatMetric("gophor_bytes_served_total", "counter", "Bytes sent to clients.", atomic.LoadInt64(&m.BytesServed))
+    text += formatMetric("gophor_cache_hits_total", "counter", "File cache lookups finding the file cached.", atomic.LoadInt64(&m.CacheHits))
+    text += formatMetric("gophor_cache_misses_total", "counter", "File cache lookups loading the file from disk.", atomic.LoadInt64(&m.CacheMisses))
+    text += formatMetric("gophor_cache_evictions_total", "counter", "Files evicted from the file cache.", atomic.LoadInt64(&m.CacheEvictions))
+    text += formatMetric("gophor_connections_total", "counter", "Client connections accepted, each handling a single request.", int64(acceptedConnections()))
+    text += formatMetric("gophor_active_connections", "gauge", "Client connections currently being served.", int64(activeConnections()))
+    text += formatMetric("gophor_rejected_connections_total", "counter", "Client connections turned away as the server was busy.", rejectedConnections())
+    return []byte(text)
+}
+
+/* Format single unlabelled metric with its help and type */
+func formatMetric(name, metricType, help string, value int64) string {
+    text := "# HELP "+name+" "+help+"\n"
+    text += "# TYPE "+name+" "+metricType+"\n"
+    return text+name+" "+strconv.FormatInt(value, 10)+"\n"
+}
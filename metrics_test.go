@@ -0,0 +1,109 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestMetricsNilSafe(t *testing.T) {
+    var m *Metrics
+    m.CountSent(10)
+    m.CacheHit()
+    m.CacheMiss()
+    m.CacheEvicted()
+}
+
+func TestMetricsCounted(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.Init(1, 1, 1)
+    Config.Metrics = NewMetrics("/metrics")
+    dir := t.TempDir()
+    first := writeTestFile(t, dir, "first.txt", "first")
+    second := writeTestFile(t, dir, "second.txt", "second")
+
+    /* Miss, hit, then a miss evicting the first file. Directory without a
+     * gophermap is generated, never touching the cache
+     */
+    for _, filePath := range []string{ first, first, second } {
+        if _, gophorErr := respondTestRequest(filePath); gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+    }
+    if _, gophorErr := respondTestRequest(dir); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    response, gophorErr := respondTestRequest("/metrics")
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    for _, expected := range []string{
+        "gophor_cache_hits_total 1\n",
+        "gophor_cache_misses_total 2\n",
+        "gophor_cache_evictions_total 1\n",
+        "gophor_active_connections 0\n",
+        "# TYPE gophor_active_connections gauge\n",
+    } {
+        if !strings.Contains(response, expected) {
+            t.Errorf("expected %q in metrics, got:\n%s", expected, response)
+        }
+    }
+}
+
+func TestMetricsRequestsByType(t *testing.T) {
+    setupTestConfig()
+    Config.Metrics = NewMetrics("/metrics")
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "contents")
+
+    /* Counted alongside status counters, so only ever go up */
+    before := atomic.LoadInt64(&requestsByType[TypeFile])
+    beforeDir := atomic.LoadInt64(&requestsByType[TypeDirectory])
+
+    worker := NewWorker(&GophorConn{ nil, testHost, 0 })
+    worker.Type = requestItemType(filePath)
+    worker.Sent = 8
+    worker.LogRequest(nil, RequestServed)
+
+    worker = NewWorker(&GophorConn{ nil, testHost, 0 })
+    worker.Type = requestItemType(dir)
+    worker.LogRequest(nil, RequestServed)
+
+    output := string(Config.Metrics.Render())
+    for _, expected := range []string{
+        fmt.Sprintf("gophor_requests_total{type=\"0\"} %d\n", before+1),
+        fmt.Sprintf("gophor_requests_total{type=\"1\"} %d\n", beforeDir+1),
+        "gophor_bytes_served_total 8\n",
+    } {
+        if !strings.Contains(output, expected) {
+            t.Errorf("expected %q in metrics, got:\n%s", expected, output)
+        }
+    }
+}
+
+func TestMetricsRequestDuration(t *testing.T) {
+    setupTestConfig()
+    Config.Metrics = NewMetrics("/metrics")
+    Config.Metrics.ObserveDuration(time.Millisecond)
+    Config.Metrics.ObserveDuration(200*time.Millisecond)
+    Config.Metrics.ObserveDuration(time.Minute)
+
+    /* Buckets are cumulative, with everything in +Inf */
+    output := string(Config.Metrics.Render())
+    for _, expected := range []string{
+        "# TYPE gophor_request_duration_seconds histogram\n",
+        "gophor_request_duration_seconds_bucket{le=\"0.005\"} 1\n",
+        "gophor_request_duration_seconds_bucket{le=\"0.25\"} 2\n",
+        "gophor_request_duration_seconds_bucket{le=\"30\"} 2\n",
+        "gophor_request_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+        "gophor_request_duration_seconds_sum 60.201\n",
+        "gophor_request_duration_seconds_count 3\n",
+    } {
+        if !strings.Contains(output, expected) {
+            t.Errorf("expected %q in metrics, got:\n%s", expected, output)
+        }
+    }
+}
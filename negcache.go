@@ -0,0 +1,113 @@
+package main
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+/* NegativeCache:
+ * Records recently requested paths that didn't exist, so
+ * repeated requests for them (e.g. from scrapers) don't
+ * each hit the filesystem. Entries expire after a short
+ * TTL so newly created files show up quickly. All entries
+ * share the same TTL, so the list is in expiry order and
+ * the oldest entry is always at the front.
+ */
+type NegativeCache struct {
+    Map   map[string]*list.Element
+    List  *list.List
+    Mutex sync.Mutex
+    Size  int
+    TTL   time.Duration
+}
+
+/* NegativeCacheEntry:
+ * A missing path and when it stops being trusted.
+ */
+type NegativeCacheEntry struct {
+    Path    string
+    Expires time.Time
+}
+
+/* Create new negative cache, nil (disabled) if size or TTL not positive */
+func NewNegativeCache(size int, ttl time.Duration) *NegativeCache {
+    if size < 1 || ttl <= 0 {
+        return nil
+    }
+
+    return &NegativeCache{
+        make(map[string]*list.Element),
+        list.New(),
+        sync.Mutex{},
+        size,
+        ttl,
+    }
+}
+
+/* Check if path was recently found missing */
+func (nc *NegativeCache) Contains(path string) bool {
+    if nc == nil {
+        return false
+    }
+
+    nc.Mutex.Lock()
+    defer nc.Mutex.Unlock()
+
+    nc.expire(time.Now())
+    _, ok := nc.Map[path]
+    return ok
+}
+
+/* Record path as missing, dropping the oldest entry if full */
+func (nc *NegativeCache) Add(path string) {
+    if nc == nil {
+        return
+    }
+
+    nc.Mutex.Lock()
+    defer nc.Mutex.Unlock()
+
+    now := time.Now()
+    nc.expire(now)
+
+    /* Re-adding moves entry to back with a new expiry */
+    if elem, ok := nc.Map[path]; ok {
+        nc.List.Remove(elem)
+    } else if nc.List.Len() >= nc.Size {
+        oldest := nc.List.Front()
+        delete(nc.Map, oldest.Value.(*NegativeCacheEntry).Path)
+        nc.List.Remove(oldest)
+    }
+
+    nc.Map[path] = nc.List.PushBack(&NegativeCacheEntry{ path, now.Add(nc.TTL) })
+}
+
+/* Forget path, e.g. once something is being served there */
+func (nc *NegativeCache) Remove(path string) {
+    if nc == nil {
+        return
+    }
+
+    nc.Mutex.Lock()
+    defer nc.Mutex.Unlock()
+
+    if elem, ok := nc.Map[path]; ok {
+        delete(nc.Map, path)
+        nc.List.Remove(elem)
+    }
+}
+
+/* Drop expired entries from the front of the list. Must be called
+ * while holding the mutex
+ */
+func (nc *NegativeCache) expire(now time.Time) {
+    for elem := nc.List.Front(); elem != nil; elem = nc.List.Front() {
+        entry := elem.Value.(*NegativeCacheEntry)
+        if now.Before(entry.Expires) {
+            return
+        }
+        delete(nc.Map, entry.Path)
+        nc.List.Remove(elem)
+    }
+}
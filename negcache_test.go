@@ -0,0 +1,67 @@
+package main
+
+import (
+    "path"
+    "testing"
+    "time"
+)
+
+func TestNegativeCacheExpiry(t *testing.T) {
+    nc := NewNegativeCache(10, 20*time.Millisecond)
+    nc.Add("/missing")
+    if !nc.Contains("/missing") {
+        t.Fatal("expected missing path to be remembered")
+    }
+
+    time.Sleep(30*time.Millisecond)
+    if nc.Contains("/missing") || nc.List.Len() != 0 {
+        t.Errorf("expected missing path to expire")
+    }
+}
+
+func TestNegativeCacheCapacity(t *testing.T) {
+    nc := NewNegativeCache(2, time.Minute)
+    nc.Add("/a")
+    nc.Add("/b")
+    nc.Add("/c")
+
+    if nc.Contains("/a") || !nc.Contains("/b") || !nc.Contains("/c") {
+        t.Errorf("expected oldest entry dropped when full, got %v", nc.Map)
+    }
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+    if NewNegativeCache(0, time.Second) != nil || NewNegativeCache(10, 0) != nil {
+        t.Errorf("expected nil negative cache with zero size or TTL")
+    }
+
+    /* Disabled cache never remembers anything */
+    var nc *NegativeCache
+    nc.Add("/missing")
+    if nc.Contains("/missing") {
+        t.Errorf("expected disabled negative cache to contain nothing")
+    }
+}
+
+func TestHandleRequestMissingCached(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.Missing = NewNegativeCache(10, 50*time.Millisecond)
+    dir := t.TempDir()
+    filePath := path.Join(dir, "new.txt")
+
+    _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+    if gophorErr == nil || gophorErr.Code != FileStatErr {
+        t.Fatalf("expected stat error for missing file, got %v", gophorErr)
+    }
+    if !Config.FileSystem.Missing.Contains(filePath) {
+        t.Fatal("expected missing path to be remembered")
+    }
+
+    /* Newly created file is visible once negative entry expires */
+    writeTestFile(t, dir, "new.txt", "hello")
+    time.Sleep(60*time.Millisecond)
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+    if gophorErr != nil || string(output) != "hello" {
+        t.Errorf("expected new file served after expiry, got %v %q", gophorErr, output)
+    }
+}
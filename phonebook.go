@@ -0,0 +1,215 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+)
+
+/* Contact:
+ * A single phonebook entry, fields kept in the order
+ * they're listed in the contacts file.
+ */
+type Contact struct {
+    Fields []string
+    Values []string
+}
+
+/* Get value of named field, empty if not set */
+func (c *Contact) Get(field string) string {
+    for i, f := range c.Fields {
+        if f == field {
+            return c.Values[i]
+        }
+    }
+    return ""
+}
+
+/* PhonebookFileContents:
+ * Implementation of FileContents answering CSO (qi)
+ * style queries from the request query against a set
+ * of contacts, parsed once when generated.
+ */
+type PhonebookFileContents struct {
+    contacts []*Contact
+    fields   []string
+}
+
+func (fc *PhonebookFileContents) Render(request *FileSystemRequest) []byte {
+    return fc.Query(request.Query)
+}
+
+func (fc *PhonebookFileContents) Load() *GophorError {
+    /* do nothing */
+    return nil
+}
+
+func (fc *PhonebookFileContents) Clear() {
+    /* do nothing */
+}
+
+/* Answer query of space separated 'value' or 'field=value' terms, optionally
+ * prefixed by the qi 'query' or 'ph' command. Contacts must match every
+ * term, a bare value matching any searchable field
+ */
+func (fc *PhonebookFileContents) Query(query string) []byte {
+    terms := strings.Fields(query)
+    if len(terms) > 0 && (strings.EqualFold(terms[0], "query") || strings.EqualFold(terms[0], "ph")) {
+        terms = terms[1:]
+    }
+
+    if len(terms) == 0 {
+        return []byte("599:Empty query, try 'smith' or '"+fc.fields[0]+"=smith' (searchable fields: "+strings.Join(fc.fields, ", ")+")"+DOSLineEnd)
+    }
+
+    /* Check any named fields are searchable before looking */
+    for _, term := range terms {
+        if split := strings.SplitN(term, "=", 2); len(split) == 2 && !fc.isSearchable(split[0]) {
+            return []byte("507:Field is not searchable: "+split[0]+DOSLineEnd)
+        }
+    }
+
+    text := ""
+    matches := 0
+    for _, contact := range fc.contacts {
+        if !fc.matchesAll(contact, terms) {
+            continue
+        }
+        matches += 1
+
+        /* Field names right-aligned, as qi servers do */
+        width := 0
+        for _, field := range contact.Fields {
+            if len(field) > width {
+                width = len(field)
+            }
+        }
+        for i, field := range contact.Fields {
+            text += "-200:"+strconv.Itoa(matches)+":"+strings.Repeat(" ", width-len(field))+field+": "+contact.Values[i]+DOSLineEnd
+        }
+    }
+
+    if matches == 0 {
+        return []byte("501:No matches to your query."+DOSLineEnd)
+    }
+    return []byte(text+"200:Ok."+DOSLineEnd)
+}
+
+func (fc *PhonebookFileContents) isSearchable(field string) bool {
+    for _, f := range fc.fields {
+        if strings.EqualFold(f, field) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Check contact matches all terms, by case-insensitive substring */
+func (fc *PhonebookFileContents) matchesAll(contact *Contact, terms []string) bool {
+    for _, term := range terms {
+        fields, value := fc.fields, term
+        if split := strings.SplitN(term, "=", 2); len(split) == 2 {
+            fields, value = split[:1], split[1]
+        }
+
+        matched := false
+        for _, field := range fields {
+            if strings.Contains(strings.ToLower(contact.Get(strings.ToLower(field))), strings.ToLower(value)) {
+                matched = true
+                break
+            }
+        }
+        if !matched {
+            return false
+        }
+    }
+    return true
+}
+
+/* Parse contacts file of 'field: value' lines, contacts separated by blank
+ * lines and '#' for comments. Field names are case-insensitive
+ */
+func parseContacts(filePath string) ([]*Contact, *GophorError) {
+    contacts := make([]*Contact, 0)
+    contact := &Contact{}
+    lineNo := 0
+
+    gophorErr := bufferedScan(filePath, func(scanner *bufio.Scanner) bool {
+        lineNo += 1
+        line := strings.TrimSpace(scanner.Text())
+        switch {
+            case line == "":
+                if len(contact.Fields) > 0 {
+                    contacts = append(contacts, contact)
+                    contact = &Contact{}
+                }
+            case strings.HasPrefix(line, "#"):
+                /* comment */
+            default:
+                split := strings.SplitN(line, ":", 2)
+                if len(split) != 2 {
+                    Config.LogSystemError("Skipped invalid contact line %d in %s: %s\n", lineNo, filePath, line)
+                    return true
+                }
+                contact.Fields = append(contact.Fields, strings.ToLower(strings.TrimSpace(split[0])))
+                contact.Values = append(contact.Values, strings.TrimSpace(split[1]))
+        }
+        return true
+    })
+    if gophorErr != nil {
+        return nil, gophorErr
+    }
+
+    if len(contact.Fields) > 0 {
+        contacts = append(contacts, contact)
+    }
+    return contacts, nil
+}
+
+/* Serve phonebook at the root of the default and each virtual host, unless
+ * there's a real file there
+ */
+func cachePhonebookFiles() {
+    if Config.PhonebookContacts == "" {
+        return
+    }
+
+    if len(Config.PhonebookFields) == 0 {
+        Config.LogSystemError("Skipped generating phonebook, no searchable fields\n")
+        return
+    }
+
+    contacts, gophorErr := parseContacts(Config.PhonebookContacts)
+    if gophorErr != nil {
+        Config.LogSystemError("Skipped generating phonebook, error reading contacts %s: %s\n", Config.PhonebookContacts, gophorErr.Error())
+        return
+    }
+
+    for _, root := range virtualHostRoots() {
+        cachePhonebookFile(path.Join(root, PhonebookFileStr), contacts)
+    }
+}
+
+func cachePhonebookFile(filePath string, contacts []*Contact) {
+    _, err := os.Stat(filePath)
+    if err == nil {
+        return
+    }
+    storePolicyFile(filePath, &PhonebookFileContents{ contacts, Config.PhonebookFields })
+}
+
+/* Parse new-line separated searchable field names */
+func parsePhonebookFields(fields string) ([]string, error) {
+    ret := make([]string, 0)
+    for _, field := range splitNonEmpty(fields, "\n") {
+        field = strings.ToLower(strings.TrimSpace(field))
+        if field == "" || strings.ContainsAny(field, "=: \t") {
+            return nil, errors.New("invalid phonebook field: "+field)
+        }
+        ret = append(ret, field)
+    }
+    return ret, nil
+}
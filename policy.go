@@ -2,49 +2,73 @@ package main
 
 import (
     "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
 )
 
-func cachePolicyFiles(description, admin, geoloc string) {
-    /* See if caps txt exists, if not generate */
-    _, err := os.Stat("/caps.txt")
-    if err != nil {
-        /* We need to generate the caps txt and manually load into cache */
-        content := generateCapsTxt(description, admin, geoloc)
-
-        /* Create new file object from generated file contents */
-        fileContents := &GeneratedFileContents{ content }
-        file := NewFile(fileContents)
-
-        /* Trigger a load contents just to set it as fresh etc */
-        file.LoadContents()
+/* Generate policy files at the root of the default and each virtual host */
+func cachePolicyFiles() {
+    for _, root := range virtualHostRoots() {
+        cachePolicyFile(path.Join(root, "caps.txt"), generateCapsTxt)
+        cachePolicyFile(path.Join(root, "robots.txt"), generateRobotsTxt)
+        cacheSecurityFile(path.Join(root, "security.txt"))
+        cachePolicyFile(path.Join(root, "humans.txt"), generateHumansTxt)
+        if Config.StatusEnabled {
+            cacheStatusFile(path.Join(root, "status.txt"))
+        }
+        if Config.SitemapInterval > 0 {
+            cacheSitemapFile(path.Join(root, "sitemap.txt"))
+        }
+    }
+    cachePhonebookFiles()
+}
 
-        /* No need to worry about mutexes here, no other goroutines running yet */
-        Config.FileSystem.CacheMap.Put("/caps.txt", file)
+func cachePolicyFile(filePath string, generate func() []byte) {
+    /* See if policy file exists, if so nothing to do. We're only called
+     * once chroot'ed into the server root, so absolute paths already
+     * resolve under it
+     */
+    _, err := os.Stat(filePath)
+    if err == nil {
+        return
+    }
 
-        Config.LogSystem("Generated policy file: /caps.txt\n")
+    /* We need to generate the policy file and manually load into cache,
+     * generators return nil if they can't produce a valid file
+     */
+    content := generate()
+    if content == nil {
+        Config.LogSystemError("Skipped generating policy file: %s\n", filePath)
+        return
     }
 
-    /* See if caps txt exists, if not generate */
-    _, err = os.Stat("/robots.txt")
-    if err != nil {
-        /* We need to generate the caps txt and manually load into cache */
-        content := generateRobotsTxt()
+    storePolicyFile(filePath, &GeneratedFileContents{ content })
+}
 
-        /* Create new file object from generated file contents */
-        fileContents := &GeneratedFileContents{ content }
-        file := NewFile(fileContents)
+/* Store file contents as policy file served at path */
+func storePolicyFile(filePath string, fileContents FileContents) {
+    /* Create new file object from file contents */
+    file := NewFile(fileContents)
 
-        /* Trigger a load contents just to set it as fresh etc */
-        file.LoadContents()
+    /* Trigger a load contents just to set it as fresh etc */
+    file.LoadContents()
 
-        /* No need to worry about mutexes here, no other goroutines running yet */
-        Config.FileSystem.CacheMap.Put("/robots.txt", file)
+    /* Kept outside of the cache so they're never evicted. Regenerated on
+     * reload, so guard against concurrent requests
+     */
+    Config.FileSystem.PolicyMutex.Lock()
+    Config.FileSystem.PolicyFiles[filePath] = file
+    Config.FileSystem.PolicyMutex.Unlock()
 
-        Config.LogSystem("Generated policy file: /robots.txt\n")
-    }
+    /* Path may have been found missing before it was generated */
+    Config.FileSystem.Missing.Remove(filePath)
+
+    Config.LogSystem("Generated policy file: %s\n", filePath)
 }
 
-func generateCapsTxt(description, admin, geoloc string) []byte {
+func generateCapsTxt() []byte {
     text := "CAPS"+DOSLineEnd
     text += DOSLineEnd
     text += "# This is an automatically generated"+DOSLineEnd
@@ -62,20 +86,120 @@ func generateCapsTxt(description, admin, geoloc string) []byte {
     text += DOSLineEnd
     text += "ServerSoftware=Gophor"+DOSLineEnd
     text += "ServerSoftwareVersion="+GophorVersion+DOSLineEnd
-    text += "ServerDescription="+description+DOSLineEnd
-    text += "ServerGeolocationString="+geoloc+DOSLineEnd
-    text += "ServerDefaultEncoding=ascii"+DOSLineEnd
+    text += "ServerDescription="+Config.Description+DOSLineEnd
+    text += "ServerGeolocationString="+Config.Geolocation+DOSLineEnd
+    text += "ServerDefaultEncoding="+serverDefaultEncoding()+DOSLineEnd
+    if Config.TLSPort != 0 {
+        text += DOSLineEnd
+        text += "ServerTLS=TRUE"+DOSLineEnd
+        text += "ServerTLSPort="+strconv.Itoa(Config.TLSPort)+DOSLineEnd
+    }
     text += DOSLineEnd
-    text += "ServerAdmin="+admin+DOSLineEnd
+    text += "ServerAdmin="+Config.AdminEmail+DOSLineEnd
     return []byte(text)
 }
 
 func generateRobotsTxt() []byte {
-    text := "Usage-agent: *"+DOSLineEnd
-    text += "Disallow: *"+DOSLineEnd
+    text := "User-agent: *"+DOSLineEnd
+
+    /* No rules configured, fall back to disallowing everything */
+    if len(Config.RobotsAllow) == 0 && len(Config.RobotsDisallow) == 0 {
+        text += "Disallow: *"+DOSLineEnd
+        text += DOSLineEnd
+        text += "Crawl-delay: 99999"+DOSLineEnd
+        text += DOSLineEnd
+        text += "# This server does not support scraping"+DOSLineEnd
+        return []byte(text)
+    }
+
+    for _, rule := range Config.RobotsAllow {
+        text += "Allow: "+rule+DOSLineEnd
+    }
+    for _, rule := range Config.RobotsDisallow {
+        text += "Disallow: "+rule+DOSLineEnd
+    }
+
+    if Config.RobotsCrawlDelay > 0 {
+        text += DOSLineEnd
+        text += "Crawl-delay: "+strconv.Itoa(Config.RobotsCrawlDelay)+DOSLineEnd
+    }
+
     text += DOSLineEnd
-    text += "Crawl-delay: 99999"+DOSLineEnd
+    text += "# This is an automatically generated"+DOSLineEnd
+    text += "# server policy file: robots.txt"+DOSLineEnd
+    return []byte(text)
+}
+
+/* SecurityFileContents:
+ * Implementation of FileContents that generates security.txt
+ * afresh on every render, so its expiry is always counted
+ * from now however long the server has been up.
+ */
+type SecurityFileContents struct {}
+
+func (fc *SecurityFileContents) Render(request *FileSystemRequest) []byte {
+    return generateSecurityTxt()
+}
+
+func (fc *SecurityFileContents) Load() *GophorError {
+    /* do nothing */
+    return nil
+}
+
+func (fc *SecurityFileContents) Clear() {
+    /* do nothing */
+}
+
+/* Serve security.txt generated on each request at path, unless there's a
+ * real file there or we can't produce a valid one
+ */
+func cacheSecurityFile(filePath string) {
+    _, err := os.Stat(filePath)
+    if err == nil {
+        return
+    }
+
+    if generateSecurityTxt() == nil {
+        Config.LogSystemError("Skipped generating policy file: %s\n", filePath)
+        return
+    }
+
+    storePolicyFile(filePath, &SecurityFileContents{})
+}
+
+func generateSecurityTxt() []byte {
+    /* Contact is required (RFC 9116), without it we don't generate */
+    if Config.AdminEmail == "" {
+        return nil
+    }
+
+    text := "# This is an automatically generated"+DOSLineEnd
+    text += "# server policy file: security.txt"+DOSLineEnd
+    text += DOSLineEnd
+    text += "Contact: mailto:"+Config.AdminEmail+DOSLineEnd
+    if Config.SecurityEncryption != "" {
+        text += "Encryption: "+Config.SecurityEncryption+DOSLineEnd
+    }
+    if Config.SecurityPolicy != "" {
+        text += "Policy: "+Config.SecurityPolicy+DOSLineEnd
+    }
+    text += "Expires: "+time.Now().Add(Config.SecurityExpiry).UTC().Format(time.RFC3339)+DOSLineEnd
+    return []byte(text)
+}
+
+func generateHumansTxt() []byte {
+    text := "/* TEAM */"+DOSLineEnd
+    text += "Admin: "+Config.AdminEmail+DOSLineEnd
     text += DOSLineEnd
-    text += "# This server does not support scraping"+DOSLineEnd
+    text += "/* SITE */"+DOSLineEnd
+    text += "Software: Gophor"+DOSLineEnd
+    text += "Version: "+GophorVersion+DOSLineEnd
+    if Config.HumansCredits != "" {
+        text += DOSLineEnd
+        text += "/* THANKS */"+DOSLineEnd
+        for _, line := range strings.Split(Config.HumansCredits, "\n") {
+            text += line+DOSLineEnd
+        }
+    }
     return []byte(text)
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestPolicyFilesNotEvicted(t *testing.T) {
+    setupTestConfig()
+
+    /* Caching disabled server setup */
+    Config.FileSystem.Init(1, 1, 0)
+
+    dir := t.TempDir()
+    policyPaths := []string{ dir+"/caps.txt", dir+"/robots.txt", dir+"/humans.txt" }
+    for _, policyPath := range policyPaths {
+        cachePolicyFile(policyPath, generateCapsTxt)
+    }
+
+    /* Churn the cache with regular files */
+    for i := 0; i < 10; i += 1 {
+        filePath := writeTestFile(t, dir, fmt.Sprintf("%d.txt", i), "contents")
+        Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, testHost, "", nil, "" })
+    }
+
+    for _, policyPath := range policyPaths {
+        if _, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ policyPath, testHost, "", nil, "" }); gophorErr != nil {
+            t.Errorf("expected generated policy file %s to be served: %s", policyPath, gophorErr)
+        }
+    }
+}
+
+func TestGenerateRobotsTxt(t *testing.T) {
+    setupTestConfig()
+    lines := func(lines ...string) string {
+        return strings.Join(lines, DOSLineEnd)+DOSLineEnd
+    }
+    footer := lines("", "# This is an automatically generated", "# server policy file: robots.txt")
+
+    tests := []struct {
+        Allow      []string
+        Disallow   []string
+        CrawlDelay int
+        Expected   string
+    }{
+        /* No rules, disallow everything */
+        { nil, nil, 0, lines("User-agent: *", "Disallow: *", "", "Crawl-delay: 99999", "", "# This server does not support scraping") },
+        { nil, nil, 10, lines("User-agent: *", "Disallow: *", "", "Crawl-delay: 99999", "", "# This server does not support scraping") },
+
+        /* Allow rules before disallow rules, each in the order given */
+        { []string{ "/docs", "/pub" }, []string{ "/private" }, 0, lines("User-agent: *", "Allow: /docs", "Allow: /pub", "Disallow: /private")+footer },
+        { nil, []string{ "/private", "/tmp" }, 0, lines("User-agent: *", "Disallow: /private", "Disallow: /tmp")+footer },
+        { []string{ "/" }, nil, 30, lines("User-agent: *", "Allow: /", "", "Crawl-delay: 30")+footer },
+    }
+
+    for _, test := range tests {
+        Config.RobotsAllow = test.Allow
+        Config.RobotsDisallow = test.Disallow
+        Config.RobotsCrawlDelay = test.CrawlDelay
+        if output := string(generateRobotsTxt()); output != test.Expected {
+            t.Errorf("allow %q disallow %q crawl-delay %d: expected %q, got %q", test.Allow, test.Disallow, test.CrawlDelay, test.Expected, output)
+        }
+    }
+}
+
+func TestGenerateHumansTxt(t *testing.T) {
+    setupTestConfig()
+    Config.AdminEmail = "admin@example.com"
+    base := "/* TEAM */"+DOSLineEnd+"Admin: admin@example.com"+DOSLineEnd+DOSLineEnd+"/* SITE */"+DOSLineEnd+"Software: Gophor"+DOSLineEnd+"Version: "+GophorVersion+DOSLineEnd
+
+    /* No credits, no thanks section */
+    if output := string(generateHumansTxt()); output != base {
+        t.Errorf("expected %q, got %q", base, output)
+    }
+
+    /* Credits one per line */
+    Config.HumansCredits = "Jane Smith\nJohn Doe"
+    expected := base+DOSLineEnd+"/* THANKS */"+DOSLineEnd+"Jane Smith"+DOSLineEnd+"John Doe"+DOSLineEnd
+    if output := string(generateHumansTxt()); output != expected {
+        t.Errorf("expected %q, got %q", expected, output)
+    }
+}
+
+func TestHumansTxtOnlyWhenAbsent(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    realPath := writeTestFile(t, dir, "real/humans.txt", "real humans")
+    generatedPath := dir+"/humans.txt"
+    cachePolicyFile(realPath, generateHumansTxt)
+    cachePolicyFile(generatedPath, generateHumansTxt)
+
+    Config.FileSystem.PolicyMutex.RLock()
+    _, realGenerated := Config.FileSystem.PolicyFiles[realPath]
+    _, generated := Config.FileSystem.PolicyFiles[generatedPath]
+    Config.FileSystem.PolicyMutex.RUnlock()
+    if realGenerated || !generated {
+        t.Errorf("expected humans.txt generated only where absent, over real file %v, where absent %v", realGenerated, generated)
+    }
+
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ generatedPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.HasPrefix(string(output), "/* TEAM */") {
+        t.Errorf("expected generated humans.txt served, got %q", output)
+    }
+}
+
+func TestSecurityTxtRequiresContact(t *testing.T) {
+    setupTestConfig()
+
+    if content := generateSecurityTxt(); content != nil {
+        t.Errorf("expected no security.txt without admin email, got %q", content)
+    }
+
+    Config.AdminEmail = "admin@example.com"
+    if content := string(generateSecurityTxt()); !strings.Contains(content, "Contact: mailto:admin@example.com"+DOSLineEnd) {
+        t.Errorf("expected Contact field in security.txt, got %q", content)
+    }
+}
+
+func TestSecurityTxtExpiresFromRequest(t *testing.T) {
+    setupTestConfig()
+    securityPath := t.TempDir()+"/security.txt"
+
+    /* Not served without a contact */
+    cacheSecurityFile(securityPath)
+    if Config.FileSystem.isPolicyFile(securityPath) {
+        t.Fatal("expected no security.txt without admin email")
+    }
+
+    Config.AdminEmail = "admin@example.com"
+    Config.SecurityExpiry = time.Hour
+    cacheSecurityFile(securityPath)
+
+    /* Expiry counted from each request, not from when it was generated */
+    expires := func() time.Time {
+        output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ securityPath, testHost, "", nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        for _, line := range strings.Split(string(output), DOSLineEnd) {
+            if strings.HasPrefix(line, "Expires: ") {
+                expiry, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, "Expires: "))
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return expiry
+            }
+        }
+        t.Fatalf("expected Expires field in security.txt, got %q", output)
+        return time.Time{}
+    }
+
+    if expiry := expires(); expiry.Before(time.Now().Add(time.Hour - time.Minute)) {
+        t.Errorf("expected security.txt to expire an hour from now, got %s", expiry)
+    }
+
+    /* Stand in for time passing by moving expiry on a day */
+    Config.SecurityExpiry = 25*time.Hour
+    if expiry := expires(); expiry.Before(time.Now().Add(24*time.Hour)) {
+        t.Errorf("expected security.txt expiry regenerated on request, got %s", expiry)
+    }
+}
+
+func TestStatusTxtRendersLive(t *testing.T) {
+    setupTestConfig()
+    statusPath := t.TempDir()+"/status.txt"
+    cacheStatusFile(statusPath)
+
+    before, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ statusPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.Contains(string(before), "ServerSoftwareVersion="+GophorVersion+DOSLineEnd) {
+        t.Errorf("expected version in status.txt, got %q", before)
+    }
+
+    countRequest(RequestServed, TypeFile)
+    after, _ := Config.FileSystem.HandleRequest(&FileSystemRequest{ statusPath, testHost, "", nil, "" })
+    served := fmt.Sprintf("RequestsServed=%d", atomic.LoadInt64(&servedCount))
+    if strings.Contains(string(before), served) || !strings.Contains(string(after), served) {
+        t.Errorf("expected status.txt regenerated with new request count %q, got %q", served, after)
+    }
+
+    /* Along with the breakdown by item type */
+    byType := fmt.Sprintf("0:%d", atomic.LoadInt64(&requestsByType[TypeFile]))
+    if !strings.Contains(string(after), "RequestsByType=") || !strings.Contains(string(after), byType) {
+        t.Errorf("expected status.txt to include requests by type %q, got %q", byType, after)
+    }
+}
+
+func TestPhonebookQuery(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    Config.PhonebookContacts = writeTestFile(t, dir, "contacts", "# staff\nname: Jane Smith\nemail: jane@example.org\nphone: 555-0100\n\nname: John Doe\nemail: john@example.net\n")
+    Config.PhonebookFields = []string{ "name", "email" }
+
+    contacts, gophorErr := parseContacts(Config.PhonebookContacts)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    phonebookPath := dir+"/phonebook"
+    cachePhonebookFile(phonebookPath, contacts)
+
+    for _, test := range []struct {
+        query    string
+        expected string
+    }{
+        { "", "599:" },
+        { "smith", "-200:1:phone: 555-0100"+DOSLineEnd+"200:Ok."+DOSLineEnd },
+        { "query email=example", "-200:2: name: John Doe"+DOSLineEnd },
+        { "name=jane email=.net", "501:No matches to your query."+DOSLineEnd },
+        { "phone=555", "507:Field is not searchable: phone"+DOSLineEnd },
+    } {
+        response, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ phonebookPath, testHost, test.query, nil, "" })
+        if gophorErr != nil {
+            t.Fatal(gophorErr)
+        }
+        if !strings.Contains(string(response), test.expected) {
+            t.Errorf("expected phonebook query %q response containing %q, got %q", test.query, test.expected, response)
+        }
+    }
+}
+
+func TestPolicyFilesPreferRealFiles(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.PolicyFiles = make(map[string]*File)
+
+    /* Policy files are looked for at each root, as served. After chroot the
+     * server root is '/', so this covers it the same as a virtual host root
+     */
+    root := t.TempDir()
+    capsPath := writeTestFile(t, root, "caps.txt", "CAPS\nreal caps\n")
+    Config.VirtualHosts = []*VirtualHost{ &VirtualHost{ "example.org", "", root } }
+    cachePolicyFiles()
+
+    Config.FileSystem.PolicyMutex.RLock()
+    _, capsGenerated := Config.FileSystem.PolicyFiles[capsPath]
+    _, robotsGenerated := Config.FileSystem.PolicyFiles[root+"/robots.txt"]
+    Config.FileSystem.PolicyMutex.RUnlock()
+    if capsGenerated || !robotsGenerated {
+        t.Errorf("expected only missing policy files generated, caps.txt %v robots.txt %v", capsGenerated, robotsGenerated)
+    }
+
+    output, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ capsPath, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if string(output) != "CAPS\nreal caps\n" {
+        t.Errorf("expected real caps.txt served over generated, got %q", output)
+    }
+}
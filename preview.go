@@ -0,0 +1,60 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "path"
+    "strings"
+)
+
+/* Write gophermap at path to out rendered exactly as a client requesting it
+ * would receive it. With sections, each section's output is preceded by a
+ * marker line naming its type, to see which produced what. Returns the exit
+ * code, non-zero if it couldn't be rendered
+ */
+func runGophermapPreview(gophermapPath string, host *ConnHost, showSections bool, out io.Writer) int {
+    /* Gophermaps are served for their directory */
+    requestPath := gophermapPath
+    if isGophermapName(path.Base(gophermapPath)) {
+        requestPath = path.Dir(gophermapPath)
+    }
+    request := &FileSystemRequest{ requestPath, host, "", nil, "" }
+
+    if !showSections {
+        output, gophorErr := Config.FileSystem.HandleRequest(request)
+        if gophorErr != nil {
+            fmt.Fprintf(out, "Error rendering %s: %s\n", gophermapPath, gophorErr.Error())
+            return 1
+        }
+        out.Write(output)
+        return 0
+    }
+
+    sections, _, gophorErr := readGophermapWithErrors(gophermapPath)
+    if gophorErr != nil {
+        fmt.Fprintf(out, "Error reading %s: %s\n", gophermapPath, gophorErr.Error())
+        return 1
+    }
+
+    contents := &GophermapContents{ gophermapPath, sections }
+    writePreviewSection(out, "header map", contents.renderInjectedMap(Config.HeaderMap, request))
+    for i, section := range sections {
+        output, gophorErr := section.Render(request)
+        if gophorErr != nil {
+            output = []byte("render error: "+gophorErr.Error()+"\n")
+        }
+        writePreviewSection(out, fmt.Sprintf("%d %s", i+1, strings.TrimPrefix(fmt.Sprintf("%T", section), "*main.")), output)
+    }
+    writePreviewSection(out, "footer map", contents.renderInjectedMap(Config.FooterMap, request))
+    writePreviewSection(out, "footer", Config.Current().FooterText)
+    return 0
+}
+
+/* Write section output preceded by marker line naming it, skipping empty */
+func writePreviewSection(out io.Writer, name string, output []byte) {
+    if len(output) == 0 {
+        return
+    }
+    fmt.Fprintf(out, "--- [%s] %d bytes\n", name, len(output))
+    out.Write(output)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+)
+
+func TestGophermapPreview(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", "some notes")
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "Welcome\n="+dir+"/notes.txt\n*\n")
+
+    /* Exactly as served for the directory */
+    served, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ dir, testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    out := &bytes.Buffer{}
+    if code := runGophermapPreview(gophermapPath, testHost, false, out); code != 0 || out.String() != string(served) {
+        t.Errorf("expected preview as served (exit 0), got exit %d %q", code, out.String())
+    }
+
+    /* Sections marked with their type, the listing last before the footer */
+    out.Reset()
+    if code := runGophermapPreview(gophermapPath, testHost, true, out); code != 0 {
+        t.Fatalf("expected exit 0 previewing sections, got %d", code)
+    }
+    output := out.String()
+    for _, expected := range []string{ "--- [1 GophermapText] ", "--- [2 GophermapText] ", "--- [3 GophermapDirListing] ", "--- [footer] " } {
+        if !strings.Contains(output, expected) {
+            t.Errorf("expected %q in sections preview, got:\n%s", expected, output)
+        }
+    }
+    if !strings.HasSuffix(output, string(Config.Current().FooterText)) {
+        t.Errorf("expected sections preview to end with footer, got:\n%s", output)
+    }
+
+    out.Reset()
+    if code := runGophermapPreview(dir+"/missing/"+GophermapFileStr, testHost, false, out); code == 0 {
+        t.Errorf("expected non-zero exit previewing missing gophermap, got output %q", out.String())
+    }
+}
+
+func TestGophermapPreviewWithoutChroot(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    writeTestFile(t, dir, "notes.txt", "some notes\n")
+    writeTestFile(t, dir, "docs/"+GophermapFileStr, "=/notes.txt\n*\n")
+    writeTestFile(t, dir, "docs/guide.txt", "guide")
+
+    /* Include resolved under the server root, listing selectors within it */
+    setupUnchrootedFileSystem(dir, false)
+    Config.FileSystem.Init(1, 1, 0)
+    Config.FileSystem.NoCache = true
+    root := Config.FileSystem.Root
+    host := &ConnHost{ testHost.Name, testHost.Port, root, "" }
+
+    out := &bytes.Buffer{}
+    if code := runGophermapPreview(Config.FileSystem.DiskPath("/docs/"+GophermapFileStr), host, false, out); code != 0 {
+        t.Fatalf("expected exit 0 previewing, got %d %q", code, out.String())
+    }
+    output := out.String()
+    if !strings.Contains(output, "some notes") || !strings.Contains(output, "1..\t/\t") || !strings.Contains(output, "0guide.txt\t/docs/guide.txt\t") {
+        t.Errorf("expected include and listing resolved within server root, got %q", output)
+    }
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+/* GophermapProxy:
+ * An implementation of GophermapSection marking a name in
+ * the gophermap's directory as a proxied remote resource.
+ * It renders nothing itself (link to it with a regular menu
+ * line), instead requests for the name are relayed to the
+ * remote gopher server and the response streamed back.
+ */
+type GophermapProxy struct {
+    Name     string
+    Host     string
+    Port     string
+    Selector string
+}
+
+/* Create proxy from '%proxy name host port [selector]' directive arguments,
+ * false if arguments invalid
+ */
+func NewGophermapProxy(args []string) (*GophermapProxy, bool) {
+    if len(args) < 4 || len(args) > 5 || strings.Contains(args[1], "/") {
+        return nil, false
+    }
+
+    selector := ""
+    if len(args) == 5 {
+        selector = args[4]
+    }
+    return &GophermapProxy{ args[1], args[2], args[3], selector }, true
+}
+
+func (p *GophermapProxy) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    return nil, nil
+}
+
+/* Dial remote server, relay selector (and query if any) then stream the
+ * response back via send, up to max bytes and within timeout
+ */
+func (p *GophermapProxy) Relay(query string, send func([]byte) *GophorError) *GophorError {
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(p.Host, p.Port), RemoteDialTimeout)
+    if err != nil {
+        return &GophorError{ RemoteDialErr, err }
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(ProxyTimeout))
+
+    request := p.Selector
+    if query != "" {
+        request += Tab+query
+    }
+    _, err = conn.Write([]byte(request+DOSLineEnd))
+    if err != nil {
+        return &GophorError{ RemoteDialErr, err }
+    }
+
+    /* Stream response, anything beyond max bytes is dropped */
+    reader := io.LimitReader(conn, ProxyMaxBytes)
+    buf := make([]byte, FileReadBufSize)
+    sent := 0
+    for {
+        count, err := reader.Read(buf)
+        if count > 0 {
+            gophorErr := send(buf[:count])
+            if gophorErr != nil {
+                return gophorErr
+            }
+            sent += count
+        }
+
+        if err == io.EOF {
+            return nil
+        } else if err != nil {
+            /* Only report failure if nothing sent, else client gets a truncated response */
+            if sent == 0 {
+                return &GophorError{ RemoteReadErr, err }
+            }
+            Config.LogSystemError("Proxied response from %s:%s truncated: %s\n", p.Host, p.Port, err.Error())
+            return nil
+        }
+    }
+}
+
+/* Find proxy for request path declared in the gophermap of its directory.
+ * Real files always take precedence, and nothing is proxied unless remote
+ * content is enabled
+ */
+func findGophermapProxy(requestPath string) *GophermapProxy {
+    if !Config.RemoteEnabled || requestPath == "/" {
+        return nil
+    }
+    if _, err := os.Stat(requestPath); err == nil {
+        return nil
+    }
+
+    gophermapPath, ok := findGophermap(path.Dir(requestPath))
+    if !ok {
+        return nil
+    }
+
+    name := path.Base(requestPath)
+    var proxy *GophermapProxy
+    bufferedScan(gophermapPath,
+        func(scanner *bufio.Scanner) bool {
+            line := scanner.Text()
+
+            switch parseLineType(line) {
+                case TypeDirective:
+                    args := strings.Fields(line[1:])
+                    if args[0] != DirectiveProxy {
+                        break
+                    }
+                    if p, ok := NewGophermapProxy(args); ok && p.Name == name {
+                        proxy = p
+                        return false
+                    }
+
+                case TypeEnd, TypeEndBeginList:
+                    /* Nothing of interest after these lines */
+                    return false
+            }
+
+            return true
+        },
+    )
+
+    return proxy
+}
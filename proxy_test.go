@@ -0,0 +1,97 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "path"
+    "testing"
+)
+
+/* Start remote replying with the request line it received */
+func startEchoRemote(t *testing.T) (string, string) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+
+            line, _ := bufio.NewReader(conn).ReadString('\n')
+            fmt.Fprintf(conn, "got: %q", line)
+            conn.Close()
+        }
+    }()
+
+    host, port, _ := net.SplitHostPort(listener.Addr().String())
+    return host, port
+}
+
+func TestFindGophermapProxy(t *testing.T) {
+    setupTestConfig()
+    Config.RemoteEnabled = true
+    dir := t.TempDir()
+    writeTestFile(t, dir, GophermapFileStr, "%proxy weather example.org 70 /forecast\n%proxy notes example.org 70\n")
+    writeTestFile(t, dir, "notes", "real file")
+
+    proxy := findGophermapProxy(path.Join(dir, "weather"))
+    if proxy == nil || *proxy != (GophermapProxy{ "weather", "example.org", "70", "/forecast" }) {
+        t.Errorf("expected proxy for weather, got %+v", proxy)
+    }
+
+    /* Real files take precedence, undeclared names aren't proxied */
+    for _, name := range []string{ "notes", "other" } {
+        if proxy := findGophermapProxy(path.Join(dir, name)); proxy != nil {
+            t.Errorf("expected no proxy for %s, got %+v", name, proxy)
+        }
+    }
+
+    /* Nothing proxied with remote content disabled */
+    Config.RemoteEnabled = false
+    if proxy := findGophermapProxy(path.Join(dir, "weather")); proxy != nil {
+        t.Errorf("expected no proxy with remote disabled, got %+v", proxy)
+    }
+}
+
+func TestGophermapProxyRelay(t *testing.T) {
+    setupTestConfig()
+    host, port := startEchoRemote(t)
+    proxy := &GophermapProxy{ "search", host, port, "/search" }
+
+    output := ""
+    gophorErr := proxy.Relay("gopher", func(b []byte) *GophorError {
+        output += string(b)
+        return nil
+    })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    if expected := fmt.Sprintf("got: %q", "/search\tgopher\r\n"); output != expected {
+        t.Errorf("expected relayed response %q, got %q", expected, output)
+    }
+}
+
+func TestGophermapProxyRelayDialFailure(t *testing.T) {
+    setupTestConfig()
+
+    /* Grab a free port then close it, so nothing is listening */
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    host, port, _ := net.SplitHostPort(listener.Addr().String())
+    listener.Close()
+
+    proxy := &GophermapProxy{ "dead", host, port, "" }
+    gophorErr := proxy.Relay("", func(b []byte) *GophorError { return nil })
+    if gophorErr == nil || gophorErr.Code != RemoteDialErr {
+        t.Errorf("expected remote dial error, got %v", gophorErr)
+    }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+/* RateLimiter:
+ * Per-client token bucket rate limiter, keyed by client
+ * IP. Buckets refill at the configured rate up to burst
+ * size, and idle buckets are periodically evicted so
+ * memory doesn't grow unbounded.
+ */
+type RateLimiter struct {
+    Buckets map[string]*TokenBucket
+    Mutex   sync.Mutex
+    Rate    float64
+    Burst   float64
+}
+
+/* TokenBucket:
+ * Holds the current token count for a client, and
+ * the time the bucket was last refilled.
+ */
+type TokenBucket struct {
+    Tokens     float64
+    LastRefill time.Time
+}
+
+/* Function used to get the current time when refilling buckets, swappable
+ * so time passing can be simulated
+ */
+var rateLimiterNow = time.Now
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+    return &RateLimiter{
+        make(map[string]*TokenBucket),
+        sync.Mutex{},
+        rate,
+        float64(burst),
+    }
+}
+
+/* Check if client at ip is allowed a request, taking a token if so */
+func (rl *RateLimiter) Allow(ip string) bool {
+    rl.Mutex.Lock()
+    defer rl.Mutex.Unlock()
+
+    now := rateLimiterNow()
+    bucket, ok := rl.Buckets[ip]
+    if !ok {
+        /* New client, start with a full bucket */
+        bucket = &TokenBucket{ rl.Burst, now }
+        rl.Buckets[ip] = bucket
+    } else {
+        /* Refill tokens for time passed since last request */
+        bucket.Tokens += now.Sub(bucket.LastRefill).Seconds() * rl.Rate
+        if bucket.Tokens > rl.Burst {
+            bucket.Tokens = rl.Burst
+        }
+        bucket.LastRefill = now
+    }
+
+    if bucket.Tokens < 1 {
+        return false
+    }
+    bucket.Tokens -= 1
+    return true
+}
+
+/* Remove buckets that would have refilled completely, these
+ * clients are indistinguishable from new ones
+ */
+func (rl *RateLimiter) evictStale() {
+    rl.Mutex.Lock()
+    defer rl.Mutex.Unlock()
+
+    now := rateLimiterNow()
+    for ip, bucket := range rl.Buckets {
+        if bucket.Tokens + now.Sub(bucket.LastRefill).Seconds() * rl.Rate >= rl.Burst {
+            delete(rl.Buckets, ip)
+        }
+    }
+}
+
+func startRateLimiterCleanup(rl *RateLimiter, sleepTime time.Duration) {
+    go func() {
+        for {
+            time.Sleep(sleepTime)
+            rl.evictStale()
+        }
+    }()
+}
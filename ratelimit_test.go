@@ -0,0 +1,120 @@
+package main
+
+import (
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+/* Replace the rate limiter clock with one only moved on by the returned
+ * function, restored when the test ends
+ */
+func fakeRateLimiterClock(t *testing.T) func(time.Duration) {
+    now := time.Now()
+    rateLimiterNow = func() time.Time { return now }
+    t.Cleanup(func() { rateLimiterNow = time.Now })
+    return func(d time.Duration) {
+        now = now.Add(d)
+    }
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+    tests := []struct {
+        Name     string
+        Rate     float64
+        Burst    int
+        Requests []time.Duration
+        Expected []bool
+    }{
+        /* Each request made after the given time has passed */
+        { "burst exhausted",        1, 3, []time.Duration{ 0, 0, 0, 0 },                        []bool{ true, true, true, false } },
+        { "refilled over time",     1, 2, []time.Duration{ 0, 0, 0, time.Second, 0 },           []bool{ true, true, false, true, false } },
+        { "partial refill",         2, 1, []time.Duration{ 0, time.Second/4, time.Second/4 },   []bool{ true, false, true } },
+        { "refill capped at burst", 1, 2, []time.Duration{ 0, 0, time.Hour, 0, 0, 0 },          []bool{ true, true, true, true, false, false } },
+        { "zero burst",             1, 0, []time.Duration{ 0, time.Hour },                      []bool{ false, false } },
+    }
+
+    for _, test := range tests {
+        advance := fakeRateLimiterClock(t)
+        rl := NewRateLimiter(test.Rate, test.Burst)
+        for i, wait := range test.Requests {
+            advance(wait)
+            if allowed := rl.Allow("192.0.2.1"); allowed != test.Expected[i] {
+                t.Errorf("%s: request %d allowed = %t, expected %t", test.Name, i+1, allowed, test.Expected[i])
+            }
+        }
+    }
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+    fakeRateLimiterClock(t)
+    rl := NewRateLimiter(1, 1)
+
+    /* One client exhausting its bucket doesn't affect another */
+    if !rl.Allow("192.0.2.1") || rl.Allow("192.0.2.1") {
+        t.Fatal("expected first client allowed one request only")
+    }
+    if !rl.Allow("192.0.2.2") {
+        t.Error("expected second client allowed despite first being limited")
+    }
+    if rl.Allow("192.0.2.1") {
+        t.Error("expected first client still limited")
+    }
+}
+
+func TestRateLimiterEvictStale(t *testing.T) {
+    advance := fakeRateLimiterClock(t)
+    rl := NewRateLimiter(1, 4)
+
+    /* Drained and half drained buckets, the latter refilled first */
+    for i := 0; i < 4; i += 1 {
+        rl.Allow("192.0.2.1")
+    }
+    rl.Allow("192.0.2.2")
+    rl.Allow("192.0.2.2")
+
+    advance(2*time.Second)
+    rl.evictStale()
+    if _, ok := rl.Buckets["192.0.2.2"]; ok {
+        t.Error("expected fully refilled bucket evicted")
+    }
+    if _, ok := rl.Buckets["192.0.2.1"]; !ok {
+        t.Fatal("expected partly refilled bucket kept")
+    }
+
+    /* Kept bucket remembers what's left, evicted once full too */
+    if !rl.Allow("192.0.2.1") || !rl.Allow("192.0.2.1") || rl.Allow("192.0.2.1") {
+        t.Error("expected kept bucket to have only its 2 refilled tokens")
+    }
+    advance(time.Hour)
+    rl.evictStale()
+    if len(rl.Buckets) != 0 {
+        t.Errorf("expected all buckets evicted once refilled, %d left", len(rl.Buckets))
+    }
+}
+
+func TestServeRateLimited(t *testing.T) {
+    setupTestConfig()
+    fakeRateLimiterClock(t)
+    Config.RateLimiter = NewRateLimiter(1, 0)
+    filePath := writeTestFile(t, t.TempDir(), "file.txt", "contents")
+
+    /* Rejected before the selector is read, so the client's write is left
+     * unread and the connection closed
+     */
+    server, client := net.Pipe()
+    go client.Write([]byte(filePath+DOSLineEnd))
+    output := make(chan string)
+    go func() {
+        b, _ := io.ReadAll(client)
+        output <- string(b)
+    }()
+
+    NewWorker(&GophorConn{ server, testHost, 0 }).Serve()
+    response := <-output
+    if !strings.HasPrefix(response, "3") || !strings.Contains(response, "429 Too Many Requests") || strings.Contains(response, "contents") {
+        t.Errorf("expected type 3 rate limit error, got %q", response)
+    }
+}
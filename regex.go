@@ -1,31 +1,33 @@
 package main
 
 import (
+    "errors"
     "regexp"
-    "strings"
 )
 
-func compileUserRestrictedFilesRegex(restrictedFiles string) []*regexp.Regexp {
-    Config.LogSystem("Compiling restricted file regular expressions\n")
+func compileUserRestrictedFilesRegex(restrictedFiles string) ([]*regexp.Regexp, error) {
+    if restrictedFiles != "" {
+        Config.LogSystem("Compiling restricted file regular expressions\n")
+    }
 
     /* Return slice */
     restrictedFilesRegex := make([]*regexp.Regexp, 0)
 
     /* Split the user supplied RestrictedFiles string by new-line */
-    for _, expr := range strings.Split(restrictedFiles, "\n") {
+    for _, expr := range splitNonEmpty(restrictedFiles, "\n") {
         regex, err := regexp.Compile(expr)
         if err != nil {
-            Config.LogSystemFatal("Failed compiling user restricted files regex: %s\n", expr)
+            return nil, errors.New("failed compiling user restricted files regex "+expr+": "+err.Error())
         }
         restrictedFilesRegex = append(restrictedFilesRegex, regex)
     }
 
-    return restrictedFilesRegex
+    return restrictedFilesRegex, nil
 }
 
 /* Iterate through restricted file expressions, check if file _is_ restricted */
 func isRestrictedFile(name string) bool {
-    for _, regex := range Config.RestrictedFiles {
+    for _, regex := range Config.Current().RestrictedFiles {
         if regex.MatchString(name) {
             return true
         }
@@ -0,0 +1,147 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "io"
+    "io/ioutil"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* GophermapRemoteListing:
+ * An implementation of GophermapSection that fetches a
+ * remote gopher server's menu and inlines it, keeping
+ * the sanitized result (or error) for a short TTL so we
+ * don't dial out on every single render. Only one fetch
+ * runs at a time, and it happens outside of the mutex so
+ * renders never queue behind a slow remote.
+ */
+type GophermapRemoteListing struct {
+    Host     string
+    Port     string
+    Selector string
+
+    Mutex    sync.Mutex
+    Contents []byte
+    Fetched  time.Time
+    Fetching chan struct{}
+}
+
+func NewGophermapRemoteListing(host, port, selector string) *GophermapRemoteListing {
+    return &GophermapRemoteListing{ Host: host, Port: port, Selector: selector }
+}
+
+/* Function used to fetch remote menus, swappable for testing */
+var remoteFetch = fetchRemoteMenu
+
+func (s *GophermapRemoteListing) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    s.Mutex.Lock()
+
+    /* Serve from our copy if still within TTL */
+    if s.Contents != nil && time.Since(s.Fetched) < Config.RemoteTTL {
+        contents := s.Contents
+        s.Mutex.Unlock()
+        return contents, nil
+    }
+
+    /* Start a fetch, unless one is already in progress */
+    fetching := s.Fetching
+    if fetching == nil {
+        fetching = make(chan struct{})
+        s.Fetching = fetching
+        go s.fetch(fetching)
+    }
+
+    /* If we have a stale copy serve that while the fetch runs, else wait */
+    contents := s.Contents
+    s.Mutex.Unlock()
+    if contents != nil {
+        return contents, nil
+    }
+
+    <-fetching
+    s.Mutex.Lock()
+    contents = s.Contents
+    s.Mutex.Unlock()
+    return contents, nil
+}
+
+/* Fetch remote menu, storing result (or error line) then signalling done */
+func (s *GophermapRemoteListing) fetch(done chan struct{}) {
+    menu, gophorErr := remoteFetch(s.Host, s.Port, s.Selector)
+
+    var contents []byte
+    if gophorErr != nil {
+        /* Failures are kept for the TTL too, so a dead remote isn't hammered */
+        Config.LogSystemError("Failed fetching remote listing gopher://%s:%s/1%s: %s\n", s.Host, s.Port, s.Selector, gophorErr.Error())
+        contents = buildInfoLine("Error fetching remote listing: "+s.Host)
+    } else {
+        contents = sanitizeRemoteMenu(menu, s.Host, s.Port)
+    }
+
+    s.Mutex.Lock()
+    s.Contents = contents
+    s.Fetched  = time.Now()
+    s.Fetching = nil
+    s.Mutex.Unlock()
+
+    close(done)
+}
+
+/* Dial remote gopher server, request selector and read the response */
+func fetchRemoteMenu(host, port, selector string) ([]byte, *GophorError) {
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), RemoteDialTimeout)
+    if err != nil {
+        return nil, &GophorError{ RemoteDialErr, err }
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(RemoteReadTimeout))
+
+    _, err = conn.Write([]byte(selector+DOSLineEnd))
+    if err != nil {
+        return nil, &GophorError{ RemoteDialErr, err }
+    }
+
+    /* Read up to max bytes, anything beyond is dropped */
+    contents, err := ioutil.ReadAll(io.LimitReader(conn, RemoteMaxBytes))
+    if err != nil {
+        return nil, &GophorError{ RemoteReadErr, err }
+    }
+
+    return contents, nil
+}
+
+/* Sanitize a remote menu, dropping malformed lines and the terminating
+ * last line. If requested, entries advertising some other host (e.g. an
+ * internal name) are rewritten to the host and port we dialled
+ */
+func sanitizeRemoteMenu(menu []byte, host, port string) []byte {
+    output := make([]byte, 0)
+
+    scanner := bufio.NewScanner(bytes.NewReader(menu))
+    for scanner.Scan() {
+        line := strings.TrimSuffix(scanner.Text(), "\r")
+        if line == End {
+            break
+        }
+
+        /* Valid menu lines have type + display, selector, host and port */
+        fields := strings.Split(line, Tab)
+        if len(line) < 1 || len(fields) < 4 || strings.ContainsAny(line, "\x00\r") {
+            continue
+        }
+
+        /* Info and error lines keep their null host */
+        itemType := ItemType(line[0])
+        if Config.RemoteRewrite && itemType != TypeInfo && itemType != TypeError {
+            fields[2], fields[3] = host, port
+        }
+
+        output = append(output, []byte(strings.Join(fields[:4], Tab)+DOSLineEnd)...)
+    }
+
+    return output
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+/* Start mock remote gopher server replying with menu, returning host and
+ * port. Counts connections served
+ */
+func startMockRemote(t *testing.T, menu string, count *int32) (string, string) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            atomic.AddInt32(count, 1)
+
+            /* Read selector line, reply then close */
+            buf := make([]byte, 256)
+            conn.Read(buf)
+            conn.Write([]byte(menu))
+            conn.Close()
+        }
+    }()
+
+    host, port, _ := net.SplitHostPort(listener.Addr().String())
+    return host, port
+}
+
+func TestRemoteListingMockRemote(t *testing.T) {
+    setupTestConfig()
+    Config.RemoteTTL     = time.Minute
+    Config.RemoteRewrite = true
+
+    var count int32
+    menu := "iWelcome\t\tnull.host\t0\r\n"+
+            "0About\t/about.txt\tinternal.lan\t70\r\n"+
+            "malformed line\r\n"+
+            ".\r\n"+
+            "0After end\t/after\tinternal.lan\t70\r\n"
+    host, port := startMockRemote(t, menu, &count)
+
+    listing := NewGophermapRemoteListing(host, port, "/")
+    output, gophorErr := listing.Render(&FileSystemRequest{ "/", testHost, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+
+    expected := "iWelcome\t\tnull.host\t0\r\n"+
+                "0About\t/about.txt\t"+host+"\t"+port+"\r\n"
+    if string(output) != expected {
+        t.Errorf("expected sanitized menu %q, got %q", expected, output)
+    }
+
+    /* Within TTL we shouldn't dial again */
+    listing.Render(&FileSystemRequest{ "/", testHost, "", nil, "" })
+    if n := atomic.LoadInt32(&count); n != 1 {
+        t.Errorf("expected single remote fetch within TTL, got %d", n)
+    }
+}
+
+func TestRemoteListingFailureCached(t *testing.T) {
+    setupTestConfig()
+    Config.RemoteTTL = time.Minute
+
+    /* Slow failing remote, hit by many concurrent renders */
+    var calls int32
+    remoteFetch = func(host, port, selector string) ([]byte, *GophorError) {
+        atomic.AddInt32(&calls, 1)
+        time.Sleep(50*time.Millisecond)
+        return nil, &GophorError{ RemoteDialErr, nil }
+    }
+    defer func() { remoteFetch = fetchRemoteMenu }()
+
+    listing := NewGophermapRemoteListing("dead.host", "70", "/")
+    var wg sync.WaitGroup
+    for i := 0; i < 10; i += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            output, _ := listing.Render(&FileSystemRequest{ "/", testHost, "", nil, "" })
+            if string(output) != string(buildInfoLine("Error fetching remote listing: dead.host")) {
+                t.Errorf("expected error line, got %q", output)
+            }
+        }()
+    }
+    wg.Wait()
+
+    /* Failure is cached for the TTL */
+    listing.Render(&FileSystemRequest{ "/", testHost, "", nil, "" })
+    if n := atomic.LoadInt32(&calls); n != 1 {
+        t.Errorf("expected single fetch of dead remote, got %d", n)
+    }
+}
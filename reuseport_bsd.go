@@ -0,0 +1,12 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+    "syscall"
+)
+
+/* Set SO_REUSEPORT on socket */
+func setReusePort(fd uintptr) error {
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEPORT, 1)
+}
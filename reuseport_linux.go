@@ -0,0 +1,13 @@
+package main
+
+import (
+    "syscall"
+)
+
+/* SO_REUSEPORT, missing from the syscall package on Linux */
+const soReusePort = 0xf
+
+/* Set SO_REUSEPORT on socket */
+func setReusePort(fd uintptr) error {
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
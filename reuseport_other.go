@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+    "errors"
+)
+
+/* SO_REUSEPORT isn't available here, listeners are never shared */
+func setReusePort(fd uintptr) error {
+    return errors.New("SO_REUSEPORT unsupported on this platform")
+}
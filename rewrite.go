@@ -0,0 +1,89 @@
+package main
+
+import (
+    "strings"
+)
+
+/* SelectorRewrite:
+ * An old selector mapped to its new location, so links
+ * to a reorganised site keep working. Prefix rewrites
+ * cover everything below the old selector too, keeping
+ * whatever followed it. Redirecting rewrites send a
+ * menu pointing at the new location, the rest serve it
+ * in place of the old.
+ */
+type SelectorRewrite struct {
+    From     string
+    To       string
+    Prefix   bool
+    Redirect bool
+}
+
+/* Check rewrite covers selector */
+func (rewrite *SelectorRewrite) Matches(selector string) bool {
+    if rewrite.Prefix {
+        return hasPathPrefix(selector, rewrite.From)
+    }
+    return selector == rewrite.From
+}
+
+/* Rewrite selector covered by this rewrite to its new location */
+func (rewrite *SelectorRewrite) Apply(selector string) string {
+    if rewrite.From == "/" {
+        return sanitizePath(rewrite.To+selector)
+    }
+    return sanitizePath(rewrite.To+strings.TrimPrefix(selector, rewrite.From))
+}
+
+/* Parse new-line separated 'old=new' entries. Old selectors ending '/*' match
+ * as a prefix, and new selectors starting '>' are redirected to rather than
+ * served in place, e.g. '/blog/*=>/posts'
+ */
+func parseSelectorRewrites(entries string) []*SelectorRewrite {
+    rewrites := make([]*SelectorRewrite, 0)
+    for _, entry := range splitNonEmpty(entries, "\n") {
+        split := strings.SplitN(entry, "=", 2)
+        if len(split) != 2 || split[0] == "" {
+            Config.LogSystemFatal("Invalid rewrite entry: %s\n", entry)
+        }
+
+        from, prefix := split[0], false
+        if strings.HasSuffix(from, "/*") {
+            from, prefix = strings.TrimSuffix(from, "*"), true
+        }
+
+        to, redirect := split[1], false
+        if strings.HasPrefix(to, ">") {
+            to, redirect = to[1:], true
+        }
+        if to == "" {
+            Config.LogSystemFatal("No new selector supplied for rewrite entry: %s\n", entry)
+        }
+
+        rewrites = append(rewrites, &SelectorRewrite{ sanitizePath(from), sanitizePath(to), prefix, redirect })
+    }
+    return rewrites
+}
+
+/* Find rewrite covering selector, nil if none. The longest matching old
+ * selector takes precedence, exact over prefix where they're the same
+ */
+func findSelectorRewrite(selector string) *SelectorRewrite {
+    var found *SelectorRewrite
+    for _, rewrite := range Config.SelectorRewrites {
+        if !rewrite.Matches(selector) {
+            continue
+        }
+
+        if found == nil || len(rewrite.From) > len(found.From) || (len(rewrite.From) == len(found.From) && found.Prefix && !rewrite.Prefix) {
+            found = rewrite
+        }
+    }
+    return found
+}
+
+/* Render menu pointing at new location of a moved selector */
+func renderRewriteRedirect(host *ConnHost, selector string) []byte {
+    itemType := requestItemType(host.PathFor(selector))
+    return terminateMenu(append(buildInfoLine(MovedNoticeStr), buildLine(itemType, selector, host.SelectorFor(host.PathFor(selector)), host.Name, host.Port)...))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "testing"
+)
+
+func TestParseSelectorRewrites(t *testing.T) {
+    setupTestConfig()
+    rewrites := parseSelectorRewrites("/old=/new\n/blog/*=>posts/\n")
+    if len(rewrites) != 2 {
+        t.Fatalf("expected 2 rewrites, got %d", len(rewrites))
+    }
+
+    if *rewrites[0] != (SelectorRewrite{ "/old", "/new", false, false }) {
+        t.Errorf("unexpected exact rewrite: %+v", *rewrites[0])
+    }
+    if *rewrites[1] != (SelectorRewrite{ "/blog", "/posts", true, true }) {
+        t.Errorf("unexpected prefix redirect: %+v", *rewrites[1])
+    }
+}
+
+func TestSelectorRewriteOverlapping(t *testing.T) {
+    setupTestConfig()
+    Config.SelectorRewrites = parseSelectorRewrites("/docs/*=/manual\n/docs/api/*=/reference\n/docs/api=/api-index\n/docs/apis=/other\n")
+
+    tests := []struct {
+        Selector  string
+        Rewritten string
+    }{
+        { "/docs",              "/manual" },
+        { "/docs/intro.txt",    "/manual/intro.txt" },
+        { "/docs/api",          "/api-index" },
+        { "/docs/api/get.txt",  "/reference/get.txt" },
+        { "/docs/apis",         "/other" },
+        { "/docs/apis/x.txt",   "/manual/apis/x.txt" },
+        { "/documents",         "" },
+    }
+
+    for _, test := range tests {
+        rewrite := findSelectorRewrite(test.Selector)
+        rewritten := ""
+        if rewrite != nil {
+            rewritten = rewrite.Apply(test.Selector)
+        }
+        if rewritten != test.Rewritten {
+            t.Errorf("expected %s rewritten to %q, got %q", test.Selector, test.Rewritten, rewritten)
+        }
+    }
+}
+
+func TestSelectorRewriteServe(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    newPath := writeTestFile(t, dir, "new.txt", "moved here")
+    Config.SelectorRewrites = parseSelectorRewrites(dir+"/old.txt="+newPath+"\n"+dir+"/gone.txt=>"+newPath+"\n")
+
+    /* Served in place */
+    if response, _ := respondTestRequest(dir+"/old.txt"); response != "moved here" {
+        t.Errorf("expected rewritten selector served in place, got %q", response)
+    }
+
+    /* Redirected with a menu linking the new location */
+    expected := string(buildInfoLine(MovedNoticeStr))+string(buildLine(TypeFile, newPath, newPath, testHost.Name, testHost.Port))+LastLine
+    if response, _ := respondTestRequest(dir+"/gone.txt"); response != expected {
+        t.Errorf("expected redirect menu %q, got %q", expected, response)
+    }
+}
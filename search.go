@@ -0,0 +1,100 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "bufio"
+    "errors"
+    "strings"
+)
+
+/* Returned from the search walk function to stop walking early */
+var errSearchLimitReached = errors.New("search result limit reached")
+
+/* Perform a full-text search of text files under the configured search
+ * root, returning a gophermap with an entry for each matching file the
+ * client is allowed access to
+ */
+func search(query string, host *ConnHost, allowed func(string) bool) []byte {
+    /* Create return slice, first add a title + a space */
+    output := make([]byte, 0)
+    output = append(output, buildLine(TypeInfo, "[ Search results for: "+query+" ]", "TITLE", NullHost, NullPort)...)
+    output = append(output, buildInfoLine("")...)
+
+    /* No query, nothing to search for */
+    if query == "" {
+        output = append(output, buildInfoLine("No search query supplied")...)
+        return append(output, Config.Current().FooterText...)
+    }
+
+    /* Case-insensitive searching just compares lower-case */
+    if !Config.SearchCaseSensitive {
+        query = strings.ToLower(query)
+    }
+
+    /* Keep hold of hidden files for each walked directory */
+    hiddenByDir := make(map[string]map[string]bool)
+
+    /* Search within the host's root */
+    searchRoot := host.PathFor(Config.SearchRoot)
+
+    count := 0
+    filepath.Walk(searchRoot, func(itemPath string, info os.FileInfo, err error) error {
+        /* Skip anything we fail to stat */
+        if err != nil {
+            return nil
+        }
+
+        /* Search root itself is never hidden, skip anything hidden or outside ACL */
+        if (itemPath != searchRoot && isHiddenFromWalk(itemPath, info.Name(), hiddenByDir)) || !allowed(itemPath) {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        /* Only search regular text files */
+        if info.Mode() & os.ModeType != 0 || !isTextType(getItemType(itemPath)) {
+            return nil
+        }
+
+        /* Look for first matching line */
+        match := ""
+        bufferedScan(itemPath,
+            func(scanner *bufio.Scanner) bool {
+                line := scanner.Text()
+                compare := line
+                if !Config.SearchCaseSensitive {
+                    compare = strings.ToLower(line)
+                }
+
+                if strings.Contains(compare, query) {
+                    match = line
+                    return false
+                }
+                return true
+            },
+        )
+        if match == "" {
+            return nil
+        }
+
+        /* Tabs would break the gopher line, so replace with spaces */
+        match = strings.TrimSpace(strings.Replace(match, Tab, " ", -1))
+        selector := host.SelectorFor(itemPath)
+        output = append(output, buildLine(getItemType(itemPath), selector+": "+match, selector, host.Name, host.Port)...)
+
+        count += 1
+        if count >= SearchMaxResults {
+            return errSearchLimitReached
+        }
+        return nil
+    })
+
+    if count == 0 {
+        output = append(output, buildInfoLine("No results found")...)
+    }
+
+    /* Append footer text (contains last line) and return */
+    return append(output, Config.Current().FooterText...)
+}
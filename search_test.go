@@ -0,0 +1,111 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+)
+
+/* Search everything, as a client allowed access to all of it */
+func searchAll(query string) string {
+    return string(search(query, testHost, func(string) bool { return true }))
+}
+
+/* Count result lines in search output */
+func countSearchResults(output string) int {
+    count := 0
+    for _, line := range strings.Split(output, DOSLineEnd) {
+        if line != "" && ItemType(line[0]) == TypeFile {
+            count += 1
+        }
+    }
+    return count
+}
+
+func TestSearchMatches(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.SearchRoot = dir
+
+    notesPath := writeTestFile(t, dir, "docs/notes.txt", "First line\nAll about\tgopher holes\nMore gopher\n")
+    writeTestFile(t, dir, "other.txt", "nothing to see\n")
+    writeTestFile(t, dir, "image.png", "gopher\n")
+
+    /* Each matching text file listed once, by its first matching line */
+    output := searchAll("gopher")
+    expected := string(buildLine(TypeFile, notesPath+": All about gopher holes", notesPath, testHost.Name, testHost.Port))
+    if !strings.HasPrefix(output, string(buildLine(TypeInfo, "[ Search results for: gopher ]", "TITLE", NullHost, NullPort))) || !strings.Contains(output, expected) {
+        t.Errorf("expected search result %q, got %q", expected, output)
+    }
+    if count := countSearchResults(output); count != 1 || strings.Contains(output, "image.png") {
+        t.Errorf("expected only text file in results, got %d: %q", count, output)
+    }
+    if !strings.HasSuffix(output, string(Config.Current().FooterText)) {
+        t.Errorf("expected search results to end with footer, got %q", output)
+    }
+
+    if output := searchAll("missing"); !strings.Contains(output, string(buildInfoLine("No results found"))) {
+        t.Errorf("expected no results notice, got %q", output)
+    }
+    if output := searchAll(""); !strings.Contains(output, string(buildInfoLine("No search query supplied"))) {
+        t.Errorf("expected no query notice, got %q", output)
+    }
+}
+
+func TestSearchSkipsHidden(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.SearchRoot = dir
+
+    writeTestFile(t, dir, GophermapFileStr, "-secret.txt\n-private\n")
+    writeTestFile(t, dir, IgnoreFileStr, "*.bak\n")
+    writeTestFile(t, dir, "secret.txt", "password\n")
+    writeTestFile(t, dir, "notes.bak", "password\n")
+    writeTestFile(t, dir, "private/notes.txt", "password\n")
+    publicPath := writeTestFile(t, dir, "public.txt", "password\n")
+
+    output := searchAll("password")
+    if count := countSearchResults(output); count != 1 || !strings.Contains(output, publicPath+": password") {
+        t.Errorf("expected only public file in results, got %d: %q", count, output)
+    }
+}
+
+func TestSearchCaseSensitivity(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.SearchRoot = dir
+    writeTestFile(t, dir, "notes.txt", "All about Gopher\n")
+
+    for _, test := range []struct {
+        CaseSensitive bool
+        Query         string
+        Results       int
+    }{
+        { false, "gopher", 1 },
+        { false, "GOPHER", 1 },
+        { true,  "Gopher", 1 },
+        { true,  "gopher", 0 },
+    } {
+        Config.SearchCaseSensitive = test.CaseSensitive
+        if count := countSearchResults(searchAll(test.Query)); count != test.Results {
+            t.Errorf("case sensitive %t query %q: expected %d results, got %d", test.CaseSensitive, test.Query, test.Results, count)
+        }
+    }
+}
+
+func TestSearchMaxResults(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.SearchRoot = dir
+    for i := 0; i < SearchMaxResults+10; i += 1 {
+        writeTestFile(t, dir, fmt.Sprintf("%03d.txt", i), "gopher\n")
+    }
+
+    if count := countSearchResults(searchAll("gopher")); count != SearchMaxResults {
+        t.Errorf("expected results capped at %d, got %d", SearchMaxResults, count)
+    }
+}
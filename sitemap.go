@@ -0,0 +1,95 @@
+package main
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+)
+
+/* SitemapFileContents:
+ * Implementation of FileContents listing every selector
+ * reachable under a root, one per line. The tree is
+ * walked at most once per interval, as a full walk of a
+ * big site is expensive. Only what anyone may access is
+ * listed, so the same sitemap can be served to all.
+ */
+type SitemapFileContents struct {
+    Root      string
+    Interval  time.Duration
+
+    Mutex     sync.Mutex
+    Paths     []string
+    Generated time.Time
+}
+
+func (fc *SitemapFileContents) Render(request *FileSystemRequest) []byte {
+    fc.Mutex.Lock()
+    if fc.Paths == nil || time.Since(fc.Generated) > fc.Interval {
+        fc.Paths     = walkSitemap(fc.Root)
+        fc.Generated = time.Now()
+    }
+    paths := fc.Paths
+    fc.Mutex.Unlock()
+
+    /* Selectors are relative to the host requested through */
+    text := ""
+    for _, p := range paths {
+        text += request.Host.SelectorFor(p)+DOSLineEnd
+    }
+    return []byte(text)
+}
+
+func (fc *SitemapFileContents) Load() *GophorError {
+    /* do nothing */
+    return nil
+}
+
+func (fc *SitemapFileContents) Clear() {
+    /* do nothing */
+}
+
+/* Serve generated sitemap at path, unless there's a real file there */
+func cacheSitemapFile(filePath string) {
+    _, err := os.Stat(filePath)
+    if err == nil {
+        return
+    }
+    storePolicyFile(filePath, &SitemapFileContents{ Root: path.Dir(filePath), Interval: Config.SitemapInterval })
+}
+
+/* Walk tree at root collecting paths of every file and directory that can be
+ * requested, skipping hidden files and anything with access restrictions
+ */
+func walkSitemap(root string) []string {
+    paths := make([]string, 0)
+    hiddenByDir := make(map[string]map[string]bool)
+
+    filepath.Walk(root, func(itemPath string, info os.FileInfo, err error) error {
+        /* Skip anything we fail to stat */
+        if err != nil {
+            return nil
+        }
+
+        /* Skip hidden files and restricted directories, with all below */
+        if itemPath != root && isHiddenFromWalk(itemPath, info.Name(), hiddenByDir) || len(accessRestrictions(itemPath)) > 0 {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        /* Gophermaps themselves are served via their directory */
+        if isGophermapName(info.Name()) || info.Mode() & (os.ModeType &^ os.ModeDir) != 0 {
+            return nil
+        }
+
+        paths = append(paths, itemPath)
+        return nil
+    })
+
+    sort.Strings(paths)
+    return paths
+}
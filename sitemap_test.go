@@ -0,0 +1,56 @@
+package main
+
+import (
+    "os"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestWalkSitemap(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "public.txt", "public")
+    writeTestFile(t, dir, "hidden.txt", "hidden")
+    writeTestFile(t, dir, GophermapFileStr, "-hidden.txt\niHello\n")
+    if err := os.MkdirAll(path.Join(dir, "docs"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    writeTestFile(t, path.Join(dir, "docs"), "manual.txt", "manual")
+    if err := os.MkdirAll(path.Join(dir, "private"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    writeTestFile(t, path.Join(dir, "private"), AclFileStr, "192.168.0.0/16\n")
+    writeTestFile(t, path.Join(dir, "private"), "secret.txt", "secret")
+
+    expected := []string{ dir, dir+"/docs", dir+"/docs/manual.txt", dir+"/public.txt" }
+    if paths := walkSitemap(dir); strings.Join(paths, " ") != strings.Join(expected, " ") {
+        t.Errorf("expected sitemap %v, got %v", expected, paths)
+    }
+}
+
+func TestSitemapRegenerated(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "first.txt", "first")
+
+    contents := &SitemapFileContents{ Root: dir, Interval: time.Hour }
+    request := &FileSystemRequest{ dir+"/sitemap.txt", testHost, "", nil, "" }
+    expected := dir+DOSLineEnd+dir+"/first.txt"+DOSLineEnd
+    if output := string(contents.Render(request)); output != expected {
+        t.Errorf("expected sitemap %q, got %q", expected, output)
+    }
+
+    /* New files only listed once the interval has passed */
+    writeTestFile(t, dir, "second.txt", "second")
+    if output := string(contents.Render(request)); output != expected {
+        t.Errorf("expected cached sitemap %q within interval, got %q", expected, output)
+    }
+
+    contents.Generated = time.Now().Add(-2*time.Hour)
+    expected += dir+"/second.txt"+DOSLineEnd
+    if output := string(contents.Render(request)); output != expected {
+        t.Errorf("expected regenerated sitemap %q, got %q", expected, output)
+    }
+}
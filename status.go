@@ -0,0 +1,107 @@
+package main
+
+import (
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+/* When the server started, for uptime */
+var startTime = time.Now()
+
+/* Requests handled so far, by access log status */
+var (
+    servedCount   int64
+    notFoundCount int64
+    errorCount    int64
+)
+
+/* Requests handled so far, by item type of the resource requested */
+var requestsByType [256]int64
+
+/* Count handled request with supplied access log status and item type */
+func countRequest(status string, itemType ItemType) {
+    atomic.AddInt64(&requestsByType[itemType], 1)
+    switch status {
+        case RequestServed:
+            atomic.AddInt64(&servedCount, 1)
+        case RequestNotFound:
+            atomic.AddInt64(&notFoundCount, 1)
+        default:
+            atomic.AddInt64(&errorCount, 1)
+    }
+}
+
+/* StatusFileContents:
+ * Implementation of FileContents that generates the
+ * server status page afresh on every render, so it's
+ * never served stale from memory.
+ */
+type StatusFileContents struct {}
+
+func (fc *StatusFileContents) Render(request *FileSystemRequest) []byte {
+    return generateStatusTxt()
+}
+
+func (fc *StatusFileContents) Load() *GophorError {
+    /* do nothing */
+    return nil
+}
+
+func (fc *StatusFileContents) Clear() {
+    /* do nothing */
+}
+
+/* Format request counts by item type as 'type:count' pairs, e.g. '0:12,1:3' */
+func formatRequestTypeCounts() string {
+    pairs := make([]string, 0)
+    for i := range requestsByType {
+        if count := atomic.LoadInt64(&requestsByType[i]); count > 0 {
+            pairs = append(pairs, string(rune(i))+":"+strconv.FormatInt(count, 10))
+        }
+    }
+    return strings.Join(pairs, ",")
+}
+
+/* Serve live status page at path, unless there's a real file there */
+func cacheStatusFile(filePath string) {
+    _, err := os.Stat(filePath)
+    if err == nil {
+        return
+    }
+    storePolicyFile(filePath, &StatusFileContents{})
+}
+
+func generateStatusTxt() []byte {
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+
+    text := "# This is an automatically generated"+DOSLineEnd
+    text += "# server status file: status.txt"+DOSLineEnd
+    text += DOSLineEnd
+    text += "ServerSoftware=Gophor"+DOSLineEnd
+    text += "ServerSoftwareVersion="+GophorVersion+DOSLineEnd
+    text += "Uptime="+time.Since(startTime).Truncate(time.Second).String()+DOSLineEnd
+    text += DOSLineEnd
+    text += "RequestsServed="+strconv.FormatInt(atomic.LoadInt64(&servedCount), 10)+DOSLineEnd
+    text += "RequestsNotFound="+strconv.FormatInt(atomic.LoadInt64(&notFoundCount), 10)+DOSLineEnd
+    text += "RequestsErrored="+strconv.FormatInt(atomic.LoadInt64(&errorCount), 10)+DOSLineEnd
+    text += "RequestsByType="+formatRequestTypeCounts()+DOSLineEnd
+    text += "ConnectionsAccepted="+strconv.FormatUint(acceptedConnections(), 10)+DOSLineEnd
+    text += "ConnectionsActive="+strconv.Itoa(int(activeConnections()))+DOSLineEnd
+    text += "ConnectionsRejected="+strconv.FormatInt(rejectedConnections(), 10)+DOSLineEnd
+    text += DOSLineEnd
+    text += "CacheFiles="+strconv.Itoa(Config.FileSystem.CacheCount())+DOSLineEnd
+    text += "CacheShards="+strconv.Itoa(len(Config.FileSystem.CacheShards))+DOSLineEnd
+    text += "CacheFileMax="+strconv.FormatInt(atomic.LoadInt64(&Config.FileSystem.CacheFileMax), 10)+DOSLineEnd
+    text += DOSLineEnd
+    text += "Goroutines="+strconv.Itoa(runtime.NumGoroutine())+DOSLineEnd
+    text += "HeapAlloc="+strconv.FormatUint(mem.HeapAlloc, 10)+DOSLineEnd
+    text += "HeapSys="+strconv.FormatUint(mem.HeapSys, 10)+DOSLineEnd
+    text += "HeapObjects="+strconv.FormatUint(mem.HeapObjects, 10)+DOSLineEnd
+    text += "NumGC="+strconv.FormatUint(uint64(mem.NumGC), 10)+DOSLineEnd
+    return []byte(text)
+}
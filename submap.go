@@ -0,0 +1,120 @@
+package main
+
+import (
+    "os"
+    "sync"
+)
+
+/* SubmapCache:
+ * Parsed sections of gophermaps included by other gophermaps,
+ * keyed by path and only reused while the modified times on
+ * disk of the submap and everything it includes are unchanged.
+ * Parents are only parsed on a file cache miss or change, but
+ * a submap shared by many parents would otherwise be re-read
+ * from disk for each of them.
+ */
+type SubmapCache struct {
+    Entries map[string]*SubmapCacheEntry
+    Mutex   sync.RWMutex
+}
+
+/* SubmapCacheEntry:
+ * Parsed submap sections, and the modified times of
+ * the submap file and every file (or glob include
+ * directory) read into them, keyed by path. Missing
+ * files are noted too, in case they turn up.
+ */
+type SubmapCacheEntry struct {
+    ModTimes map[string]int64
+    Sections []GophermapSection
+}
+
+/* Get paths of everything read into the entry's sections, besides the submap */
+func (entry *SubmapCacheEntry) Sources(submapPath string) []string {
+    sources := make([]string, 0, len(entry.ModTimes))
+    for source := range entry.ModTimes {
+        if source != submapPath {
+            sources = append(sources, source)
+        }
+    }
+    return sources
+}
+
+/* Check nothing read into entry's sections has changed on disk since */
+func (entry *SubmapCacheEntry) IsFresh() bool {
+    for source, modTime := range entry.ModTimes {
+        if sourceModTime(source) != modTime {
+            return false
+        }
+    }
+    return true
+}
+
+/* Get modified time of file at path, -1 if it can't be stat'd */
+func sourceModTime(path string) int64 {
+    stat, err := os.Stat(path)
+    if err != nil {
+        return -1
+    }
+    return stat.ModTime().UnixNano()
+}
+
+func NewSubmapCache() *SubmapCache {
+    return &SubmapCache{ Entries: make(map[string]*SubmapCacheEntry) }
+}
+
+/* Read submap sections at path, included by the gophermaps in including,
+ * reusing cached sections if neither the file nor anything it includes has
+ * changed. Also returns the paths of everything it includes. A nil cache
+ * always reads from disk
+ */
+func (c *SubmapCache) Read(path string, including []string) ([]GophermapSection, []string, *GophorError) {
+    if c == nil {
+        return readGophermapSources(path, including)
+    }
+
+    stat, err := os.Stat(path)
+    if err != nil {
+        c.Mutex.Lock()
+        delete(c.Entries, path)
+        c.Mutex.Unlock()
+        return nil, nil, &GophorError{ FileStatErr, err }
+    }
+    modTime := stat.ModTime().UnixNano()
+
+    c.Mutex.RLock()
+    entry, ok := c.Entries[path]
+    c.Mutex.RUnlock()
+    if ok && entry.IsFresh() {
+        return entry.Sections, entry.Sources(path), nil
+    }
+
+    sections, sources, gophorErr := readGophermapSources(path, including)
+    if gophorErr != nil {
+        return nil, nil, gophorErr
+    }
+
+    /* Submap's own time taken before reading, so changes made while it's
+     * read aren't missed. Included files are only known once read
+     */
+    modTimes := map[string]int64{ path: modTime }
+    for _, source := range sources {
+        modTimes[source] = sourceModTime(source)
+    }
+
+    c.Mutex.Lock()
+    c.Entries[path] = &SubmapCacheEntry{ modTimes, sections }
+    c.Mutex.Unlock()
+    return sections, sources, nil
+}
+
+/* Drop all cached submaps, e.g. after a reload changed formatting */
+func (c *SubmapCache) Clear() {
+    if c == nil {
+        return
+    }
+
+    c.Mutex.Lock()
+    c.Entries = make(map[string]*SubmapCacheEntry)
+    c.Mutex.Unlock()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSubmapCache(t *testing.T) {
+    setupTestConfig()
+    Config.SubmapCache = NewSubmapCache()
+    dir := t.TempDir()
+    submapPath := writeTestFile(t, dir, "sub/"+GophermapFileStr, "Shared\n")
+    first := writeTestFile(t, dir, "a/"+GophermapFileStr, "="+submapPath+"\n")
+    second := writeTestFile(t, dir, "b/"+GophermapFileStr, "="+submapPath+"\n*\n")
+
+    /* Both parents reuse the same parsed submap sections */
+    renderTestGophermap(t, first)
+    cached := Config.SubmapCache.Entries[submapPath]
+    if cached == nil {
+        t.Fatal("expected submap cached after parent read")
+    }
+    sections, gophorErr := readGophermap(second)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if Config.SubmapCache.Entries[submapPath] != cached || sections[0] != cached.Sections[0] {
+        t.Errorf("expected cached submap sections reused")
+    }
+
+    /* Parent's own dir listing still comes last */
+    if _, ok := sections[len(sections)-1].(*GophermapDirListing); !ok {
+        t.Errorf("expected parent dir listing as last section, got %T", sections[len(sections)-1])
+    }
+
+    /* Changed submap is re-read */
+    writeTestFile(t, dir, "sub/"+GophermapFileStr, "Changed\n")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(submapPath, modTime, modTime)
+    if output := renderTestGophermap(t, first); output != string(buildInfoLine("Changed")) {
+        t.Errorf("expected changed submap re-read, got %q", output)
+    }
+
+    /* Removed submap drops out of cache */
+    os.Remove(submapPath)
+    renderTestGophermap(t, first)
+    if _, ok := Config.SubmapCache.Entries[submapPath]; ok {
+        t.Errorf("expected removed submap dropped from cache")
+    }
+}
+
+func TestSubmapCacheNestedInclude(t *testing.T) {
+    setupTestConfig()
+    Config.SubmapCache = NewSubmapCache()
+    dir := t.TempDir()
+    textPath := writeTestFile(t, dir, "inner/notes.txt", "Old notes\n")
+    innerPath := writeTestFile(t, dir, "inner/"+GophermapFileStr, "="+textPath+"\n")
+    outerPath := writeTestFile(t, dir, "outer/"+GophermapFileStr, "="+innerPath+"\n")
+    parentPath := writeTestFile(t, dir, "parent/"+GophermapFileStr, "="+outerPath+"\n")
+
+    if output := renderTestGophermap(t, parentPath); !strings.Contains(output, "Old notes") {
+        t.Fatalf("expected nested include rendered, got %q", output)
+    }
+
+    /* Change two submaps down is picked up by the parent, with neither
+     * submap in between changed
+     */
+    writeTestFile(t, dir, "inner/notes.txt", "New notes\n")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(textPath, modTime, modTime)
+    if output := renderTestGophermap(t, parentPath); !strings.Contains(output, "New notes") {
+        t.Errorf("expected changed nested include re-read, got %q", output)
+    }
+
+    /* As are includes that were missing turning up */
+    writeTestFile(t, dir, "inner/"+GophermapFileStr, "="+textPath+"\n="+dir+"/inner/later.txt\n")
+    os.Chtimes(innerPath, modTime.Add(time.Hour), modTime.Add(time.Hour))
+    if output := renderTestGophermap(t, parentPath); !strings.Contains(output, "Error reading include") {
+        t.Fatalf("expected missing include reported, got %q", output)
+    }
+    writeTestFile(t, dir, "inner/later.txt", "Later\n")
+    if output := renderTestGophermap(t, parentPath); !strings.Contains(output, "Later") {
+        t.Errorf("expected include turning up re-read, got %q", output)
+    }
+
+    /* Unchanged submaps are still reused */
+    cached := Config.SubmapCache.Entries[outerPath]
+    renderTestGophermap(t, parentPath)
+    if Config.SubmapCache.Entries[outerPath] != cached {
+        t.Errorf("expected unchanged submap reused")
+    }
+}
+
+func TestSubmapCacheGlobInclude(t *testing.T) {
+    setupTestConfig()
+    Config.SubmapCache = NewSubmapCache()
+    dir := t.TempDir()
+    writeTestFile(t, dir, "posts/a.txt", "First post\n")
+    submapPath := writeTestFile(t, dir, "sub/"+GophermapFileStr, "="+dir+"/posts/*.txt\n")
+    parentPath := writeTestFile(t, dir, GophermapFileStr, "="+submapPath+"\n")
+    renderTestGophermap(t, parentPath)
+
+    /* New matches change the glob's directory, so are picked up */
+    writeTestFile(t, dir, "posts/b.txt", "Second post\n")
+    modTime := time.Now().Add(time.Hour)
+    os.Chtimes(dir+"/posts", modTime, modTime)
+    if output := renderTestGophermap(t, parentPath); !strings.Contains(output, "Second post") {
+        t.Errorf("expected new glob match included, got %q", output)
+    }
+}
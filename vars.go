@@ -0,0 +1,52 @@
+package main
+
+import (
+    "os"
+    "regexp"
+    "strings"
+)
+
+/* Gophermap variable placeholders, e.g. '${SITE_NAME}' */
+var gophermapVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+/* Parse new-line separated list of variables allowed in gophermaps, either
+ * 'NAME' taking its value from the environment or 'NAME=value'. Only listed
+ * variables are ever substituted, so the environment can't leak otherwise
+ */
+func parseGophermapVars(entries string) map[string]string {
+    vars := make(map[string]string)
+    for _, entry := range splitNonEmpty(entries, "\n") {
+        name, value := entry, ""
+        if i := strings.Index(entry, "="); i >= 0 {
+            name, value = entry[:i], entry[i+1:]
+        } else {
+            value = os.Getenv(name)
+        }
+
+        if !gophermapVarRegex.MatchString("${"+name+"}") {
+            Config.LogSystemFatal("Invalid gophermap variable name: %s\n", name)
+        }
+
+        /* Values mustn't add fields or lines to gophermap lines */
+        vars[name] = sanitizeQuery(value)
+    }
+    return vars
+}
+
+/* Substitute '${NAME}' placeholders in gophermap line with allowed variables.
+ * Unknown variables are left as-is, or removed if configured
+ */
+func substituteGophermapVars(line string) string {
+    if len(Config.GophermapVars) == 0 && !Config.GophermapVarsUnknownEmpty {
+        return line
+    }
+
+    return gophermapVarRegex.ReplaceAllStringFunc(line, func(placeholder string) string {
+        if value, ok := Config.GophermapVars[placeholder[2:len(placeholder)-1]]; ok {
+            return value
+        } else if Config.GophermapVarsUnknownEmpty {
+            return ""
+        }
+        return placeholder
+    })
+}
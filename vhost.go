@@ -0,0 +1,108 @@
+package main
+
+import (
+    "path"
+    "strings"
+)
+
+/* VirtualHost:
+ * A hostname served from its own root directory within the
+ * server root, matched either by a leading hostname prefix
+ * in the selector or by the port connected to. Cached files
+ * and generated policy files are keyed by path, so each
+ * virtual host gets its own without sharing entries.
+ */
+type VirtualHost struct {
+    Name string
+    Port string
+    Root string
+}
+
+/* Parse new-line separated 'hostname[:port]=root' entries, roots being
+ * directories within the server root
+ */
+func parseVirtualHosts(entries string) []*VirtualHost {
+    vhosts := make([]*VirtualHost, 0)
+    for _, entry := range splitNonEmpty(entries, "\n") {
+        split := strings.SplitN(entry, "=", 2)
+        if len(split) != 2 || split[0] == "" || split[1] == "" {
+            Config.LogSystemFatal("Invalid virtual host entry: %s\n", entry)
+        }
+
+        name, port := split[0], ""
+        if i := strings.LastIndex(name, ":"); i >= 0 {
+            name, port = name[:i], name[i+1:]
+        }
+        if name == "" {
+            Config.LogSystemFatal("Invalid virtual host entry, no hostname: %s\n", entry)
+        }
+
+        vhosts = append(vhosts, &VirtualHost{ name, port, sanitizePath(split[1]) })
+    }
+    return vhosts
+}
+
+/* Match connection to a virtual host, first by hostname prefixing the
+ * selector (e.g. 'example.org/docs') then by the port connected to, not the
+ * one advertised. Returns the host to serve the request as and remaining
+ * selector, falling back to the connection's default host if nothing matches
+ */
+func matchVirtualHost(connHost *ConnHost, localPort, selector string) (*ConnHost, string) {
+    /* Hostname prefix, kept on selectors we generate so clients stay on this host */
+    trimmed := strings.TrimPrefix(selector, "/")
+    first := trimmed
+    if i := strings.Index(trimmed, "/"); i >= 0 {
+        first = trimmed[:i]
+    }
+    for _, vhost := range Config.VirtualHosts {
+        if first == vhost.Name {
+            return &ConnHost{ vhost.Name, connHost.Port, vhost.Root, "/"+vhost.Name }, strings.TrimPrefix(trimmed, first)
+        }
+    }
+
+    /* Port connected to */
+    for _, vhost := range Config.VirtualHosts {
+        if vhost.Port != "" && vhost.Port == localPort {
+            return &ConnHost{ vhost.Name, connHost.Port, vhost.Root, "" }, selector
+        }
+    }
+
+    return connHost, selector
+}
+
+/* Map selector to a path within the server root for this host */
+func (host *ConnHost) PathFor(selector string) string {
+    if host.Root == "" {
+        return selector
+    }
+    return path.Join(host.Root, selector)
+}
+
+/* Map path within the server root back to a selector for this host,
+ * anything outside the host's root maps to its root
+ */
+func (host *ConnHost) SelectorFor(filePath string) string {
+    selector := filePath
+    if host.Root != "" && host.Root != "/" {
+        switch {
+            case strings.HasPrefix(filePath, host.Root+"/"):
+                selector = filePath[len(host.Root):]
+            default:
+                selector = "/"
+        }
+    }
+
+    if host.Prefix != "" {
+        selector = path.Join(host.Prefix, selector)
+    }
+    return selector
+}
+
+/* Roots of default and all virtual hosts, for generating policy files */
+func virtualHostRoots() []string {
+    roots := []string{ "/" }
+    for _, vhost := range Config.VirtualHosts {
+        roots = append(roots, vhost.Root)
+    }
+    return roots
+}
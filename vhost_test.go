@@ -0,0 +1,114 @@
+package main
+
+import (
+    "path"
+    "strings"
+    "testing"
+)
+
+func TestParseVirtualHosts(t *testing.T) {
+    setupTestConfig()
+    vhosts := parseVirtualHosts("example.org=/example\nother.org:7070=other/\n")
+    if len(vhosts) != 2 {
+        t.Fatalf("expected 2 virtual hosts, got %d", len(vhosts))
+    }
+
+    if *vhosts[0] != (VirtualHost{ "example.org", "", "/example" }) {
+        t.Errorf("unexpected first virtual host: %+v", *vhosts[0])
+    }
+    if *vhosts[1] != (VirtualHost{ "other.org", "7070", "/other" }) {
+        t.Errorf("unexpected second virtual host: %+v", *vhosts[1])
+    }
+}
+
+func TestMatchVirtualHost(t *testing.T) {
+    setupTestConfig()
+    Config.VirtualHosts = []*VirtualHost{
+        &VirtualHost{ "example.org", "", "/example" },
+        &VirtualHost{ "other.org", "7070", "/other" },
+    }
+
+    /* Matched by the port connected to, the advertised port only ends up
+     * in generated selectors
+     */
+    tests := []struct {
+        Port      string
+        LocalPort string
+        Selector  string
+        Name      string
+        Path      string
+    }{
+        { "70",   "70",   "/example.org/docs", "example.org", "/example/docs" },
+        { "70",   "70",   "example.org",       "example.org", "/example" },
+        { "7070", "7070", "/docs",             "other.org",   "/other/docs" },
+        { "70",   "70",   "/docs",             "localhost",   "/docs" },
+        { "70",   "70",   "/example.orgx",     "localhost",   "/example.orgx" },
+        { "70",   "7070", "/docs",             "other.org",   "/other/docs" },
+        { "7070", "70",   "/docs",             "localhost",   "/docs" },
+    }
+
+    for _, test := range tests {
+        host, selector := matchVirtualHost(&ConnHost{ "localhost", test.Port, "", "" }, test.LocalPort, test.Selector)
+        if host.Name != test.Name {
+            t.Errorf("matchVirtualHost(%s on %s, %q) matched %s, expected %s", test.Port, test.LocalPort, test.Selector, host.Name, test.Name)
+        }
+        if host.Port != test.Port {
+            t.Errorf("matchVirtualHost(%s on %s, %q) advertises port %s, expected %s", test.Port, test.LocalPort, test.Selector, host.Port, test.Port)
+        }
+        if requestPath := host.PathFor(sanitizePath(selector)); requestPath != test.Path {
+            t.Errorf("matchVirtualHost(%s on %s, %q) resolved to %s, expected %s", test.Port, test.LocalPort, test.Selector, requestPath, test.Path)
+        }
+    }
+}
+
+func TestSelectorFor(t *testing.T) {
+    portHost   := &ConnHost{ "other.org", "7070", "/other", "" }
+    prefixHost := &ConnHost{ "example.org", "70", "/example", "/example.org" }
+
+    tests := []struct {
+        Host     *ConnHost
+        Path     string
+        Selector string
+    }{
+        { testHost,   "/docs/a.txt",    "/docs/a.txt" },
+        { portHost,   "/other/a.txt",   "/a.txt" },
+        { portHost,   "/other",         "/" },
+        { portHost,   "/",              "/" },
+        { portHost,   "/otherwise.txt", "/" },
+        { prefixHost, "/example/a.txt", "/example.org/a.txt" },
+        { prefixHost, "/example",       "/example.org" },
+    }
+
+    for _, test := range tests {
+        if selector := test.Host.SelectorFor(test.Path); selector != test.Selector {
+            t.Errorf("SelectorFor(%q) on %s = %q, expected %q", test.Path, test.Host.Name, selector, test.Selector)
+        }
+    }
+}
+
+func TestVirtualHostListing(t *testing.T) {
+    setupTestConfig()
+    root := path.Join(t.TempDir(), "example")
+    writeTestFile(t, root, "docs/notes.txt", "notes")
+    gophermapPath := writeTestFile(t, root, "links/"+GophermapFileStr, "1Home\t/\t$hostname\t70\n")
+
+    /* Listing selectors are relative to the virtual host's root, with prefix kept */
+    host := &ConnHost{ "example.org", "70", root, "/example.org" }
+    output, gophorErr := listDir(&FileSystemRequest{ path.Join(root, "docs"), host, "", nil, "" }, map[string]bool{}, DefaultDirSort)
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    entries := listingEntries(t, output)
+    if len(entries) != 1 || entries[0] != "notes.txt"+Tab+"/example.org/docs/notes.txt" {
+        t.Errorf("unexpected virtual host listing entries: %v", entries)
+    }
+
+    /* Hostname substitution uses the virtual host's name */
+    output, gophorErr = Config.FileSystem.HandleRequest(&FileSystemRequest{ path.Dir(gophermapPath), host, "", nil, "" })
+    if gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    if !strings.Contains(string(output), Tab+"example.org"+Tab) {
+        t.Errorf("expected virtual host name substituted in gophermap, got:\n%s", output)
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "os"
+    "path"
+    "path/filepath"
+)
+
+/* Preload gophermaps, then regular files, found under supplied paths into
+ * the file cache so the first requests for them don't pay the load cost.
+ * Files too large to cache, or hashing to a shard already holding its
+ * share of the cache, are skipped so warmup never evicts what it loaded.
+ * Returns number of files loaded
+ */
+func warmFileCache(paths []string) int {
+    gophermaps := make([]string, 0)
+    files := make([]string, 0)
+    hiddenByDir := make(map[string]map[string]bool)
+
+    for _, root := range paths {
+        root = path.Join("/", root)
+        filepath.Walk(root, func(itemPath string, info os.FileInfo, err error) error {
+            /* Skip anything we fail to stat */
+            if err != nil {
+                return nil
+            }
+
+            switch {
+                case info.IsDir():
+                    if itemPath != root && isHiddenFromWalk(itemPath, info.Name(), hiddenByDir) {
+                        return filepath.SkipDir
+                    }
+
+                case info.Mode() & os.ModeType != 0 || info.Size() > Config.FileSystem.CacheFileMax:
+                    /* Not a regular file, or too large to be cached */
+                    break
+
+                case isGophermapName(info.Name()):
+                    gophermaps = append(gophermaps, itemPath)
+
+                case !isHiddenFromWalk(itemPath, info.Name(), hiddenByDir):
+                    files = append(files, itemPath)
+            }
+            return nil
+        })
+    }
+
+    /* Gophermaps are requested most, so get first pick of the cache */
+    host := &ConnHost{ Config.Current().Hostname, "", "", "" }
+    loaded := 0
+    for _, filePath := range append(gophermaps, files...) {
+        if Config.FileSystem.shardFull(filePath) {
+            continue
+        }
+
+        _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ filePath, host, "", nil, "" })
+        if gophorErr != nil {
+            Config.LogSystemError("Skipped warming cache with %s: %s\n", filePath, gophorErr.Error())
+            continue
+        }
+        loaded += 1
+    }
+
+    return loaded
+}
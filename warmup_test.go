@@ -0,0 +1,47 @@
+package main
+
+import (
+    "fmt"
+    "path"
+    "testing"
+)
+
+func TestWarmFileCache(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.initShards(10, 1)
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, "docs/"+GophermapFileStr, "Docs\n")
+    notesPath := writeTestFile(t, dir, "docs/notes.txt", "notes")
+    writeTestFile(t, dir, "other/skipped.txt", "skipped")
+
+    /* Only listed paths are walked */
+    if loaded := warmFileCache([]string{ path.Join(dir, "docs") }); loaded != 2 {
+        t.Errorf("expected 2 files warmed, got %d", loaded)
+    }
+    for _, filePath := range []string{ gophermapPath, notesPath } {
+        if Config.FileSystem.shardFor(filePath).Map.Get(filePath) == nil {
+            t.Errorf("expected %s in cache after warmup", filePath)
+        }
+    }
+    if count := Config.FileSystem.CacheCount(); count != 2 {
+        t.Errorf("expected only warmed paths cached, got %d files", count)
+    }
+}
+
+func TestWarmFileCacheRespectsSize(t *testing.T) {
+    setupTestConfig()
+    Config.FileSystem.initShards(3, 1)
+    dir := t.TempDir()
+    for i := 0; i < 5; i += 1 {
+        writeTestFile(t, dir, fmt.Sprintf("%d.txt", i), "contents")
+    }
+    gophermapPath := writeTestFile(t, dir, "sub/"+GophermapFileStr, "Sub\n")
+
+    /* Warmup stops once cache is full, gophermaps taking priority */
+    if loaded := warmFileCache([]string{ dir }); loaded != 3 {
+        t.Errorf("expected warmup to stop at cache size 3, loaded %d", loaded)
+    }
+    if Config.FileSystem.shardFor(gophermapPath).Map.Get(gophermapPath) == nil {
+        t.Errorf("expected gophermap warmed before regular files")
+    }
+}
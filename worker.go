@@ -1,62 +1,109 @@
 package main
 
 import (
+    "net"
+    "time"
+    "bytes"
+    "errors"
     "path"
+    "path/filepath"
+    "runtime/debug"
     "strings"
+    "syscall"
 )
 
 type Worker struct {
-    Conn *GophorConn
+    Conn    *GophorConn
+    Sent    int
+    Type    ItemType
+    Started time.Time
 }
 
 func NewWorker(conn *GophorConn) *Worker {
-    return &Worker{ conn }
+    return &Worker{ conn, 0, TypeUnknown, time.Time{} }
 }
 
 func (worker *Worker) Serve() {
+    /* Read buffer + final result */
+    buf := make([]byte, SocketReadBufSize)
+    received := make([]byte, 0)
+
     defer func() {
+        /* A panic only loses this connection, never the whole server */
+        if r := recover(); r != nil {
+            Config.LogSystemError("Recovered from panic serving selector %q: %v\n%s", readUpToFirstTabOrCrlf(received), r, debug.Stack())
+            worker.LogRequest(received, RequestError)
+        }
+
         /* Close-up shop */
         worker.Conn.Close()
+        worker.Log("Closed connection, sent %d bytes\n", worker.Sent)
     }()
 
+    worker.Log("Accepted connection\n")
+
+    /* Check client hasn't exceeded rate limit */
+    if Config.RateLimiter != nil && !Config.RateLimiter.Allow(worker.RemoteIP()) {
+        worker.LogError("Rate limit exceeded, closing connection\n")
+        worker.SendRaw(generateGopherErrorResponse(ErrorResponse429))
+        worker.LogRequest(nil, RequestError)
+        return
+    }
+
     var count int
     var err error
 
-    /* Read buffer + final result */
-    buf := make([]byte, SocketReadBufSize)
-    received := make([]byte, 0)
+    /* Don't let slow (or dead) clients hold the connection open forever */
+    worker.Conn.SetReadDeadline(time.Now().Add(Config.ReadTimeout))
 
-    iter := 0
     for {
         /* Buffered read from listener */
         count, err = worker.Conn.Read(buf)
         if err != nil {
-            Config.LogSystemError("Error reading from socket on port %s: %s\n", worker.Conn.Host.Port, err.Error())
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                Config.LogSystemError("Timed out reading from socket on port %s\n", worker.Conn.Host.Port)
+            } else {
+                Config.LogSystemError("Error reading from socket on port %s: %s\n", worker.Conn.Host.Port, err.Error())
+            }
             return
         }
 
         /* Only copy non-null bytes */
         received = append(received, buf[:count]...)
 
-        /* If count is less than expected read size, we've hit EOF */
-        if count < SocketReadBufSize {
-            /* EOF */
-            break
-        }
-
-        /* Hit max read chunk size, send error + close connection */
-        if iter == MaxSocketReadChunks {
-            Config.LogSystemError("Reached max socket read size %d. Closing connection...\n", MaxSocketReadChunks*SocketReadBufSize)
+        /* Request line too long, send error + close connection rather than
+         * keep reading. Allow for the CR-LF ending it
+         */
+        lineEnd := bytes.Index(received, []byte(DOSLineEnd))
+        if lineEnd > Config.MaxSelectorLength || (lineEnd < 0 && len(received) > Config.MaxSelectorLength+len(DOSLineEnd)) {
+            worker.LogError("Rejected request longer than max selector length %d. Closing connection...\n", Config.MaxSelectorLength)
+            worker.SendRaw(generateGopherErrorResponseFromCode(SelectorLengthErr))
+            worker.LogRequest(received[:Config.MaxSelectorLength], RequestError)
             return
         }
 
-        /* Keep count :) */
-        iter += 1
+        /* If we've the whole request line, or count is less than expected
+         * read size, we've hit EOF
+         */
+        if lineEnd >= 0 || count < SocketReadBufSize {
+            /* EOF */
+            break
+        }
     }
 
-    /* Handle request */
+    /* Handle request, timed from here once the selector's been read. Write
+     * deadlines are set for each chunk sent, see Write()
+     */
+    worker.Started = time.Now()
     gophorErr := worker.RespondGopher(received)
 
+    /* Clients hanging up mid-response are expected, not a system error */
+    if gophorErr != nil && isClientDisconnect(gophorErr) {
+        worker.Log("Client disconnected after %d bytes: %s\n", worker.Sent, gophorErr.Err.Error())
+        worker.LogRequest(received, RequestDisconnected)
+        return
+    }
+
     /* Handle any error */
     if gophorErr != nil {
         Config.LogSystemError("%s\n", gophorErr.Error())
@@ -69,48 +116,278 @@ func (worker *Worker) Serve() {
             /* No gods. No masters. We don't care about error checking here */
             worker.SendRaw(response)
         }
+
+        if gophorErrorToResponseCode(gophorErr.Code) == ErrorResponse404 {
+            worker.LogRequest(received, RequestNotFound)
+        } else {
+            worker.LogRequest(received, RequestError)
+        }
+    } else {
+        worker.LogRequest(received, RequestServed)
+    }
+}
+
+/* Get time taken handling request so far, 0 if never started */
+func (worker *Worker) Duration() time.Duration {
+    if worker.Started.IsZero() {
+        return 0
+    }
+    return time.Since(worker.Started)
+}
+
+/* Record request in the structured access log */
+func (worker *Worker) LogRequest(received []byte, status string) {
+    duration := worker.Duration()
+    countRequest(status, worker.Type)
+    Config.Metrics.CountSent(worker.Sent)
+    Config.Metrics.ObserveDuration(duration)
+
+    /* Warn of slow requests, e.g. from expensive gophermaps */
+    if Config.SlowRequestThreshold > 0 && duration > Config.SlowRequestThreshold {
+        Config.LogSystemError("Slow request took %s: %q\n", duration, readUpToFirstTabOrCrlf(received))
     }
+
+    if Config.RequestLogger == nil {
+        return
+    }
+
+    Config.RequestLogger.Log(&RequestLogEntry{
+        Time:     time.Now(),
+        ClientIP: worker.RemoteIP(),
+        Location: Config.GeoDatabase.Lookup(worker.RemoteIP()),
+        ConnID:   worker.Conn.ID,
+        Selector: readUpToFirstTabOrCrlf(received),
+        Query:    readQuery(received),
+        Size:     worker.Sent,
+        Status:   status,
+        Duration: duration,
+    })
 }
 
+/* Send response to client in chunks, so large responses to slow clients
+ * aren't cut off by the write timeout while still making progress
+ */
 func (worker *Worker) SendRaw(b []byte) *GophorError {
+    for len(b) > 0 {
+        chunk := b
+        if len(chunk) > SocketWriteChunkSize {
+            chunk = chunk[:SocketWriteChunkSize]
+        }
+
+        count, err := worker.Write(chunk)
+        if err != nil {
+            return &GophorError{ SocketWriteErr, err }
+        } else if count != len(chunk) {
+            return &GophorError{ SocketWriteCountErr, nil }
+        }
+        b = b[count:]
+    }
+    return nil
+}
+
+/* Write to client, counting bytes sent, so files can be streamed to the worker.
+ * Each write gets the full write timeout, so only a stalled client times out
+ */
+func (worker *Worker) Write(b []byte) (int, error) {
+    worker.Conn.SetWriteDeadline(time.Now().Add(Config.WriteTimeout))
     count, err := worker.Conn.Write(b)
+    worker.Sent += count
+    return count, err
+}
+
+/* Check if error writing response is the client having gone away, by broken
+ * pipe or connection reset
+ */
+func isClientDisconnect(gophorErr *GophorError) bool {
+    return gophorErr.Code == SocketWriteErr && (errors.Is(gophorErr, syscall.EPIPE) || errors.Is(gophorErr, syscall.ECONNRESET))
+}
+
+func (worker *Worker) RemoteIP() string {
+    host, _, err := net.SplitHostPort(worker.Conn.RemoteAddr().String())
     if err != nil {
-        return &GophorError{ SocketWriteErr, err }
-    } else if count != len(b) {
-        return &GophorError{ SocketWriteCountErr, nil }
+        return worker.Conn.RemoteAddr().String()
     }
-    return nil
+    return host
 }
 
 func (worker *Worker) Log(format string, args ...interface{}) {
-    Config.LogAccess(worker.Conn.RemoteAddr().String(), format, args...)
+    Config.LogAccess(worker.Conn.LogSource(), format, args...)
 }
 
 func (worker *Worker) LogError(format string, args ...interface{}) {
-    Config.LogAccessError(worker.Conn.RemoteAddr().String(), format, args...)
+    Config.LogAccessError(worker.Conn.LogSource(), format, args...)
 }
 
 func (worker *Worker) RespondGopher(data []byte) *GophorError {
-    /* According to Gopher spec, only read up to first Tab or Crlf */
+    /* According to Gopher spec, only read up to first Tab or Crlf. Anything
+     * after the tab is the query, kept apart so never used for file lookup
+     */
     dataStr := readUpToFirstTabOrCrlf(data)
+    query := readQuery(data)
 
-    /* Handle URL request if presented */
-    lenBefore := len(dataStr)
-    dataStr = strings.TrimPrefix(dataStr, "URL:")
-    switch len(dataStr) {
-        case lenBefore-4:
-            /* Send an HTML redirect to supplied URL */
-            worker.Log("Redirecting to %s\n", dataStr)
-            return worker.SendRaw(generateHtmlRedirect(dataStr))
-        default:
-            /* Do nothing */
+    /* Handle URL request if presented and enabled */
+    if Config.HtmlRedirects != nil && strings.HasPrefix(dataStr, UrlSelectorPrefix) {
+        /* Send an HTML redirect to supplied URL */
+        url := strings.TrimPrefix(dataStr, UrlSelectorPrefix)
+        worker.Type = TypeHtml
+        worker.Log("Redirecting to %s\n", url)
+        return worker.SendRaw(Config.HtmlRedirects.Get(url))
     }
 
-    /* Sanitize supplied path */
-    requestPath := sanitizePath(dataStr)
+    /* Match virtual host, stripping any hostname prefix from selector */
+    host, dataStr := matchVirtualHost(worker.Conn.Host, worker.Conn.LocalPort(), dataStr)
+
+    /* Reject selectors resolving outside the server root */
+    if !isWithinRoot(dataStr) {
+        worker.LogError("Denied path traversal request: %s\n", dataStr)
+        return &GophorError{ IllegalPathErr, nil }
+    }
+
+    /* Sanitize supplied path, then map to path within host's root. An empty
+     * selector is the most common request of all, for the root index, and
+     * sanitizes to '/' same as requesting it explicitly
+     */
+    selector := sanitizePath(dataStr)
+
+    /* Rewrite moved selectors, either redirecting or serving the new location */
+    if rewrite := findSelectorRewrite(selector); rewrite != nil {
+        rewritten := rewrite.Apply(selector)
+        if rewrite.Redirect {
+            worker.Log("Redirected moved selector: %s -> %s\n", selector, rewritten)
+            worker.Type = TypeDirectory
+            return worker.SendRaw(renderRewriteRedirect(host, rewritten))
+        }
+        selector = rewritten
+    }
+
+    requestPath := host.PathFor(selector)
+
+    /* In maintenance mode everything but policy files gets the maintenance menu */
+    if inMaintenance() && !Config.FileSystem.isPolicyFile(requestPath) {
+        worker.Log("Served maintenance menu: %s\n", requestPath)
+        worker.Type = TypeDirectory
+        return worker.SendRaw(renderMaintenanceMenu(&FileSystemRequest{ requestPath, host, query, nil, "" }))
+    }
+
+    /* Symlinks only served if followed, and resolving within the root */
+    if !Config.FileSystem.isSymlinkAllowed(requestPath) {
+        worker.LogError("Denied symlink request: %s\n", requestPath)
+        return &GophorError{ IllegalPathErr, nil }
+    }
+
+    /* Directory access files are never served */
+    if path.Base(requestPath) == AclFileStr {
+        worker.LogError("Denied access file request: %s\n", requestPath)
+        return &GophorError{ AccessDeniedErr, nil }
+    }
+
+    /* Check client is allowed access to this selector, and any
+     * gophermaps merged into it
+     */
+    if !worker.isAllowed(requestPath) || !worker.isAllowedAll(Config.MergedMaps[requestPath]) {
+        worker.LogError("Access denied (subject '%s'): %s\n", worker.Conn.ClientSubject(), requestPath)
+        return &GophorError{ AccessDeniedErr, nil }
+    }
+
+    /* Gopher+ clients get menus with lines flagged as having attributes,
+     * else the item's attribute block instead of its contents, or those of
+     * everything in a directory
+     */
+    if marker := readGopherPlus(data); isGopherPlusRequest(marker) {
+        var response []byte
+        var gophorErr *GophorError
+        served, itemType := "Gopher+ attributes", TypeFile
+        switch {
+            case isGopherPlusDirectory(marker):
+                response, gophorErr = renderGopherPlusDirectory(host, requestPath)
+
+            case isGopherPlusItem(marker) && requestItemType(requestPath) == TypeDirectory:
+                /* A lone marker after the selector isn't a query */
+                if query == marker {
+                    query = ""
+                }
+                served, itemType = "Gopher+ menu", TypeDirectory
+                response, gophorErr = renderGopherPlusMenu(&FileSystemRequest{ requestPath, host, query, nil, marker })
+
+            default:
+                response, gophorErr = renderGopherPlusAttributes(host, requestPath)
+        }
+        if gophorErr != nil {
+            worker.LogError("Failed to serve %s: %s\n", served, requestPath)
+            return gophorErr
+        }
+        worker.Log("Served %s: %s\n", served, requestPath)
+        worker.Type = itemType
+        return worker.SendRaw(response)
+    }
+
+    /* Handle search request if search enabled and selector matches */
+    if Config.SearchSelector != "" && selector == Config.SearchSelector {
+        worker.Log("Searching for: %s\n", query)
+        worker.Type = TypeSearch
+        return worker.SendRaw(search(query, host, worker.isAllowed))
+    }
+
+    /* Handle changelog request if enabled and selector matches */
+    if Config.Changelog != nil && selector == Config.Changelog.Selector {
+        worker.Log("Served: %s\n", requestPath)
+        worker.Type = TypeDirectory
+        return worker.SendRaw(Config.Changelog.Render(host, worker.isAllowed))
+    }
+
+    /* Handle metrics request if enabled and selector matches, sent as text */
+    if Config.Metrics != nil && selector == Config.Metrics.Selector {
+        worker.Log("Served: %s\n", requestPath)
+        worker.Type = TypeFile
+        return worker.SendRaw(Config.Metrics.Render())
+    }
+
+    /* Note item type of what's requested for metrics and status page, costs
+     * a stat so only if either is enabled
+     */
+    if Config.Metrics != nil || Config.StatusEnabled {
+        worker.Type = requestItemType(requestPath)
+    }
+
+    /* Relay proxied remote resources */
+    if proxy := findGophermapProxy(requestPath); proxy != nil {
+        worker.Log("Proxying: %s -> gopher://%s:%s/%s\n", requestPath, proxy.Host, proxy.Port, proxy.Selector)
+        return proxy.Relay(query, worker.SendRaw)
+    }
+
+    /* Gzip compressed copies of files too large to cache are compressed
+     * as they're streamed, rather than each request compressing in memory
+     */
+    if sourcePath := Config.FileSystem.gzipStreamSource(requestPath); sourcePath != "" {
+        gophorErr := Config.FileSystem.StreamGzipFile(sourcePath, worker)
+        if gophorErr != nil {
+            if !isClientDisconnect(gophorErr) {
+                worker.LogError("Failed to stream compressed: %s\n", requestPath)
+            }
+            return gophorErr
+        }
+        worker.Log("Streamed compressed: %s\n", requestPath)
+        return nil
+    }
+
+    /* Large regular files, or those resumed from an offset in the query,
+     * are streamed from disk rather than held in memory
+     */
+    if Config.FileSystem.isStreamable(requestPath, query) {
+        offset, _ := parseFileOffset(query)
+        gophorErr := Config.FileSystem.StreamFile(requestPath, offset, worker)
+        if gophorErr != nil {
+            if !isClientDisconnect(gophorErr) {
+                worker.LogError("Failed to stream: %s (offset %d)\n", requestPath, offset)
+            }
+            return gophorErr
+        }
+        worker.Log("Streamed: %s (offset %d)\n", requestPath, offset)
+        return nil
+    }
 
     /* Append lastline */
-    response, gophorErr := Config.FileSystem.HandleRequest(requestPath, worker.Conn.Host)
+    response, gophorErr := Config.FileSystem.HandleRequest(&FileSystemRequest{ requestPath, host, query, nil, "" })
     if gophorErr != nil {
         worker.LogError("Failed to serve: %s\n", requestPath)
         return gophorErr
@@ -141,15 +418,76 @@ func readUpToFirstTabOrCrlf(data []byte) string {
     return dataStr
 }
 
-func sanitizePath(dataStr string) string {
-    /* Clean path and trim '/' prefix if still exists */
-    requestPath := strings.TrimPrefix(path.Clean(dataStr), "/")
+func readQuery(data []byte) string {
+    /* Query is anything after the first tab, up to cr-lf */
+    i := bytes.IndexByte(data, '\t')
+    if i < 0 {
+        return ""
+    }
+    query := data[i+1:]
+
+    /* Gopher+ and other extensions may follow a second tab, ignore */
+    if j := bytes.IndexByte(query, '\t'); j >= 0 {
+        query = query[:j]
+    }
+
+    return strings.TrimSuffix(string(query), DOSLineEnd)
+}
+
+/* Check client is allowed access to path, by both certificate subject
+ * and network
+ */
+func (worker *Worker) isAllowed(requestPath string) bool {
+    return isClientCertAllowed(requestPath, worker.Conn.ClientSubject()) && isNetworkAllowed(requestPath, worker.RemoteIP())
+}
+
+/* Check client is allowed access to each of paths */
+func (worker *Worker) isAllowedAll(paths []string) bool {
+    for _, p := range paths {
+        if !worker.isAllowed(p) {
+            return false
+        }
+    }
+    return true
+}
 
-    if requestPath == "." {
-        requestPath = "/"
-    } else if !strings.HasPrefix(requestPath, "/") {
-        requestPath = "/" + requestPath
+/* Check client certificate subject is allowed for all selector prefixes
+ * in the ACL covering the request path
+ */
+func isClientCertAllowed(requestPath, subject string) bool {
+    for prefix, subjects := range Config.ClientCertACL {
+        if !hasPathPrefix(requestPath, prefix) {
+            continue
+        }
+
+        allowed := false
+        for _, s := range subjects {
+            if subject != "" && s == subject {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            return false
+        }
     }
+    return true
+}
+
+/* Check path is prefix, or within directory prefix */
+func hasPathPrefix(requestPath, prefix string) bool {
+    return prefix == "/" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+func sanitizePath(dataStr string) string {
+    /* Clean path as if from root, so it always has a '/' prefix and no '..' */
+    return path.Clean("/"+dataStr)
+}
 
-    return requestPath
+/* Check path doesn't escape the server root once cleaned. After chroot the
+ * root is "/", and relative paths (e.g. gophermap includes) resolve from there
+ */
+func isWithinRoot(requestPath string) bool {
+    cleaned := filepath.Clean(strings.TrimPrefix(requestPath, "/"))
+    return cleaned != ".." && !strings.HasPrefix(cleaned, "../")
 }
@@ -0,0 +1,468 @@
+package main
+
+import (
+    "bytes"
+    "io"
+    "log"
+    "net"
+    "path"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestClientCertACL(t *testing.T) {
+    setupTestConfig()
+    Config.ClientCertACL = map[string][]string{ "/dir": []string{ "alice" } }
+
+    tests := []struct {
+        Path    string
+        Subject string
+        Allowed bool
+    }{
+        { "/dir",           "alice", true },
+        { "/dir/notes.txt", "alice", true },
+        { "/dir/notes.txt", "bob",   false },
+        { "/dir/notes.txt", "",      false },
+        { "/directory",     "",      true },
+        { "/other.txt",     "",      true },
+    }
+
+    for _, test := range tests {
+        if allowed := isClientCertAllowed(test.Path, test.Subject); allowed != test.Allowed {
+            t.Errorf("isClientCertAllowed(%q, %q) = %t, expected %t", test.Path, test.Subject, allowed, test.Allowed)
+        }
+    }
+
+}
+
+/* Access check for client with certificate subject */
+func subjectAllowed(subject string) func(string) bool {
+    return func(requestPath string) bool {
+        return isClientCertAllowed(requestPath, subject)
+    }
+}
+
+func TestSearchRespectsClientCertACL(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.SearchRoot = dir
+    Config.ClientCertACL = map[string][]string{ dir+"/private": []string{ "alice" } }
+
+    writeTestFile(t, dir, "private/notes.txt", "topsecret password here\n")
+    writeTestFile(t, dir, "public.txt", "password reset instructions\n")
+
+    output := string(search("password", testHost, subjectAllowed("")))
+    if strings.Contains(output, "topsecret") || !strings.Contains(output, "reset instructions") {
+        t.Errorf("expected only public result for anonymous search, got %q", output)
+    }
+
+    output = string(search("password", testHost, subjectAllowed("alice")))
+    if !strings.Contains(output, "topsecret") {
+        t.Errorf("expected private result for allowed subject, got %q", output)
+    }
+}
+
+func TestChangelogRespectsClientCertACL(t *testing.T) {
+    setupTestConfig()
+    Config.Current().PageWidth = MaxPageWidth
+    dir := t.TempDir()
+    Config.ClientCertACL = map[string][]string{ dir+"/private": []string{ "alice" } }
+
+    writeTestFile(t, dir, "private/notes.txt", "secret")
+    writeTestFile(t, dir, "public.txt", "public")
+
+    /* Pre-fill entries from our temp tree, within TTL so they're used */
+    changelog := NewChangelog("/changes", time.Hour, 10, time.Hour)
+    changelog.Entries   = walkRecentChanges(dir, time.Time{}, 10)
+    changelog.Generated = time.Now()
+
+    output := string(changelog.Render(testHost, subjectAllowed("")))
+    if strings.Contains(output, "notes.txt") || !strings.Contains(output, "public.txt") {
+        t.Errorf("expected only public entries for anonymous changelog, got %q", output)
+    }
+
+    output = string(changelog.Render(testHost, subjectAllowed("alice")))
+    if !strings.Contains(output, "notes.txt") {
+        t.Errorf("expected private entries for allowed subject, got %q", output)
+    }
+}
+
+func TestIsWithinRoot(t *testing.T) {
+    tests := []struct {
+        Path   string
+        Within bool
+    }{
+        { "",                     true },
+        { "/",                    true },
+        { "/docs/../notes.txt",   true },
+        { "//../notes.txt",       true },
+        { "..",                   false },
+        { "../../etc/passwd",     false },
+        { "/../etc/passwd",       false },
+        { "docs/../../etc/passwd", false },
+        { "docs/./../..",         false },
+    }
+
+    for _, test := range tests {
+        if within := isWithinRoot(test.Path); within != test.Within {
+            t.Errorf("isWithinRoot(%q) = %t, expected %t", test.Path, within, test.Within)
+        }
+    }
+}
+
+func TestSanitizePath(t *testing.T) {
+    tests := map[string]string{
+        "":                 "/",
+        "/":                "/",
+        "docs/":            "/docs",
+        "//docs//a.txt":    "/docs/a.txt",
+        "/docs/../a.txt":   "/a.txt",
+        "../../etc/passwd": "/etc/passwd",
+    }
+
+    for dataStr, expected := range tests {
+        if requestPath := sanitizePath(dataStr); requestPath != expected {
+            t.Errorf("sanitizePath(%q) = %q, expected %q", dataStr, requestPath, expected)
+        }
+    }
+}
+
+func TestRespondGopherPathTraversal(t *testing.T) {
+    setupTestConfig()
+    server, client := net.Pipe()
+    defer server.Close()
+    defer client.Close()
+    worker := NewWorker(&GophorConn{ server, testHost, 0 })
+
+    for _, selector := range []string{ "../../etc/passwd", "/../etc/passwd", "docs/../../../etc/passwd" } {
+        gophorErr := worker.RespondGopher([]byte(selector+DOSLineEnd))
+        if gophorErr == nil || gophorErr.Code != IllegalPathErr {
+            t.Errorf("expected illegal path error for selector %q, got %v", selector, gophorErr)
+        }
+    }
+}
+
+func TestRespondGopherQuery(t *testing.T) {
+    setupTestConfig()
+    dir := t.TempDir()
+    writeTestFile(t, dir, GophermapFileStr, "Results for $query\n")
+
+    for query, expected := range map[string]string{ "": "Results for ", "gopher\tholes": "Results for gopher", "a\r\nb": "Results for ab" } {
+        server, client := net.Pipe()
+        output := make(chan string)
+        go func() {
+            b, _ := io.ReadAll(client)
+            output <- string(b)
+        }()
+
+        /* Query is substituted, but never part of the path looked up */
+        request := dir
+        if query != "" {
+            request += Tab+query
+        }
+        gophorErr := NewWorker(&GophorConn{ server, testHost, 0 }).RespondGopher([]byte(request+DOSLineEnd))
+        server.Close()
+        if gophorErr != nil {
+            t.Fatalf("query %q: %v", query, gophorErr)
+        }
+        if response := <-output; !strings.HasPrefix(response, string(buildInfoLine(expected))) {
+            t.Errorf("query %q: expected %q, got %q", query, expected, response)
+        }
+    }
+}
+
+/* Gophermap section that panics when rendered */
+type panicSection struct {}
+
+func (s *panicSection) Render(request *FileSystemRequest) ([]byte, *GophorError) {
+    var section *GophermapText
+    return section.Render(request)
+}
+
+/* Serve request over a pipe, returning the response */
+func serveTestRequest(request string) string {
+    server, client := net.Pipe()
+    go func() {
+        client.Write([]byte(request+DOSLineEnd))
+    }()
+
+    output := make(chan string)
+    go func() {
+        b, _ := io.ReadAll(client)
+        output <- string(b)
+    }()
+
+    NewWorker(&GophorConn{ server, testHost, 0 }).Serve()
+    return <-output
+}
+
+func TestServeRecoversFromPanic(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = time.Second
+    Config.WriteTimeout = time.Second
+    dir := t.TempDir()
+    gophermapPath := writeTestFile(t, dir, GophermapFileStr, "iHello\n")
+    writeTestFile(t, dir, "file.txt", "still here")
+
+    /* Swap the cached gophermap's sections for one that panics */
+    if _, gophorErr := Config.FileSystem.FetchFile(&FileSystemRequest{ gophermapPath, testHost, "", nil, "" }); gophorErr != nil {
+        t.Fatal(gophorErr)
+    }
+    file := Config.FileSystem.shardFor(gophermapPath).Map.Get(gophermapPath)
+    file.contents = &GophermapContents{ gophermapPath, []GophermapSection{ &panicSection{} } }
+
+    /* Connection is closed, and following requests still served */
+    if response := serveTestRequest(dir); response != "" {
+        t.Errorf("expected nothing sent for panicking request, got %q", response)
+    }
+    if file.InUse() {
+        t.Errorf("expected cached file released after panic")
+    }
+    if response := serveTestRequest(path.Join(dir, "file.txt")); !strings.HasPrefix(response, "still here") {
+        t.Errorf("expected requests served after panic, got %q", response)
+    }
+}
+
+func TestServeLogsConnectionLifecycle(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = time.Second
+    Config.WriteTimeout = time.Second
+    buf := &bytes.Buffer{}
+    Config.AccessLogger = log.New(buf, "", 0)
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, "file.txt", "contents")
+
+    server, client := net.Pipe()
+    go func() {
+        client.Write([]byte(filePath+DOSLineEnd))
+        io.ReadAll(client)
+    }()
+    NewWorker(&GophorConn{ server, testHost, 42 }).Serve()
+
+    /* Accept, selector and close events all tagged with the connection ID */
+    lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+    expected := []string{ "Accepted connection", "Served: "+filePath, "Closed connection, sent 8 bytes" }
+    if len(lines) != len(expected) {
+        t.Fatalf("expected %d access log lines, got %q", len(expected), lines)
+    }
+    for i, line := range lines {
+        if !strings.Contains(line, " #42] "+expected[i]) {
+            t.Errorf("expected access log line %q tagged with connection ID, got %q", expected[i], line)
+        }
+    }
+}
+
+func TestEmptySelectorServesRootIndex(t *testing.T) {
+    setupTestConfig()
+    Config.GophermapNames = []string{ ".gophermap", GophermapFileStr }
+    root := t.TempDir()
+    host := &ConnHost{ testHost.Name, testHost.Port, root, "" }
+
+    /* Request root with supplied selector, returning the response */
+    respond := func(selector string) string {
+        server, client := net.Pipe()
+        output := make(chan string)
+        go func() {
+            b, _ := io.ReadAll(client)
+            output <- string(b)
+        }()
+
+        gophorErr := NewWorker(&GophorConn{ server, host, 0 }).RespondGopher([]byte(selector+DOSLineEnd))
+        server.Close()
+        if gophorErr != nil {
+            t.Fatalf("selector %q: %v", selector, gophorErr)
+        }
+        return <-output
+    }
+
+    /* No gophermap, auto listing titled by hostname */
+    writeTestFile(t, root, "file.txt", "contents")
+    for _, selector := range []string{ "", "/" } {
+        if response := respond(selector); !strings.HasPrefix(response, "i[ "+testHost.Name+" ]\tTITLE") || !strings.Contains(response, "0file.txt\t/file.txt\t") {
+            t.Errorf("selector %q: expected root listing, got %q", selector, response)
+        }
+    }
+
+    /* Gophermap found from the configured names, ending the menu properly */
+    writeTestFile(t, root, ".gophermap", "Welcome\n")
+    for _, selector := range []string{ "", "/" } {
+        expected := string(buildInfoLine("Welcome"))+LastLine
+        if response := respond(selector); response != expected {
+            t.Errorf("selector %q: expected root gophermap %q, got %q", selector, expected, response)
+        }
+    }
+}
+
+func TestServeRejectsLongSelector(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = time.Second
+    Config.WriteTimeout = time.Second
+    Config.MaxSelectorLength = 1024
+
+    /* Multi-megabyte selector, only ever partly read before rejection */
+    server, client := net.Pipe()
+    written := make(chan int)
+    go func() {
+        n, _ := client.Write(bytes.Repeat([]byte("a"), 4*1024*1024))
+        written <- n
+    }()
+
+    output := make(chan string)
+    go func() {
+        b, _ := io.ReadAll(client)
+        output <- string(b)
+    }()
+
+    NewWorker(&GophorConn{ server, testHost, 0 }).Serve()
+    response := <-output
+    if !strings.HasPrefix(response, "3") || !strings.Contains(response, "400 Bad Request") {
+        t.Errorf("expected type 3 error for oversized selector, got %q", response)
+    }
+    if n := <-written; n > Config.MaxSelectorLength+SocketReadBufSize {
+        t.Errorf("expected reading to stop at max selector length, read %d bytes", n)
+    }
+
+    /* Selectors up to the limit are still served */
+    dir := t.TempDir()
+    filePath := writeTestFile(t, dir, strings.Repeat("b", 200)+".txt", "long name")
+    if response := serveTestRequest(filePath); response != "long name" {
+        t.Errorf("expected selector within limit served, got %q", response)
+    }
+}
+
+func TestSlowRequestWarning(t *testing.T) {
+    setupTestConfig()
+    buf := &bytes.Buffer{}
+    Config.SystemLogger = log.New(buf, "", 0)
+    Config.SlowRequestThreshold = time.Second
+
+    /* Never started, so not timed */
+    worker := NewWorker(&GophorConn{ nil, testHost, 0 })
+    worker.LogRequest([]byte("/fast"+DOSLineEnd), RequestServed)
+
+    worker.Started = time.Now().Add(-2*time.Second)
+    worker.LogRequest([]byte("/slow"+DOSLineEnd), RequestServed)
+
+    if output := buf.String(); strings.Contains(output, "/fast") || !strings.Contains(output, "Slow request took") || !strings.Contains(output, "\"/slow\"") {
+        t.Errorf("expected slow request warning for /slow only, got %q", output)
+    }
+}
+
+func TestServeClientDisconnectMidWrite(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = time.Second
+    Config.WriteTimeout = 5*time.Second
+    Config.FileSystem.StreamFileMin = 1
+    systemBuf := &bytes.Buffer{}
+    Config.SystemLogger = log.New(systemBuf, "", 0)
+    accessBuf := &bytes.Buffer{}
+    Config.AccessLogger = log.New(accessBuf, "", 0)
+    filePath := writeTestFile(t, t.TempDir(), "large.bin", strings.Repeat("x", 16*1024*1024))
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+
+    /* Client requests a large file then resets the connection, unread */
+    go func() {
+        conn, err := net.Dial("tcp", listener.Addr().String())
+        if err != nil {
+            return
+        }
+        conn.Write([]byte(filePath+DOSLineEnd))
+        buf := make([]byte, 1024)
+        conn.Read(buf)
+        conn.(*net.TCPConn).SetLinger(0)
+        conn.Close()
+    }()
+
+    server, err := listener.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    worker := NewWorker(&GophorConn{ server, testHost, 0 })
+    worker.Serve()
+
+    if worker.Sent >= 16*1024*1024 {
+        t.Skip("whole file sent before client disconnected")
+    }
+    if systemBuf.Len() != 0 {
+        t.Errorf("expected client disconnect kept out of system log, got %q", systemBuf.String())
+    }
+    if !strings.Contains(accessBuf.String(), "Client disconnected after") {
+        t.Errorf("expected client disconnect in access log, got %q", accessBuf.String())
+    }
+}
+
+func TestServeStalledClientTimesOut(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = 50*time.Millisecond
+    Config.WriteTimeout = 50*time.Millisecond
+    filePath := writeTestFile(t, t.TempDir(), "large.txt", strings.Repeat("x", 4*SocketWriteChunkSize))
+
+    /* Serve connection, failing if it isn't closed in good time */
+    serve := func(server net.Conn) *Worker {
+        worker := NewWorker(&GophorConn{ server, testHost, 0 })
+        done := make(chan struct{})
+        go func() {
+            worker.Serve()
+            close(done)
+        }()
+        select {
+            case <-done:
+            case <-time.After(5*time.Second):
+                t.Fatal("stalled client never timed out")
+        }
+        return worker
+    }
+
+    /* Client never sends a selector */
+    server, client := net.Pipe()
+    defer client.Close()
+    serve(server)
+
+    /* Client sends a selector then never reads the response */
+    server, client = net.Pipe()
+    defer client.Close()
+    go client.Write([]byte(filePath+DOSLineEnd))
+    if worker := serve(server); worker.Sent != 0 {
+        t.Errorf("expected nothing sent to stalled client, sent %d bytes", worker.Sent)
+    }
+}
+
+func TestServeSlowClientNotCutOff(t *testing.T) {
+    setupTestConfig()
+    Config.ReadTimeout = time.Second
+    Config.WriteTimeout = 100*time.Millisecond
+    contents := strings.Repeat("x", 4*SocketWriteChunkSize)
+    filePath := writeTestFile(t, t.TempDir(), "large.txt", contents)
+
+    /* Client reads each chunk well within the write timeout, though the
+     * whole transfer takes longer
+     */
+    server, client := net.Pipe()
+    output := make(chan string)
+    go func() {
+        client.Write([]byte(filePath+DOSLineEnd))
+        received := []byte{}
+        buf := make([]byte, SocketWriteChunkSize)
+        for {
+            time.Sleep(40*time.Millisecond)
+            count, err := client.Read(buf)
+            received = append(received, buf[:count]...)
+            if err != nil {
+                break
+            }
+        }
+        output <- string(received)
+    }()
+
+    NewWorker(&GophorConn{ server, testHost, 0 }).Serve()
+    if response := <-output; response != contents {
+        t.Errorf("expected whole file sent to slow client, got %d of %d bytes", len(response), len(contents))
+    }
+}